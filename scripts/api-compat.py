@@ -0,0 +1,314 @@
+#!/usr/bin/python3
+
+# Report changes to the client/server API between two revisions that
+# would break a client talking to a server of the other revision, as
+# happens when the snap is refreshed under a running client:
+#
+#   $ scripts/api-compat.py                 # main vs the working tree
+#   $ scripts/api-compat.py 21.04.2 HEAD
+#
+# For each revision the API definition in subiquity/common/apidef.py is
+# imported (from a "git archive" of the revision, or the working tree)
+# and dumped to JSON: every endpoint and method with its parameter and
+# return types, and the fields of every attr class and the members of
+# every enum those refer to. "--dump" prints this for the tree the
+# script is run from.
+#
+# The serializer requires every field of an attr class to be present
+# when deserializing and does not know about enum members it has not
+# heard of, so whether a change breaks depends on which way the type
+# travels: adding a field to something the client sends breaks old
+# clients, adding one to something the server returns does not. A field
+# that disappears and another of the same type that appears in the same
+# class are reported as a possible rename. The exit status is 1 if
+# anything breaking was found.
+
+import argparse
+import json
+import os
+import re
+import subprocess
+import sys
+import tempfile
+
+
+REQUEST = 'request'
+RESPONSE = 'response'
+
+
+def dump_api():
+    import enum
+    import inspect
+    import typing
+
+    import attr
+
+    from subiquity.common.api.defs import Payload
+    from subiquity.common.apidef import API
+
+    types = {}
+
+    def describe(ann):
+        if ann is None or ann is type(None):
+            return 'None'
+        if ann is inspect.Parameter.empty:
+            return 'None'
+        origin = getattr(ann, '__origin__', None)
+        if origin is not None:
+            args = ann.__args__
+            if origin is Payload:
+                return describe(args[0])
+            if origin is typing.Union:
+                if type(None) in args and len(args) == 2:
+                    inner = [a for a in args if a is not type(None)][0]
+                    return 'Optional[{}]'.format(describe(inner))
+                return 'Union[{}]'.format(
+                    ', '.join(describe(a) for a in args))
+            if origin in (list, typing.List):
+                return 'List[{}]'.format(describe(args[0]))
+            if origin in (dict, typing.Dict):
+                return 'Dict[{}, {}]'.format(
+                    describe(args[0]), describe(args[1]))
+            return str(ann)
+        if attr.has(ann):
+            if ann.__name__ not in types:
+                types[ann.__name__] = None
+                types[ann.__name__] = {
+                    'kind': 'attr',
+                    'fields': [
+                        {'name': f.name, 'type': describe(f.type)}
+                        for f in attr.fields(ann)
+                        ],
+                    }
+            return ann.__name__
+        if isinstance(ann, type) and issubclass(ann, enum.Enum):
+            types.setdefault(ann.__name__, {
+                'kind': 'enum',
+                'members': [m.name for m in ann],
+                })
+            return ann.__name__
+        return getattr(ann, '__name__', str(ann))
+
+    endpoints = {}
+
+    def walk(cls):
+        for k, v in cls.__dict__.items():
+            if isinstance(v, type):
+                walk(v)
+            elif k in ('GET', 'POST', 'PUT', 'DELETE'):
+                sig = inspect.signature(v)
+                params = []
+                for name, param in sig.parameters.items():
+                    is_payload = getattr(
+                        param.annotation, '__origin__', None) is Payload
+                    params.append({
+                        'name': name,
+                        'type': describe(param.annotation),
+                        'payload': is_payload,
+                        'required':
+                            param.default is inspect.Parameter.empty,
+                        })
+                endpoints['{} {}'.format(k, cls.fullpath)] = {
+                    'params': params,
+                    'returns': describe(sig.return_annotation),
+                    }
+
+    walk(API)
+    return {'endpoints': endpoints, 'types': types}
+
+
+def load_api(revision):
+    """Dump the API of revision (None for the working tree)."""
+    top = subprocess.run(
+        ['git', 'rev-parse', '--show-toplevel'], check=True,
+        stdout=subprocess.PIPE, encoding='utf-8').stdout.strip()
+    with tempfile.TemporaryDirectory() as tmpdir:
+        if revision is None:
+            tree = top
+        else:
+            tree = tmpdir
+            archive = subprocess.run(
+                ['git', 'archive', revision, 'subiquity', 'subiquitycore',
+                 'fake_deps'],
+                cwd=top, check=True, stdout=subprocess.PIPE).stdout
+            subprocess.run(
+                ['tar', '-x', '-C', tree], input=archive, check=True)
+        env = os.environ.copy()
+        env['PYTHONPATH'] = os.pathsep.join(
+            [tree, os.path.join(tree, 'fake_deps')])
+        env['SUBIQUITY_NO_I18N'] = '1'
+        output = subprocess.run(
+            [sys.executable, os.path.abspath(__file__), '--dump'],
+            cwd=tree, env=env, check=True, stdout=subprocess.PIPE).stdout
+    return json.loads(output)
+
+
+def type_names(desc):
+    """The names of the attr classes and enums mentioned in desc."""
+    return re.findall(r'\w+', desc)
+
+
+def reachable(api):
+    """Map type name -> set of directions it travels in."""
+    directions = {}
+
+    def visit(desc, direction):
+        for name in type_names(desc):
+            if name not in api['types']:
+                continue
+            seen = directions.setdefault(name, set())
+            if direction in seen:
+                continue
+            seen.add(direction)
+            info = api['types'][name]
+            if info['kind'] == 'attr':
+                for field in info['fields']:
+                    visit(field['type'], direction)
+
+    for endpoint in api['endpoints'].values():
+        for param in endpoint['params']:
+            visit(param['type'], REQUEST)
+        visit(endpoint['returns'], RESPONSE)
+    return directions
+
+
+class Report:
+
+    def __init__(self):
+        self.breaking = []
+        self.compatible = []
+
+    def add(self, breaking, message):
+        if breaking:
+            self.breaking.append(message)
+        else:
+            self.compatible.append(message)
+
+
+def compare_endpoints(old, new, report):
+    for key in sorted(set(old) | set(new)):
+        if key not in new:
+            report.add(True, "{}: removed".format(key))
+            continue
+        if key not in old:
+            report.add(False, "{}: added".format(key))
+            continue
+        o, n = old[key], new[key]
+        o_params = {p['name']: p for p in o['params']}
+        n_params = {p['name']: p for p in n['params']}
+        for name in sorted(set(o_params) | set(n_params)):
+            op, np = o_params.get(name), n_params.get(name)
+            if np is None:
+                report.add(True, "{}: parameter {} removed".format(key, name))
+            elif op is None:
+                report.add(
+                    np['required'],
+                    "{}: {} parameter {} added".format(
+                        key, 'required' if np['required'] else 'optional',
+                        name))
+            else:
+                if op['type'] != np['type']:
+                    report.add(
+                        True, "{}: parameter {} changed from {} to {}".format(
+                            key, name, op['type'], np['type']))
+                if np['required'] and not op['required']:
+                    report.add(
+                        True, "{}: parameter {} is now required".format(
+                            key, name))
+        if o['returns'] != n['returns']:
+            report.add(
+                True, "{}: return type changed from {} to {}".format(
+                    key, o['returns'], n['returns']))
+
+
+def compare_types(old_api, new_api, report):
+    old_types, new_types = old_api['types'], new_api['types']
+    directions = reachable(new_api)
+    old_directions = reachable(old_api)
+    for name in sorted(set(old_types) & set(new_types)):
+        o, n = old_types[name], new_types[name]
+        dirs = directions.get(name, set()) | old_directions.get(name, set())
+        if o['kind'] != n['kind']:
+            report.add(True, "{}: changed from {} to {}".format(
+                name, o['kind'], n['kind']))
+            continue
+        if o['kind'] == 'enum':
+            for member in o['members']:
+                if member not in n['members']:
+                    report.add(
+                        REQUEST in dirs,
+                        "{}: member {} removed".format(name, member))
+            for member in n['members']:
+                if member not in o['members']:
+                    report.add(
+                        RESPONSE in dirs,
+                        "{}: member {} added".format(name, member))
+            continue
+        o_fields = {f['name']: f['type'] for f in o['fields']}
+        n_fields = {f['name']: f['type'] for f in n['fields']}
+        removed = [f for f in o_fields if f not in n_fields]
+        added = [f for f in n_fields if f not in o_fields]
+        for field in removed:
+            renamed = [f for f in added if n_fields[f] == o_fields[field]]
+            if renamed:
+                message = "{}: field {} removed (renamed to {}?)".format(
+                    name, field, ' or '.join(renamed))
+            else:
+                message = "{}: field {} removed".format(name, field)
+            # An old receiver of this type requires the field.
+            report.add(RESPONSE in dirs, message)
+        for field in added:
+            # A new receiver requires the field from old senders.
+            report.add(
+                REQUEST in dirs,
+                "{}: field {} added".format(name, field))
+        for field in sorted(set(o_fields) & set(n_fields)):
+            if o_fields[field] != n_fields[field]:
+                report.add(
+                    True, "{}: field {} changed from {} to {}".format(
+                        name, field, o_fields[field], n_fields[field]))
+
+
+def main():
+    parser = argparse.ArgumentParser(
+        description="Report incompatible API changes between revisions.")
+    parser.add_argument(
+        'old', nargs='?', default='main',
+        help="the old revision (default: %(default)s)")
+    parser.add_argument(
+        'new', nargs='?', default=None,
+        help="the new revision (default: the working tree)")
+    parser.add_argument(
+        '--dump', action='store_true',
+        help="print the API of the tree this is run in as JSON and exit")
+    parser.add_argument(
+        '--all', action='store_true', help="list compatible changes too")
+    opts = parser.parse_args()
+
+    if opts.dump:
+        json.dump(dump_api(), sys.stdout, indent=2, sort_keys=True)
+        print()
+        return 0
+
+    old = load_api(opts.old)
+    new = load_api(opts.new)
+    report = Report()
+    compare_endpoints(old['endpoints'], new['endpoints'], report)
+    compare_types(old, new, report)
+
+    new_name = opts.new or 'the working tree'
+    if report.breaking:
+        print("breaking changes from {} to {}:".format(opts.old, new_name))
+        for message in report.breaking:
+            print("  " + message)
+    else:
+        print("no breaking changes from {} to {}".format(opts.old, new_name))
+    if opts.all and report.compatible:
+        print("compatible changes:")
+        for message in report.compatible:
+            print("  " + message)
+    return 1 if report.breaking else 0
+
+
+if __name__ == '__main__':
+    sys.exit(main())
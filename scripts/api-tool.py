@@ -0,0 +1,181 @@
+#!/usr/bin/python3
+
+# Call any endpoint of a running subiquity server from the command line.
+#
+# The command line mirrors the API definition in subiquity/common/apidef.py:
+# each path component is a sub-command and the HTTP method comes last,
+# followed by the method's parameters. Query parameters are options taking
+# JSON (a bare word is fine for a str parameter) and the payload, if
+# there is one, is a positional JSON argument ("-" reads it from stdin).
+# Values are checked against the annotations with the same serializer the
+# client uses before anything is sent. For example:
+#
+#   $ PYTHONPATH=. scripts/api-tool.py --socket .subiquity/socket \
+#       meta status GET
+#   $ PYTHONPATH=. scripts/api-tool.py network info GET --dev-name ens3
+#   $ PYTHONPATH=. scripts/api-tool.py locale POST '"en_US.UTF-8"'
+#
+# Run with --list to see every endpoint and its signature.
+
+import argparse
+import asyncio
+import inspect
+import json
+import re
+import sys
+
+import aiohttp
+
+from subiquity.common.api.defs import Payload
+from subiquity.common.apidef import API
+from subiquity.common.serialize import Serializer
+
+
+METHODS = ('GET', 'POST', 'PUT', 'DELETE')
+
+
+def endpoints(cls):
+    """Yield (endpoint class, method) for everything under cls."""
+    for k, v in cls.__dict__.items():
+        if isinstance(v, type):
+            yield from endpoints(v)
+        elif k in METHODS:
+            yield cls, v
+
+
+def payload_param(sig):
+    for name, param in sig.parameters.items():
+        if getattr(param.annotation, '__origin__', None) is Payload:
+            return name, param.annotation.__args__[0]
+    return None, None
+
+
+def describe_annotation(ann):
+    if ann is inspect.Parameter.empty:
+        return 'None'
+    if getattr(ann, '__origin__', None) is Payload:
+        return 'Payload[{}]'.format(describe_annotation(ann.__args__[0]))
+    if hasattr(ann, '__origin__'):
+        # Drop the module names from things like typing.List[foo.Bar].
+        return re.sub(r'[\w.]+\.(\w+)', r'\1', str(ann))
+    return getattr(ann, '__name__', str(ann))
+
+
+def describe(cls, meth):
+    sig = inspect.signature(meth)
+    params = ', '.join(
+        '{}: {}'.format(name, describe_annotation(param.annotation))
+        for name, param in sig.parameters.items())
+    return '{} {}({}) -> {}'.format(
+        meth.__name__, cls.fullpath, params,
+        describe_annotation(sig.return_annotation))
+
+
+def make_parser():
+    parser = argparse.ArgumentParser(
+        description="Call an endpoint of a running subiquity server.")
+    parser.add_argument(
+        '--socket', default='/run/subiquity/socket',
+        help="the server's socket (default: %(default)s)")
+    parser.add_argument(
+        '--list', action='store_true', help="list the endpoints and exit")
+    subparsers = {(): parser.add_subparsers(dest='path0')}
+    parsers = {(): parser}
+    for cls, meth in endpoints(API):
+        path = cls.fullname
+        for i in range(len(path)):
+            prefix = path[:i+1]
+            if prefix not in parsers:
+                parsers[prefix] = subparsers[path[:i]].add_parser(path[i])
+                subparsers[prefix] = parsers[prefix].add_subparsers(
+                    dest='path{}'.format(i+1))
+        sub = subparsers[path].add_parser(
+            meth.__name__, help=describe(cls, meth))
+        sub.set_defaults(endpoint=cls, meth=meth)
+        sig = inspect.signature(meth)
+        data_arg, data_ann = payload_param(sig)
+        for name, param in sig.parameters.items():
+            ann = describe_annotation(param.annotation)
+            if name == data_arg:
+                sub.add_argument(
+                    'data', metavar=name.upper(),
+                    help="JSON for {} ('-' for stdin)".format(ann))
+            else:
+                sub.add_argument(
+                    '--' + name.replace('_', '-'), dest=name, metavar='JSON',
+                    required=param.default is inspect.Parameter.empty,
+                    help="a {}".format(ann))
+    return parser
+
+
+def load_json(annotation, text):
+    try:
+        return json.loads(text)
+    except json.JSONDecodeError:
+        if annotation is str:
+            return text
+        raise
+
+
+def build_request(serializer, meth, opts):
+    """Check the arguments and return (query params, JSON body)."""
+    sig = inspect.signature(meth)
+    data_arg, data_ann = payload_param(sig)
+    params = {}
+    data = None
+    for name, param in sig.parameters.items():
+        if name == data_arg:
+            text = opts.data
+            if text == '-':
+                text = sys.stdin.read()
+            value = serializer.deserialize(data_ann, load_json(data_ann, text))
+            data = serializer.serialize(data_ann, value)
+            continue
+        text = getattr(opts, name)
+        if text is None:
+            continue
+        ann = param.annotation
+        value = serializer.deserialize(ann, load_json(ann, text))
+        params[name] = serializer.to_json(ann, value)
+    return params, data
+
+
+async def call(socket_path, method, path, params, data):
+    conn = aiohttp.UnixConnector(path=socket_path)
+    async with aiohttp.ClientSession(connector=conn) as session:
+        async with session.request(
+                method, 'http://a' + path, params=params, json=data,
+                timeout=0) as resp:
+            body = await resp.text()
+            return resp.status, body
+
+
+def main():
+    parser = make_parser()
+    opts = parser.parse_args()
+    if opts.list:
+        for cls, meth in endpoints(API):
+            print(describe(cls, meth))
+        return 0
+    if getattr(opts, 'meth', None) is None:
+        parser.error("no endpoint given, see --list")
+    serializer = Serializer()
+    try:
+        params, data = build_request(serializer, opts.meth, opts)
+    except Exception as e:
+        parser.error("bad argument: {}".format(e))
+    status, body = asyncio.get_event_loop().run_until_complete(call(
+        opts.socket, opts.meth.__name__, opts.endpoint.fullpath,
+        params, data))
+    try:
+        print(json.dumps(json.loads(body), indent=2))
+    except json.JSONDecodeError:
+        print(body)
+    if status >= 400:
+        print("server returned status {}".format(status), file=sys.stderr)
+        return 1
+    return 0
+
+
+if __name__ == '__main__':
+    sys.exit(main())
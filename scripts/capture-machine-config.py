@@ -0,0 +1,155 @@
+#!/usr/bin/python3
+
+# Capture the storage and network probe data of the machine this runs on
+# as a machine config for --machine-config, like the ones in examples/.
+#
+# Run it as root in the live session, with a python that has probert (the
+# one in the subiquity snap does):
+#
+#   $ sudo /snap/subiquity/current/usr/bin/python3.8 \
+#       capture-machine-config.py weird-raid-box
+#
+# which writes weird-raid-box.json. Serial numbers, WWNs and MAC
+# addresses are replaced with made up but consistent values everywhere
+# they appear (including in /dev/disk/by-id links and interface names
+# like enx525400123456) so the file can be shared. Pass --from to
+# sanitize probert output that was saved some other way.
+
+import argparse
+import json
+import re
+import sys
+
+
+# udev properties and sysfs attributes of block devices that identify
+# a particular piece of hardware.
+SERIAL_KEYS = {
+    'ID_SERIAL',
+    'ID_SERIAL_SHORT',
+    'ID_SCSI_SERIAL',
+    'ID_WWN',
+    'ID_WWN_WITH_EXTENSION',
+    'SCSI_IDENT_SERIAL',
+    'SCSI_IDENT_LUN_NAA_REG',
+    'SCSI_IDENT_LUN_NAA_REGEXT',
+    'SCSI_IDENT_LUN_T10',
+    'SCSI_IDENT_LUN_VENDOR',
+    'SCSI_IDENT_LUN_ATA',
+    'serial',
+    'wwid',
+    'wwn',
+    }
+
+MAC_RE = re.compile(r'^[0-9a-f]{2}(:[0-9a-f]{2}){5}$', re.IGNORECASE)
+
+
+def walk(value, func):
+    if isinstance(value, dict):
+        return {k: walk(v, func) for k, v in value.items()}
+    if isinstance(value, list):
+        return [walk(v, func) for v in value]
+    if isinstance(value, str):
+        return func(value)
+    return value
+
+
+def find_values(value, pred, key=None):
+    if isinstance(value, dict):
+        for k, v in value.items():
+            yield from find_values(v, pred, k)
+    elif isinstance(value, list):
+        for v in value:
+            yield from find_values(v, pred, key)
+    elif isinstance(value, str) and pred(key, value):
+        yield value
+
+
+def is_serial(key, value):
+    # Very short values (e.g. "0") would match all over the place.
+    return key in SERIAL_KEYS and len(value.strip()) >= 4
+
+
+NOT_MACS = {'00:00:00:00:00:00', 'ff:ff:ff:ff:ff:ff'}
+
+
+def is_mac(key, value):
+    return bool(MAC_RE.match(value)) and value.lower() not in NOT_MACS
+
+
+def make_replacements(data):
+    """Map each identifying string in data to a made up one.
+
+    The keys are lower case, as the matching ignores case.
+    """
+    replacements = {}
+    serials = sorted(set(
+        v.strip() for v in find_values(data.get('storage', {}), is_serial)))
+    for i, serial in enumerate(serials, 1):
+        replacements[serial.lower()] = 'SANITIZED{:04d}'.format(i)
+    macs = sorted(set(
+        v.lower() for v in find_values(data.get('network', {}), is_mac)))
+    for i, mac in enumerate(macs, 1):
+        fake = '52:54:00:{:02x}:{:02x}:{:02x}'.format(
+            i >> 16, (i >> 8) & 0xff, i & 0xff)
+        replacements[mac] = fake
+        # As in ID_NET_NAME_MAC=enx525400123456.
+        replacements[mac.replace(':', '')] = fake.replace(':', '')
+    return replacements
+
+
+def sanitize(data):
+    replacements = make_replacements(data)
+    if not replacements:
+        return data
+    # Longest first, so that a serial that contains another one is
+    # replaced as a whole.
+    pattern = re.compile('|'.join(
+        re.escape(k) for k in sorted(replacements, key=len, reverse=True)),
+        re.IGNORECASE)
+
+    def replace(s):
+        return pattern.sub(lambda m: replacements[m.group(0).lower()], s)
+
+    return walk(data, replace)
+
+
+def probe():
+    from probert.prober import Prober
+    prober = Prober()
+    prober.probe_all()
+    results = prober.get_results()
+    return {
+        'network': results['network'],
+        'storage': results['storage'],
+        }
+
+
+def main():
+    parser = argparse.ArgumentParser(
+        description="Save this machine's probe data as a machine config.")
+    parser.add_argument('name', help="the config is written to NAME.json")
+    parser.add_argument(
+        '--from', dest='from_file', metavar='FILE',
+        help="sanitize saved probert output instead of probing")
+    parser.add_argument(
+        '--no-sanitize', action='store_true',
+        help="keep serial numbers and MAC addresses")
+    opts = parser.parse_args()
+    if opts.from_file is not None:
+        with open(opts.from_file) as fp:
+            data = json.load(fp)
+    else:
+        data = probe()
+    if not opts.no_sanitize:
+        data = sanitize(data)
+    path = opts.name
+    if not path.endswith('.json'):
+        path += '.json'
+    with open(path, 'w') as fp:
+        json.dump(data, fp, indent=4, sort_keys=True)
+        fp.write('\n')
+    print("wrote", path, file=sys.stderr)
+
+
+if __name__ == '__main__':
+    main()
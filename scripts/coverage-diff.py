@@ -0,0 +1,165 @@
+#!/usr/bin/python3
+
+# Run the unit tests with coverage in the working tree and in another
+# revision and report how the coverage of each file changed, e.g.:
+#
+#   $ scripts/coverage-diff.py            # compare with main
+#   $ scripts/coverage-diff.py HEAD~3 --min-delta 5
+#
+# The other revision is checked out into a temporary git worktree, so
+# uncommitted changes in the working tree are measured as they are. The
+# tests are run the way tox runs them (fake_deps on PYTHONPATH, no i18n)
+# with the python given by --python, which needs the coverage module
+# (5.0 or later, for "coverage json").
+#
+# Files are listed if their coverage moved by at least --min-delta
+# percentage points or they gained uncovered lines, with new files (the
+# usual way for untested code to land) marked as such. The exit status
+# is 1 if any file gained --fail-on-new-missing or more uncovered lines,
+# so this can be used as a CI gate.
+
+import argparse
+import json
+import os
+import subprocess
+import sys
+import tempfile
+
+
+SOURCES = 'console_conf,subiquity,subiquitycore'
+
+
+def run_coverage(python, tree, output):
+    env = os.environ.copy()
+    env['PYTHONPATH'] = os.path.join(tree, 'fake_deps')
+    env['SUBIQUITY_NO_I18N'] = '1'
+    env['FAKE_TRANSLATE'] = 'always'
+    env['COVERAGE_FILE'] = output + '.data'
+    # Failing tests still leave coverage data behind and the point is to
+    # compare coverage, so the exit status of the test run is ignored.
+    subprocess.run(
+        [python, '-m', 'coverage', 'run', '--branch', '--source', SOURCES,
+         '-m', 'unittest', 'discover'],
+        cwd=tree, env=env)
+    subprocess.run(
+        [python, '-m', 'coverage', 'json', '-o', output],
+        cwd=tree, env=env, check=True)
+    with open(output) as fp:
+        data = json.load(fp)
+    return {
+        os.path.relpath(os.path.join(tree, path), tree): info['summary']
+        for path, info in data['files'].items()
+        }
+
+
+def percent(summary):
+    if summary is None:
+        return None
+    return summary['percent_covered']
+
+
+def missing(summary):
+    if summary is None:
+        return 0
+    return summary['missing_lines']
+
+
+def diff(old, new):
+    """Yield (path, old summary, new summary) for files that changed."""
+    for path in sorted(set(old) | set(new)):
+        o = old.get(path)
+        n = new.get(path)
+        if o != n:
+            yield path, o, n
+
+
+def fmt_percent(p):
+    if p is None:
+        return '-'
+    return '{:.1f}%'.format(p)
+
+
+def main():
+    parser = argparse.ArgumentParser(
+        description="Compare test coverage of the working tree with a "
+        "revision.")
+    parser.add_argument(
+        'revision', nargs='?', default='main',
+        help="the revision to compare with (default: %(default)s)")
+    parser.add_argument(
+        '--python', default='python3',
+        help="the python to run the tests with (default: %(default)s)")
+    parser.add_argument(
+        '--min-delta', type=float, default=1.0,
+        help="hide files whose coverage changed by less than this many "
+        "percentage points and gained no uncovered lines "
+        "(default: %(default)s)")
+    parser.add_argument(
+        '--fail-on-new-missing', type=int, default=None, metavar='N',
+        help="exit with status 1 if a file gained N or more uncovered lines")
+    opts = parser.parse_args()
+
+    top = subprocess.run(
+        ['git', 'rev-parse', '--show-toplevel'], check=True,
+        stdout=subprocess.PIPE, encoding='utf-8').stdout.strip()
+
+    with tempfile.TemporaryDirectory() as tmpdir:
+        worktree = os.path.join(tmpdir, 'tree')
+        subprocess.run(
+            ['git', 'worktree', 'add', '--detach', worktree, opts.revision],
+            cwd=top, check=True)
+        try:
+            old = run_coverage(
+                opts.python, worktree, os.path.join(tmpdir, 'old.json'))
+        finally:
+            subprocess.run(
+                ['git', 'worktree', 'remove', '--force', worktree], cwd=top)
+        new = run_coverage(
+            opts.python, top, os.path.join(tmpdir, 'new.json'))
+
+    rows = []
+    failed = False
+    for path, o, n in diff(old, new):
+        delta_missing = missing(n) - missing(o)
+        if o is None or n is None:
+            delta = None
+        else:
+            delta = percent(n) - percent(o)
+            if abs(delta) < opts.min_delta and delta_missing <= 0:
+                continue
+        if opts.fail_on_new_missing is not None and \
+           delta_missing >= opts.fail_on_new_missing:
+            failed = True
+        if o is None:
+            note = 'new file'
+        elif n is None:
+            note = 'removed'
+        else:
+            note = '{:+.1f}'.format(delta)
+        rows.append((
+            path, fmt_percent(percent(o)), fmt_percent(percent(n)), note,
+            '{:+d}'.format(delta_missing)))
+
+    if not rows:
+        print("no coverage changes against", opts.revision)
+    else:
+        headings = ('FILE', opts.revision, 'WORKING TREE', 'DELTA',
+                    'UNCOVERED LINES')
+        widths = [max(len(r[i]) for r in rows + [headings])
+                  for i in range(len(headings))]
+        for row in [headings] + rows:
+            print('  '.join(
+                cell.ljust(w) if i == 0 else cell.rjust(w)
+                for i, (cell, w) in enumerate(zip(row, widths))))
+
+    if failed:
+        print(
+            "files gained {} or more uncovered lines".format(
+                opts.fail_on_new_missing),
+            file=sys.stderr)
+        return 1
+    return 0
+
+
+if __name__ == '__main__':
+    sys.exit(main())
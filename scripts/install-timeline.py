@@ -0,0 +1,430 @@
+#!/usr/bin/python3
+
+# Put what happened during an install into one timeline, from the logs
+# of a bug report or a copy of /var/log/installer:
+#
+#   $ scripts/install-timeline.py /path/to/var/log/installer
+#   $ scripts/install-timeline.py --html timeline.html bundle/
+#
+# Directories are searched for the files it knows about and files can
+# also be named directly:
+#
+#  * subiquity-server-debug.log and subiquity-client-debug.log (the
+#    start/finish lines for each context, and anything logged at
+#    WARNING or above);
+#  * journal exports in "journalctl -o json" format, such as
+#    examples/curtin-events.json (curtin's events, and subiquity's if no
+#    server log was found);
+#  * journal excerpts in the default text format, such as
+#    installer-journal.txt (curtin's events).
+#
+# --all includes every log line rather than just the events and
+# warnings. The timeline ends with the steps that started but never
+# finished, which is usually where a hung install is stuck, and the
+# slowest steps. With --html a page showing the steps as bars on a
+# shared time axis is written too.
+#
+# The logs use local time and the journal exports UTC; the live session
+# runs in UTC so no conversion is done. Text journal lines have no year,
+# which is taken from the other logs (or --year).
+
+import argparse
+import datetime
+import html
+import json
+import os
+import re
+import sys
+
+
+SUBIQUITY_LOG_RE = re.compile(
+    r'^(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d,\d{3}) (\w+) (\S+):(\d+) (.*)$')
+JOURNAL_SHORT_RE = re.compile(
+    r'^(\w{3} [ \d]\d \d\d:\d\d:\d\d) (\S+) ([^\s\[:]+)(?:\[\d+\])?: (.*)$')
+JOURNAL_ISO_RE = re.compile(
+    r'^(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d)(?:[+-]\d{4})? (\S+) '
+    r'([^\s\[:]+)(?:\[\d+\])?: (.*)$')
+CURTIN_EVENT_RE = re.compile(
+    r'^(start|finish): ([^:\s]+): (?:(SUCCESS|FAIL|WARN): )?(.*)$')
+RESULTS = ('SUCCESS', 'FAIL', 'WARN')
+
+WARNING_LEVELS = {'WARNING', 'ERROR', 'CRITICAL'}
+
+
+class Entry:
+
+    def __init__(self, time, source, message, *, kind='log', name=None,
+                 result=None):
+        self.time = time
+        self.source = source
+        self.message = message
+        self.kind = kind  # 'start', 'finish' or 'log'
+        self.name = name
+        self.result = result
+
+
+class Span:
+
+    def __init__(self, source, name, start):
+        self.source = source
+        self.name = name
+        self.start = start
+        self.end = None
+        self.result = None
+
+    @property
+    def duration(self):
+        if self.end is None:
+            return None
+        return (self.end - self.start).total_seconds()
+
+
+def subiquity_event(time, source, name, message):
+    if message.startswith('start: '):
+        return Entry(
+            time, source, message, kind='start', name=name,
+            result=None)
+    if message.startswith('finish: '):
+        # "finish: <description> <result>"
+        result = message.rpartition(' ')[2]
+        if result in RESULTS:
+            return Entry(
+                time, source, message, kind='finish', name=name,
+                result=result)
+    return None
+
+
+def read_subiquity_log(path, source, opts):
+    entries = []
+    # Whether the last line that started an entry was included.
+    included = False
+    with open(path, errors='replace') as fp:
+        for line in fp:
+            line = line.rstrip('\n')
+            m = SUBIQUITY_LOG_RE.match(line)
+            if m is None:
+                # A continuation line, e.g. of a traceback.
+                if included:
+                    entries[-1].message += '\n' + line
+                continue
+            included = False
+            stamp, level, logger, lineno, message = m.groups()
+            time = datetime.datetime.strptime(stamp, '%Y-%m-%d %H:%M:%S,%f')
+            # Context events are logged by a logger named after the
+            # context, e.g. subiquity/Install/install.
+            if '/' in logger:
+                entry = subiquity_event(time, source, logger, message)
+                if entry is not None:
+                    entries.append(entry)
+                    continue
+            if opts.all or level in WARNING_LEVELS:
+                entries.append(Entry(
+                    time, source, '{} {}: {}'.format(level, logger, message)))
+                included = True
+    return entries
+
+
+def curtin_event(time, message):
+    m = CURTIN_EVENT_RE.match(message)
+    if m is None:
+        return None
+    kind, name, result = m.group(1, 2, 3)
+    if kind == 'finish' and result is None:
+        return None
+    return Entry(
+        time, 'curtin', message, kind=kind, name=name, result=result)
+
+
+def read_journal_json(path, opts, subiquity_events):
+    entries = []
+    with open(path, errors='replace') as fp:
+        for line in fp:
+            line = line.strip()
+            if not line:
+                continue
+            try:
+                data = json.loads(line)
+            except json.JSONDecodeError:
+                continue
+            time = datetime.datetime.utcfromtimestamp(
+                int(data['__REALTIME_TIMESTAMP']) / 1e6)
+            message = data.get('MESSAGE', '')
+            if isinstance(message, list):
+                # journalctl -o json encodes non-UTF-8 messages as bytes.
+                message = bytes(message).decode('utf-8', 'replace')
+            ident = data.get('SYSLOG_IDENTIFIER', '')
+            if 'CURTIN_EVENT_TYPE' in data:
+                entry = curtin_event(time, message)
+                if entry is not None:
+                    entries.append(entry)
+                    continue
+            if 'SUBIQUITY_EVENT_TYPE' in data:
+                if subiquity_events:
+                    name = data.get('SUBIQUITY_CONTEXT_NAME', '')
+                    entries.append(Entry(
+                        time, 'server', message.strip(),
+                        kind=data['SUBIQUITY_EVENT_TYPE'], name=name,
+                        result=None))
+                continue
+            if opts.all or int(data.get('PRIORITY', 6)) <= 4:
+                entries.append(Entry(
+                    time, 'journal', '{}: {}'.format(ident, message)))
+    return entries
+
+
+def read_journal_text(path, opts, year):
+    entries = []
+    with open(path, errors='replace') as fp:
+        for line in fp:
+            line = line.rstrip('\n')
+            m = JOURNAL_ISO_RE.match(line)
+            if m is not None:
+                time = datetime.datetime.strptime(
+                    m.group(1), '%Y-%m-%dT%H:%M:%S')
+            else:
+                m = JOURNAL_SHORT_RE.match(line)
+                if m is None:
+                    continue
+                time = datetime.datetime.strptime(
+                    '{} {}'.format(year, m.group(1)), '%Y %b %d %H:%M:%S')
+            host, ident, message = m.group(2, 3, 4)
+            if ident.startswith('curtin_event'):
+                entry = curtin_event(time, message)
+                if entry is not None:
+                    entries.append(entry)
+                    continue
+            if opts.all:
+                entries.append(Entry(
+                    time, 'journal', '{}: {}'.format(ident, message)))
+    return entries
+
+
+def is_journal_json(path):
+    with open(path, errors='replace') as fp:
+        first = fp.readline()
+    try:
+        return '__REALTIME_TIMESTAMP' in json.loads(first)
+    except (json.JSONDecodeError, TypeError):
+        return False
+
+
+def classify(path):
+    """Return what kind of log path is, or None to ignore it."""
+    base = os.path.basename(path)
+    if base.startswith('subiquity-server-debug.log'):
+        return 'server'
+    if base.startswith('subiquity-client-debug.log'):
+        return 'client'
+    if base.endswith('.json') and is_journal_json(path):
+        return 'journal-json'
+    if 'journal' in base and base.endswith(('.txt', '.log')):
+        return 'journal-text'
+    return None
+
+
+def find_logs(paths):
+    found = {}
+    for path in paths:
+        if os.path.isdir(path):
+            candidates = []
+            for dirpath, dirnames, filenames in os.walk(path):
+                dirnames.sort()
+                for f in sorted(filenames):
+                    candidates.append(os.path.join(dirpath, f))
+        else:
+            candidates = [path]
+        for candidate in candidates:
+            kind = classify(candidate)
+            if kind is None:
+                continue
+            # subiquity-server-debug.log is a symlink to the .<pid> file.
+            found.setdefault(os.path.realpath(candidate), kind)
+    return found
+
+
+def build_spans(entries):
+    spans = []
+    open_spans = {}
+    for entry in entries:
+        key = (entry.source, entry.name)
+        if entry.kind == 'start':
+            span = Span(entry.source, entry.name, entry.time)
+            spans.append(span)
+            open_spans.setdefault(key, []).append(span)
+        elif entry.kind == 'finish':
+            stack = open_spans.get(key)
+            if stack:
+                span = stack.pop()
+                span.end = entry.time
+                span.result = entry.result
+    return spans
+
+
+def format_duration(seconds):
+    if seconds < 60:
+        return '{:.1f}s'.format(seconds)
+    minutes, seconds = divmod(int(seconds), 60)
+    return '{}m{:02d}s'.format(minutes, seconds)
+
+
+def write_text(entries, spans, out, slowest):
+    t0 = entries[0].time
+    for entry in entries:
+        offset = (entry.time - t0).total_seconds()
+        lines = entry.message.split('\n')
+        print('{:>9.3f}  {}  {:<7} {}'.format(
+            offset, entry.time.strftime('%H:%M:%S.%f')[:-3], entry.source,
+            lines[0]), file=out)
+        for line in lines[1:]:
+            print(' ' * 33 + line, file=out)
+    unfinished = [s for s in spans if s.end is None]
+    if unfinished:
+        print(file=out)
+        print('started but never finished:', file=out)
+        for span in unfinished:
+            print('  {}  {:<7} {}'.format(
+                span.start.strftime('%H:%M:%S'), span.source, span.name),
+                file=out)
+    finished = sorted(
+        (s for s in spans if s.end is not None),
+        key=lambda s: s.duration, reverse=True)
+    if finished and slowest:
+        print(file=out)
+        print('slowest steps:', file=out)
+        for span in finished[:slowest]:
+            print('  {:>8}  {:<7} {}'.format(
+                format_duration(span.duration), span.source, span.name),
+                file=out)
+
+
+HTML_TEMPLATE = """\
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Install timeline</title>
+<style>
+body {{ font-family: sans-serif; font-size: 13px; }}
+.row {{ position: relative; height: 18px; border-bottom: 1px solid #eee; }}
+.label {{ position: absolute; left: 0; width: 34%; overflow: hidden;
+          white-space: nowrap; text-overflow: ellipsis; }}
+.track {{ position: absolute; left: 35%; right: 0; top: 2px;
+          bottom: 2px; }}
+.bar {{ position: absolute; top: 0; bottom: 0; min-width: 2px; }}
+.SUCCESS {{ background: #0e8420; }}
+.WARN {{ background: #f99b11; }}
+.FAIL {{ background: #c7162b; }}
+.unfinished {{ background: repeating-linear-gradient(
+    45deg, #666, #666 4px, #aaa 4px, #aaa 8px); }}
+.curtin {{ opacity: 0.75; }}
+table {{ border-collapse: collapse; margin-top: 2em; }}
+td {{ padding: 0 1em 0 0; vertical-align: top; white-space: pre-wrap;
+      font-family: monospace; }}
+</style>
+</head>
+<body>
+<h1>Install timeline</h1>
+<p>{start} to {end} ({duration}). Striped bars never finished.</p>
+{rows}
+<table>
+{events}
+</table>
+</body>
+</html>
+"""
+
+
+def write_html(entries, spans, path):
+    t0 = entries[0].time
+    t1 = max([e.time for e in entries])
+    total = max((t1 - t0).total_seconds(), 0.001)
+    rows = []
+    for span in spans:
+        end = span.end or t1
+        left = 100 * (span.start - t0).total_seconds() / total
+        width = 100 * (end - span.start).total_seconds() / total
+        if span.end is None:
+            cls = 'unfinished'
+            title = 'never finished'
+        else:
+            cls = span.result or 'SUCCESS'
+            title = format_duration(span.duration)
+        depth = span.name.count('/')
+        rows.append(
+            '<div class="row {source}" title="{title}">'
+            '<div class="label" style="padding-left: {indent}em">{name}'
+            '</div><div class="track"><div class="bar {cls}" '
+            'style="left: {left:.3f}%; width: {width:.3f}%"></div></div>'
+            '</div>'.format(
+                source=span.source, title=html.escape(title),
+                indent=depth, name=html.escape(span.name), cls=cls,
+                left=left, width=width))
+    events = []
+    for entry in entries:
+        events.append('<tr><td>{}</td><td>{}</td><td>{}</td></tr>'.format(
+            entry.time.strftime('%H:%M:%S.%f')[:-3], entry.source,
+            html.escape(entry.message)))
+    with open(path, 'w') as fp:
+        fp.write(HTML_TEMPLATE.format(
+            start=t0.strftime('%Y-%m-%d %H:%M:%S'),
+            end=t1.strftime('%H:%M:%S'),
+            duration=format_duration(total),
+            rows='\n'.join(rows),
+            events='\n'.join(events)))
+
+
+def main():
+    parser = argparse.ArgumentParser(
+        description="Merge installer logs into one timeline.")
+    parser.add_argument(
+        'paths', nargs='+', metavar='PATH',
+        help="log files or directories containing them")
+    parser.add_argument(
+        '--all', action='store_true',
+        help="include every log line, not just events and warnings")
+    parser.add_argument(
+        '--html', metavar='FILE', help="also write a HTML timeline to FILE")
+    parser.add_argument(
+        '--year', type=int, default=None,
+        help="the year of text journal lines (default: from the other logs)")
+    parser.add_argument(
+        '--slowest', type=int, default=10, metavar='N',
+        help="list the N slowest steps (default: %(default)s)")
+    opts = parser.parse_args()
+
+    logs = find_logs(opts.paths)
+    if not logs:
+        parser.error("no logs found")
+
+    entries = []
+    for path, kind in sorted(logs.items()):
+        if kind in ('server', 'client'):
+            entries.extend(read_subiquity_log(path, kind, opts))
+    have_server_events = any(
+        e.source == 'server' and e.kind != 'log' for e in entries)
+    year = opts.year
+    if year is None:
+        if entries:
+            year = min(e.time for e in entries).year
+        else:
+            year = datetime.date.today().year
+    for path, kind in sorted(logs.items()):
+        if kind == 'journal-json':
+            entries.extend(read_journal_json(
+                path, opts, not have_server_events))
+        elif kind == 'journal-text':
+            entries.extend(read_journal_text(path, opts, year))
+    if not entries:
+        parser.error("no events found in " + ', '.join(sorted(logs)))
+    # sort is stable, so lines with the same timestamp stay in order.
+    entries.sort(key=lambda e: e.time)
+
+    spans = build_spans(entries)
+    write_text(entries, spans, sys.stdout, opts.slowest)
+    if opts.html:
+        write_html(entries, spans, opts.html)
+        print("wrote", opts.html, file=sys.stderr)
+
+
+if __name__ == '__main__':
+    main()
@@ -1,11 +1,13 @@
 #!/usr/bin/python3
 
 from collections import defaultdict
+import gettext
 import os
 import shutil
 import subprocess
 import sys
 from typing import Dict
+from xml.etree import ElementTree
 
 from subiquity.common.serialize import Serializer
 from subiquity.common.types import (
@@ -52,6 +54,57 @@ for line in p.stdout:
             code=name, name=value, variants=[])
 
 
+# console-setup's list of layouts is only updated by hand and so lags
+# behind xkeyboard-config's. Add the layouts and variants it does not
+# know about from the xkb rules, named the way console-setup names them.
+XKB_RULES = '/usr/share/X11/xkb/rules/evdev.xml'
+
+# Layouts in the rules that cannot be used as they are.
+SKIPPED_XKB_LAYOUTS = {'custom'}
+
+
+def xkb_layouts(path):
+    """Yield (code, description, [(code, description)]) for the layouts
+    in an xkb rules file."""
+    root = ElementTree.parse(path).getroot()
+    for layout in root.iter('layout'):
+        code = layout.findtext('configItem/name')
+        if code in SKIPPED_XKB_LAYOUTS:
+            continue
+        variants = [
+            (variant.findtext('configItem/name'),
+             variant.findtext('configItem/description'))
+            for variant in layout.iterfind('variantList/variant')
+            ]
+        yield code, layout.findtext('configItem/description'), variants
+
+
+def add_xkb_layouts(lang, layouts, xkb):
+    translation = gettext.translation(
+        'xkeyboard-config', languages=[lang], fallback=True)
+    for code, description, variants in xkb:
+        layout = layouts.get(code)
+        if layout is None:
+            name = translation.gettext(description)
+            layout = layouts[code] = KeyboardLayout(
+                code=code, name=name,
+                variants=[KeyboardVariant(code="", name=name)])
+        known = {variant.code for variant in layout.variants}
+        for variant_code, variant_description in variants:
+            if variant_code in known:
+                continue
+            layout.variants.append(KeyboardVariant(
+                code=variant_code,
+                name=layout.name + " - " + translation.gettext(
+                    variant_description)))
+
+
+if os.path.exists(XKB_RULES):
+    xkb = list(xkb_layouts(XKB_RULES))
+    for lang, layouts in lang_to_layouts.items():
+        add_xkb_layouts(lang, layouts, xkb)
+
+
 s = Serializer(compact=True)
 
 
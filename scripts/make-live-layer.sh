@@ -0,0 +1,123 @@
+#!/bin/bash
+
+# make-live-layer.sh [-o $layer] [$old_iso $new_iso]
+#
+# Build a small squashfs containing the subiquity and subiquitycore
+# packages from this tree, and optionally add it to an existing live
+# server ISO. This takes seconds rather than the minutes a snapcraft
+# build and inject-subiquity-snap.sh take, so it is the quickest way to
+# try a change to the client or server code on a real ISO. Changes to
+# the snap itself (dependencies, snapcraft.yaml, curtin) still need the
+# full rebuild.
+#
+# casper mounts every *.squashfs in /casper on the ISO as a layer of the
+# live filesystem in name order, so the layer is added as
+# /casper/subiquity-live-layer.squashfs, which sorts after
+# filesystem.squashfs and installer.squashfs. The ISO is modified with
+# xorriso (keeping its boot setup), which needs neither root nor loop
+# mounts.
+#
+# The snap is still the one seeded in the ISO and cannot be changed from
+# a layer, as it is a read-only squashfs of its own. Instead the layer
+# adds drop-ins to the subiquity snap's services that bind mount the
+# packages from the layer over the ones in the snap before the server
+# or client starts. Check "journalctl -t subiquity-live-layer" in the
+# live session to see which revision of the tree is being used.
+
+set -eux
+
+src="$(dirname "$(dirname "$(readlink -f "${0}")")")"
+layer=
+
+while getopts ":o:" opt; do
+    case "${opt}" in
+        o)
+            layer="$(readlink -f "${OPTARG}")"
+            ;;
+        \?)
+            echo "Invalid option: -$OPTARG" >&2
+            exit 1
+            ;;
+    esac
+done
+shift $((OPTIND-1))
+
+OLD_ISO=
+NEW_ISO=
+if [ $# -eq 2 ]; then
+    OLD_ISO="$(readlink -f "${1}")"
+    NEW_ISO="$(readlink -f "${2}")"
+elif [ $# -ne 0 ]; then
+    echo "usage: $0 [-o layer.squashfs] [old.iso new.iso]" >&2
+    exit 1
+fi
+
+tmpdir="$(mktemp -d)"
+
+cleanup () {
+    rm -rf "${tmpdir}"
+}
+
+trap cleanup EXIT
+
+# Without -o, keep the layer only if it is not going into an ISO.
+if [ -z "${layer}" ]; then
+    if [ -n "${NEW_ISO}" ]; then
+        layer="${tmpdir}/subiquity-live-layer.squashfs"
+    else
+        layer="$(pwd)/subiquity-live-layer.squashfs"
+    fi
+fi
+
+share=usr/share/subiquity-live-layer
+root="${tmpdir}/root"
+mkdir -p "${root}/${share}/python"
+
+rsync -a --exclude __pycache__ --exclude tests \
+      "${src}/subiquity" "${src}/subiquitycore" "${root}/${share}/python/"
+
+(cd "${src}" && git describe --always --dirty) > "${root}/${share}/REVISION"
+
+cat > "${root}/${share}/apply" <<'EOF'
+#!/bin/sh
+# Bind mount the packages from the layer over the ones in the snap. This
+# runs before each start of the snap's services so it has to be
+# idempotent.
+layer=/usr/share/subiquity-live-layer
+site=$(echo /snap/subiquity/current/lib/python3*/site-packages)
+for pkg in subiquity subiquitycore; do
+    if ! mountpoint -q "$site/$pkg"; then
+        mount --bind "$layer/python/$pkg" "$site/$pkg"
+    fi
+done
+logger -t subiquity-live-layer "using subiquity from $(cat $layer/REVISION)"
+EOF
+chmod 755 "${root}/${share}/apply"
+
+for service in subiquity-server subiquity-service; do
+    dropin="${root}/etc/systemd/system/snap.subiquity.${service}.service.d"
+    mkdir -p "${dropin}"
+    cat > "${dropin}/live-layer.conf" <<EOF
+[Service]
+ExecStartPre=/${share}/apply
+EOF
+done
+
+rm -f "${layer}"
+mksquashfs "${root}" "${layer}" -all-root -comp gzip -Xcompression-level 3
+
+if [ -z "${NEW_ISO}" ]; then
+    exit 0
+fi
+
+cd "${tmpdir}"
+xorriso -osirrox on -indev "${OLD_ISO}" -extract /md5sum.txt md5sum.txt
+chmod u+w md5sum.txt
+sed -i'' '/\.\/casper\/subiquity-live-layer.squashfs/d' md5sum.txt
+echo "$(md5sum < "${layer}" | cut -d' ' -f1)  ./casper/subiquity-live-layer.squashfs" >> md5sum.txt
+
+rm -f "${NEW_ISO}"
+xorriso -indev "${OLD_ISO}" -outdev "${NEW_ISO}" \
+        -map "${layer}" /casper/subiquity-live-layer.squashfs \
+        -map md5sum.txt /md5sum.txt \
+        -boot_image any replay
@@ -39,6 +39,19 @@ for answers in examples/answers*.yaml; do
     grep -q 'finish: subiquity/Install/install/run_unattended_upgrades: SUCCESS: downloading and installing security updates' .subiquity/subiquity-server-debug.log
 done
 
+# Answer the screens with random choices too. Set SUBIQUITY_FUZZ_SEEDS to
+# try other seeds; the answers of a failing run are kept for replaying
+# with --answers.
+for seed in ${SUBIQUITY_FUZZ_SEEDS:-1 2 3}; do
+    clean
+    if ! timeout --foreground 60 sh -c "LANG=C.UTF-8 python3 -m subiquity.cmd.tui --fuzz-answers $seed --dry-run --snaps-from-examples --machine-config examples/simple.json" < $tty; then
+        cp .subiquity/fuzz-answers.yaml fuzz-answers-$seed.yaml
+        echo "fuzzing with seed $seed failed, answers saved to fuzz-answers-$seed.yaml"
+        exit 1
+    fi
+    validate
+done
+
 clean
 timeout --foreground 60 sh -c "LANG=C.UTF-8 python3 -m subiquity.cmd.tui --autoinstall examples/autoinstall.yaml \
                                --dry-run --machine-config examples/existing-partitions.json --bootloader bios \
@@ -66,3 +79,12 @@ grep -q 'finish: subiquity/Install/install/run_unattended_upgrades: SUCCESS: dow
 
 python3 -m subiquity.cmd.schema > "$testschema"
 diff -u "autoinstall-schema.json" "$testschema"
+
+python3 -m subiquity.cmd.validate_autoinstall examples/autoinstall.yaml
+python3 -m subiquity.cmd.validate_autoinstall - < examples/autoinstall.yaml
+python3 -m subiquity.cmd.validate_autoinstall --schema autoinstall-schema.json \
+        --schema-version 1 examples/autoinstall-user-data.yaml
+if python3 -m subiquity.cmd.validate_autoinstall examples/autoinstall-invalid.yaml; then
+    echo "invalid autoinstall config passed validation"
+    exit 1
+fi
@@ -116,6 +116,10 @@ setup(name='subiquity',
           'console_scripts': [
               'subiquity-server = subiquity.cmd.server:main',
               'subiquity-tui = subiquity.cmd.tui:main',
+              ('subiquity-validate-autoinstall = '
+               'subiquity.cmd.validate_autoinstall:main'),
+              ('subiquity-clone-install = '
+               'subiquity.cmd.clone_install:main'),
               'console-conf-tui = console_conf.cmd.tui:main',
               ('console-conf-write-login-details = '
                'console_conf.cmd.write_login_details:main'),
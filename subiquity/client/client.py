@@ -26,6 +26,7 @@ import aiohttp
 from subiquitycore.async_helpers import (
     run_in_thread,
     )
+from subiquitycore.controllerset import ControllerSet
 from subiquitycore.screen import is_linux_tty
 from subiquitycore.tuicontroller import Skip
 from subiquitycore.tui import TuiApplication
@@ -38,6 +39,11 @@ from subiquity.client.keycodes import (
     )
 from subiquity.common.api.client import make_client_for_conn
 from subiquity.common.apidef import API
+from subiquity.common.console import (
+    FBTERM_ENV,
+    fbterm_cmdline,
+    RESUME_AFTER_ENV,
+    )
 from subiquity.common.errorreport import (
     ErrorReporter,
     )
@@ -102,6 +108,7 @@ class SubiquityClient(TuiApplication):
         "Proxy",
         "Mirror",
         "Refresh",
+        "ISCSI",
         "Filesystem",
         "Identity",
         "SSH",
@@ -109,6 +116,14 @@ class SubiquityClient(TuiApplication):
         "Progress",
         ]
 
+    # The screens shown instead when the server is in rescue mode.
+    rescue_controllers = [
+        "Serial",
+        "Welcome",
+        "Keyboard",
+        "Rescue",
+        ]
+
     def __init__(self, opts):
         if is_linux_tty():
             self.input_filter = KeyCodesFilter()
@@ -120,6 +135,7 @@ class SubiquityClient(TuiApplication):
         self.interactive = None
         self.server_updated = None
         self.restarting = False
+        self.switch_to_fbterm = False
         self.global_overlays = []
 
         try:
@@ -179,9 +195,17 @@ class SubiquityClient(TuiApplication):
             if self.opts.server_pid is not None:
                 cmdline.extend(['--server-pid', self.opts.server_pid])
             log.debug("restarting %r", cmdline)
+        if self.switch_to_fbterm:
+            cmdline = fbterm_cmdline(cmdline)
 
         os.execvp(cmdline[0], cmdline)
 
+    def restart_in_fbterm(self):
+        os.environ[FBTERM_ENV] = '1'
+        os.environ[RESUME_AFTER_ENV] = self.controllers.cur.name
+        self.switch_to_fbterm = True
+        self.restart(remove_last_screen=False)
+
     def resp_hook(self, response):
         headers = response.headers
         if 'x-updated' in headers:
@@ -311,15 +335,20 @@ class SubiquityClient(TuiApplication):
                             ])
                     print(line)
                 return
+            if status.rescue:
+                self.controllers = ControllerSet(
+                    self.controllers_mod, self.rescue_controllers,
+                    init_args=(self,))
             await super().start()
-            journald_listen(
-                self.aio_loop,
-                [status.event_syslog_id],
-                self.controllers.Progress.event)
-            journald_listen(
-                self.aio_loop,
-                [status.log_syslog_id],
-                self.controllers.Progress.log_line)
+            if not status.rescue:
+                journald_listen(
+                    self.aio_loop,
+                    [status.event_syslog_id],
+                    self.controllers.Progress.event)
+                journald_listen(
+                    self.aio_loop,
+                    [status.log_syslog_id],
+                    self.controllers.Progress.log_line)
             if not status.cloud_init_ok:
                 self.add_global_overlay(CloudInitFail(self))
             self.error_reporter.load_reports()
@@ -415,11 +444,15 @@ class SubiquityClient(TuiApplication):
             if os.path.exists(state_path):
                 with open(state_path) as fp:
                     last_screen = fp.read().strip()
+        # Only the first client to run inside fbterm carries on from
+        # the screen the switch happened on.
+        resume_after = os.environ.pop(RESUME_AFTER_ENV, None)
         index = 0
-        if last_screen:
-            for i, controller in enumerate(self.controllers.instances):
-                if controller.name == last_screen:
-                    index = i
+        for i, controller in enumerate(self.controllers.instances):
+            if controller.name == last_screen:
+                index = i
+            elif controller.name == resume_after:
+                index = i + 1
         self.aio_loop.create_task(self._select_initial_screen(index))
 
     async def _select_initial_screen(self, index):
@@ -454,6 +487,11 @@ class SubiquityClient(TuiApplication):
 
     async def make_view_for_controller(self, new):
         view = await super().make_view_for_controller(new)
+        if new.endpoint_name is not None:
+            # The timeout of an interactive section only starts once
+            # there is someone being asked to answer it.
+            self.aio_loop.create_task(
+                self.client.meta.section_shown.POST(new.endpoint_name))
         if new.answers:
             self.aio_loop.create_task(self._start_answers_for_view(new, view))
         with open(self.state_path('last-screen'), 'w') as fp:
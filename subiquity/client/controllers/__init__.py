@@ -16,12 +16,14 @@
 from subiquitycore.tuicontroller import RepeatedController
 from .filesystem import FilesystemController
 from .identity import IdentityController
+from .iscsi import ISCSIController
 from .keyboard import KeyboardController
 from .mirror import MirrorController
 from .network import NetworkController
 from .progress import ProgressController
 from .proxy import ProxyController
 from .refresh import RefreshController
+from .rescue import RescueController
 from .serial import SerialController
 from .snaplist import SnapListController
 from .ssh import SSHController
@@ -32,6 +34,7 @@ from .zdev import ZdevController
 __all__ = [
     'FilesystemController',
     'IdentityController',
+    'ISCSIController',
     'KeyboardController',
     'MirrorController',
     'NetworkController',
@@ -39,6 +42,7 @@ __all__ = [
     'ProxyController',
     'RefreshController',
     'RepeatedController',
+    'RescueController',
     'SerialController',
     'SnapListController',
     'SSHController',
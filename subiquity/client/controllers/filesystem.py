@@ -30,6 +30,9 @@ from subiquity.ui.views import (
     FilesystemView,
     GuidedDiskSelectionView,
     )
+from subiquity.ui.views.filesystem.filesystem import (
+    DevicesChangedStretchy,
+    )
 from subiquity.ui.views.filesystem.probing import (
     SlowProbing,
     ProbingFailed,
@@ -54,6 +57,7 @@ class FilesystemController(SubiquityTuiController, FilesystemManipulator):
     def __init__(self, app):
         super().__init__(app)
         self.model = None
+        self.optional_fstypes = []
         self.answers.setdefault('guided', False)
         self.answers.setdefault('guided-index', 0)
         self.answers.setdefault('manual', [])
@@ -77,7 +81,11 @@ class FilesystemController(SubiquityTuiController, FilesystemManipulator):
             return ProbingFailed(self, status.error_report)
         if status.error_report:
             self.app.show_error_report(status.error_report)
-        return GuidedDiskSelectionView(self, status.disks)
+        self.optional_fstypes = status.optional_fstypes or []
+        return GuidedDiskSelectionView(
+            self, status.disks, status.resize_targets, self.optional_fstypes,
+            status.reinstall_targets or [], status.reset_partition_size,
+            status.zfs_supported)
 
     async def run_answers(self):
         # Wait for probing to finish.
@@ -90,6 +98,9 @@ class FilesystemController(SubiquityTuiController, FilesystemManipulator):
             self.ui.body.form.guided_choice.value = {
                 'disk': disk,
                 'use_lvm': method == "lvm",
+                'use_zfs': method == "zfs",
+                'reset_partition': self.answers.get(
+                    'guided-reset-partition', False),
                 }
             self.ui.body.done(self.ui.body.form)
             await self.app.confirm_install()
@@ -208,6 +219,7 @@ class FilesystemController(SubiquityTuiController, FilesystemManipulator):
             self.endpoint.guided.POST(choice))
         self.model = FilesystemModel(status.bootloader)
         self.model.load_server_data(status)
+        self.model.optional_fstypes = self.optional_fstypes
         if self.model.bootloader == Bootloader.PREP:
             self.supports_resilient_boot = False
         else:
@@ -239,5 +251,18 @@ class FilesystemController(SubiquityTuiController, FilesystemManipulator):
         self.app.prev_screen()
 
     def finish(self):
+        self.app.aio_loop.create_task(self._finish())
+
+    async def _finish(self):
+        status = await self.app.wait_with_progress(self.endpoint.POST(
+            self.model._render_actions(), generation=self.model.generation))
+        if status is not None:
+            # The devices changed under us, so start again from what the
+            # server has now.
+            self.model.load_server_data(status)
+            self.ui.set_body(FilesystemView(self.model, self))
+            self.ui.body.show_stretchy_overlay(
+                DevicesChangedStretchy(self.ui.body))
+            return
         log.debug("FilesystemController.finish next_screen")
-        self.app.next_screen(self.endpoint.POST(self.model._render_actions()))
+        self.app.next_screen()
@@ -0,0 +1,56 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+from subiquity.client.controller import SubiquityTuiController
+from subiquity.common.types import (
+    ISCSIDiscovery,
+    ISCSILogin,
+    )
+from subiquity.ui.views import ISCSIView
+
+
+log = logging.getLogger("subiquity.client.controllers.iscsi")
+
+
+class ISCSIController(SubiquityTuiController):
+
+    endpoint_name = 'iscsi'
+
+    async def make_ui(self):
+        status = await self.endpoint.GET()
+        return ISCSIView(self, status)
+
+    def run_answers(self):
+        if 'accept-default' in self.answers:
+            self.done()
+
+    def cancel(self):
+        self.app.prev_screen()
+
+    def done(self):
+        self.app.next_screen(self.endpoint.POST())
+
+    async def discover(self, portal, chap):
+        return await self.endpoint.discover.POST(
+            ISCSIDiscovery(portal=portal, chap=chap))
+
+    async def login(self, target, chap):
+        return await self.endpoint.login.POST(
+            ISCSILogin(target=target, chap=chap))
+
+    async def logout(self, target):
+        return await self.endpoint.logout.POST(target)
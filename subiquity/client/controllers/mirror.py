@@ -27,7 +27,8 @@ class MirrorController(SubiquityTuiController):
 
     async def make_ui(self):
         mirror = await self.endpoint.GET()
-        return MirrorView(self, mirror)
+        ranking = await self.endpoint.ranking.GET()
+        return MirrorView(self, mirror, ranking)
 
     def run_answers(self):
         if 'mirror' in self.answers:
@@ -39,6 +40,10 @@ class MirrorController(SubiquityTuiController):
     def cancel(self):
         self.app.prev_screen()
 
+    async def rank(self):
+        await self.endpoint.ranking.POST()
+        return await self.endpoint.ranking.GET(wait=True)
+
     def done(self, mirror):
         log.debug("MirrorController.done next_screen mirror=%s", mirror)
         self.app.next_screen(self.endpoint.POST(mirror))
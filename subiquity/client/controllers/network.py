@@ -22,7 +22,9 @@ from typing import List, Optional
 from subiquitycore.controllers.network import NetworkAnswersMixin
 from subiquitycore.models.network import (
     BondConfig,
+    BridgeConfig,
     NetDevInfo,
+    RoutingConfig,
     StaticConfig,
     )
 from subiquitycore.ui.views.network import NetworkView
@@ -37,10 +39,12 @@ log = logging.getLogger('subiquity.client.controllers.network')
 class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
 
     endpoint_name = 'network'
+    can_import_installed_config = True
 
     def __init__(self, app):
         super().__init__(app)
         self.view = None
+        self.offline = False
 
     async def update_link_POST(self, act: LinkAction,
                                info: NetDevInfo) -> None:
@@ -53,9 +57,10 @@ class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
         if act == LinkAction.DEL:
             self.view.del_link(info)
 
-    async def route_watch_POST(self, routes: List[int]) -> None:
+    async def route_watch_POST(self, routes: List[int],
+                               ipv6_only: bool) -> None:
         if self.view is not None:
-            self.view.update_default_routes(routes)
+            self.view.update_default_routes(routes, ipv6_only)
 
     async def apply_starting_POST(self) -> None:
         if self.view is not None:
@@ -83,7 +88,8 @@ class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
 
     async def make_ui(self):
         netdev_infos = await self.endpoint.GET()
-        self.view = NetworkView(self, netdev_infos)
+        self.offline = await self.app.client.offline.GET()
+        self.view = NetworkView(self, netdev_infos, offline=self.offline)
         await self.subscribe()
         return self.view
 
@@ -95,8 +101,20 @@ class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
     def cancel(self):
         self.app.prev_screen()
 
+    def set_offline(self, offline: bool) -> None:
+        # Tell the server at once, so it does not carry on with lookups
+        # that the install is not going to use.
+        self.offline = offline
+        self.app.aio_loop.create_task(self.app.client.offline.POST(offline))
+
+    async def _post_done(self):
+        # Record the choice first so the network controller knows
+        # whether the install may use the network when it is configured.
+        await self.app.client.offline.POST(self.offline)
+        await self.endpoint.POST()
+
     def done(self):
-        self.app.next_screen(self.endpoint.POST())
+        self.app.next_screen(self._post_done())
 
     def set_static_config(self, dev_name: str, ip_version: int,
                           static_config: StaticConfig) -> None:
@@ -104,6 +122,11 @@ class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
             self.endpoint.set_static_config.POST(
                 dev_name, ip_version, static_config))
 
+    def set_routing_config(self, dev_name: str,
+                           routing_config: RoutingConfig) -> None:
+        self.app.aio_loop.create_task(
+            self.endpoint.set_routing_config.POST(dev_name, routing_config))
+
     def enable_dhcp(self, dev_name, ip_version: int) -> None:
         self.app.aio_loop.create_task(
             self.endpoint.enable_dhcp.POST(dev_name, ip_version))
@@ -112,9 +135,9 @@ class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
         self.app.aio_loop.create_task(
             self.endpoint.disable.POST(dev_name, ip_version))
 
-    def add_vlan(self, dev_name: str, vlan_id: int):
+    def add_vlans(self, dev_name: str, vlan_ids: List[int]):
         self.app.aio_loop.create_task(
-            self.endpoint.vlan.PUT(dev_name, vlan_id))
+            self.endpoint.vlan.PUT(dev_name, vlan_ids))
 
     def delete_link(self, dev_name: str):
         self.app.aio_loop.create_task(self.endpoint.delete.POST(dev_name))
@@ -125,5 +148,18 @@ class NetworkController(SubiquityTuiController, NetworkAnswersMixin):
             self.endpoint.add_or_edit_bond.POST(
                 existing_name, new_name, new_info))
 
+    def add_or_update_bridge(self, existing_name: Optional[str],
+                             new_name: str, new_info: BridgeConfig) -> None:
+        self.app.aio_loop.create_task(
+            self.endpoint.add_or_edit_bridge.POST(
+                existing_name, new_name, new_info))
+
+    async def installed_network_configs(self):
+        return await self.endpoint.installed_configs.GET()
+
+    def import_installed_config(self, config):
+        self.app.aio_loop.create_task(
+            self.endpoint.import_installed.POST(config))
+
     async def get_info_for_netdev(self, dev_name: str) -> str:
         return await self.endpoint.info.GET(dev_name)
@@ -16,6 +16,7 @@
 import logging
 
 from subiquity.client.controller import SubiquityTuiController
+from subiquity.common.types import StoreProxyConfig
 from subiquity.ui.views.proxy import ProxyView
 
 log = logging.getLogger('subiquity.client.controllers.proxy')
@@ -27,15 +28,34 @@ class ProxyController(SubiquityTuiController):
 
     async def make_ui(self):
         proxy = await self.endpoint.GET()
-        return ProxyView(self, proxy)
+        self.store_proxy = await self.app.client.store_proxy.GET()
+        return ProxyView(self, proxy, self.store_proxy.url)
 
     def run_answers(self):
-        if 'proxy' in self.answers:
-            self.done(self.answers['proxy'])
+        if 'proxy' in self.answers or 'snap-store-proxy' in self.answers:
+            self.done(
+                self.answers.get('proxy', ''),
+                self.answers.get('snap-store-proxy', ''))
 
     def cancel(self):
         self.app.prev_screen()
 
-    def done(self, proxy):
-        log.debug("ProxyController.done next_screen proxy=%s", proxy)
-        self.app.next_screen(self.endpoint.POST(proxy))
+    async def _done(self, proxy, store_proxy_url):
+        await self.endpoint.POST(proxy)
+        if store_proxy_url != self.store_proxy.url:
+            error = await self.app.wait_with_text_dialog(
+                self.app.client.store_proxy.POST(
+                    StoreProxyConfig(url=store_proxy_url)),
+                _("Registering with the snap store proxy..."))
+            if error is not None:
+                self.store_proxy = StoreProxyConfig()
+                if isinstance(self.ui.body, ProxyView):
+                    self.ui.body.store_proxy_failed(error)
+                return
+        self.app.next_screen()
+
+    def done(self, proxy, store_proxy_url=''):
+        log.debug(
+            "ProxyController.done proxy=%s store_proxy=%s",
+            proxy, store_proxy_url)
+        self.app.aio_loop.create_task(self._done(proxy, store_proxy_url))
@@ -0,0 +1,82 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+import os
+
+from subiquity.client.controller import SubiquityTuiController
+from subiquity.common.types import RescueUnlock
+from subiquity.ui.views import RescueView
+
+
+log = logging.getLogger("subiquity.client.controllers.rescue")
+
+
+RESCUE_SHELL_INTRO = _("""\
+Rescue shell session activated.
+
+This shell is running inside the install mounted at {mount_point}, with
+the devices and filesystems of the installer environment available.
+You will be returned to the installer when this shell is exited, for
+example by typing Control-D or 'exit'.
+""")
+
+
+class RescueController(SubiquityTuiController):
+
+    endpoint_name = 'rescue'
+
+    async def make_ui(self):
+        status = await self.endpoint.GET()
+        return RescueView(self, status)
+
+    def run_answers(self):
+        pass
+
+    def cancel(self):
+        self.app.prev_screen()
+
+    async def status(self):
+        return await self.endpoint.GET()
+
+    async def unlock(self, path, passphrase):
+        return await self.endpoint.unlock.POST(
+            RescueUnlock(path=path, passphrase=passphrase))
+
+    async def mount(self, root):
+        return await self.endpoint.mount.POST(root)
+
+    async def unmount(self):
+        return await self.endpoint.unmount.POST()
+
+    async def run_action(self, root, action):
+        return await self.endpoint.run.POST(root, action)
+
+    def shell(self, mount_point, after_hook=None):
+
+        def _before():
+            os.system("clear")
+            print(RESCUE_SHELL_INTRO.format(mount_point=mount_point))
+
+        if self.app.opts.dry_run:
+            # The install is not really mounted and chroot needs root.
+            cmd = ['bash']
+        else:
+            cmd = ['chroot', mount_point, '/bin/bash', '--login']
+        self.app.run_command_in_foreground(
+            cmd, before_hook=_before, after_hook=after_hook, cwd=mount_point)
+
+    def reboot(self):
+        self.app.aio_loop.create_task(self.endpoint.reboot.POST())
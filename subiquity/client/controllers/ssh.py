@@ -13,9 +13,12 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+import asyncio
 import logging
 import subprocess
 
+import aiohttp
+
 from subiquitycore.async_helpers import schedule_task
 from subiquitycore.context import with_context
 from subiquitycore import utils
@@ -26,6 +29,43 @@ from subiquity.ui.views.ssh import SSHView
 
 log = logging.getLogger('subiquity.client.controllers.ssh')
 
+SSH_KEYS_TIMEOUT = 30
+
+# ssh-import-id only knows about Launchpad and Github, keys from these
+# services (and https:// URLs) are fetched directly.
+SSH_KEY_URLS = {
+    'gl': 'https://gitlab.com/{}.keys',
+    'cb': 'https://codeberg.org/{}.keys',
+    }
+
+
+def ssh_keys_url(ssh_import_id):
+    """Return the URL to fetch keys for ssh_import_id from.
+
+    Returns None for the ids that are handled by ssh-import-id.
+    """
+    if ssh_import_id.startswith('https://'):
+        return ssh_import_id
+    service, sep, username = ssh_import_id.partition(':')
+    if service in SSH_KEY_URLS and username:
+        return SSH_KEY_URLS[service].format(username)
+    return None
+
+
+def parse_authorized_keys(content, ssh_import_id):
+    """Extract the keys from authorized_keys style content.
+
+    The keys are labelled with ssh_import_id in the same way as the
+    output of ssh-import-id.
+    """
+    keys = []
+    for line in content.replace('\r', '').splitlines():
+        line = line.strip()
+        if not line or line.startswith('#'):
+            continue
+        keys.append('{} # ssh-import-id {}'.format(line, ssh_import_id))
+    return keys
+
 
 class FetchSSHKeysFailure(Exception):
     def __init__(self, message, output):
@@ -81,17 +121,60 @@ class SSHController(SubiquityTuiController):
             raise subprocess.CalledProcessError(cp.returncode, cmd)
         return cp
 
+    async def _fetch_url(self, url):
+        timeout = aiohttp.ClientTimeout(total=SSH_KEYS_TIMEOUT)
+        async with aiohttp.ClientSession(
+                timeout=timeout, trust_env=True) as session:
+            async with session.get(url) as resp:
+                if resp.status != 200:
+                    raise FetchSSHKeysFailure(
+                        _("Importing keys failed:"),
+                        "{} returned HTTP status {}".format(url, resp.status))
+                return await resp.text()
+
+    async def fetch_url_keys(self, ssh_import_id, url):
+        try:
+            content = await self._fetch_url(url)
+        except (aiohttp.ClientError, asyncio.TimeoutError,
+                UnicodeDecodeError) as e:
+            failure = FetchSSHKeysFailure(
+                _("Importing keys failed:"),
+                "fetching {} failed: {}".format(
+                    url, str(e) or type(e).__name__))
+        except FetchSSHKeysFailure as e:
+            failure = e
+        else:
+            keys = parse_authorized_keys(content, ssh_import_id)
+            if keys:
+                return '\n'.join(keys)
+            failure = FetchSSHKeysFailure(
+                _("Importing keys failed:"),
+                "no keys found at {}".format(url))
+        if isinstance(self.ui.body, SSHView):
+            self.ui.body.fetching_ssh_keys_failed(
+                failure.message, failure.output)
+        raise failure
+
     @with_context(
         name="ssh_import_id", description="{ssh_import_id}")
     async def _fetch_ssh_keys(self, *, context, ssh_import_id, ssh_data):
         with self.context.child("ssh_import_id", ssh_import_id):
-            try:
-                cp = await self.run_cmd_checked(
-                    ['ssh-import-id', '-o-', ssh_import_id],
-                    failmsg=_("Importing keys failed:"))
-            except subprocess.CalledProcessError:
-                return
-            key_material = cp.stdout.replace('\r', '').strip()
+            url = ssh_keys_url(ssh_import_id)
+            if url is not None:
+                try:
+                    key_material = await self.fetch_url_keys(
+                        ssh_import_id, url)
+                except FetchSSHKeysFailure as e:
+                    log.debug("fetching keys failed: %s", e.output)
+                    return
+            else:
+                try:
+                    cp = await self.run_cmd_checked(
+                        ['ssh-import-id', '-o-', ssh_import_id],
+                        failmsg=_("Importing keys failed:"))
+                except subprocess.CalledProcessError:
+                    return
+                key_material = cp.stdout.replace('\r', '').strip()
 
             try:
                 cp = await self.run_cmd_checked(
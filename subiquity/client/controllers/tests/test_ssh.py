@@ -0,0 +1,59 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.client.controllers.ssh import (
+    parse_authorized_keys,
+    ssh_keys_url,
+    )
+
+
+class TestSSHKeysURL(unittest.TestCase):
+
+    def test_import_id_services(self):
+        self.assertIsNone(ssh_keys_url('lp:someone'))
+        self.assertIsNone(ssh_keys_url('gh:someone'))
+
+    def test_forges(self):
+        self.assertEqual(
+            ssh_keys_url('gl:someone'), 'https://gitlab.com/someone.keys')
+        self.assertEqual(
+            ssh_keys_url('cb:someone'), 'https://codeberg.org/someone.keys')
+
+    def test_url(self):
+        url = 'https://example.com/keys'
+        self.assertEqual(ssh_keys_url(url), url)
+        self.assertIsNone(ssh_keys_url('http://example.com/keys'))
+
+
+class TestParseAuthorizedKeys(unittest.TestCase):
+
+    def test_labels_keys(self):
+        content = (
+            "# a comment\r\n"
+            "ssh-ed25519 AAAAC3Nza one@example\r\n"
+            "\r\n"
+            "ssh-rsa AAAAB3Nza\n")
+        self.assertEqual(
+            parse_authorized_keys(content, 'gl:someone'),
+            [
+                'ssh-ed25519 AAAAC3Nza one@example '
+                '# ssh-import-id gl:someone',
+                'ssh-rsa AAAAB3Nza # ssh-import-id gl:someone',
+            ])
+
+    def test_empty(self):
+        self.assertEqual(parse_authorized_keys("\n# nothing\n", 'cb:x'), [])
@@ -16,8 +16,14 @@
 import logging
 
 from subiquitycore import i18n
+from subiquitycore.screen import is_linux_tty
 from subiquitycore.tuicontroller import Skip
 from subiquity.client.controller import SubiquityTuiController
+from subiquity.common.console import (
+    console_can_show,
+    fbterm_available,
+    running_in_fbterm,
+    )
 from subiquity.ui.views.welcome import WelcomeView
 
 log = logging.getLogger('subiquity.client.controllers.welcome')
@@ -42,8 +48,19 @@ class WelcomeController(SubiquityTuiController):
     def done(self, code):
         log.debug("WelcomeController.done %s next_screen", code)
         i18n.switch_language(code)
+        if self.can_switch_to_fbterm() and not console_can_show(code):
+            self.app.aio_loop.create_task(self._restart_in_fbterm(code))
+            return
         self.app.next_screen(self.endpoint.POST(code))
 
+    def can_switch_to_fbterm(self):
+        return is_linux_tty() and not running_in_fbterm() and \
+            fbterm_available()
+
+    async def _restart_in_fbterm(self, code):
+        await self.endpoint.POST(code)
+        self.app.restart_in_fbterm()
+
     def cancel(self, sender=None):
         if not self.serial:
             # Can't go back from here unless we're on serial!
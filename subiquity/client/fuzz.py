@@ -0,0 +1,89 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Generate random but valid answers, for testing.
+
+Each screen gets one of the choices its answers handling knows how to
+make, picked by a random.Random seeded from the command line so that a
+failing run can be repeated exactly.
+"""
+
+import random
+import string
+
+
+# The crypted form of "ubuntu", as in examples/answers.yaml.
+PASSWORD = (
+    '$6$wdAcoXrU039hKYPd$508Qvbe7ObUnxoj15DRCkzC3qO7edjH0VV7BPNRDYK4QR8ofJ'
+    'aEEF2heacn0QgD.f8pO8SNp83XNdWG6tocBM1')
+
+LANGUAGES = ['en_US', 'en_GB', 'fr_FR', 'de_DE', 'es_ES', 'ru_RU', 'pl_PL']
+KEYBOARD_LAYOUTS = [
+    ('us', ''), ('us', 'dvorak'), ('gb', ''), ('fr', ''), ('de', ''),
+    ]
+COUNTRY_CODES = ['us', 'gb', 'fr', 'de', 'br', 'cn']
+GUIDED_METHODS = [None, 'lvm', 'zfs']
+# Snaps that have info in examples/snaps (for --snaps-from-examples).
+SNAPS = ['aws-cli', 'canonical-livepatch', 'docker', 'etcd']
+
+
+def _word(rng, prefix):
+    return prefix + ''.join(
+        rng.choice(string.ascii_lowercase) for _ in range(rng.randint(3, 8)))
+
+
+def fuzz_answers(seed):
+    rng = random.Random(seed)
+    layout, variant = rng.choice(KEYBOARD_LAYOUTS)
+    if rng.random() < 0.5:
+        mirror = {'accept-default': True}
+    else:
+        mirror = {'country-code': rng.choice(COUNTRY_CODES)}
+    filesystem = {
+        'guided': True,
+        'guided-index': 0,
+        }
+    method = rng.choice(GUIDED_METHODS)
+    if method is not None:
+        filesystem['guided-method'] = method
+    # No ssh-import-id: that would need the network, and real users.
+    ssh = {'install_server': rng.random() < 0.5, 'pwauth': True}
+    snaps = {
+        name: {
+            'channel': rng.choice(['stable', 'candidate', 'edge']),
+            'is_classic': False,
+            }
+        for name in rng.sample(SNAPS, rng.randint(0, len(SNAPS)))
+        }
+    return {
+        'Welcome': {'lang': rng.choice(LANGUAGES)},
+        'Refresh': {'update': rng.random() < 0.5},
+        'Keyboard': {'layout': layout, 'variant': variant},
+        'Zdev': {'accept-default': True},
+        'Network': {'accept-default': True},
+        'Proxy': {'proxy': ''},
+        'Mirror': mirror,
+        'ISCSI': {'accept-default': True},
+        'Filesystem': filesystem,
+        'Identity': {
+            'realname': _word(rng, 'Fuzz ').title(),
+            'username': _word(rng, 'fuzz'),
+            'hostname': _word(rng, 'host-'),
+            'password': PASSWORD,
+            },
+        'SSH': ssh,
+        'SnapList': {'snaps': snaps},
+        'InstallProgress': {'reboot': True},
+        }
@@ -0,0 +1,389 @@
+#!/usr/bin/env python3
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Write an autoinstall config that reproduces an existing install.
+
+This looks at the files of an install, either the running system or
+one mounted somewhere (rescue mode mounts the install it is working on
+under the server's state directory), and makes a best-effort guess at
+the identity, locale, keyboard, network, storage layout, packages and
+snaps that would install something like it on another machine. The
+result is a starting point: it is worth reviewing, in particular the
+network config, which names the interfaces of the old machine.
+"""
+
+import argparse
+import glob
+import json
+import os
+import re
+import sys
+
+import yaml
+
+from subiquity.common.installfiles import (
+    parse_fstab,
+    parse_os_release,
+    parse_passwd,
+    )
+
+
+# Packages of these priorities are part of every server install.
+BASE_PRIORITIES = {'required', 'important', 'standard'}
+
+# Packages for one particular kernel version, which are pulled in by
+# the kernel metapackages (and may well not be in the archive any more).
+KERNEL_PACKAGE_RE = re.compile(
+    r'^linux-(image|headers|modules|modules-extra|tools)-\d')
+
+# Snaps that are installed along with others or are part of the seed,
+# rather than being chosen.
+SKIPPED_SNAP_TYPES = {'base', 'core', 'os', 'snapd', 'kernel', 'gadget'}
+
+
+def read_file(root, path, default=None):
+    try:
+        with open(os.path.join(root, path)) as fp:
+            return fp.read()
+    except (OSError, UnicodeDecodeError):
+        return default
+
+
+def parse_deb822(content):
+    """Parse the stanzas of a dpkg status or apt extended_states file."""
+    stanzas = []
+    cur = {}
+    key = None
+    for line in content.splitlines():
+        if not line.strip():
+            if cur:
+                stanzas.append(cur)
+            cur = {}
+            key = None
+        elif line[0] in ' \t':
+            if key is not None:
+                cur[key] += '\n' + line.strip()
+        elif ':' in line:
+            key, value = line.split(':', 1)
+            cur[key] = value.strip()
+    if cur:
+        stanzas.append(cur)
+    return stanzas
+
+
+def manual_packages(dpkg_status, extended_states=''):
+    """Find the installed packages that were not installed automatically.
+
+    Packages everything has anyway and packages for a particular kernel
+    version are left out.
+    """
+    auto = set()
+    for stanza in parse_deb822(extended_states):
+        if stanza.get('Auto-Installed') == '1':
+            auto.add(stanza.get('Package'))
+    packages = set()
+    for stanza in parse_deb822(dpkg_status):
+        name = stanza.get('Package')
+        if name is None or name in auto:
+            continue
+        if stanza.get('Status', '').split()[-1:] != ['installed']:
+            continue
+        if stanza.get('Priority') in BASE_PRIORITIES:
+            continue
+        if KERNEL_PACKAGE_RE.match(name):
+            continue
+        packages.add(name)
+    return sorted(packages)
+
+
+def installed_snaps(state):
+    """Find the snaps that were chosen from snapd's state.json."""
+    snaps = []
+    snapsts = state.get('data', {}).get('snaps', {})
+    for name, snapst in sorted(snapsts.items()):
+        if snapst.get('type', 'app') in SKIPPED_SNAP_TYPES:
+            continue
+        snap = {'name': name}
+        if snapst.get('channel'):
+            snap['channel'] = snapst['channel']
+        if snapst.get('classic'):
+            snap['classic'] = True
+        snaps.append(snap)
+    return snaps
+
+
+def merge_netplan(contents):
+    """Merge netplan yaml documents in the way netplan does.
+
+    Later documents override the scalar values of earlier ones and are
+    merged into their mappings.
+    """
+    def merge(old, new):
+        if isinstance(old, dict) and isinstance(new, dict):
+            r = dict(old)
+            for k, v in new.items():
+                r[k] = merge(old.get(k), v) if k in old else v
+            return r
+        return new
+
+    network = {}
+    for content in contents:
+        try:
+            config = yaml.safe_load(content)
+        except yaml.YAMLError:
+            continue
+        if isinstance(config, dict) and \
+           isinstance(config.get('network'), dict):
+            network = merge(network, config['network'])
+    if not network:
+        return None
+    network.pop('renderer', None)
+    network.setdefault('version', 2)
+    return network
+
+
+def parse_shadow(content):
+    """Map usernames to their password hashes."""
+    hashes = {}
+    for line in content.splitlines():
+        parts = line.split(':')
+        if len(parts) >= 2:
+            hashes[parts[0]] = parts[1]
+    return hashes
+
+
+def parse_group(content):
+    """Map usernames to the supplementary groups they are in."""
+    groups = {}
+    for line in content.splitlines():
+        parts = line.split(':')
+        if len(parts) != 4:
+            continue
+        for member in parts[3].split(','):
+            if member:
+                groups.setdefault(member, []).append(parts[0])
+    return groups
+
+
+def guess_layout(fstab):
+    """Guess the guided layout that gives a root filesystem like fstab's."""
+    for spec, mountpoint, fstype, options in parse_fstab(fstab):
+        if mountpoint != '/':
+            continue
+        if fstype == 'zfs':
+            return {'name': 'zfs'}
+        layout = {'name': 'direct'}
+        # curtin refers to logical volumes by their dm uuid, other
+        # installers use /dev/mapper/VG-LV or /dev/VG/LV.
+        if '/dm-uuid-LVM-' in spec:
+            layout['name'] = 'lvm'
+        elif spec.startswith('/dev/mapper/') and '-' in spec:
+            layout['name'] = 'lvm'
+        elif spec.startswith('/dev/') and spec.count('/') == 3 and \
+                not spec.startswith(('/dev/disk/', '/dev/md/')):
+            layout['name'] = 'lvm'
+        if fstype not in ('ext4', 'zfs'):
+            layout['fstype'] = fstype
+        return layout
+    return None
+
+
+class Cloner:
+
+    def __init__(self, root):
+        self.root = root
+        self.notes = []
+
+    def note(self, msg, *args):
+        self.notes.append(msg.format(*args))
+
+    def authorized_keys(self, username):
+        keys = read_file(
+            self.root, 'home/{}/.ssh/authorized_keys'.format(username), '')
+        return [
+            line.strip() for line in keys.splitlines()
+            if line.strip() and not line.startswith('#')
+            ]
+
+    def identity(self):
+        users = parse_passwd(read_file(self.root, 'etc/passwd', ''))
+        if not users:
+            self.note("no user accounts found, fill in identity by hand")
+            return None, None
+        users.sort(key=lambda u: u.uid)
+        user = users[0]
+        hostname = read_file(self.root, 'etc/hostname', '').strip()
+        identity = {
+            'hostname': hostname or 'ubuntu',
+            'username': user.username,
+            }
+        if user.realname:
+            identity['realname'] = user.realname
+        shadow = read_file(self.root, 'etc/shadow')
+        if shadow is None:
+            self.note(
+                "etc/shadow cannot be read (run as root?), set the "
+                "passwords in identity by hand")
+            hashes = {}
+        else:
+            hashes = parse_shadow(shadow)
+        identity['password'] = hashes.get(user.username, '!')
+        groups = parse_group(read_file(self.root, 'etc/group', ''))
+        extra_users = []
+        for other in users[1:]:
+            extra_user = {'username': other.username}
+            if other.realname:
+                extra_user['realname'] = other.realname
+            if hashes.get(other.username, '!') not in ('', '!', '*'):
+                extra_user['password'] = hashes[other.username]
+            if other.username in groups:
+                extra_user['groups'] = groups[other.username]
+            keys = self.authorized_keys(other.username)
+            if keys:
+                extra_user['ssh-authorized-keys'] = keys
+            extra_users.append(extra_user)
+        if extra_users:
+            identity['users'] = extra_users
+        return identity, user
+
+    def ssh(self, user, packages):
+        ssh = {'install-server': 'openssh-server' in packages}
+        if user is not None:
+            keys = self.authorized_keys(user.username)
+            if keys:
+                ssh['authorized-keys'] = keys
+        sshd_config = read_file(self.root, 'etc/ssh/sshd_config', '')
+        for line in sshd_config.splitlines():
+            words = line.split()
+            if len(words) == 2 and words[0] == 'PasswordAuthentication':
+                ssh['allow-pw'] = words[1] == 'yes'
+        return ssh
+
+    def keyboard(self):
+        content = read_file(self.root, 'etc/default/keyboard')
+        if content is None:
+            return None
+        settings = parse_os_release(content)
+        if not settings.get('XKBLAYOUT'):
+            return None
+        keyboard = {'layout': settings['XKBLAYOUT']}
+        if settings.get('XKBVARIANT'):
+            keyboard['variant'] = settings['XKBVARIANT']
+        return keyboard
+
+    def locale(self):
+        content = read_file(self.root, 'etc/default/locale')
+        if content is None:
+            return None
+        return parse_os_release(content).get('LANG')
+
+    def network(self):
+        paths = sorted(
+            glob.glob(os.path.join(self.root, 'etc/netplan/*.yaml')),
+            key=os.path.basename)
+        return merge_netplan(
+            read_file(self.root, path, '') for path in paths)
+
+    def storage(self):
+        fstab = read_file(self.root, 'etc/fstab', '')
+        if read_file(self.root, 'etc/crypttab', '').strip():
+            self.note("the install is encrypted, the clone will not be")
+        layout = guess_layout(fstab)
+        if layout is None:
+            self.note("no root filesystem in etc/fstab, using the lvm layout")
+            layout = {'name': 'lvm'}
+        return {'layout': layout}
+
+    def packages(self):
+        status = read_file(self.root, 'var/lib/dpkg/status')
+        if status is None:
+            self.note("no dpkg database found")
+            return []
+        return manual_packages(
+            status, read_file(self.root, 'var/lib/apt/extended_states', ''))
+
+    def snaps(self):
+        state = read_file(self.root, 'var/lib/snapd/state.json')
+        if state is None:
+            return []
+        try:
+            return installed_snaps(json.loads(state))
+        except ValueError:
+            self.note("snapd's state.json cannot be parsed")
+            return []
+
+    def config(self):
+        config = {'version': 1}
+        identity, user = self.identity()
+        packages = self.packages()
+        for key, value in [
+                ('locale', self.locale()),
+                ('keyboard', self.keyboard()),
+                ('network', self.network()),
+                ('storage', self.storage()),
+                ('identity', identity),
+                ('ssh', self.ssh(user, packages)),
+                ('packages', packages),
+                ('snaps', self.snaps()),
+                ]:
+            if value:
+                config[key] = value
+        return config
+
+
+def make_clone_args_parser():
+    parser = argparse.ArgumentParser(
+        description='Write an autoinstall config that reproduces an install',
+        prog='subiquity.clone-install')
+    parser.add_argument(
+        'root', metavar='ROOT', nargs='?', default='/',
+        help="Root directory of the install (default: the running system)")
+    parser.add_argument(
+        '-o', '--output', metavar='FILE',
+        help="Write the config to FILE instead of standard output.")
+    parser.add_argument(
+        '--user-data', action='store_true',
+        help="Write cloud-init user-data with the config under an "
+             "'autoinstall' key.")
+    return parser
+
+
+def main():
+    parser = make_clone_args_parser()
+    opts = parser.parse_args(sys.argv[1:])
+    if not os.path.isdir(os.path.join(opts.root, 'etc')):
+        print("{}: does not look like an install".format(opts.root),
+              file=sys.stderr)
+        return 1
+    cloner = Cloner(opts.root)
+    config = cloner.config()
+    if opts.user_data:
+        content = '#cloud-config\n' + yaml.dump(
+            {'autoinstall': config}, default_flow_style=False)
+    else:
+        content = yaml.dump(config, default_flow_style=False)
+    if opts.output is not None:
+        with open(opts.output, 'w') as fp:
+            fp.write(content)
+    else:
+        sys.stdout.write(content)
+    for note in cloner.notes:
+        print("note:", note, file=sys.stderr)
+    return 0
+
+
+if __name__ == '__main__':
+    sys.exit(main())
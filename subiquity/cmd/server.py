@@ -40,7 +40,13 @@ def make_server_args_parser():
     parser.add_argument('--bootloader',
                         choices=['none', 'bios', 'prep', 'uefi'],
                         help='Override style of bootloader to use')
-    parser.add_argument('--autoinstall', action='store')
+    parser.add_argument(
+        '--autoinstall', action='store',
+        help="Path to the autoinstall config, or - to read it from stdin.")
+    parser.add_argument(
+        '--rescue', action='store_true',
+        help=("Offer to repair the existing installs instead of installing. "
+              "Also enabled by subiquity-rescue on the kernel command line."))
     with open('/proc/cmdline') as fp:
         cmdline = fp.read()
     parser.add_argument('--kernel-cmdline', action='store', default=cmdline)
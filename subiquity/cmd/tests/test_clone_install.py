@@ -0,0 +1,115 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.cmd.clone_install import (
+    guess_layout,
+    installed_snaps,
+    manual_packages,
+    merge_netplan,
+    )
+
+
+DPKG_STATUS = """\
+Package: base-files
+Status: install ok installed
+Priority: required
+
+Package: htop
+Status: install ok installed
+Priority: optional
+Description: interactive processes viewer
+ Htop is an ncursed-based process viewer.
+
+Package: libncursesw6
+Status: install ok installed
+Priority: optional
+
+Package: removed-thing
+Status: deinstall ok config-files
+Priority: optional
+
+Package: linux-image-5.4.0-42-generic
+Status: install ok installed
+Priority: optional
+
+Package: linux-generic
+Status: install ok installed
+Priority: optional
+"""
+
+EXTENDED_STATES = """\
+Package: libncursesw6
+Architecture: amd64
+Auto-Installed: 1
+"""
+
+
+class TestCloneInstall(unittest.TestCase):
+
+    def test_manual_packages(self):
+        self.assertEqual(
+            manual_packages(DPKG_STATUS, EXTENDED_STATES),
+            ['htop', 'linux-generic'])
+
+    def test_installed_snaps(self):
+        state = {'data': {'snaps': {
+            'core18': {'type': 'base', 'channel': 'stable'},
+            'lxd': {'type': 'app', 'channel': '4.0/stable/ubuntu-20.04'},
+            'code': {'channel': 'latest/stable', 'classic': True},
+            }}}
+        self.assertEqual(installed_snaps(state), [
+            {'name': 'code', 'channel': 'latest/stable', 'classic': True},
+            {'name': 'lxd', 'channel': '4.0/stable/ubuntu-20.04'},
+            ])
+
+    def test_merge_netplan(self):
+        self.assertEqual(
+            merge_netplan([
+                'network:\n'
+                '  version: 2\n'
+                '  renderer: networkd\n'
+                '  ethernets:\n'
+                '    eth0: {dhcp4: true}\n',
+                'network:\n'
+                '  ethernets:\n'
+                '    eth0: {dhcp6: true}\n'
+                '    eth1: {dhcp4: false}\n',
+                'not: [yaml',
+                ]),
+            {
+                'version': 2,
+                'ethernets': {
+                    'eth0': {'dhcp4': True, 'dhcp6': True},
+                    'eth1': {'dhcp4': False},
+                    },
+            })
+        self.assertIsNone(merge_netplan([]))
+
+    def test_guess_layout(self):
+        self.assertEqual(
+            guess_layout(
+                '/dev/disk/by-id/dm-uuid-LVM-abc / ext4 defaults 0 1\n'),
+            {'name': 'lvm'})
+        self.assertEqual(
+            guess_layout('/dev/mapper/vg0-root / xfs defaults 0 1\n'),
+            {'name': 'lvm', 'fstype': 'xfs'})
+        self.assertEqual(
+            guess_layout('UUID=1234 / ext4 defaults 0 1\n'),
+            {'name': 'direct'})
+        self.assertEqual(
+            guess_layout('rpool/ROOT/ubuntu / zfs defaults 0 0\n'),
+            {'name': 'zfs'})
@@ -0,0 +1,109 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import io
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from subiquity.cmd.validate_autoinstall import (
+    controller_errors,
+    format_path,
+    load_config,
+    version_errors,
+    )
+
+
+SCHEMA = {
+    'properties': {
+        'version': {'type': 'integer', 'minimum': 1, 'maximum': 1},
+        },
+    }
+
+
+def make_controller(key, exc=None):
+    controller = mock.Mock()
+    controller.autoinstall_key = key
+    if exc is not None:
+        controller.setup_autoinstall.side_effect = exc
+    return controller
+
+
+class TestLoadConfig(unittest.TestCase):
+
+    def load(self, content):
+        with tempfile.TemporaryDirectory() as tdir:
+            path = os.path.join(tdir, 'config.yaml')
+            with open(path, 'w') as fp:
+                fp.write(content)
+            return load_config(path)
+
+    def test_config(self):
+        self.assertEqual(
+            self.load("version: 1\nlocale: en_GB.UTF-8\n"),
+            {'version': 1, 'locale': 'en_GB.UTF-8'})
+
+    def test_user_data(self):
+        self.assertEqual(
+            self.load("#cloud-config\nautoinstall:\n  version: 1\n"),
+            {'version': 1})
+
+    def test_stdin(self):
+        with mock.patch('sys.stdin', io.StringIO("version: 1\n")):
+            self.assertEqual(load_config('-'), {'version': 1})
+
+
+class TestFormatPath(unittest.TestCase):
+
+    def test_path(self):
+        self.assertEqual(format_path(['storage', 'config', 0]),
+                         'storage/config/0')
+
+    def test_top_level(self):
+        self.assertEqual(format_path([]), '<top level>')
+
+
+class TestVersionErrors(unittest.TestCase):
+
+    def test_unpinned(self):
+        self.assertEqual(list(version_errors({'version': 1}, SCHEMA, None)),
+                         [])
+
+    def test_pinned(self):
+        self.assertEqual(list(version_errors({'version': 1}, SCHEMA, 1)), [])
+
+    def test_wrong_version(self):
+        self.assertEqual(
+            list(version_errors({'version': 1}, SCHEMA, 2)),
+            [
+                "version: config is for version 1, not 2",
+                "version: version 2 is not supported (1-1 are)",
+            ])
+
+
+class TestControllerErrors(unittest.TestCase):
+
+    def test_errors(self):
+        app = mock.Mock()
+        app.controllers.instances = [
+            make_controller(None, ValueError("not checked")),
+            make_controller('locale'),
+            make_controller('keyboard', ValueError("no such layout")),
+            ]
+        self.assertEqual(
+            list(controller_errors(app, {'version': 1})),
+            ["keyboard: ValueError: no such layout"])
+        self.assertFalse(app.interactive)
@@ -21,8 +21,12 @@ import fcntl
 import subprocess
 import sys
 
+import yaml
+
 from subiquitycore.log import setup_logger
 
+from subiquity.client.fuzz import fuzz_answers
+
 from .common import (
     LOGDIR,
     setup_environment,
@@ -54,6 +58,8 @@ def make_client_args_parser():
     parser.add_argument('--ssh', action='store_true',
                         dest='ssh',
                         help='Print ssh login details')
+    parser.add_argument('--discover', action='store_true',
+                        help='List the installers advertised on the LAN')
     parser.add_argument('--ascii', action='store_true',
                         dest='ascii',
                         help='Run the installer in ascii mode.')
@@ -69,6 +75,9 @@ def make_client_args_parser():
     parser.add_argument('--click', metavar="PAT", action=ClickAction,
                         help='Synthesize a click on a button matching PAT')
     parser.add_argument('--answers')
+    parser.add_argument('--fuzz-answers', metavar='SEED', type=int,
+                        help=('Answer every screen with random choices '
+                              'picked using SEED (dry-run only)'))
     parser.add_argument('--server-pid')
     return parser
 
@@ -76,6 +85,48 @@ def make_client_args_parser():
 AUTO_ANSWERS_FILE = "/subiquity_config/answers.yaml"
 
 
+def reopen_tty_as_stdin():
+    try:
+        fd = os.open('/dev/tty', os.O_RDONLY)
+    except OSError:
+        # No controlling terminal, which is fine if nothing is going
+        # to be typed.
+        return
+    os.dup2(fd, 0)
+    os.close(fd)
+
+
+def discover():
+    from subiquity.common.mdns import parse_avahi_browse, SERVICE_TYPE
+    try:
+        cp = subprocess.run(
+            ['avahi-browse', '--parsable', '--resolve', '--terminate',
+             SERVICE_TYPE],
+            stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+            universal_newlines=True)
+    except FileNotFoundError:
+        print("avahi-browse not found, install avahi-utils", file=sys.stderr)
+        return 1
+    if cp.returncode != 0:
+        print(cp.stderr.strip(), file=sys.stderr)
+        return 1
+    installers = parse_avahi_browse(cp.stdout)
+    if not installers:
+        print("no installers found")
+        return 0
+    # Anyone on the LAN can advertise these, see subiquity.common.mdns.
+    print("These host key fingerprints are not authenticated. Check the "
+          "one ssh shows\nagainst those on the installer's console.\n")
+    for installer in installers:
+        print("{} ({}) ssh port {}".format(
+            installer.hostname, installer.address, installer.port))
+        print("    session {}".format(installer.session_id))
+        for keytype, fingerprint in sorted(
+                installer.host_key_fingerprints.items()):
+            print("    {} {}".format(keytype.upper(), fingerprint))
+    return 0
+
+
 def main():
     setup_environment()
     # setup_environment sets $APPORT_DATA_DIR which must be set before
@@ -83,6 +134,8 @@ def main():
     from subiquity.client.client import SubiquityClient
     parser = make_client_args_parser()
     args = sys.argv[1:]
+    if '--discover' in args:
+        return discover()
     if '--dry-run' in args:
         opts, unknown = parser.parse_known_args(args)
         if opts.socket is None:
@@ -91,7 +144,15 @@ def main():
             opts.socket = sock_path
             server_args = ['--dry-run', '--socket=' + sock_path] + unknown
             server_parser = make_server_args_parser()
-            server_parser.parse_args(server_args)  # just to check
+            server_opts = server_parser.parse_args(server_args)
+            if server_opts.autoinstall == '-':
+                # The client needs stdin for the terminal, so hand the
+                # server a copy of the config instead.
+                autoinstall_path = '.subiquity/autoinstall-stdin.yaml'
+                with open(autoinstall_path, 'w') as fp:
+                    fp.write(sys.stdin.read())
+                server_args.extend(['--autoinstall', autoinstall_path])
+                reopen_tty_as_stdin()
             server_output = open('.subiquity/server-output', 'w')
             server_cmd = [sys.executable, '-m', 'subiquity.cmd.server'] + \
                 server_args
@@ -118,6 +179,18 @@ def main():
     logger.info("Starting Subiquity revision {}".format(version))
     logger.info("Arguments passed: {}".format(sys.argv))
 
+    if opts.fuzz_answers is not None:
+        if not opts.dry_run:
+            parser.error("--fuzz-answers only works with --dry-run")
+        # Keep the generated answers where a failing run can be replayed
+        # from with --answers.
+        opts.answers = os.path.join(logdir, 'fuzz-answers.yaml')
+        with open(opts.answers, 'w') as fp:
+            fp.write("# generated by --fuzz-answers {}\n".format(
+                opts.fuzz_answers))
+            yaml.safe_dump(fuzz_answers(opts.fuzz_answers), fp)
+        logger.info("fuzzing answers with seed %s", opts.fuzz_answers)
+
     if opts.answers is None and os.path.exists(AUTO_ANSWERS_FILE):
         logger.debug("Autoloading answers from %s", AUTO_ANSWERS_FILE)
         opts.answers = AUTO_ANSWERS_FILE
@@ -0,0 +1,146 @@
+#!/usr/bin/env python3
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Check an autoinstall config without running an install.
+
+The document is checked against the full schema (either the one
+generated by this version of subiquity or one saved from a release
+with --schema) and then handed to each controller's
+load_autoinstall_data, which is where most of the checks that cannot
+be expressed in the schema are done.
+"""
+
+import argparse
+import json
+import sys
+
+import jsonschema
+
+import yaml
+
+from subiquity.cmd.schema import make_app, make_schema
+
+
+def make_validate_args_parser():
+    parser = argparse.ArgumentParser(
+        description='Validate an autoinstall config',
+        prog='subiquity.validate-autoinstall')
+    parser.add_argument(
+        'config', metavar='CONFIG',
+        help=("Autoinstall config to check, or - to read it from stdin. "
+              "This can also be cloud-init user-data with the config "
+              "under an 'autoinstall' key."))
+    parser.add_argument(
+        '--schema', metavar='SCHEMA',
+        help=("Check against this JSON schema (for example the "
+              "autoinstall-schema.json from a released version of "
+              "subiquity) instead of the one generated from this version."))
+    parser.add_argument(
+        '--schema-version', metavar='N', type=int,
+        help="Require the config to be for this version of the format.")
+    return parser
+
+
+def load_config(path):
+    if path == '-':
+        config = yaml.safe_load(sys.stdin)
+    else:
+        with open(path) as fp:
+            config = yaml.safe_load(fp)
+    if isinstance(config, dict) and 'autoinstall' in config:
+        config = config['autoinstall']
+    return config
+
+
+def format_path(path):
+    return '/'.join(str(p) for p in path) or '<top level>'
+
+
+def schema_errors(config, schema):
+    cls = jsonschema.validators.validator_for(schema)
+    validator = cls(schema)
+    errors = validator.iter_errors(config)
+    for error in sorted(errors, key=lambda e: format_path(e.path)):
+        yield "{}: {}".format(format_path(error.path), error.message)
+
+
+def version_errors(config, schema, pinned):
+    version = config.get('version')
+    spec = schema['properties']['version']
+    if pinned is not None and version != pinned:
+        yield "version: config is for version {!r}, not {}".format(
+            version, pinned)
+    if pinned is not None and \
+       not spec['minimum'] <= pinned <= spec['maximum']:
+        yield "version: version {} is not supported ({}-{} are)".format(
+            pinned, spec['minimum'], spec['maximum'])
+
+
+def controller_errors(app, config):
+    app.autoinstall_config = config
+    app.interactive = bool(config.get('interactive-sections'))
+    for controller in app.controllers.instances:
+        if controller.autoinstall_key is None:
+            continue
+        try:
+            controller.setup_autoinstall()
+        except jsonschema.ValidationError as e:
+            yield "{}/{}: {}".format(
+                controller.autoinstall_key, format_path(e.path), e.message)
+        except Exception as e:
+            yield "{}: {}: {}".format(
+                controller.autoinstall_key, type(e).__name__, e)
+
+
+def validate(config, *, schema=None, schema_version=None):
+    app = make_app()
+    if schema is None:
+        schema = make_schema(app)
+    if not isinstance(config, dict):
+        return ["<top level>: config is not a mapping"]
+    errors = list(schema_errors(config, schema))
+    errors.extend(version_errors(config, schema, schema_version))
+    if errors:
+        # The controllers assume the config has at least the right
+        # shape, so don't bother going further.
+        return errors
+    return list(controller_errors(app, config))
+
+
+def main():
+    parser = make_validate_args_parser()
+    opts = parser.parse_args(sys.argv[1:])
+    schema = None
+    if opts.schema is not None:
+        with open(opts.schema) as fp:
+            schema = json.load(fp)
+    try:
+        config = load_config(opts.config)
+    except yaml.YAMLError as e:
+        print("{}: invalid YAML: {}".format(opts.config, e))
+        return 1
+    errors = validate(
+        config, schema=schema, schema_version=opts.schema_version)
+    for error in errors:
+        print("{}: {}".format(opts.config, error))
+    if errors:
+        return 1
+    print("{}: OK".format(opts.config))
+    return 0
+
+
+if __name__ == '__main__':
+    sys.exit(main())
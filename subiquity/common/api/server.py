@@ -122,6 +122,16 @@ def _make_handler(controller, definition, implementation, serializer):
                 resp = web.json_response(
                     serializer.serialize(def_ret_ann, result),
                     headers={'x-status': 'ok'})
+            except web.HTTPException as exc:
+                # The implementation refused the request. That is the
+                # client's fault, so there is no crash to report.
+                resp = web.Response(
+                    status=exc.status,
+                    headers={
+                        'x-status': 'error',
+                        'x-error-type': type(exc).__name__,
+                        'x-error-msg': exc.reason,
+                        })
             except Exception as exc:
                 resp = web.Response(
                     status=500,
@@ -13,7 +13,6 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-import asyncio
 import unittest
 
 from aiohttp.test_utils import TestClient, TestServer
@@ -21,6 +20,7 @@ from aiohttp import web
 
 from subiquitycore.context import Context
 from subiquitycore import contextlib38
+from subiquitycore.tests import run_coro
 
 from subiquity.common.api.defs import api, Payload
 from subiquity.common.api.server import (
@@ -31,10 +31,6 @@ from subiquity.common.api.server import (
     )
 
 
-def run_coro(coro):
-    asyncio.get_event_loop().run_until_complete(coro)
-
-
 class TestApp:
 
     def report_start_event(self, context, description):
@@ -161,6 +157,26 @@ class TestBind(unittest.TestCase):
 
         run_coro(run())
 
+    def test_refused(self):
+        @api
+        class API:
+            def GET(): ...
+
+        class Impl(TestControllerBase):
+            async def GET(self):
+                raise web.HTTPUnprocessableEntity(reason="no thanks")
+
+        async def run():
+            async with makeTestClient(API, Impl()) as client:
+                resp = await client.get('/')
+                self.assertEqual(resp.status, 422)
+                self.assertEqual(resp.headers['x-status'], 'error')
+                self.assertEqual(
+                    resp.headers['x-error-type'], 'HTTPUnprocessableEntity')
+                self.assertEqual(resp.headers['x-error-msg'], 'no thanks')
+
+        run_coro(run())
+
     def test_post(self):
         @api
         class API:
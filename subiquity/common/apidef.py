@@ -18,7 +18,9 @@ from typing import List, Optional
 
 from subiquitycore.models.network import (
     BondConfig,
+    BridgeConfig,
     NetDevInfo,
+    RoutingConfig,
     StaticConfig,
     )
 
@@ -30,16 +32,37 @@ from subiquity.common.types import (
     ErrorReportRef,
     GuidedChoice,
     GuidedStorageResponse,
+    KdumpInfo,
     KeyboardSetting,
     KeyboardSetup,
+    NVMeoFResponse,
+    NVMeoFTarget,
     IdentityData,
+    IdentityUser,
+    InstalledNetworkConfig,
+    InventoryConfig,
+    ISCSIDiscovery,
+    ISCSIDiscoveryResponse,
+    ISCSILogin,
+    ISCSIStatus,
+    ISCSITarget,
+    MirrorRanking,
     RefreshStatus,
     SnapInfo,
     SnapListResponse,
     SnapSelection,
     SSHData,
     LiveSessionSSHInfo,
+    RecoveryKeyExport,
+    RecoveryKeyExportResponse,
+    RecoveryKeyResponse,
+    RescueAction,
+    RescueActionResult,
+    RescueStatus,
+    RescueUnlock,
     StorageResponse,
+    StoreProxyConfig,
+    SwapConfig,
     ZdevInfo,
     )
 
@@ -47,13 +70,47 @@ from subiquity.common.types import (
 @api
 class API:
     """The API offered by the subiquity installer process."""
-    identity = simple_endpoint(IdentityData)
+    inventory = simple_endpoint(InventoryConfig)
     locale = simple_endpoint(str)
-    mirror = simple_endpoint(str)
+    offline = simple_endpoint(bool)
     proxy = simple_endpoint(str)
     ssh = simple_endpoint(SSHData)
     updates = simple_endpoint(str)
 
+    class identity:
+        def GET() -> IdentityData: ...
+        def POST(data: Payload[IdentityData]): ...
+
+        class users:
+            """The users to create besides the one in IdentityData."""
+            def GET() -> List[IdentityUser]: ...
+            def POST(data: Payload[List[IdentityUser]]): ...
+
+    class mirror:
+        def GET() -> str: ...
+        def POST(data: Payload[str]): ...
+
+        class ranking:
+            def GET(wait: bool = False) -> MirrorRanking:
+                """Get the results of measuring the speed of the mirrors.
+
+                If wait is true, block until the measurements are done."""
+
+            def POST() -> None:
+                """Start measuring the speed of the country mirrors."""
+
+    class store_proxy:
+        def GET() -> StoreProxyConfig: ...
+
+        def POST(data: Payload[StoreProxyConfig]) -> Optional[str]:
+            """Register with the snap store proxy at data.url.
+
+            Returns a message saying what went wrong if that failed."""
+
+    class kdump:
+        def GET() -> KdumpInfo: ...
+        def POST(data: Payload[bool]): ...
+
     class meta:
         class status:
             def GET(cur: Optional[ApplicationState] = None) \
@@ -68,6 +125,12 @@ class API:
             def POST(tty: str) -> None:
                 """Confirm that the installation should proceed."""
 
+        class section_shown:
+            def POST(endpoint_name: str) -> None:
+                """Start the timeout of the section for endpoint_name.
+
+                Clients call this when they show the screen for it."""
+
         class restart:
             def POST() -> None:
                 """Restart the server process."""
@@ -107,7 +170,15 @@ class API:
             def GET(layout_code: str, variant_code: str) -> bool: ...
 
         class steps:
-            def GET(index: Optional[str]) -> AnyStep: ...
+            def GET(index: Optional[str]) -> AnyStep:
+                """Get a step of the keyboard layout detection.
+
+                Detection starts at the step with no index and ends at a
+                StepResult. A StepPressKey asks for a key with one of
+                the symbols to be pressed and maps the (linux) keycodes
+                that may be pressed to the index of the next step, a
+                StepKeyPresent asks whether the keyboard has a key with
+                the symbol and has the next step for each answer."""
 
     class zdev:
         def GET() -> List[ZdevInfo]: ...
@@ -131,6 +202,13 @@ class API:
             def PUT(socket_path: str) -> None: ...
             def DELETE(socket_path: str) -> None: ...
 
+        class installed_configs:
+            def GET() -> List[InstalledNetworkConfig]:
+                """Return the netplan configs of installs on the disks."""
+
+        class import_installed:
+            def POST(config: Payload[InstalledNetworkConfig]) -> None: ...
+
         # These methods could definitely be more RESTish, like maybe a
         # GET request to /network/interfaces/$name should return netplan
         # config which could then be POSTed back the same path. But
@@ -167,6 +245,10 @@ class API:
             def POST(dev_name: str, ip_version: int,
                      static_config: Payload[StaticConfig]) -> None: ...
 
+        class set_routing_config:
+            def POST(dev_name: str,
+                     routing_config: Payload[RoutingConfig]) -> None: ...
+
         class enable_dhcp:
             def POST(dev_name: str, ip_version: int) -> None: ...
 
@@ -174,18 +256,48 @@ class API:
             def POST(dev_name: str, ip_version: int) -> None: ...
 
         class vlan:
-            def PUT(dev_name: str, vlan_id: int) -> None: ...
+            def PUT(dev_name: str, vlan_ids: List[int]) -> None: ...
 
         class add_or_edit_bond:
             def POST(existing_name: Optional[str], new_name: str,
                      bond_config: Payload[BondConfig]) -> None: ...
 
+        class add_or_edit_bridge:
+            def POST(existing_name: Optional[str], new_name: str,
+                     bridge_config: Payload[BridgeConfig]) -> None: ...
+
         class delete:
             def POST(dev_name: str) -> None: ...
 
         class info:
             def GET(dev_name: str) -> str: ...
 
+    class iscsi:
+        def GET() -> ISCSIStatus: ...
+        def POST() -> None: ...
+
+        class discover:
+            def POST(discovery: Payload[ISCSIDiscovery]) \
+                    -> ISCSIDiscoveryResponse:
+                """Ask the portal which targets it offers."""
+
+        class login:
+            def POST(login: Payload[ISCSILogin]) -> ISCSIStatus: ...
+
+        class logout:
+            def POST(target: Payload[ISCSITarget]) -> ISCSIStatus: ...
+
+    class nvmeof:
+        def GET() -> NVMeoFResponse:
+            """Return the subsystems that are connected."""
+
+        class discover:
+            def POST(address: str, port: int = 8009) -> NVMeoFResponse:
+                """Ask a discovery controller for its subsystems."""
+
+        class connect:
+            def POST(target: Payload[NVMeoFTarget]) -> NVMeoFResponse: ...
+
     class storage:
         class guided:
             def GET(min_size: int = None, wait: bool = False) \
@@ -197,7 +309,13 @@ class API:
                 pass
 
         def GET(wait: bool = False) -> StorageResponse: ...
-        def POST(config: Payload[list]): ...
+        def POST(config: Payload[list], generation: Optional[int] = None) \
+                -> Optional[StorageResponse]:
+            """Replace the storage config, all at once or not at all.
+
+            If the devices have been probed again since the
+            StorageResponse with the given generation, nothing is
+            changed and the current StorageResponse is returned."""
 
         class reset:
             def POST() -> StorageResponse: ...
@@ -206,6 +324,20 @@ class API:
             def GET() -> bool:
                 pass
 
+        class swap:
+            def GET() -> SwapConfig: ...
+            def POST(config: Payload[SwapConfig]) -> None: ...
+
+    class recovery_key:
+        def GET() -> RecoveryKeyResponse: ...
+
+        def POST() -> RecoveryKeyResponse:
+            """Generate a new recovery key for the encrypted volumes."""
+
+        class export:
+            def POST(export: Payload[RecoveryKeyExport]) \
+                    -> RecoveryKeyExportResponse: ...
+
     class snaplist:
         def GET(wait: bool = False) -> SnapListResponse: ...
         def POST(data: Payload[List[SnapSelection]]): ...
@@ -216,6 +348,28 @@ class API:
     class reboot:
         def POST(): ...
 
+    class rescue:
+        def GET() -> RescueStatus:
+            """Find the existing installs on the disks."""
+
+        class unlock:
+            def POST(data: Payload[RescueUnlock]) -> RescueStatus:
+                """Open an encrypted device and look for installs on it."""
+
+        class mount:
+            def POST(root: str) -> RescueStatus:
+                """Mount an install, ready to be chrooted into."""
+
+        class unmount:
+            def POST() -> RescueStatus: ...
+
+        class run:
+            def POST(root: str, action: RescueAction) -> RescueActionResult:
+                ...
+
+        class reboot:
+            def POST() -> None: ...
+
 
 class LinkAction(enum.Enum):
     NEW = enum.auto()
@@ -229,7 +383,7 @@ class NetEventAPI:
         def POST(act: LinkAction, info: Payload[NetDevInfo]) -> None: ...
 
     class route_watch:
-        def POST(routes: List[int]) -> None: ...
+        def POST(routes: List[int], ipv6_only: bool) -> None: ...
 
     class apply_starting:
         def POST() -> None: ...
@@ -0,0 +1,75 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Showing languages the linux console cannot.
+
+The linux console can only load 512 glyphs at a time, which is nowhere
+near enough for Chinese, Japanese or Korean. The languagelist marks the
+languages it can show with "console" (the others with "ssh"). When one
+of the others is chosen on the console, the client restarts itself
+inside fbterm, which draws text on the framebuffer with fontconfig's
+fonts, and the installed system gets fbterm and a font for it.
+"""
+
+import os
+import shutil
+
+
+# Set in the environment of a client running inside fbterm (and so of
+# any client it restarts as).
+FBTERM_ENV = 'SUBIQUITY_FBTERM'
+# The screen the client was on when it restarted inside fbterm, so the
+# new client can carry on from the one after it.
+RESUME_AFTER_ENV = 'SUBIQUITY_RESUME_AFTER'
+
+# What the installed system needs to show the languages the console
+# cannot.
+FBTERM_PACKAGES = ['fbterm', 'fonts-noto-cjk']
+
+
+def read_languagelist():
+    """Yield the (level, code, name) of the languages in the languagelist."""
+    base = os.environ.get("SNAP", ".")
+    with open(os.path.join(base, "languagelist")) as lang_file:
+        for line in lang_file:
+            level, code, name = line.strip().split(':')
+            yield level, code, name
+
+
+def console_can_show(code, languages=None):
+    """Whether the linux console can show the language with locale code.
+
+    The encoding is ignored, so zh_CN matches zh_CN.UTF-8, and languages
+    that are not in the list are assumed to be fine.
+    """
+    if languages is None:
+        languages = read_languagelist()
+    code = code.split('.')[0]
+    for level, lang_code, name in languages:
+        if lang_code.split('.')[0] == code:
+            return level == "console"
+    return True
+
+
+def running_in_fbterm():
+    return os.environ.get(FBTERM_ENV) == '1'
+
+
+def fbterm_available():
+    return shutil.which('fbterm') is not None and os.path.exists('/dev/fb0')
+
+
+def fbterm_cmdline(cmdline):
+    return ['fbterm', '--'] + cmdline
@@ -26,6 +26,8 @@ import apport
 import apport.crashdb
 import apport.hookutils
 
+import problem_report
+
 import attr
 
 import bson
@@ -168,6 +170,8 @@ class ErrorReport(metaclass=urwid.MetaSignals):
                 self._file.close()
                 self._file = None
                 urwid.emit_signal(self, "changed")
+                if self.state == ErrorReportState.DONE:
+                    await self.reporter.send_to_destinations(self)
         if wait:
             with self._context.child("add_info") as context:
                 _bg_add_info()
@@ -254,6 +258,17 @@ class ErrorReport(metaclass=urwid.MetaSignals):
 
         schedule_task(upload())
 
+    def fields(self):
+        """Return the fields of the report, all as text."""
+        fields = {}
+        for k, v in self.pr.items():
+            if isinstance(v, problem_report.CompressedValue):
+                v = v.get_value()
+            if isinstance(v, bytes):
+                v = v.decode('utf-8', 'replace')
+            fields[k] = v
+        return fields
+
     def _path_with_ext(self, ext):
         return os.path.join(
             self.reporter.crash_directory, self.base + '.' + ext)
@@ -288,6 +303,14 @@ class ErrorReport(metaclass=urwid.MetaSignals):
     def oops_id(self):
         return self.meta.get("oops-id")
 
+    @property
+    def allow_upload(self):
+        return self.meta.get("allow-upload", True)
+
+    @property
+    def sent_to(self):
+        return self.meta.get("sent-to", [])
+
     @property
     def persistent_details(self):
         """Return fs-label, path-on-fs to report."""
@@ -344,6 +367,11 @@ class ErrorReporter(object):
             }
         if dry_run:
             self.crashdb_spec['launchpad_instance'] = 'staging'
+        # Whether reports can be sent to Canonical, and where else they
+        # are sent once they have been generated. A destination has a
+        # name and an async send(report) method.
+        self.allow_upload = True
+        self.destinations = []
         self._apport_data = []
         self._apport_files = []
 
@@ -385,6 +413,8 @@ class ErrorReporter(object):
 
         try:
             report = ErrorReport.new(self, kind)
+            if not self.allow_upload:
+                report.set_meta("allow-upload", False)
             self.reports.insert(0, report)
             self._reports_by_base[report.base] = report
         except Exception:
@@ -423,6 +453,21 @@ class ErrorReporter(object):
         # In the fullness of time we should do the signature thing here.
         return report
 
+    async def send_to_destinations(self, report):
+        for destination in self.destinations:
+            with report._context.child(
+                    "send", "to " + destination.name) as context:
+                try:
+                    await destination.send(report)
+                except Exception:
+                    log.exception(
+                        "sending %s to %s failed", report.base,
+                        destination.name)
+                    context.description = "failed"
+                else:
+                    report.set_meta(
+                        "sent-to", report.sent_to + [destination.name])
+
     def get(self, error_ref):
         return self._reports_by_base.get(error_ref.base)
 
@@ -62,6 +62,10 @@ class FilesystemManipulator:
             volume.wipe = 'superblock'
             preserve = False
         fs = self.model.add_filesystem(volume, fstype, preserve)
+        if not preserve and spec.get('label'):
+            fs.label = spec['label']
+        if not preserve and fstype == 'btrfs':
+            fs.subvolumes = spec.get('subvolumes')
         if isinstance(volume, Partition):
             if fstype == "swap":
                 volume.flag = "swap"
@@ -85,6 +89,8 @@ class FilesystemManipulator:
                          grub_device=None):
         part = self.model.add_partition(
             device, spec["size"], flag, wipe, grub_device)
+        part.partition_name = spec.get('partition_name')
+        part.partition_type = spec.get('partition_type')
         self.create_filesystem(part, spec)
         return part
 
@@ -147,13 +153,15 @@ class FilesystemManipulator:
         for device in spec['devices']:
             self.clear(device)
             if key:
-                device = self.model.add_dm_crypt(device, key)
+                device = self.model.add_dm_crypt(
+                    device, key, spec.get('integrity'))
             devices.add(device)
         return self.model.add_volgroup(name=spec['name'], devices=devices)
     create_lvm_volgroup = create_volgroup
 
     def delete_volgroup(self, vg):
-        for lv in list(vg.partitions()):
+        # Thin volumes have to go before the pools they are in.
+        for lv in sorted(vg.partitions(), key=lambda lv: bool(lv.thin_pool)):
             self.delete_logical_volume(lv)
         for d in vg.devices:
             d.wipe = 'superblock'
@@ -166,7 +174,11 @@ class FilesystemManipulator:
         lv = self.model.add_logical_volume(
             vg=vg,
             name=spec['name'],
-            size=spec['size'])
+            size=spec['size'],
+            thin_pool=spec.get('thin_pool'),
+            pool=spec.get('pool'))
+        if lv.thin_pool:
+            return lv
         self.create_filesystem(lv, spec)
         return lv
     create_lvm_partition = create_logical_volume
@@ -176,6 +188,26 @@ class FilesystemManipulator:
         self.model.remove_logical_volume(lv)
     delete_lvm_partition = delete_logical_volume
 
+    def create_dm_integrity(self, volume, spec):
+        self.clear(volume)
+        dm_integrity = self.model.add_dm_integrity(
+            volume, spec.get('algorithm', 'crc32c'))
+        if spec.get('fstype') is not None:
+            self.create_filesystem(dm_integrity, spec)
+        return dm_integrity
+
+    def delete_dm_integrity(self, dm_integrity):
+        self.clear(dm_integrity)
+        dm_integrity.volume.wipe = 'superblock'
+        self.model.remove_dm_integrity(dm_integrity)
+
+    def delete_zpool(self, zpool):
+        for zfs in list(zpool.zfses()):
+            self.model.remove_zfs(zfs)
+        for d in zpool.vdevs:
+            d.wipe = 'superblock'
+        self.model.remove_zpool(zpool)
+
     def delete(self, obj):
         if obj is None:
             return
@@ -188,11 +220,13 @@ class FilesystemManipulator:
         for subobj in obj.fs(), obj.constructed_device():
             self.delete(subobj)
 
-    def reformat(self, disk):
+    def reformat(self, disk, secure_wipe=None):
         disk.grub_device = False
         for p in list(disk.partitions()):
             self.delete_partition(p)
         self.clear(disk)
+        if disk.type == "disk":
+            disk.secure_wipe = secure_wipe
 
     def partition_disk_handler(self, disk, partition, spec):
         log.debug('partition_disk_handler: %s %s %s', disk, partition, spec)
@@ -203,6 +237,9 @@ class FilesystemManipulator:
                 partition.size = align_up(spec['size'])
                 if disk.free_for_partitions < 0:
                     raise Exception("partition size too large")
+            for key in 'partition_name', 'partition_type':
+                if key in spec:
+                    setattr(partition, key, spec[key])
             self.delete_filesystem(partition.fs())
             self.create_filesystem(partition, spec)
             return
@@ -241,6 +278,8 @@ class FilesystemManipulator:
                 lv.size = align_up(spec['size'])
                 if vg.free_for_partitions < 0:
                     raise Exception("lv size too large")
+            if lv.thin_pool:
+                return
             self.delete_filesystem(lv.fs())
             self.create_filesystem(lv, spec)
             return
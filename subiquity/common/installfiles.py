@@ -0,0 +1,174 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Reading the files that describe an existing install."""
+
+import glob
+import logging
+import os
+import shlex
+import tempfile
+
+from subiquitycore.utils import arun_command
+
+from subiquity.common.types import ExistingUser
+
+
+log = logging.getLogger("subiquity.common.installfiles")
+
+# Filesystems worth looking in for an existing install that can be
+# reinstalled over.
+REINSTALL_ROOT_FSTYPES = {'ext3', 'ext4', 'xfs', 'btrfs'}
+
+# The files that describe an existing install, relative to its root.
+# Ubuntu installs to btrfs put the root filesystem in a subvolume
+# called @. The root is the first of INSTALL_ROOTS with an etc/fstab,
+# so the lists of files to read all include it.
+INSTALL_FILES = ['etc/os-release', 'etc/fstab', 'etc/passwd']
+NETPLAN_FILES = ['etc/os-release', 'etc/fstab', 'etc/netplan/*.yaml']
+INSTALL_ROOTS = ['', '@']
+
+# Mounting a filesystem read-only still replays its journal, which
+# writes to the disk. These options stop that, so looking for an
+# install really leaves it alone.
+READ_ONLY_MOUNT_OPTIONS = {
+    'ext3': 'ro,noload',
+    'ext4': 'ro,noload',
+    'xfs': 'ro,norecovery',
+    'btrfs': 'ro,nologreplay',
+    }
+
+# The range of uids adduser gives to normal users.
+FIRST_USER_UID = 1000
+LAST_USER_UID = 59999
+
+
+def parse_os_release(content):
+    r = {}
+    for line in content.splitlines():
+        line = line.strip()
+        if not line or line.startswith('#') or '=' not in line:
+            continue
+        key, value = line.split('=', 1)
+        try:
+            value = ' '.join(shlex.split(value))
+        except ValueError:
+            continue
+        r[key] = value
+    return r
+
+
+def parse_fstab(content):
+    """Return (spec, mountpoint, fstype, options) for each fstab entry."""
+    entries = []
+    for line in content.splitlines():
+        parts = line.split()
+        if len(parts) < 3 or parts[0].startswith('#'):
+            continue
+        options = parts[3] if len(parts) > 3 else 'defaults'
+        entries.append((parts[0], parts[1], parts[2], options))
+    return entries
+
+
+def parse_passwd(content):
+    """Find the normal users with a home directory under /home."""
+    users = []
+    for line in content.splitlines():
+        parts = line.split(':')
+        if len(parts) != 7:
+            continue
+        username, _pw, uid, _gid, gecos, home, _shell = parts
+        try:
+            uid = int(uid)
+        except ValueError:
+            continue
+        if not FIRST_USER_UID <= uid <= LAST_USER_UID:
+            continue
+        if not home.startswith('/home/'):
+            continue
+        users.append(ExistingUser(
+            username=username, uid=uid, realname=gecos.split(',')[0]))
+    return users
+
+
+async def read_install_files(device, fstype, patterns=INSTALL_FILES):
+    """Mount device read-only and read the files matching patterns.
+
+    The patterns are relative to the root of the install: the first
+    directory in INSTALL_ROOTS that has an etc/fstab. The result maps
+    the paths that were found to their contents.
+    """
+    files = {}
+    options = READ_ONLY_MOUNT_OPTIONS.get(fstype, 'ro')
+    with tempfile.TemporaryDirectory() as mnt:
+        cp = await arun_command(
+            ['mount', '-t', fstype, '-o', options, device, mnt])
+        if cp.returncode != 0:
+            log.debug("mounting %s failed: %s", device, cp.stderr)
+            return files
+        try:
+            for root in INSTALL_ROOTS:
+                base = os.path.join(mnt, root)
+                for pattern in patterns:
+                    for path in glob.glob(os.path.join(base, pattern)):
+                        try:
+                            with open(path) as fp:
+                                files[os.path.relpath(path, base)] = fp.read()
+                        except (OSError, UnicodeDecodeError):
+                            pass
+                if 'etc/fstab' in files:
+                    break
+        finally:
+            await arun_command(['umount', mnt])
+    return files
+
+
+FSTAB_TAGS = {
+    'UUID': 'ID_FS_UUID',
+    'LABEL': 'ID_FS_LABEL',
+    'PARTUUID': 'ID_PART_ENTRY_UUID',
+    'PARTLABEL': 'ID_PART_ENTRY_NAME',
+    }
+
+
+def find_fstab_device(spec, blockdevs):
+    """Find the path of the block device an fstab entry refers to."""
+    for tag in FSTAB_TAGS:
+        prefix = '/dev/disk/by-{}/'.format(tag.lower())
+        if spec.startswith(prefix):
+            spec = '{}={}'.format(tag, spec[len(prefix):])
+    if '=' not in spec:
+        if spec in blockdevs:
+            return spec
+        for path, data in blockdevs.items():
+            if spec in data.get('DEVLINKS', '').split():
+                return path
+        return None
+    tag, value = spec.split('=', 1)
+    key = FSTAB_TAGS.get(tag)
+    if key is None:
+        return None
+    value = value.strip('"')
+    if tag in ('UUID', 'PARTUUID'):
+        value = value.lower()
+    for path, data in blockdevs.items():
+        probed = data.get(key)
+        if probed is None:
+            continue
+        if tag in ('UUID', 'PARTUUID'):
+            probed = probed.lower()
+        if probed == value:
+            return path
+    return None
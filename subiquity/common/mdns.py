@@ -0,0 +1,131 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Advertising the installer over mDNS / DNS-SD and finding it again.
+
+The server publishes a service of type SERVICE_TYPE for the installer's
+ssh server by dropping a static service file into avahi's service
+directory, and subiquity --discover lists the services avahi-browse
+finds on the LAN.
+
+Nothing authenticates mDNS, so anyone on the LAN can advertise a
+service with the same TXT records. The host key fingerprints in them
+help tell installers apart but are no way to verify a host key: that
+still has to be done against the fingerprints the installer shows on
+its console.
+"""
+
+import re
+from typing import Dict, List
+from xml.sax.saxutils import escape
+
+import attr
+
+
+SERVICE_TYPE = '_subiquity._tcp'
+SSH_PORT = 22
+
+FINGERPRINT_PREFIX = 'fp-'
+
+
+@attr.s(auto_attribs=True)
+class DiscoveredInstaller:
+    name: str
+    hostname: str
+    address: str
+    port: int
+    session_id: str = ''
+    # {keytype: fingerprint}
+    host_key_fingerprints: Dict[str, str] = attr.Factory(dict)
+
+
+def txt_records(hostname, session_id, host_key_fingerprints):
+    """Return the TXT records for an installer as a list of strings.
+
+    host_key_fingerprints is a sequence of (keytype, fingerprint)
+    pairs, as returned by subiquitycore.ssh.host_key_fingerprints.
+    """
+    records = [
+        'hostname=' + hostname,
+        'session=' + session_id,
+        ]
+    for keytype, fingerprint in host_key_fingerprints:
+        records.append(
+            '{}{}={}'.format(FINGERPRINT_PREFIX, keytype.lower(), fingerprint))
+    return records
+
+
+def render_avahi_service(records, port=SSH_PORT):
+    txt = ''.join(
+        '    <txt-record>{}</txt-record>\n'.format(escape(record))
+        for record in records)
+    return (
+        '<?xml version="1.0" standalone="no"?>\n'
+        '<!DOCTYPE service-group SYSTEM "avahi-service.dtd">\n'
+        '<service-group>\n'
+        '  <name replace-wildcards="yes">Ubuntu installer on %h</name>\n'
+        '  <service>\n'
+        '    <type>{type}</type>\n'
+        '    <port>{port}</port>\n'
+        '{txt}'
+        '  </service>\n'
+        '</service-group>\n'
+        ).format(type=SERVICE_TYPE, port=port, txt=txt)
+
+
+def _unescape(value):
+    # avahi-browse --parsable escapes awkward characters as \DDD, in
+    # decimal.
+    return re.sub(r'\\(\d{3})', lambda m: chr(int(m.group(1))), value)
+
+
+def _parse_txt(txt):
+    records = {}
+    for record in re.findall(r'"((?:[^"\\]|\\.)*)"', txt):
+        key, sep, value = _unescape(record).partition('=')
+        if sep:
+            records.setdefault(key, value)
+    return records
+
+
+def parse_avahi_browse(output) -> List[DiscoveredInstaller]:
+    """Parse the output of avahi-browse --parsable --resolve."""
+    installers = []
+    seen = set()
+    for line in output.splitlines():
+        fields = line.split(';')
+        # =;iface;protocol;name;type;domain;host;address;port;txt
+        if len(fields) < 10 or fields[0] != '=':
+            continue
+        if fields[4] != SERVICE_TYPE:
+            continue
+        name = _unescape(fields[3])
+        address = fields[7]
+        if (name, address) in seen:
+            continue
+        seen.add((name, address))
+        txt = _parse_txt(';'.join(fields[9:]))
+        installers.append(DiscoveredInstaller(
+            name=name,
+            hostname=txt.get('hostname', fields[6]),
+            address=address,
+            port=int(fields[8]),
+            session_id=txt.get('session', ''),
+            host_key_fingerprints={
+                key[len(FINGERPRINT_PREFIX):]: value
+                for key, value in txt.items()
+                if key.startswith(FINGERPRINT_PREFIX)
+                }))
+    return installers
@@ -0,0 +1,45 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.common.console import console_can_show
+
+
+LANGUAGES = [
+    ('console', 'en_US.UTF-8', 'English'),
+    ('ssh', 'zh_CN.UTF-8', '中文(简体)'),
+    ('console', 'nb', 'Norsk bokmål'),
+    ]
+
+
+class TestConsoleCanShow(unittest.TestCase):
+
+    def test_console_language(self):
+        self.assertTrue(console_can_show('en_US.UTF-8', LANGUAGES))
+
+    def test_ssh_language(self):
+        self.assertFalse(console_can_show('zh_CN.UTF-8', LANGUAGES))
+
+    def test_encoding_ignored(self):
+        self.assertFalse(console_can_show('zh_CN', LANGUAGES))
+        self.assertTrue(console_can_show('nb.UTF-8', LANGUAGES))
+
+    def test_unknown_language(self):
+        self.assertTrue(console_can_show('C.UTF-8', LANGUAGES))
+
+    def test_languagelist(self):
+        self.assertFalse(console_can_show('zh_CN.UTF-8'))
+        self.assertTrue(console_can_show('fr_FR.UTF-8'))
@@ -222,3 +222,43 @@ class TestFilesystemManipulator(unittest.TestCase):
             disk1, disk1p2, {'fstype': 'ext4', 'mount': '/'})
         efi_mnt = manipulator.model._mount_for_path("/boot/efi")
         self.assertEqual(efi_mnt.device.volume, disk1p1)
+
+    def test_partition_name_type_and_label(self):
+        manipulator, disk = make_manipulator_and_disk()
+        part = manipulator.create_partition(disk, {
+            'size': 1 << 30,
+            'partition_name': 'boot',
+            'partition_type': 'bc13c2ff-59e6-4262-a352-b275fd6f7172',
+            'fstype': 'ext4',
+            'label': 'boot',
+            })
+        self.assertEqual(part.partition_name, 'boot')
+        self.assertEqual(
+            part.partition_type, 'bc13c2ff-59e6-4262-a352-b275fd6f7172')
+        self.assertEqual(part.fs().label, 'boot')
+        manipulator.partition_disk_handler(
+            disk, part, {'partition_type': None, 'fstype': 'ext4'})
+        self.assertIsNone(part.partition_type)
+        self.assertEqual(part.partition_name, 'boot')
+        self.assertIsNone(part.fs().label)
+
+    def test_btrfs_subvolumes(self):
+        manipulator, disk = make_manipulator_and_disk()
+        subvolumes = [{'name': '@', 'mount': '/'}]
+        part = manipulator.create_partition(disk, {
+            'size': 1 << 30,
+            'fstype': 'btrfs',
+            'mount': '/',
+            'subvolumes': subvolumes,
+            })
+        self.assertEqual(part.fs().subvolumes, subvolumes)
+        manipulator.partition_disk_handler(
+            disk, part, {'fstype': 'ext4', 'subvolumes': subvolumes})
+        self.assertIsNone(part.fs().subvolumes)
+
+    def test_reformat_secure_wipe(self):
+        manipulator, disk = make_manipulator_and_disk()
+        manipulator.reformat(disk, secure_wipe='zero')
+        self.assertEqual(disk.secure_wipe, 'zero')
+        manipulator.reformat(disk)
+        self.assertIsNone(disk.secure_wipe)
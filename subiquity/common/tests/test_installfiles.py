@@ -0,0 +1,150 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import contextlib
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import run_coro
+
+from subiquity.common.installfiles import (
+    find_fstab_device,
+    NETPLAN_FILES,
+    parse_fstab,
+    parse_os_release,
+    parse_passwd,
+    read_install_files,
+    )
+from subiquity.common.types import ExistingUser
+
+
+class TestParsing(unittest.TestCase):
+
+    def test_parse_os_release(self):
+        content = (
+            '# comment\n'
+            'NAME="Ubuntu"\n'
+            'VERSION_ID="20.04"\n'
+            'PRETTY_NAME="Ubuntu 20.04.2 LTS"\n'
+            'ID=ubuntu\n')
+        self.assertEqual(parse_os_release(content), {
+            'NAME': 'Ubuntu',
+            'VERSION_ID': '20.04',
+            'PRETTY_NAME': 'Ubuntu 20.04.2 LTS',
+            'ID': 'ubuntu',
+            })
+
+    def test_parse_fstab(self):
+        content = (
+            '# /etc/fstab: static file system information.\n'
+            'UUID=1234 / ext4 errors=remount-ro 0 1\n'
+            '\n'
+            '/dev/sda3 /home ext4\n'
+            '/swap.img none swap sw 0 0\n')
+        self.assertEqual(parse_fstab(content), [
+            ('UUID=1234', '/', 'ext4', 'errors=remount-ro'),
+            ('/dev/sda3', '/home', 'ext4', 'defaults'),
+            ('/swap.img', 'none', 'swap', 'sw'),
+            ])
+
+    def test_parse_passwd(self):
+        content = (
+            'root:x:0:0:root:/root:/bin/bash\n'
+            'nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin\n'
+            'ubuntu:x:1000:1000:Ubuntu User,,,:/home/ubuntu:/bin/bash\n'
+            'svc:x:1001:1001::/srv/svc:/bin/sh\n')
+        self.assertEqual(parse_passwd(content), [
+            ExistingUser(username='ubuntu', uid=1000, realname='Ubuntu User'),
+            ])
+
+    def test_find_fstab_device(self):
+        blockdevs = {
+            '/dev/sda2': {
+                'ID_FS_UUID': 'abcd-1234',
+                'DEVLINKS': '/dev/disk/by-id/ata-disk-part2',
+                },
+            '/dev/sda3': {
+                'ID_FS_LABEL': 'boot',
+                'ID_PART_ENTRY_UUID': 'EF01',
+                },
+            }
+        self.assertEqual(
+            find_fstab_device('UUID=ABCD-1234', blockdevs), '/dev/sda2')
+        self.assertEqual(
+            find_fstab_device('/dev/disk/by-uuid/abcd-1234', blockdevs),
+            '/dev/sda2')
+        self.assertEqual(
+            find_fstab_device('/dev/disk/by-id/ata-disk-part2', blockdevs),
+            '/dev/sda2')
+        self.assertEqual(
+            find_fstab_device('LABEL="boot"', blockdevs), '/dev/sda3')
+        self.assertEqual(
+            find_fstab_device('PARTUUID=ef01', blockdevs), '/dev/sda3')
+        self.assertEqual(
+            find_fstab_device('/dev/sda3', blockdevs), '/dev/sda3')
+        self.assertIsNone(find_fstab_device('UUID=nope', blockdevs))
+
+
+class TestReadInstall(unittest.TestCase):
+
+    def mount_args(self, fstype):
+        cp = mock.Mock(returncode=32, stderr='')
+        with mock.patch(
+                'subiquity.common.installfiles.arun_command',
+                new=mock.AsyncMock(return_value=cp)) as arun_command:
+            run_coro(read_install_files('/dev/sda2', fstype))
+        return arun_command.call_args[0][0][:5]
+
+    def test_journal_not_replayed(self):
+        self.assertEqual(
+            self.mount_args('ext4'),
+            ['mount', '-t', 'ext4', '-o', 'ro,noload'])
+        self.assertEqual(
+            self.mount_args('xfs'),
+            ['mount', '-t', 'xfs', '-o', 'ro,norecovery'])
+        self.assertEqual(
+            self.mount_args('btrfs'),
+            ['mount', '-t', 'btrfs', '-o', 'ro,nologreplay'])
+
+    def test_root_is_where_the_fstab_is(self):
+        # The top level of a btrfs filesystem can have files of its own,
+        # but the install is in the @ subvolume.
+        cp = mock.Mock(returncode=0)
+        with tempfile.TemporaryDirectory() as mnt:
+            for path, content in [
+                    ('etc/os-release', 'NAME="Other"\n'),
+                    ('@/etc/os-release', 'NAME="Ubuntu"\n'),
+                    ('@/etc/fstab', ''),
+                    ('@/etc/netplan/50-cloud-init.yaml', 'network: {}\n'),
+                    ]:
+                path = os.path.join(mnt, path)
+                os.makedirs(os.path.dirname(path), exist_ok=True)
+                with open(path, 'w') as fp:
+                    fp.write(content)
+            with mock.patch(
+                    'subiquity.common.installfiles.arun_command',
+                    new=mock.AsyncMock(return_value=cp)), \
+                mock.patch(
+                    'tempfile.TemporaryDirectory',
+                    return_value=contextlib.nullcontext(mnt)):
+                files = run_coro(read_install_files(
+                    '/dev/sda2', 'btrfs', NETPLAN_FILES))
+        self.assertEqual(files, {
+            'etc/os-release': 'NAME="Ubuntu"\n',
+            'etc/fstab': '',
+            'etc/netplan/50-cloud-init.yaml': 'network: {}\n',
+            })
@@ -0,0 +1,59 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.common.mdns import (
+    DiscoveredInstaller,
+    parse_avahi_browse,
+    render_avahi_service,
+    txt_records,
+    )
+
+
+class TestMDNS(unittest.TestCase):
+
+    def test_txt_records(self):
+        records = txt_records(
+            'ubuntu-server', 'abc', [('ED25519', 'SHA256:xyz')])
+        self.assertEqual(records, [
+            'hostname=ubuntu-server',
+            'session=abc',
+            'fp-ed25519=SHA256:xyz',
+            ])
+        service = render_avahi_service(records)
+        self.assertIn('<type>_subiquity._tcp</type>', service)
+        self.assertIn('<txt-record>session=abc</txt-record>', service)
+
+    def test_parse_avahi_browse(self):
+        output = '\n'.join([
+            '+;eth0;IPv4;Ubuntu\\032installer\\032on\\032ubuntu-server;'
+            '_subiquity._tcp;local',
+            '=;eth0;IPv4;Ubuntu\\032installer\\032on\\032ubuntu-server;'
+            '_subiquity._tcp;local;ubuntu-server.local;192.168.122.10;22;'
+            '"fp-ed25519=SHA256:xyz" "session=abc" '
+            '"hostname=ubuntu-server"',
+            '=;eth0;IPv4;other;_ssh._tcp;local;other.local;'
+            '192.168.122.11;22;',
+            ])
+        self.assertEqual(parse_avahi_browse(output), [
+            DiscoveredInstaller(
+                name='Ubuntu installer on ubuntu-server',
+                hostname='ubuntu-server',
+                address='192.168.122.10',
+                port=22,
+                session_id='abc',
+                host_key_fingerprints={'ed25519': 'SHA256:xyz'}),
+            ])
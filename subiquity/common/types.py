@@ -77,6 +77,7 @@ class ApplicationStatus:
     echo_syslog_id: str
     log_syslog_id: str
     event_syslog_id: str
+    rescue: bool = False
 
 
 class PasswordKind(enum.Enum):
@@ -114,6 +115,29 @@ class RefreshStatus:
     new_snap_version: str = ''
 
 
+class MirrorRankingState(enum.Enum):
+    NOT_STARTED = enum.auto()
+    RUNNING = enum.auto()
+    FAILED = enum.auto()
+    DONE = enum.auto()
+
+
+@attr.s(auto_attribs=True)
+class MirrorSpeed:
+    url: str
+    # In bytes per second, None if the download failed.
+    speed: Optional[float] = None
+    error: str = ''
+
+
+@attr.s(auto_attribs=True)
+class MirrorRanking:
+    state: MirrorRankingState
+    results: List[MirrorSpeed] = attr.Factory(list)
+    # The fastest mirror, if it was selected.
+    selected: Optional[str] = None
+
+
 @attr.s(auto_attribs=True)
 class StepPressKey:
     # "Press a key with one of the following symbols"
@@ -195,6 +219,52 @@ class ZdevInfo:
         return self.type
 
 
+@attr.s(auto_attribs=True)
+class ISCSIChap:
+    username: str
+    password: str = attr.ib(repr=False)
+
+
+@attr.s(auto_attribs=True)
+class ISCSIDiscovery:
+    portal: str
+    chap: Optional[ISCSIChap] = None
+
+
+@attr.s(auto_attribs=True)
+class ISCSITarget:
+    portal: str  # address:port
+    iqn: str
+    logged_in: bool = False
+
+
+@attr.s(auto_attribs=True)
+class ISCSIDiscoveryResponse:
+    targets: List[ISCSITarget]
+    error: Optional[str] = None
+
+
+@attr.s(auto_attribs=True)
+class ISCSILogin:
+    target: ISCSITarget
+    chap: Optional[ISCSIChap] = None
+
+
+@attr.s(auto_attribs=True)
+class MultipathDevice:
+    name: str
+    wwid: str
+    paths: List[str]
+
+
+@attr.s(auto_attribs=True)
+class ISCSIStatus:
+    initiator_name: str
+    targets: List[ISCSITarget]
+    multipath: List[MultipathDevice]
+    error: Optional[str] = None
+
+
 class ProbeStatus(enum.Enum):
     PROBING = enum.auto()
     FAILED = enum.auto()
@@ -226,11 +296,128 @@ class Disk:
     ok_for_guided: bool
 
 
+class GuidedResizeBlocker(enum.Enum):
+    BITLOCKER = enum.auto()
+    NOT_GPT = enum.auto()
+    NO_BOOTLOADER = enum.auto()
+    PARTITION_NUMBERING = enum.auto()
+    CHECK_FAILED = enum.auto()
+    TOO_FULL = enum.auto()
+
+
+@attr.s(auto_attribs=True)
+class GuidedResizeTarget:
+    # An existing (Windows) partition that could be shrunk to make
+    # room to install alongside it. If blocker is not None, it cannot
+    # be and minimum and maximum are not set.
+    disk_id: str
+    partition_number: int
+    label: str
+    size: int
+    fstype: Optional[str] = None
+    minimum: Optional[int] = None
+    maximum: Optional[int] = None
+    blocker: Optional[GuidedResizeBlocker] = None
+
+
+@attr.s(auto_attribs=True)
+class GuidedResize:
+    partition_number: int
+    size: int
+
+
+@attr.s(auto_attribs=True)
+class ExistingUser:
+    username: str
+    uid: int
+    realname: str = ''
+
+
+@attr.s(auto_attribs=True)
+class GuidedReinstallTarget:
+    # An existing Linux install whose root filesystem (and /boot, if
+    # it has one) can be reformatted while its /home is kept.
+    disk_id: str
+    root_partition_number: int
+    home_partition_number: int
+    os_name: str
+    boot_partition_number: Optional[int] = None
+    swap_partition_number: Optional[int] = None
+    users: List[ExistingUser] = attr.Factory(list)
+
+
+@attr.s(auto_attribs=True)
+class GuidedReinstall:
+    root_partition_number: int
+    # Re-create this user from the existing install, with the same
+    # uid so that it still owns its home directory.
+    username: Optional[str] = None
+
+
+@attr.s(auto_attribs=True)
+class InstalledNetworkConfig:
+    # The netplan configuration of an existing install, which can be
+    # used as the starting point for the network configuration.
+    source: str
+    os_name: str
+    # The contents of its /etc/netplan/*.yaml, in the order netplan
+    # reads them.
+    files: List[str]
+    interfaces: List[str] = attr.Factory(list)
+
+
+class RescueAction(enum.Enum):
+    FSCK = enum.auto()
+    REINSTALL_GRUB = enum.auto()
+    UPDATE_INITRAMFS = enum.auto()
+
+
+@attr.s(auto_attribs=True)
+class RescueInstall:
+    # The path of the device holding the root filesystem.
+    root: str
+    os_name: str
+    mounted: bool = False
+
+
+@attr.s(auto_attribs=True)
+class RescueStatus:
+    installs: List[RescueInstall]
+    # Encrypted devices that have not been unlocked.
+    locked: List[str]
+    # Where the mounted install is, if one is.
+    mount_point: Optional[str] = None
+    error: Optional[str] = None
+
+
+@attr.s(auto_attribs=True)
+class RescueUnlock:
+    path: str
+    passphrase: str = attr.ib(repr=False)
+
+
+@attr.s(auto_attribs=True)
+class RescueActionResult:
+    success: bool
+    output: str
+
+
 @attr.s(auto_attribs=True)
 class GuidedChoice:
     disk_id: str
     use_lvm: bool = False
+    use_zfs: bool = False
     password: Optional[str] = attr.ib(default=None, repr=False)
+    resize: Optional[GuidedResize] = None
+    reinstall: Optional[GuidedReinstall] = None
+    # The filesystem for / when not using ZFS. None means ext4.
+    fstype: Optional[str] = None
+    # With use_lvm and a password, use LUKS2 authenticated encryption
+    # with this algorithm (e.g. "hmac-sha256").
+    integrity: Optional[str] = None
+    # Copy the installer media to a partition at the end of the disk
+    # that the machine can be restored to its factory state from.
+    reset_partition: bool = False
 
 
 @attr.s(auto_attribs=True)
@@ -238,6 +425,81 @@ class GuidedStorageResponse:
     status: ProbeStatus
     error_report: Optional[ErrorReportRef] = None
     disks: Optional[List[Disk]] = None
+    resize_targets: Optional[List[GuidedResizeTarget]] = None
+    reinstall_targets: Optional[List[GuidedReinstallTarget]] = None
+    # Filesystems the installer can use beyond the ones that are
+    # always available.
+    optional_fstypes: Optional[List[str]] = None
+    # The size of the reset partition guided storage can create, or
+    # None if there is no installer media to put on one.
+    reset_partition_size: Optional[int] = None
+    # Whether use_zfs can be chosen, which needs a curtin that knows
+    # how to create ZFS pools.
+    zfs_supported: bool = False
+
+
+class SwapKind(enum.Enum):
+    AUTO = enum.auto()       # a swapfile sized by curtin, when it makes sense
+    NONE = enum.auto()
+    FILE = enum.auto()       # a swapfile of the given size
+    PARTITION = enum.auto()  # a swap partition (or LV) set up for hibernation
+    ZRAM = enum.auto()       # only compressed swap in RAM
+
+
+@attr.s(auto_attribs=True)
+class RecoveryKeyMedium:
+    # A filesystem on removable media the recovery key can be saved to.
+    path: str
+    label: str
+    fstype: str
+
+
+@attr.s(auto_attribs=True)
+class RecoveryKeyResponse:
+    # The key added to the encrypted volumes of the install, if one has
+    # been generated.
+    key: Optional[str] = attr.ib(default=None, repr=False)
+    media: List[RecoveryKeyMedium] = attr.Factory(list)
+
+
+class RecoveryKeyExportKind(enum.Enum):
+    MEDIA = enum.auto()   # write it to a file on removable media
+    ESCROW = enum.auto()  # POST it, with the machine's identity, to a URL
+
+
+@attr.s(auto_attribs=True)
+class RecoveryKeyExport:
+    kind: RecoveryKeyExportKind
+    path: Optional[str] = None  # for MEDIA, a RecoveryKeyMedium.path
+    url: Optional[str] = None   # for ESCROW
+
+
+@attr.s(auto_attribs=True)
+class RecoveryKeyExportResponse:
+    error: Optional[str] = None
+
+
+@attr.s(auto_attribs=True)
+class SwapConfig:
+    kind: SwapKind = SwapKind.AUTO
+    # In bytes. Required for FILE, defaults to enough to hibernate for
+    # PARTITION and unused otherwise.
+    size: Optional[int] = None
+
+
+@attr.s(auto_attribs=True)
+class NVMeoFTarget:
+    address: str
+    port: int
+    subnqn: str
+    transport: str = 'tcp'
+    connected: bool = False
+
+
+@attr.s(auto_attribs=True)
+class NVMeoFResponse:
+    targets: List[NVMeoFTarget]
+    error: Optional[str] = None
 
 
 @attr.s(auto_attribs=True)
@@ -249,6 +511,14 @@ class StorageResponse:
     config: Optional[list] = None
     blockdev: Optional[dict] = None
     dasd: Optional[dict] = None
+    # Incremented each time the server probes the block devices, see
+    # the storage POST.
+    generation: int = 0
+    # The hardware secure wipe modes each disk supports, see
+    # Disk.secure_wipe_modes.
+    wipe_modes: Optional[dict] = None
+    # The id of the reset partition guided storage added, if any.
+    reset_partition: Optional[str] = None
 
 
 @attr.s(auto_attribs=True)
@@ -259,6 +529,20 @@ class IdentityData:
     hostname: str = ''
 
 
+@attr.s(auto_attribs=True)
+class IdentityUser:
+    """A user to create in addition to the one in IdentityData."""
+    username: str
+    realname: str = ''
+    # An empty password means the account can only be logged into with
+    # an SSH key.
+    crypted_password: str = attr.ib(default='', repr=False)
+    shell: str = '/bin/bash'
+    sudo: bool = False
+    groups: List[str] = attr.Factory(list)
+    ssh_authorized_keys: List[str] = attr.Factory(list)
+
+
 @attr.s(auto_attribs=True)
 class SSHData:
     install_server: bool
@@ -266,6 +550,31 @@ class SSHData:
     authorized_keys: List[str] = attr.Factory(list)
 
 
+@attr.s(auto_attribs=True)
+class KdumpInfo:
+    enabled: bool
+    # The crashkernel= size, None if the machine has too little RAM to
+    # reserve any for a crash kernel.
+    crashkernel: Optional[str] = None
+
+
+@attr.s(auto_attribs=True)
+class StoreProxyConfig:
+    url: str = ''
+    # Found from the store assertion served by the proxy if not given.
+    store_id: str = ''
+
+
+@attr.s(auto_attribs=True)
+class InventoryConfig:
+    # Where to POST the hardware inventory and install status once the
+    # install has finished, and the bearer token to authenticate with.
+    url: Optional[str] = None
+    token: Optional[str] = attr.ib(default=None, repr=False)
+    # Whether to include the full storage probe data.
+    probe_data: bool = True
+
+
 class SnapCheckState(enum.Enum):
     FAILED = enum.auto()
     LOADING = enum.auto()
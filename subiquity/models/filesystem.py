@@ -24,17 +24,24 @@ import math
 import os
 import pathlib
 import platform
+import secrets
 import tempfile
+import uuid
 
 from curtin import storage_config
 from curtin.block import partition_kname
+from curtin.block import schemas as curtin_schemas
 from curtin.util import human2bytes
 
 from probert.storage import StorageInfo
 
-from subiquitycore.gettext38 import pgettext
+from subiquitycore.gettext38 import ngettext, pgettext
 
-from subiquity.common.types import Bootloader
+from subiquity.common.types import (
+    Bootloader,
+    SwapConfig,
+    SwapKind,
+    )
 
 
 log = logging.getLogger('subiquity.models.filesystem')
@@ -192,6 +199,253 @@ raidlevels_by_value = _raidlevels_by_value()
 
 HUMAN_UNITS = ['B', 'K', 'M', 'G', 'T', 'P']
 
+# Filesystems that are only offered if the kernel supports them, and
+# the package that has to be in the target system to use them.
+OPTIONAL_FSTYPES = {
+    'bcachefs': 'bcachefs-tools',
+    }
+
+# Filesystems guided storage can put / on, as well as whichever
+# OPTIONAL_FSTYPES are supported.
+GUIDED_FSTYPES = ['ext4', 'btrfs']
+
+# The longest label each filesystem allows.
+FS_LABEL_MAX_LENGTHS = {
+    'btrfs': 255,
+    'ext2': 16,
+    'ext3': 16,
+    'ext4': 16,
+    'fat12': 11,
+    'fat16': 11,
+    'fat32': 11,
+    'jfs': 16,
+    'swap': 15,
+    'xfs': 12,
+    }
+
+# Sanitize runs in the background, so wait for the status in the low
+# bits of SSTAT to stop being 2 ("in progress") and check that it then
+# says the sanitize succeeded.
+NVME_SANITIZE_SCRIPT = """\
+set -e
+nvme sanitize "$1" --sanact=2
+while :; do
+    log=$(nvme sanitize-log "$1" -o json)
+    sstat=$(echo "$log" | sed -n 's/.*"sstat" *: *\\([0-9]*\\).*/\\1/p')
+    [ $((sstat & 7)) -eq 2 ] || break
+    sleep 5
+done
+[ $((sstat & 7)) -eq 1 ]
+"""
+
+# Run with arguments PASSWORD DISK. A drive refuses to erase itself
+# unless a user password is set, which the erase then clears again. The
+# password is cleared whatever happens, so a failed erase does not leave
+# the drive locked.
+ATA_SECURE_ERASE_SCRIPT = """\
+set -e
+password="$1"
+disk="$2"
+disable() {
+    rc=$?
+    hdparm --user-master u --security-disable "$password" "$disk" || true
+    exit $rc
+}
+trap disable EXIT
+hdparm --user-master u --security-set-pass "$password" "$disk"
+hdparm --user-master u --security-erase "$password" "$disk"
+"""
+
+# Ways of erasing a disk that go further than curtin's wiping of
+# partition tables and signatures. They are carried out as curtin
+# early_commands, before the disk is partitioned, and are all passed
+# the path of the disk as their last argument.
+SECURE_WIPE_COMMANDS = {
+    'zero': ['blkdiscard', '--zeroout', '--force'],
+    'discard': ['blkdiscard', '--force'],
+    'nvme-format': ['nvme', 'format', '--ses=1', '--force'],
+    'nvme-sanitize': ['sh', '-c', NVME_SANITIZE_SCRIPT, '--'],
+    'ata-secure-erase': ['sh', '-c', ATA_SECURE_ERASE_SCRIPT, '--'],
+    }
+
+# Roughly how fast writing zeros goes, for estimating how long it takes.
+ZERO_WIPE_BYTES_PER_SECOND = 150 << 20
+
+# GPT partition names are 36 UTF-16 code units.
+GPT_PARTITION_NAME_MAX_LENGTH = 36
+
+# Partition type GUIDs that can be given by name, from the UEFI
+# specification and the Discoverable Partitions Specification.
+GPT_PARTITION_TYPES = {
+    'esp': 'c12a7328-f81f-11d2-ba4b-00a0c93ec93b',
+    'xbootldr': 'bc13c2ff-59e6-4262-a352-b275fd6f7172',
+    'linux': '0fc63daf-8483-4772-8e79-3d69d8477de4',
+    'home': '933ac7e1-2eb4-4f13-b844-0e14e2aef915',
+    'srv': '3b8f8425-20e0-4f3b-907f-1a25a76f98e8',
+    'var': '4d21b016-b534-45c2-a9fb-5c16e091fd2d',
+    'swap': '0657fd6d-a4ab-43c4-84e5-0933c84b4f4f',
+    'lvm': 'e6d6d379-f507-44c2-a23c-238f2a3df928',
+    'raid': 'a19d880f-05fc-4d3b-a006-743f0f84911e',
+    }
+
+
+def parse_gpt_partition_type(value):
+    """Return the type GUID for value, a GUID or a GPT_PARTITION_TYPES key.
+
+    Raises ValueError if value is neither."""
+    value = value.strip().lower()
+    if value in GPT_PARTITION_TYPES:
+        return GPT_PARTITION_TYPES[value]
+    try:
+        return str(uuid.UUID(value))
+    except ValueError:
+        raise ValueError(
+            "{!r} is not a partition type GUID".format(value))
+
+
+# Used when only zram swap is wanted. This is the same as the Fedora
+# default: half of RAM, up to 4GiB.
+ZRAM_GENERATOR_CONF = """\
+[zram0]
+zram-size = min(ram / 2, 4096)
+"""
+
+
+# Run as a curthook with arguments DM_NAME KEYFILE RECOVERY_KEYFILE
+# repeated for each encrypted volume. The volumes are still open at
+# that point, which is the easiest way to find the device each one was
+# created on.
+ADD_RECOVERY_KEY_SCRIPT = """\
+set -e
+while [ $# -gt 0 ]; do
+    dev=$(cryptsetup status "$1" | sed -n 's/^ *device: *//p')
+    cryptsetup luksAddKey --key-file "$2" "$dev" "$3"
+    shift 3
+done
+"""
+
+
+# The subvolumes created on a btrfs filesystem for / unless another
+# layout is asked for: the layout the desktop installer has long used,
+# so that snapshots of / leave /home and the logs alone.
+DEFAULT_BTRFS_SUBVOLUMES = [
+    {'name': '@', 'mount': '/'},
+    {'name': '@home', 'mount': '/home'},
+    {'name': '@var-log', 'mount': '/var/log'},
+    ]
+
+
+# Run as a partitioning command after curtin's own with arguments
+# MOUNTPOINT followed by NAME PATH OPTIONS for each subvolume, sorted by
+# PATH. curtin has mounted the top level of the filesystem at
+# MOUNTPOINT and put it in the fstab, so this creates the subvolumes,
+# mounts them in its place (putting back anything mounted below it)
+# and changes the fstab to match.
+BTRFS_SUBVOLUMES_SCRIPT = """\
+set -e
+path="$1"
+shift
+top=$(realpath -m "$TARGET_MOUNT_POINT/$path")
+dev=$(findmnt -n -o SOURCE --mountpoint "$top")
+spec=$(awk -v p="$path" '$2 == p { print $1 }' "$OUTPUT_FSTAB")
+below=$(findmnt -rn -R -o TARGET,SOURCE,FSTYPE --mountpoint "$top" \\
+        | tail -n +2)
+umount -R "$top"
+tmp=$(mktemp -d)
+mount -o subvolid=5 "$dev" "$tmp"
+if [ "$2" = "$path" ]; then
+    awk -v p="$path" '$2 != p' "$OUTPUT_FSTAB" > "$OUTPUT_FSTAB.new"
+    mv "$OUTPUT_FSTAB.new" "$OUTPUT_FSTAB"
+else
+    mount "$dev" "$top"
+fi
+while [ $# -gt 0 ]; do
+    [ -d "$tmp/$1" ] || btrfs subvolume create "$tmp/$1"
+    opts="subvol=$1${3:+,$3}"
+    mkdir -p "$TARGET_MOUNT_POINT$2"
+    mount -o "$opts" "$dev" "$TARGET_MOUNT_POINT$2"
+    echo "$spec $2 btrfs $opts 0 0" >> "$OUTPUT_FSTAB"
+    shift 3
+done
+umount "$tmp"
+rmdir "$tmp"
+echo "$below" | while read -r target source fstype; do
+    [ -n "$target" ] || continue
+    mkdir -p "$target"
+    mount -t "$fstype" "$source" "$target"
+done
+"""
+
+
+def parse_btrfs_subvolumes(text):
+    """Parse a space separated list of NAME:PATH[:OPTIONS] subvolumes.
+
+    Raises ValueError if text does not describe a usable layout."""
+    subvolumes = []
+    for word in text.split():
+        parts = word.split(':')
+        if len(parts) not in (2, 3):
+            raise ValueError(
+                _("{word!r} is not of the form name:path[:options]").format(
+                    word=word))
+        subvolume = {'name': parts[0], 'mount': parts[1]}
+        if len(parts) == 3 and parts[2]:
+            subvolume['options'] = parts[2]
+        subvolumes.append(subvolume)
+    check_btrfs_subvolumes(subvolumes)
+    return subvolumes
+
+
+def check_btrfs_subvolumes(subvolumes):
+    names = set()
+    mounts = set()
+    for subvolume in subvolumes:
+        name = subvolume['name']
+        mount = subvolume['mount']
+        if not name or '/' in name or name in ('.', '..'):
+            raise ValueError(
+                _("{name!r} is not a valid subvolume name").format(
+                    name=name))
+        if not mount.startswith('/'):
+            raise ValueError(
+                _("subvolume {name} must be mounted at an absolute "
+                  "path").format(name=name))
+        if name in names:
+            raise ValueError(
+                _("subvolume {name} is listed twice").format(name=name))
+        if mount in mounts:
+            raise ValueError(
+                _("two subvolumes are mounted at {path}").format(
+                    path=mount))
+        names.add(name)
+        mounts.add(mount)
+
+
+def format_btrfs_subvolumes(subvolumes):
+    words = []
+    for subvolume in subvolumes:
+        word = '{}:{}'.format(subvolume['name'], subvolume['mount'])
+        if subvolume.get('options'):
+            word += ':' + subvolume['options']
+        words.append(word)
+    return ' '.join(words)
+
+
+def make_recovery_key():
+    # The same format as the recovery keys snapd and ubuntu-desktop-
+    # installer use: 128 random bits as eight groups of five digits.
+    key = secrets.token_bytes(16)
+    return '-'.join(
+        '{:05d}'.format(int.from_bytes(key[i:i+2], 'little'))
+        for i in range(0, 16, 2))
+
+
+def get_hibernation_swap_size(memory):
+    # The amount of swap Ubuntu recommends for hibernating: the size of
+    # RAM plus its square root, in whole GiB.
+    ram_gib = math.ceil(memory / (1 << 30))
+    return (ram_gib + math.ceil(math.sqrt(ram_gib))) << 30
+
 
 def humanize_size(size):
     if size == 0:
@@ -327,7 +581,9 @@ def get_raid_size(level, devices):
     elif level == "raid6":
         return min_size * (len(devices) - 2)
     elif level == "raid10":
-        return min_size * (len(devices) // 2)
+        # mdadm's default "near 2" layout keeps two copies of each
+        # chunk, which also works with an odd number of devices.
+        return min_size * len(devices) // 2
     else:
         raise ValueError("unknown raid level %s" % level)
 
@@ -338,6 +594,37 @@ LVM_OVERHEAD = (1 << 20)
 LVM_CHUNK_SIZE = 4 * (1 << 20)
 
 
+# curtin refuses lvm_partition actions with keys its schema does not
+# know, so thin pools and volumes are only offered when it knows the
+# ones they are rendered with. The curtin the snap is built with
+# (source-commit in snapcraft.yaml) does not, so this is False until
+# that is bumped to one that does.
+THIN_LVM_SUPPORTED = {'thin_pool', 'pool'} <= set(
+    curtin_schemas.LVM_PARTITION['properties'])
+
+
+# Resizing a partition in place and placing one at a given offset need
+# a curtin that knows the resize and offset keys, and the config has to
+# be rendered as storage version 2 for curtin to honour them.
+RESIZE_SUPPORTED = {'resize', 'offset'} <= set(
+    curtin_schemas.PARTITION['properties'])
+
+# Likewise for setting the GPT partition name and type GUID.
+PARTITION_NAME_SUPPORTED = {'partition_name', 'partition_type'} <= set(
+    curtin_schemas.PARTITION['properties'])
+
+# Keys of partition actions that only storage version 2 understands.
+STORAGE_V2_PARTITION_KEYS = [
+    'offset', 'resize', 'partition_name', 'partition_type',
+    ]
+
+
+def get_thin_pool_metadata_size(size):
+    # lvm sizes the metadata of a thin pool with the default 64KiB
+    # chunks at 64 bytes per chunk, with a minimum of 2MiB.
+    return align_up(max(2 << 20, size // (64 << 10) * 64), LVM_CHUNK_SIZE)
+
+
 def get_lvm_size(devices, size_overrides={}):
     r = 0
     for d in devices:
@@ -359,11 +646,11 @@ class attributes:
     # Just a namespace to hang our wrappers around attr.ib() off.
 
     @staticmethod
-    def ref(*, backlink=None):
+    def ref(*, backlink=None, default=attr.NOTHING):
         metadata = {'ref': True}
         if backlink:
             metadata['backlink'] = backlink
-        return attr.ib(metadata=metadata)
+        return attr.ib(metadata=metadata, default=default)
 
     @staticmethod
     def reflist(*, backlink=None, default=attr.NOTHING):
@@ -473,6 +760,13 @@ def _generic_can_REMOVE(obj):
                     cdtype=cd.desc(),
                     cdlabel=cd.label,
                     min_devices=min_devices)
+    elif isinstance(cd, DM_Integrity):
+        return _(
+            "Removing {selflabel} would leave the {cdtype} {cdlabel} with "
+            "no devices.").format(
+                selflabel=obj.label,
+                cdtype=cd.desc(),
+                cdlabel=cd.label)
     elif isinstance(cd, LVM_VolGroup):
         if len(cd.devices) == 1:
             return _(
@@ -546,6 +840,10 @@ class _Formattable(ABC):
                 if m:
                     # A filesytem
                     r.append(_("mounted at {path}").format(path=m.path))
+                    if fs.subvolumes:
+                        r.append(_("with subvolumes {names}").format(
+                            names=", ".join(
+                                sv['name'] for sv in fs.subvolumes)))
                 elif not getattr(self, 'is_esp', False):
                     # A filesytem
                     r.append(_("not mounted"))
@@ -739,9 +1037,25 @@ class Disk(_Device):
     name = attr.ib(default="")
     grub_device = attr.ib(default=False)
     device_id = attr.ib(default=None)
+    # One of SECURE_WIPE_COMMANDS. Not passed on to curtin.
+    secure_wipe = attr.ib(default=None)
 
     _info = attr.ib(default=None)
 
+    def secure_wipe_modes(self):
+        """Return the supported secure wipe modes for this disk.
+
+        This is a dict mapping mode to a rough estimate, in seconds, of
+        how long the wipe takes (or None if there is no telling)."""
+        # Zeroing is always possible, as blkdiscard --zeroout falls back
+        # to writing zeros when the device cannot zero blocks itself. The
+        # others depend on the hardware and are found by the server when
+        # it probes.
+        modes = {'zero': self.size // ZERO_WIPE_BYTES_PER_SECOND}
+        wipe_modes = (self._m._probe_data or {}).get('wipe_modes') or {}
+        modes.update(wipe_modes.get(self.path, {}))
+        return modes
+
     def info_for_display(self):
         bus = self._info.raw.get('ID_BUS', None)
         major = self._info.raw.get('MAJOR', None)
@@ -767,6 +1081,7 @@ class Disk(_Device):
             'serial': self.serial or 'unknown',
             'wwn': self.wwn or 'unknown',
             'multipath': self.multipath or 'unknown',
+            'paths': self.multipath_paths() or 'unknown',
             'size': self.size,
             'humansize': humanize_size(self.size),
             'vendor': self._info.vendor or 'unknown',
@@ -793,15 +1108,51 @@ class Disk(_Device):
     def annotations(self):
         return []
 
+    def multipath_paths(self):
+        # The number of paths multipathd has for this device, from the
+        # same probe data the topology was extracted from.
+        if not self.multipath:
+            return 0
+        mp = (self._m._probe_data or {}).get('multipath', {})
+        return len([
+            path for path in mp.get('paths', [])
+            if path.get('multipath') == self.multipath
+            ])
+
     def desc(self):
         if self.multipath:
+            paths = self.multipath_paths()
+            if paths:
+                return ngettext(
+                    "multipath device ({count} path)",
+                    "multipath device ({count} paths)",
+                    paths).format(count=paths)
             return _("multipath device")
+        if self.on_fabric:
+            return _("NVMe over Fabrics namespace")
         return _("local disk")
 
+    @property
+    def on_fabric(self):
+        # Namespaces of controllers created by "nvme connect" hang off
+        # the nvme-fabrics virtual device.
+        devpath = self._info.raw.get('DEVPATH', '')
+        return '/nvme-fabrics/' in devpath
+
+    @property
+    def removable(self):
+        if self._info is None:
+            return False
+        if self._info.raw.get('ID_BUS') == 'usb':
+            return True
+        return self._info.raw.get('attrs', {}).get('removable') == '1'
+
     @property
     def label(self):
-        if self.multipath and self.wwn:
-            return self.wwn
+        if self.multipath:
+            # This is the name the user will see in /dev/mapper (mpatha
+            # or similar, if user_friendly_names is set).
+            return self.multipath
         return self.serial or self.path
 
     def dasd(self):
@@ -923,6 +1274,12 @@ class Partition(_Formattable):
     grub_device = attr.ib(default=False)
     name = attr.ib(default=None)
     multipath = attr.ib(default=None)
+    offset = attr.ib(default=None)
+    resize = attr.ib(default=None)
+    # The GPT partition name and type GUID. If partition_type is not
+    # set, curtin picks the type from flag.
+    partition_name = attr.ib(default=None)
+    partition_type = attr.ib(default=None)
 
     @property
     def annotations(self):
@@ -950,6 +1307,9 @@ class Partition(_Formattable):
                 else:
                     r.append(_("unconfigured"))
             r.append("bios_grub")
+        elif self is self._m.reset_partition:
+            # the partition a factory reset restores the system from
+            r.append(_("reset partition"))
         elif self.flag == "extended":
             # extended partition
             r.append(_("extended"))
@@ -978,6 +1338,8 @@ class Partition(_Formattable):
     def available(self):
         if self.flag in ['bios_grub', 'prep'] or self.grub_device:
             return False
+        if self is self._m.reset_partition:
+            return False
         if self._constructed_device is not None:
             return False
         if self._fs is None:
@@ -997,6 +1359,25 @@ class Partition(_Formattable):
     def _path(self):
         return partition_kname(self.device.path, self._number)
 
+    def _blockdev_raw(self):
+        return self._m._probe_data['blockdev'].get(self._path(), {})
+
+    @property
+    def probed_fstype(self):
+        return self._blockdev_raw().get('ID_FS_TYPE')
+
+    @property
+    def probed_offset(self):
+        # The storage config extracted from the probe data does not
+        # say where existing partitions start, but udev does (in 512
+        # byte sectors).
+        if self.offset is not None:
+            return self.offset
+        start = self._blockdev_raw().get('ID_PART_ENTRY_OFFSET')
+        if start is None:
+            return None
+        return int(start) * 512
+
     @property
     def is_esp(self):
         if self.device.type != "disk":
@@ -1167,6 +1548,23 @@ class LVM_VolGroup(_Device):
     def available_for_partitions(self):
         return self.size
 
+    @property
+    def used(self):
+        # Thin volumes are allocated from their pool, not directly
+        # from the volume group. A pool also needs space for its
+        # metadata, and for a spare copy of the metadata.
+        r = 0
+        for lv in self._partitions:
+            if lv.pool is not None:
+                continue
+            r += lv.size
+            if lv.thin_pool:
+                r += 2 * get_thin_pool_metadata_size(lv.size)
+        return r
+
+    def thin_pools(self):
+        return [lv for lv in self._partitions if lv.thin_pool]
+
     @property
     def annotations(self):
         r = super().annotations
@@ -1220,10 +1618,47 @@ class LVM_LogicalVolume(_Formattable):
 
     preserve = attr.ib(default=False)
 
+    # A thin pool holds thin volumes rather than a filesystem. A thin
+    # volume's size is virtual: the space is only taken from the pool
+    # as it is written to.
+    thin_pool = attr.ib(default=None)
+    pool = attributes.ref(backlink="_thin_volumes", default=None)
+    _thin_volumes = attributes.backlink(default=attr.Factory(list))
+
     def serialize_size(self):
         return {'size': "{}B".format(self.size)}
 
+    def thin_volumes(self):
+        return self._thin_volumes
+
+    @property
+    def thin_allocated(self):
+        return sum(lv.size for lv in self._thin_volumes)
+
+    @property
+    def overprovisioned(self):
+        return bool(self.thin_pool) and self.thin_allocated > self.size
+
+    @property
+    def annotations(self):
+        r = super().annotations
+        if self.thin_pool:
+            r.append(_("thin pool"))
+            if self.overprovisioned:
+                r.append(_("overprovisioned"))
+        elif self.pool is not None:
+            r.append(_("thin"))
+        return r
+
+    def usage_labels(self):
+        if self.thin_pool:
+            return [_("{size} allocated to thin volumes").format(
+                size=humanize_size(self.thin_allocated))]
+        return super().usage_labels()
+
     def available(self):
+        if self.thin_pool:
+            return False
         if self._constructed_device is not None:
             return False
         if self._fs is None:
@@ -1259,6 +1694,10 @@ class LVM_LogicalVolume(_Formattable):
         if self.volgroup._has_preexisting_partition():
             return _("Cannot delete a single logical volume from a volume "
                      "group that already has logical volumes.")
+        if self._thin_volumes:
+            return _(
+                "Cannot delete {selflabel} because it contains thin "
+                "volumes.").format(selflabel=self.label)
         return True
 
     ok_for_raid = False
@@ -1267,6 +1706,40 @@ class LVM_LogicalVolume(_Formattable):
 
 LUKS_OVERHEAD = 16*(2**20)
 
+# dm-integrity stores a tag for every 4KiB sector, and has a journal
+# (and superblock) whose size depends a bit on the device but this is
+# a safe overestimate.
+INTEGRITY_OVERHEAD = 128*(2**20)
+INTEGRITY_SECTOR_SIZE = 4096
+# Tag sizes for the algorithms dm-integrity can use by itself...
+INTEGRITY_ALGORITHMS = {
+    'crc32c': 4,
+    'crc32': 4,
+    'sha1': 20,
+    'sha256': 32,
+    }
+# ... and for the keyed ones that only make sense with LUKS2 (that
+# supplies the key).
+LUKS_INTEGRITY_ALGORITHMS = {
+    'hmac-sha256': 32,
+    'hmac-sha512': 64,
+    }
+
+# As with thin LVM, these can only be used with a curtin that knows how
+# to create them, which the curtin in snapcraft.yaml does not: both are
+# False until it is bumped.
+DM_INTEGRITY_SUPPORTED = hasattr(curtin_schemas, 'DM_INTEGRITY')
+LUKS_INTEGRITY_SUPPORTED = 'integrity' in \
+    curtin_schemas.DM_CRYPT['properties']
+
+
+def get_integrity_size(size, tag_size):
+    size -= INTEGRITY_OVERHEAD
+    if size <= 0:
+        return 0
+    return align_down(
+        size * INTEGRITY_SECTOR_SIZE // (INTEGRITY_SECTOR_SIZE + tag_size))
+
 
 @fsobj("dm_crypt")
 class DM_Crypt:
@@ -1276,16 +1749,15 @@ class DM_Crypt:
 
     def serialize_key(self):
         if self.key and not self.keyfile:
-            f = tempfile.NamedTemporaryFile(
-                prefix='luks-key-', mode='w', delete=False)
-            f.write(self.key)
-            f.close()
-            return {'keyfile': f.name}
+            return {'keyfile': self._m.write_key_file('luks-key-', self.key)}
         else:
             return {}
 
     dm_name = attr.ib(default=None)
     preserve = attr.ib(default=False)
+    # If set, a LUKS2 volume with authenticated encryption using this
+    # algorithm (one of LUKS_INTEGRITY_ALGORITHMS).
+    integrity = attr.ib(default=None)
 
     _constructed_device = attributes.backlink()
 
@@ -1294,7 +1766,72 @@ class DM_Crypt:
 
     @property
     def size(self):
-        return self.volume.size - LUKS_OVERHEAD
+        size = self.volume.size - LUKS_OVERHEAD
+        if self.integrity is not None:
+            size = get_integrity_size(
+                size, LUKS_INTEGRITY_ALGORITHMS[self.integrity])
+        return size
+
+
+@fsobj("dm_integrity")
+class DM_Integrity(_Device):
+    # A standalone dm-integrity device, which detects (but cannot
+    # correct) corruption of the underlying volume.
+    volume = attributes.ref(backlink="_constructed_device")  # _Formattable
+    algorithm = attr.ib(default='crc32c')
+    dm_name = attr.ib(default=None)
+    preserve = attr.ib(default=False)
+    wipe = attr.ib(default=None)
+
+    @property
+    def size(self):
+        return get_integrity_size(
+            self.volume.size, INTEGRITY_ALGORITHMS[self.algorithm])
+
+    @property
+    def name(self):
+        if self.dm_name is not None:
+            return self.dm_name
+        return self.volume.label + "-integrity"
+
+    @property
+    def label(self):
+        return self.name
+
+    def desc(self):
+        return _("integrity-protected device")
+
+    @property
+    def annotations(self):
+        return super().annotations + [self.algorithm]
+
+    supported_actions = [
+        DeviceAction.FORMAT,
+        DeviceAction.REMOVE,
+        DeviceAction.DELETE,
+        ]
+
+    _can_FORMAT = property(
+        lambda self: self._constructed_device is None)
+    _can_REMOVE = property(_generic_can_REMOVE)
+
+    @property
+    def _can_DELETE(self):
+        if self.preserve:
+            return _("Cannot delete pre-existing integrity devices.")
+        return _generic_can_DELETE(self)
+
+    @property
+    def ok_for_raid(self):
+        if self._fs is not None:
+            return False
+        if self._constructed_device is not None:
+            return False
+        return True
+
+    ok_for_lvm_vg = ok_for_raid
+
+    component_name = _("data device")
 
 
 @fsobj("format")
@@ -1306,6 +1843,9 @@ class Filesystem:
     uuid = attr.ib(default=None)
     preserve = attr.ib(default=False)
     extra_options = attr.ib(default=None)
+    # For btrfs, a list of {'name', 'mount', 'options'} dicts describing
+    # the subvolumes to create and mount. Not passed on to curtin.
+    subvolumes = attr.ib(default=None)
 
     _mount = attributes.backlink()
 
@@ -1345,6 +1885,76 @@ class Mount:
         return True
 
 
+# ZFS pools and datasets, with the pool keys ZPool renders, need a
+# curtin that has schemas for them.
+ZFS_SUPPORTED = hasattr(curtin_schemas, 'ZFS') and {
+    'pool_properties', 'fs_properties', 'default_features',
+    'encryption_style', 'keyfile',
+    } <= set(getattr(curtin_schemas, 'ZPOOL', {}).get('properties', {}))
+
+
+@fsobj("zpool")
+class ZPool:
+    vdevs = attributes.reflist(backlink="_constructed_device")
+    pool = attr.ib()
+    mountpoint = attr.ib()
+
+    _zfses = attributes.backlink(default=attr.Factory(list))
+
+    pool_properties = attr.ib(default=None)
+    fs_properties = attr.ib(default=None)
+    default_features = attr.ib(default=True)
+    encryption_style = attr.ib(default=None)
+    key = attr.ib(metadata={'redact': True}, default=None)
+
+    def serialize_key(self):
+        if self.key and not self.keyfile:
+            return {'keyfile': self._m.write_key_file('zpool-key-', self.key)}
+        else:
+            return {}
+
+    keyfile = attr.ib(default=None)
+    preserve = attr.ib(default=False)
+
+    _constructed_device = attributes.backlink()
+
+    def constructed_device(self):
+        return self._constructed_device
+
+    def zfses(self):
+        return self._zfses
+
+    @property
+    def name(self):
+        return self.pool
+
+    label = name
+
+    def desc(self):
+        return _("ZFS pool")
+
+    @property
+    def size(self):
+        return sum(v.size for v in self.vdevs)
+
+    # What is a device that makes up this device referred to as?
+    component_name = "vdev"
+
+
+@fsobj("zfs")
+class ZFS:
+    pool = attributes.ref(backlink="_zfses")  # ZPool
+    volume = attr.ib()
+    properties = attr.ib(default=None)
+    preserve = attr.ib(default=False)
+
+    @property
+    def mountpoint(self):
+        if self.properties is None:
+            return None
+        return self.properties.get('mountpoint')
+
+
 def align_up(size, block_size=1 << 20):
     return (size + block_size - 1) & ~(block_size - 1)
 
@@ -1383,6 +1993,17 @@ class FilesystemModel(object):
             bootloader = self._probe_bootloader()
         self.bootloader = bootloader
         self._probe_data = None
+        # Filesystems from OPTIONAL_FSTYPES that the running kernel
+        # supports.
+        self.optional_fstypes = []
+        self.swap_policy = SwapConfig()
+        # If set, added as a second key to every encrypted volume.
+        self.recovery_key = None
+        # The files render has written keys to, see write_key_file.
+        self._key_files = []
+        # Counts the times the probe data has been loaded, so that a
+        # config built from older probe data can be refused.
+        self.generation = 0
         self.reset()
 
     def reset(self):
@@ -1399,18 +2020,27 @@ class FilesystemModel(object):
             self._actions = []
         self.swap = None
         self.grub = None
+        # The partition guided storage created to hold a copy of the
+        # installer media, if it did.
+        self.reset_partition = None
 
     def load_server_data(self, status):
         log.debug('load_server_data %s', status)
         self._all_ids = set()
         self._orig_config = status.orig_config
+        self.generation = status.generation
         self._probe_data = {
             'blockdev': status.blockdev,
             'dasd': status.dasd,
+            'wipe_modes': status.wipe_modes,
             }
         self._actions = self._actions_from_config(
             status.config,
             status.blockdev)
+        self.reset_partition = None
+        if status.reset_partition is not None:
+            self.reset_partition = self._one(
+                type='partition', id=status.reset_partition)
         self.swap = None
         self.grub = None
 
@@ -1552,6 +2182,10 @@ class FilesystemModel(object):
                 # Ignore any action we do not know how to process yet
                 # (e.g. bcache)
                 continue
+            if is_probe_data and action['type'] in ('zpool', 'zfs'):
+                # There is no way to remove an existing zpool in the UI
+                # yet, so treat the members of one as unused.
+                continue
             kw = {}
             for f in attr.fields(c):
                 n = f.name
@@ -1675,19 +2309,165 @@ class FilesystemModel(object):
 
         return r
 
+    def _storage_version(self):
+        for part in self._all(type='partition'):
+            for key in STORAGE_V2_PARTITION_KEYS:
+                if getattr(part, key) is not None:
+                    return 2
+        return 1
+
     def render(self):
         config = {
             'storage': {
-                'version': 1,
+                'version': self._storage_version(),
                 'config': self._render_actions(),
                 },
             }
-        if self.swap is not None:
-            config['swap'] = self.swap
+        self._render_secure_wipe(config)
+        self._render_btrfs_subvolumes(config)
+        self._render_swap(config)
         if self.grub is not None:
             config['grub'] = self.grub
+        if self.recovery_key is not None:
+            self._render_recovery_key(config)
         return config
 
+    def write_key_file(self, prefix, key):
+        """Write key to a file only root can read and return its path.
+
+        The rendered config refers to keys by path so that they do not end
+        up in the curtin config or logs. Call remove_key_files once curtin
+        is done with them.
+        """
+        f = tempfile.NamedTemporaryFile(prefix=prefix, mode='w', delete=False)
+        self._key_files.append(f.name)
+        with f:
+            f.write(key)
+        return f.name
+
+    def remove_key_files(self):
+        for path in self._key_files:
+            try:
+                os.unlink(path)
+            except FileNotFoundError:
+                pass
+        self._key_files = []
+
+    def _render_recovery_key(self, config):
+        dm_crypts = [
+            action for action in config['storage']['config']
+            if action['type'] == 'dm_crypt' and 'keyfile' in action
+            ]
+        if not dm_crypts:
+            return
+        keyfile = self.write_key_file('luks-recovery-key-', self.recovery_key)
+        args = []
+        for action in dm_crypts:
+            args.extend([
+                action.get('dm_name') or action['id'],
+                action['keyfile'],
+                keyfile,
+                ])
+        commands = config.setdefault('curthooks_commands', {})
+        commands['002-add-recovery-key'] = [
+            'sh', '-c', ADD_RECOVERY_KEY_SCRIPT, '--',
+            ] + args
+
+    def _render_secure_wipe(self, config):
+        commands = {}
+        for action in config['storage']['config']:
+            mode = action.pop('secure_wipe', None)
+            if mode is None:
+                continue
+            if action.get('preserve'):
+                log.warning(
+                    "not wiping %s as partitions on it are kept",
+                    action['id'])
+                continue
+            # curtin still needs to clear what it can see on the disk
+            # after the erase.
+            action['wipe'] = 'superblock-recursive'
+            key = '001-secure-wipe-{}'.format(action['id'])
+            cmd = list(SECURE_WIPE_COMMANDS[mode])
+            if mode == 'ata-secure-erase':
+                # Not a fixed password that anyone could use to unlock a
+                # drive left locked by a failed erase.
+                cmd.append(secrets.token_hex(16))
+            commands[key] = cmd + [action['path']]
+        if commands:
+            config['early_commands'] = commands
+
+    def _render_btrfs_subvolumes(self, config):
+        actions = config['storage']['config']
+        mounts = {a['device']: a for a in actions if a['type'] == 'mount'}
+        commands = {}
+        for action in actions:
+            subvolumes = action.pop('subvolumes', None)
+            if not subvolumes:
+                continue
+            mount = mounts.get(action['id'])
+            if mount is None:
+                log.warning(
+                    "not creating subvolumes on unmounted %s", action['id'])
+                continue
+            args = [mount['path']]
+            for subvolume in sorted(subvolumes, key=lambda s: s['mount']):
+                args.extend([
+                    subvolume['name'],
+                    subvolume['mount'],
+                    subvolume.get('options', ''),
+                    ])
+            # After curtin's "builtin" block-meta run, which has made
+            # and mounted the filesystem.
+            key = 'subvolumes-{}'.format(action['id'])
+            commands[key] = [
+                'sh', '-c', BTRFS_SUBVOLUMES_SCRIPT, '--',
+                ] + args
+        if commands:
+            config['partitioning_commands'] = commands
+
+    def resume_filesystem(self):
+        swaps = [
+            fs for fs in self._all(type='format', fstype='swap')
+            if fs.mount() is not None
+            ]
+        if not swaps:
+            return None
+        return max(swaps, key=lambda fs: fs.volume.size)
+
+    def _render_swap(self, config):
+        kind = self.swap_policy.kind
+        if kind == SwapKind.AUTO:
+            if self.swap is not None:
+                config['swap'] = self.swap
+            return
+        if kind == SwapKind.FILE:
+            config['swap'] = {
+                'filename': '/swap.img',
+                'size': self.swap_policy.size,
+                'maxsize': self.swap_policy.size,
+                }
+            return
+        config['swap'] = {'swap': 0}
+        if kind == SwapKind.ZRAM:
+            write_files = config.setdefault('write_files', {})
+            write_files['zram_generator'] = {
+                'path': 'etc/systemd/zram-generator.conf',
+                'content': ZRAM_GENERATOR_CONF,
+                'permissions': 0o644,
+                }
+        elif kind == SwapKind.PARTITION:
+            fs = self.resume_filesystem()
+            if fs is None or fs.uuid is None:
+                log.warning("hibernation requested but no swap to use")
+                return
+            write_files = config.setdefault('write_files', {})
+            write_files['initramfs_resume'] = {
+                'path': 'etc/initramfs-tools/conf.d/resume',
+                'content': 'RESUME=UUID={}\n'.format(fs.uuid),
+                'permissions': 0o644,
+                }
+
     def load_probe_data(self, probe_data):
         for devname, devdata in probe_data['blockdev'].items():
             if int(devdata['attrs']['size']) != 0:
@@ -1708,6 +2488,7 @@ class FilesystemModel(object):
                 "computing size on unformatted dasd from %s as %s", data, size)
             devdata['attrs']['size'] = str(size)
         self._probe_data = probe_data
+        self.generation += 1
         self.reset()
 
     def _matcher(self, type, kw):
@@ -1786,6 +2567,8 @@ class FilesystemModel(object):
         if part._fs or part._constructed_device:
             raise Exception("can only remove empty partition")
         self._remove(part)
+        if part is self.reset_partition:
+            self.reset_partition = None
         if len(part.device._partitions) == 0:
             part.device.ptable = None
 
@@ -1814,26 +2597,134 @@ class FilesystemModel(object):
             raise Exception("can only remove empty VG")
         self._remove(vg)
 
-    def add_logical_volume(self, vg, name, size):
-        lv = LVM_LogicalVolume(m=self, volgroup=vg, name=name, size=size)
+    def add_logical_volume(self, vg, name, size, thin_pool=None, pool=None):
+        if pool is not None and not pool.thin_pool:
+            raise Exception("{} is not a thin pool".format(pool.label))
+        lv = LVM_LogicalVolume(
+            m=self, volgroup=vg, name=name, size=size, thin_pool=thin_pool,
+            pool=pool)
         self._actions.append(lv)
         return lv
 
+    def overprovisioned_thin_pools(self):
+        return [
+            lv for lv in self._all(type='lvm_partition') if lv.overprovisioned
+            ]
+
+    def check_thin_lvm(self, actions=None):
+        if THIN_LVM_SUPPORTED:
+            return
+        if actions is None:
+            actions = self._actions
+        for lv in actions:
+            if lv.type != 'lvm_partition':
+                continue
+            if lv.thin_pool or lv.pool is not None:
+                raise Exception(
+                    "{} is a thin pool or volume, which curtin cannot "
+                    "create".format(lv.name))
+
+    def check_partition_names(self, actions=None):
+        if PARTITION_NAME_SUPPORTED:
+            return
+        if actions is None:
+            actions = self._actions
+        for part in actions:
+            if part.type != 'partition':
+                continue
+            if part.partition_name is not None or \
+               part.partition_type is not None:
+                raise Exception(
+                    "{} sets a partition name or type, which curtin cannot "
+                    "do".format(part.label))
+
+    def check_integrity(self, actions=None):
+        if actions is None:
+            actions = self._actions
+        for action in actions:
+            if action.type == 'dm_integrity' and \
+               not DM_INTEGRITY_SUPPORTED:
+                raise Exception(
+                    "{} is a dm-integrity device, which curtin cannot "
+                    "create".format(action.label))
+            if action.type == 'dm_crypt' and \
+               action.integrity is not None and \
+               not LUKS_INTEGRITY_SUPPORTED:
+                raise Exception(
+                    "{} uses LUKS2 integrity, which curtin cannot "
+                    "create".format(action.volume.label))
+
     def remove_logical_volume(self, lv):
         if lv._fs:
             raise Exception("can only remove empty LV")
         self._remove(lv)
 
-    def add_dm_crypt(self, volume, key):
-        if not volume.available:
+    def add_dm_crypt(self, volume, key, integrity=None):
+        if not volume.available():
             raise Exception("{} is not available".format(volume))
-        dm_crypt = DM_Crypt(m=self, volume=volume, key=key)
+        if integrity is not None and \
+           integrity not in LUKS_INTEGRITY_ALGORITHMS:
+            raise Exception(
+                "unknown integrity algorithm {!r}".format(integrity))
+        if integrity is not None and not LUKS_INTEGRITY_SUPPORTED:
+            raise Exception("curtin cannot create LUKS2 integrity")
+        dm_crypt = DM_Crypt(
+            m=self, volume=volume, key=key, integrity=integrity)
         self._actions.append(dm_crypt)
         return dm_crypt
 
     def remove_dm_crypt(self, dm_crypt):
         self._remove(dm_crypt)
 
+    def add_dm_integrity(self, volume, algorithm='crc32c'):
+        if not DM_INTEGRITY_SUPPORTED:
+            raise Exception("curtin cannot create dm-integrity devices")
+        if not volume.available():
+            raise Exception("{} is not available".format(volume))
+        if algorithm not in INTEGRITY_ALGORITHMS:
+            raise Exception(
+                "unknown integrity algorithm {!r}".format(algorithm))
+        dm_integrity = DM_Integrity(m=self, volume=volume, algorithm=algorithm)
+        self._actions.append(dm_integrity)
+        return dm_integrity
+
+    def remove_dm_integrity(self, dm_integrity):
+        if dm_integrity._fs or dm_integrity._constructed_device:
+            raise Exception("can only remove unused integrity device")
+        self._remove(dm_integrity)
+
+    def check_zfs(self, actions=None):
+        if ZFS_SUPPORTED:
+            return
+        if actions is None:
+            actions = self._actions
+        for action in actions:
+            if action.type in ('zpool', 'zfs'):
+                raise Exception(
+                    "{} is a ZFS pool or dataset, which curtin cannot "
+                    "create".format(action.id))
+
+    def add_zpool(self, vdevs, pool, mountpoint, **kw):
+        if not ZFS_SUPPORTED:
+            raise Exception("curtin cannot create ZFS pools")
+        zpool = ZPool(
+            m=self, vdevs=vdevs, pool=pool, mountpoint=mountpoint, **kw)
+        self._actions.append(zpool)
+        return zpool
+
+    def remove_zpool(self, zpool):
+        if zpool._zfses:
+            raise Exception("can only remove empty zpool")
+        self._remove(zpool)
+
+    def add_zfs(self, pool, volume, properties=None):
+        zfs = ZFS(m=self, pool=pool, volume=volume, properties=properties)
+        self._actions.append(zfs)
+        return zfs
+
+    def remove_zfs(self, zfs):
+        self._remove(zfs)
+
     def add_filesystem(self, volume, fstype, preserve=False):
         log.debug("adding %s to %s", fstype, volume)
         if not volume.available:
@@ -1858,8 +2749,8 @@ class FilesystemModel(object):
             raise Exception("%s is already mounted", fs)
         m = Mount(m=self, device=fs, path=path)
         self._actions.append(m)
-        # Adding a swap partition or mounting btrfs at / suppresses
-        # the swapfile.
+        # Adding a swap partition or mounting btrfs or bcachefs at /
+        # suppresses the swapfile.
         if not self._should_add_swapfile():
             self.swap = {'swap': 0}
         return m
@@ -1892,8 +2783,30 @@ class FilesystemModel(object):
     def _mount_for_path(self, path):
         return self._one(type='mount', path=path)
 
+    def _zfs_for_path(self, path):
+        for zfs in self._all(type='zfs'):
+            if zfs.mountpoint == path:
+                return zfs
+        return None
+
     def is_root_mounted(self):
-        return self._mount_for_path('/') is not None
+        if self._mount_for_path('/') is not None:
+            return True
+        return self._zfs_for_path('/') is not None
+
+    def needed_packages(self):
+        packages = set()
+        for fs in self._all(type='format'):
+            if fs.fstype in OPTIONAL_FSTYPES:
+                packages.add(OPTIONAL_FSTYPES[fs.fstype])
+        return sorted(packages)
+
+    def optional_packages(self):
+        # These are not on the installer media. Without the zram
+        # generator, the zram swap policy ends up with no swap at all.
+        if self.swap_policy.kind == SwapKind.ZRAM:
+            return ['systemd-zram-generator']
+        return []
 
     def can_install(self):
         return (self.is_root_mounted()
@@ -1901,7 +2814,11 @@ class FilesystemModel(object):
 
     def _should_add_swapfile(self):
         mount = self._mount_for_path('/')
-        if mount is not None and mount.device.fstype == 'btrfs':
+        # bcachefs does not support swapfiles at all.
+        if mount is not None and \
+           mount.device.fstype in ('btrfs', 'bcachefs'):
+            return False
+        if self._zfs_for_path('/') is not None:
             return False
         for swap in self._all(type='format', fstype='swap'):
             if swap.mount():
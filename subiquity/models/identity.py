@@ -35,6 +35,12 @@ class IdentityModel(object):
     def __init__(self):
         self._user = None
         self._hostname = None
+        # A subiquity.common.types.ExistingUser from an install whose
+        # /home is being kept, if the user chose to re-create it.
+        self.existing_user = None
+        # subiquity.common.types.IdentityUsers to create after the user
+        # above.
+        self.extra_users = []
 
     def add_user(self, identity_data):
         self._hostname = identity_data.hostname
@@ -54,5 +60,13 @@ class IdentityModel(object):
     def user(self):
         return self._user
 
+    def existing_uid(self):
+        """The uid to give the user so that it owns its old home."""
+        if self._user is None or self.existing_user is None:
+            return None
+        if self.existing_user.username != self._user.username:
+            return None
+        return self.existing_user.uid
+
     def __repr__(self):
         return "<LocalUser: {} {}>".format(self.user, self.hostname)
@@ -0,0 +1,55 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+log = logging.getLogger('subiquity.models.iscsi')
+
+
+class ISCSIModel(object):
+    """Model representing the iSCSI sessions the installer has set up."""
+
+    def __init__(self):
+        # A list of subiquity.common.types.ISCSILogin.
+        self.logins = []
+
+    def needed_packages(self):
+        if self.logins:
+            return ['open-iscsi']
+        return []
+
+    def render(self):
+        if not self.logins:
+            return {}
+        # The node database written by iscsiadm during the install
+        # records the portals, credentials and node.startup=automatic,
+        # and the initramfs needs all of it to find the root
+        # filesystem, so copy it across before curthooks runs
+        # update-initramfs.
+        return {
+            'curthooks_commands': {
+                '002-copy-iscsi-config': [
+                    'sh', '-c',
+                    'cp -a /etc/iscsi/. "$TARGET_MOUNT_POINT/etc/iscsi/"',
+                    ],
+                },
+            'write_files': {
+                'iscsi_initramfs': {
+                    'path': 'etc/iscsi/iscsi.initramfs',
+                    'content': 'ISCSI_AUTO=true\n',
+                    'permissions': 0o644,
+                    },
+                },
+            }
@@ -0,0 +1,65 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+log = logging.getLogger('subiquity.models.kdump')
+
+# How much memory to reserve for the crash kernel, as (minimum RAM,
+# reservation) in MiB. These are the sizes the crashkernel= ranges in
+# newer kdump-tools packages pick.
+CRASHKERNEL_SIZES = [
+    (128 << 10, 4096),
+    (64 << 10, 2048),
+    (32 << 10, 1024),
+    (4 << 10, 512),
+    (2 << 10, 320),
+    ]
+
+
+def crashkernel_size(memory):
+    """Return the MiB to reserve for the crash kernel on a machine with
+    memory bytes of RAM, or None if there is too little RAM to spare
+    any."""
+    memory_mib = memory >> 20
+    for minimum, size in CRASHKERNEL_SIZES:
+        # MemTotal leaves out what the firmware and kernel keep for
+        # themselves, so allow for a machine with (say) 4GiB of RAM
+        # reporting a little less.
+        if memory_mib >= minimum * 15 // 16:
+            return size
+    return None
+
+
+class KdumpModel:
+
+    def __init__(self):
+        self.enabled = False
+        self.memory = None
+        # Set to override the size computed from the amount of RAM.
+        self.crashkernel_override = None
+
+    def __repr__(self):
+        return "<Kdump: {}>".format(self.enabled)
+
+    def crashkernel(self):
+        if self.crashkernel_override is not None:
+            return self.crashkernel_override
+        if self.memory is None:
+            return None
+        size = crashkernel_size(self.memory)
+        if size is None:
+            return None
+        return '{}M'.format(size)
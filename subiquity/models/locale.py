@@ -15,6 +15,8 @@
 
 import logging
 
+from subiquity.common.console import console_can_show, FBTERM_PACKAGES
+
 log = logging.getLogger('subiquity.models.locale')
 
 
@@ -29,5 +31,18 @@ class LocaleModel(object):
     def switch_language(self, code):
         self.selected_language = code
 
+    def console_supported(self):
+        """Whether the linux console can show the selected language."""
+        if self.selected_language is None:
+            return True
+        return console_can_show(self.selected_language)
+
+    def optional_packages(self):
+        # Not on the installer media, see
+        # InstallController.install_optional_package.
+        if self.console_supported():
+            return []
+        return FBTERM_PACKAGES
+
     def __repr__(self):
         return "<Selected: {}>".format(self.selected_language)
@@ -13,12 +13,21 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+import copy
 import logging
+import os
 
-from subiquitycore.models.network import NetworkModel
+from subiquitycore.models.network import (
+    NetworkModel,
+    networkd_dropins,
+    )
 
 log = logging.getLogger('subiquity.models.network')
 
+# Where the certificates and keys the 802.1X settings of a wifi network
+# refer to are copied to in the target system.
+WLAN_CREDENTIALS_DIR = 'etc/netplan/credentials'
+
 
 class NetworkModel(NetworkModel):
 
@@ -32,17 +41,56 @@ class NetworkModel(NetworkModel):
         else:
             return super().render_config()
 
+    def _copy_wlan_credentials(self, config, write_files):
+        # The files are named for where they are used rather than
+        # copied to their paths in the live session, which mean
+        # nothing in the target.
+        config = copy.deepcopy(config)
+        wifis = config.get('network', {}).get('wifis', {})
+        for dev_name, wifi in wifis.items():
+            aps = wifi.get('access-points', {})
+            for i, ap in enumerate(aps.values()):
+                auth = ap.get('auth', {})
+                for key in 'ca-certificate', 'client-certificate', \
+                        'client-key':
+                    path = auth.get(key)
+                    if path is None:
+                        continue
+                    try:
+                        with open(path) as fp:
+                            content = fp.read()
+                    except OSError:
+                        log.exception("could not read %s", path)
+                        continue
+                    name = '{}-{}-{}{}'.format(
+                        dev_name, i, key, os.path.splitext(path)[1])
+                    target_path = os.path.join(WLAN_CREDENTIALS_DIR, name)
+                    write_files['wlan_' + name] = {
+                        'path': target_path,
+                        'content': content,
+                        'permissions': 0o600,
+                        }
+                    auth[key] = '/' + target_path
+        return config
+
     def render(self):
-        return {
-            'write_files': {
-                'etc_netplan_installer': {
-                    'path': 'etc/netplan/00-installer-config.yaml',
-                    'content': self.stringify_config(self.render_config()),
-                    },
-                'nonet': {
-                    'path': ('etc/cloud/cloud.cfg.d/'
-                             'subiquity-disable-cloudinit-networking.cfg'),
-                    'content': 'network: {config: disabled}\n',
-                    },
+        write_files = {
+            'nonet': {
+                'path': ('etc/cloud/cloud.cfg.d/'
+                         'subiquity-disable-cloudinit-networking.cfg'),
+                'content': 'network: {config: disabled}\n',
                 },
             }
+        config = self._copy_wlan_credentials(
+            self.render_config(), write_files)
+        write_files['etc_netplan_installer'] = {
+            'path': 'etc/netplan/00-installer-config.yaml',
+            'content': self.stringify_config(config),
+            }
+        for path, content in networkd_dropins(config, self.project).items():
+            write_files['networkd_' + os.path.basename(
+                os.path.dirname(path))] = {
+                'path': path,
+                'content': content,
+                }
+        return {'write_files': write_files}
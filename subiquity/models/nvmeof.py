@@ -0,0 +1,131 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import json
+import logging
+import sys
+
+log = logging.getLogger('subiquity.models.nvmeof')
+
+
+# For a system whose root filesystem is on an NVMe over Fabrics
+# namespace: an initramfs-tools hook to put nvme-cli and the fabric
+# configuration written to /etc/nvme into the initramfs and a script to
+# connect to the subsystems before the root filesystem is looked for.
+# nvme-cli takes the subsystems from /etc/nvme/config.json, which uses
+# the same structure it prints for the firmware's NBFT.
+NVMEOF_INITRAMFS_HOOK = """\
+#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case "$1" in
+    prereqs) prereqs; exit 0;;
+esac
+. /usr/share/initramfs-tools/hook-functions
+manual_add_modules nvme-tcp
+copy_exec /usr/sbin/nvme /usr/sbin
+mkdir -p "$DESTDIR/etc/nvme"
+cp -a /etc/nvme/. "$DESTDIR/etc/nvme/"
+"""
+
+NVMEOF_INITRAMFS_SCRIPT = """\
+#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case "$1" in
+    prereqs) prereqs; exit 0;;
+esac
+. /scripts/functions
+configure_networking
+modprobe nvme-tcp
+nvme connect-all
+"""
+
+
+class NVMeoFModel(object):
+    """Model representing the NVMe over Fabrics subsystems the installer
+    has connected to."""
+
+    def __init__(self):
+        # A list of subiquity.common.types.NVMeoFTarget.
+        self.targets = []
+        # The host identity used to connect to the subsystems, which the
+        # installed system must keep using.
+        self.host_nqn = None
+        self.host_id = None
+
+    def _config_json(self):
+        subsystems = []
+        for target in self.targets:
+            subsystems.append({
+                'nqn': target.subnqn,
+                'ports': [{
+                    'transport': target.transport,
+                    'traddr': target.address,
+                    'trsvcid': str(target.port),
+                    }],
+                })
+        host = {
+            'hostnqn': self.host_nqn,
+            'subsystems': subsystems,
+            }
+        if self.host_id:
+            host['hostid'] = self.host_id
+        return json.dumps([host], indent=2) + '\n'
+
+    def render(self):
+        if not self.targets:
+            return {}
+        write_files = {
+            'nvme_config': {
+                'path': 'etc/nvme/config.json',
+                'content': self._config_json(),
+                'permissions': 0o644,
+                },
+            'nvmeof_initramfs_hook': {
+                'path': 'etc/initramfs-tools/hooks/nvmeof',
+                'content': NVMEOF_INITRAMFS_HOOK,
+                'permissions': 0o755,
+                },
+            'nvmeof_initramfs_script': {
+                'path': 'etc/initramfs-tools/scripts/local-top/nvmeof',
+                'content': NVMEOF_INITRAMFS_SCRIPT,
+                'permissions': 0o755,
+                },
+            }
+        if self.host_nqn:
+            write_files['nvme_hostnqn'] = {
+                'path': 'etc/nvme/hostnqn',
+                'content': self.host_nqn + '\n',
+                'permissions': 0o644,
+                }
+        if self.host_id:
+            write_files['nvme_hostid'] = {
+                'path': 'etc/nvme/hostid',
+                'content': self.host_id + '\n',
+                'permissions': 0o644,
+                }
+        return {
+            # The initramfs hook needs nvme-cli to be installed in the
+            # target before curthooks builds the initramfs.
+            'curthooks_commands': {
+                '002-install-nvme-cli': [
+                    'sh', '-c',
+                    'exec "$@" --target="$TARGET_MOUNT_POINT" nvme-cli',
+                    '--', sys.executable, '-m', 'curtin', 'system-install',
+                    ],
+                },
+            'write_files': write_files,
+            }
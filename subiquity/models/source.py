@@ -0,0 +1,44 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+log = logging.getLogger('subiquity.models.source')
+
+
+class SourceModel:
+    """The filesystem image that is copied to the target.
+
+    By default this is the squashfs mounted from the install media but
+    it can be downloaded from somewhere instead.
+    """
+
+    def __init__(self):
+        self.url = None
+        self.sha256 = None
+        # Where the downloaded image is, once it has been downloaded.
+        self.path = None
+
+    def __repr__(self):
+        return "<Source: {}>".format(self.url or "install media")
+
+    def render(self):
+        if self.path is None:
+            return {}
+        return {
+            'sources': {
+                'ubuntu00': {'type': 'fsimage', 'uri': self.path},
+                },
+            }
@@ -0,0 +1,32 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+log = logging.getLogger('subiquity.models.storeproxy')
+
+
+class StoreProxyModel:
+    """The snap store proxy the target's snapd should use."""
+
+    def __init__(self):
+        self.url = ''
+        self.store_id = ''
+        # The assertions served by the proxy, set once snapd in the
+        # live session has accepted them.
+        self.assertions = ''
+
+    def __repr__(self):
+        return "<StoreProxy: {} {}>".format(self.url, self.store_id)
@@ -30,13 +30,20 @@ from subiquitycore.utils import run_command
 
 from .filesystem import FilesystemModel
 from .identity import IdentityModel
+from .inventory import InventoryModel
+from .iscsi import ISCSIModel
+from .kdump import KdumpModel
 from .keyboard import KeyboardModel
 from .locale import LocaleModel
 from .mirror import MirrorModel
 from .network import NetworkModel
+from .nvmeof import NVMeoFModel
+from .offline import OfflineModel
 from .proxy import ProxyModel
 from .snaplist import SnapListModel
+from .source import SourceModel
 from .ssh import SSHModel
+from .storeproxy import StoreProxyModel
 from .updates import UpdatesModel
 
 
@@ -69,10 +76,13 @@ ff02::2 ip6-allrouters
 INSTALL_MODEL_NAMES = [
     "debconf_selections",
     "filesystem",
+    "iscsi",
     "keyboard",
     "mirror",
     "network",
+    "nvmeof",
     "proxy",
+    "source",
     ]
 
 # Models that contribute to the cloud-init config (and other postinstall steps)
@@ -110,14 +120,21 @@ class SubiquityModel:
         self.debconf_selections = DebconfSelectionsModel()
         self.filesystem = FilesystemModel()
         self.identity = IdentityModel()
+        self.inventory = InventoryModel()
+        self.iscsi = ISCSIModel()
+        self.kdump = KdumpModel()
         self.keyboard = KeyboardModel(self.root)
         self.locale = LocaleModel()
         self.mirror = MirrorModel()
         self.network = NetworkModel()
+        self.nvmeof = NVMeoFModel()
+        self.offline = OfflineModel()
         self.packages = []
         self.proxy = ProxyModel()
         self.snaplist = SnapListModel()
+        self.source = SourceModel()
         self.ssh = SSHModel()
+        self.store_proxy = StoreProxyModel()
         self.updates = UpdatesModel()
         self.userdata = {}
 
@@ -171,6 +188,28 @@ class SubiquityModel:
             groups.add(line.split(':')[0])
         return groups
 
+    def _extra_users_config(self):
+        users = []
+        for user in self.identity.extra_users:
+            groups = list(user.groups)
+            if user.sudo and 'sudo' not in groups:
+                groups.append('sudo')
+            user_info = {
+                'name': user.username,
+                'gecos': user.realname or user.username,
+                'shell': user.shell,
+                'groups': groups,
+                }
+            if user.crypted_password:
+                user_info['passwd'] = user.crypted_password
+                user_info['lock_passwd'] = False
+            else:
+                user_info['lock_passwd'] = True
+            if user.ssh_authorized_keys:
+                user_info['ssh_authorized_keys'] = user.ssh_authorized_keys
+            users.append(user_info)
+        return users
+
     def _cloud_init_config(self):
         locale = self.locale.selected_language
         if '.' not in locale and '_' in locale:
@@ -204,25 +243,49 @@ class SubiquityModel:
                 'groups': groups,
                 'lock_passwd': False,
                 }
+            uid = self.identity.existing_uid()
+            if uid is not None:
+                user_info['uid'] = uid
             if self.ssh.authorized_keys:
                 user_info['ssh_authorized_keys'] = self.ssh.authorized_keys
             config['users'] = [user_info]
         else:
             if self.ssh.authorized_keys:
                 config['ssh_authorized_keys'] = self.ssh.authorized_keys
+        if self.identity.extra_users:
+            extra_users = self._extra_users_config()
+            # The users list replaces the one in user-data (or
+            # cloud-init's default of just the default user) so keep
+            # what that would have created.
+            users = config.setdefault(
+                'users', list(self.userdata.get('users', ['default'])))
+            users.extend(extra_users)
+            new_groups = set()
+            for user_info in extra_users:
+                new_groups.update(user_info['groups'])
+            new_groups -= self.get_target_groups()
+            if new_groups:
+                # cloud-init creates these before it creates the users.
+                config['groups'] = list(
+                    self.userdata.get('groups', [])) + sorted(new_groups)
         if self.ssh.install_server:
             config['ssh_pwauth'] = self.ssh.pwauth
-        if self.snaplist.selections:
-            cmds = []
-            for selection in self.snaplist.selections:
-                cmd = ['snap', 'install', '--channel=' + selection.channel]
-                if selection.is_classic:
-                    cmd.append('--classic')
-                cmd.append(selection.name)
-                cmds.append(' '.join(cmd))
-            config['snap'] = {
-                'commands': cmds,
-                }
+        snap_config = {}
+        cmds = []
+        if self.store_proxy.assertions:
+            # cloud-init acks the assertions before running the commands.
+            snap_config['assertions'] = [self.store_proxy.assertions]
+            cmds.append(
+                'snap set system proxy.store=' + self.store_proxy.store_id)
+        for selection in self.snaplist.selections:
+            cmd = ['snap', 'install', '--channel=' + selection.channel]
+            if selection.is_classic:
+                cmd.append('--classic')
+            cmd.append(selection.name)
+            cmds.append(' '.join(cmd))
+        if cmds:
+            snap_config['commands'] = cmds
+            config['snap'] = snap_config
         userdata = copy.deepcopy(self.userdata)
         merge_config(userdata, config)
         return userdata
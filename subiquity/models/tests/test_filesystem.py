@@ -13,20 +13,32 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+import os
 import unittest
+from unittest import mock
 
 import attr
 
+from subiquity.common.types import (
+    SwapConfig,
+    SwapKind,
+    )
 from subiquity.models.filesystem import (
     Bootloader,
     dehumanize_size,
     DeviceAction,
     Disk,
     FilesystemModel,
+    get_hibernation_swap_size,
     get_raid_size,
+    get_thin_pool_metadata_size,
     humanize_size,
+    make_recovery_key,
+    parse_btrfs_subvolumes,
+    parse_gpt_partition_type,
     Partition,
     align_down,
+    asdict,
     LVM_CHUNK_SIZE,
     )
 
@@ -124,6 +136,21 @@ class TestRoundRaidSize(unittest.TestCase):
             get_raid_size("raid1", [FakeDev(500107862016)]*2),
             499972571136)
 
+    def test_raid10(self):
+        devs = [FakeDev(10 << 30, id=str(i)) for i in range(5)]
+        raid1_size = get_raid_size("raid1", devs[:2])
+        self.assertEqual(get_raid_size("raid10", devs[:4]), raid1_size * 2)
+        # Odd numbers of devices are fine with the default layout.
+        self.assertEqual(
+            get_raid_size("raid10", devs), raid1_size * 5 // 2)
+
+    def test_raid_spares_not_counted(self):
+        model = make_model()
+        active = {make_disk(model) for i in range(4)}
+        spares = {make_disk(model)}
+        raid = model.add_raid('md0', 'raid10', active, spares)
+        self.assertEqual(raid.size, get_raid_size('raid10', active))
+
 
 @attr.s
 class FakeStorageInfo:
@@ -851,6 +878,376 @@ class TestFilesystemModel(unittest.TestCase):
         self.assertFalse(not_dos_esp.is_esp)
         self.assertTrue(dos_esp.is_esp)
 
+    @mock.patch('subiquity.models.filesystem.ZFS_SUPPORTED', True)
+    def test_zpool_usage_labels(self):
+        model, part = make_model_and_partition()
+        model.add_zpool([part], 'rpool', '/')
+        self.assertEqual(part.usage_labels(), ["vdev of ZFS pool rpool"])
+        self.assertEqual(
+            part.action_possible(DeviceAction.DELETE),
+            (False, "Cannot delete partition 1 of serial0 as it is part "
+             "of the ZFS pool rpool."))
+
+    @mock.patch('subiquity.models.filesystem.ZFS_SUPPORTED', True)
+    def test_zfs_root_mounted(self):
+        model, part = make_model_and_partition()
+        zpool = model.add_zpool([part], 'rpool', '/')
+        model.add_zfs(zpool, 'ROOT', {'canmount': 'off'})
+        self.assertFalse(model.is_root_mounted())
+        model.add_zfs(zpool, 'ROOT/ubuntu', {'mountpoint': '/'})
+        self.assertTrue(model.is_root_mounted())
+        self.assertFalse(model._should_add_swapfile())
+
+    @mock.patch('subiquity.models.filesystem.ZFS_SUPPORTED', True)
+    def test_zpool_render(self):
+        model, part = make_model_and_partition()
+        zpool = model.add_zpool(
+            [part], 'rpool', '/', key='passw0rd',
+            encryption_style='luks_keystore')
+        zfs = model.add_zfs(zpool, 'ROOT/ubuntu', {'mountpoint': '/'})
+        actions = model._render_actions()
+        self.assertEqual(
+            [a['id'] for a in actions],
+            [part.device.id, part.id, zpool.id, zfs.id])
+        zpool_action = actions[2]
+        self.assertEqual(zpool_action['vdevs'], [part.id])
+        self.assertNotIn('key', zpool_action)
+        with open(zpool_action['keyfile']) as fp:
+            self.assertEqual(fp.read(), 'passw0rd')
+        model.remove_key_files()
+        self.assertFalse(os.path.exists(zpool_action['keyfile']))
+
+    @mock.patch('subiquity.models.filesystem.ZFS_SUPPORTED', False)
+    def test_zfs_unsupported(self):
+        model, part = make_model_and_partition()
+        with self.assertRaises(Exception):
+            model.add_zpool([part], 'rpool', '/')
+        model.check_zfs()
+        with mock.patch('subiquity.models.filesystem.ZFS_SUPPORTED', True):
+            model.add_zpool([part], 'rpool', '/')
+        with self.assertRaises(Exception):
+            model.check_zfs()
+
+    def test_bcachefs_root(self):
+        model, part = make_model_and_partition()
+        self.assertEqual(model.needed_packages(), [])
+        fs = model.add_filesystem(part, 'bcachefs')
+        model.add_mount(fs, '/')
+        self.assertEqual(model.needed_packages(), ['bcachefs-tools'])
+        self.assertFalse(model._should_add_swapfile())
+
+    def test_secure_wipe_modes(self):
+        model, disk = make_model_and_disk()
+        self.assertEqual(list(disk.secure_wipe_modes()), ['zero'])
+        model._probe_data = {
+            'wipe_modes': {disk.path: {'discard': 10}},
+            }
+        self.assertEqual(
+            sorted(disk.secure_wipe_modes()), ['discard', 'zero'])
+
+    def test_render_storage_version(self):
+        model, part = make_model_and_partition()
+        self.assertEqual(model.render()['storage']['version'], 1)
+        part.resize = True
+        self.assertEqual(model.render()['storage']['version'], 2)
+
+    def test_render_secure_wipe(self):
+        model, disk = make_model_and_disk()
+        model.add_partition(disk, 1 << 30)
+        self.assertNotIn('early_commands', model.render())
+        disk.secure_wipe = 'discard'
+        config = model.render()
+        [disk_action] = [
+            a for a in config['storage']['config'] if a['type'] == 'disk']
+        self.assertNotIn('secure_wipe', disk_action)
+        self.assertEqual(disk_action['wipe'], 'superblock-recursive')
+        self.assertEqual(
+            config['early_commands'],
+            {
+                '001-secure-wipe-' + disk.id: [
+                    'blkdiscard', '--force', disk.path,
+                    ],
+            })
+        # The client sends the mode to the server in the storage config.
+        self.assertEqual(
+            [a.get('secure_wipe') for a in model._render_actions()
+             if a['type'] == 'disk'],
+            ['discard'])
+
+    def test_render_ata_secure_erase(self):
+        model, disk = make_model_and_disk()
+        disk.secure_wipe = 'ata-secure-erase'
+        key = '001-secure-wipe-' + disk.id
+        cmd1 = model.render()['early_commands'][key]
+        cmd2 = model.render()['early_commands'][key]
+        self.assertIn('--security-disable', cmd1[2])
+        self.assertEqual(cmd1[-1], disk.path)
+        self.assertEqual(len(cmd1[-2]), 32)
+        self.assertNotEqual(cmd1[-2], cmd2[-2])
+
+    def test_parse_btrfs_subvolumes(self):
+        self.assertEqual(
+            parse_btrfs_subvolumes("@:/ @home:/home:compress=zstd,noatime"),
+            [
+                {'name': '@', 'mount': '/'},
+                {'name': '@home', 'mount': '/home',
+                 'options': 'compress=zstd,noatime'},
+            ])
+        self.assertEqual(parse_btrfs_subvolumes(""), [])
+        for bad in "@", "@:home", "a/b:/x", "@:/ @:/home", "@:/ @home:/":
+            with self.subTest(text=bad):
+                with self.assertRaises(ValueError):
+                    parse_btrfs_subvolumes(bad)
+
+    def test_render_btrfs_subvolumes(self):
+        model, part = make_model_and_partition()
+        fs = model.add_filesystem(part, 'btrfs')
+        model.add_mount(fs, '/')
+        self.assertNotIn('partitioning_commands', model.render())
+        fs.subvolumes = [
+            {'name': '@home', 'mount': '/home', 'options': 'compress=zstd'},
+            {'name': '@', 'mount': '/'},
+            ]
+        config = model.render()
+        [fs_action] = [
+            a for a in config['storage']['config'] if a['type'] == 'format']
+        self.assertNotIn('subvolumes', fs_action)
+        [cmd] = config['partitioning_commands'].values()
+        self.assertEqual(
+            cmd[4:], ['/', '@', '/', '', '@home', '/home', 'compress=zstd'])
+
+    def test_parse_gpt_partition_type(self):
+        self.assertEqual(
+            parse_gpt_partition_type('XBOOTLDR'),
+            'bc13c2ff-59e6-4262-a352-b275fd6f7172')
+        self.assertEqual(
+            parse_gpt_partition_type('BC13C2FF-59E6-4262-A352-B275FD6F7172'),
+            'bc13c2ff-59e6-4262-a352-b275fd6f7172')
+        with self.assertRaises(ValueError):
+            parse_gpt_partition_type('linux-root')
+
+    def test_render_partition_type(self):
+        model, part = make_model_and_partition()
+        self.assertNotIn('partition_type', asdict(part))
+        part.partition_name = 'data'
+        part.partition_type = '0fc63daf-8483-4772-8e79-3d69d8477de4'
+        rendered = asdict(part)
+        self.assertEqual(rendered['partition_name'], 'data')
+        self.assertEqual(
+            rendered['partition_type'],
+            '0fc63daf-8483-4772-8e79-3d69d8477de4')
+        self.assertEqual(model.render()['storage']['version'], 2)
+
+    def test_check_partition_names(self):
+        model, part = make_model_and_partition()
+        with mock.patch(
+                'subiquity.models.filesystem.PARTITION_NAME_SUPPORTED', False):
+            model.check_partition_names()
+            part.partition_name = 'data'
+            with self.assertRaises(Exception):
+                model.check_partition_names()
+        with mock.patch(
+                'subiquity.models.filesystem.PARTITION_NAME_SUPPORTED', True):
+            model.check_partition_names()
+
+    def test_multipath_disk(self):
+        model = make_model()
+        disk = make_disk(model, multipath='mpatha', wwn='0x5000c500')
+        model._probe_data = {
+            'multipath': {
+                'paths': [
+                    {'device': 'sda', 'multipath': 'mpatha'},
+                    {'device': 'sdb', 'multipath': 'mpatha'},
+                    {'device': 'sdc', 'multipath': 'mpathb'},
+                    ],
+                },
+            }
+        self.assertEqual(disk.label, 'mpatha')
+        self.assertEqual(disk.multipath_paths(), 2)
+        self.assertEqual(disk.desc(), 'multipath device (2 paths)')
+
+    def test_render_swap_policy(self):
+        model = make_model()
+        model.swap_policy = SwapConfig(kind=SwapKind.FILE, size=2 << 30)
+        self.assertEqual(
+            model.render()['swap'],
+            {'filename': '/swap.img', 'size': 2 << 30, 'maxsize': 2 << 30})
+        model.swap_policy = SwapConfig(kind=SwapKind.NONE)
+        config = model.render()
+        self.assertEqual(config['swap'], {'swap': 0})
+        self.assertNotIn('write_files', config)
+        model.swap_policy = SwapConfig(kind=SwapKind.ZRAM)
+        config = model.render()
+        self.assertEqual(config['swap'], {'swap': 0})
+        self.assertIn('zram_generator', config['write_files'])
+        self.assertNotIn('systemd-zram-generator', model.needed_packages())
+        self.assertEqual(
+            model.optional_packages(), ['systemd-zram-generator'])
+
+    def test_render_swap_resume(self):
+        model, part = make_model_and_partition()
+        model.swap_policy = SwapConfig(kind=SwapKind.PARTITION)
+        self.assertNotIn('write_files', model.render())
+        fs = model.add_filesystem(part, 'swap')
+        model.add_mount(fs, '')
+        fs.uuid = 'a0d1b6b8-5176-4a64-8a7b-dac1fbd8b17f'
+        config = model.render()
+        self.assertEqual(config['swap'], {'swap': 0})
+        self.assertEqual(
+            config['write_files']['initramfs_resume']['content'],
+            'RESUME=UUID=a0d1b6b8-5176-4a64-8a7b-dac1fbd8b17f\n')
+
+    def test_recovery_key(self):
+        key = make_recovery_key()
+        groups = key.split('-')
+        self.assertEqual(len(groups), 8)
+        for group in groups:
+            self.assertEqual(len(group), 5)
+            self.assertLess(int(group), 1 << 16)
+
+    def test_render_recovery_key(self):
+        model, part = make_model_and_partition()
+        model.recovery_key = make_recovery_key()
+        self.assertNotIn('curthooks_commands', model.render())
+        dm_crypt = model.add_dm_crypt(part, key='passw0rd')
+        dm_crypt.dm_name = 'crypt-root'
+        cmd = model.render()['curthooks_commands']['002-add-recovery-key']
+        self.assertEqual(cmd[4], 'crypt-root')
+        with open(cmd[6]) as fp:
+            self.assertEqual(fp.read(), model.recovery_key)
+        model.remove_key_files()
+        self.assertFalse(os.path.exists(cmd[5]))
+        self.assertFalse(os.path.exists(cmd[6]))
+
+    def test_hibernation_swap_size(self):
+        self.assertEqual(get_hibernation_swap_size(4 << 30), 6 << 30)
+        self.assertEqual(get_hibernation_swap_size(15 << 30), 19 << 30)
+        self.assertEqual(get_hibernation_swap_size((8 << 30) - 1), 11 << 30)
+
+    def test_thin_pool(self):
+        model, vg = make_model_and_vg()
+        pool = model.add_logical_volume(
+            vg, 'pool', 10 << 30, thin_pool=True)
+        self.assertEqual(
+            vg.used, (10 << 30) + 2*get_thin_pool_metadata_size(10 << 30))
+        self.assertFalse(pool.available())
+        thin1 = model.add_logical_volume(vg, 'thin1', 8 << 30, pool=pool)
+        # Thin volumes do not use space in the volume group.
+        self.assertEqual(
+            vg.used, (10 << 30) + 2*get_thin_pool_metadata_size(10 << 30))
+        self.assertFalse(pool.overprovisioned)
+        model.add_logical_volume(vg, 'thin2', 8 << 30, pool=pool)
+        self.assertTrue(pool.overprovisioned)
+        self.assertEqual(model.overprovisioned_thin_pools(), [pool])
+        self.assertIn("overprovisioned", pool.annotations)
+        self.assertIsNot(pool._can_DELETE, True)
+        with self.assertRaises(Exception):
+            model.add_logical_volume(vg, 'thin3', 1 << 30, pool=thin1)
+
+    def test_thin_pool_render(self):
+        model, vg = make_model_and_vg()
+        pool = model.add_logical_volume(
+            vg, 'pool', 10 << 30, thin_pool=True)
+        thin = model.add_logical_volume(vg, 'thin', 20 << 30, pool=pool)
+        actions = {a['id']: a for a in model._render_actions()}
+        self.assertTrue(actions[pool.id]['thin_pool'])
+        self.assertNotIn('pool', actions[pool.id])
+        self.assertEqual(actions[thin.id]['pool'], pool.id)
+        self.assertNotIn('thin_pool', actions[thin.id])
+
+    def test_check_thin_lvm(self):
+        model, vg = make_model_and_vg()
+        model.add_logical_volume(vg, 'linear', 1 << 30)
+        model.check_thin_lvm()
+        model.add_logical_volume(vg, 'pool', 10 << 30, thin_pool=True)
+        with mock.patch(
+                'subiquity.models.filesystem.THIN_LVM_SUPPORTED', False):
+            with self.assertRaises(Exception):
+                model.check_thin_lvm()
+        with mock.patch(
+                'subiquity.models.filesystem.THIN_LVM_SUPPORTED', True):
+            model.check_thin_lvm()
+
+    @mock.patch('subiquity.models.filesystem.DM_INTEGRITY_SUPPORTED', True)
+    def test_dm_integrity(self):
+        model, part = make_model_and_partition()
+        dmi = model.add_dm_integrity(part, 'sha256')
+        self.assertIs(part.constructed_device(), dmi)
+        self.assertLess(dmi.size, part.size)
+        self.assertGreater(dmi.size, part.size * 0.99 - (128 << 20))
+        fs = model.add_filesystem(dmi, 'ext4')
+        model.add_mount(fs, '/')
+        self.assertTrue(model.is_root_mounted())
+        actions = model._render_actions()
+        self.assertEqual(
+            [a['id'] for a in actions],
+            [part.device.id, part.id, dmi.id, fs.id, fs.mount().id])
+        self.assertEqual(actions[2]['algorithm'], 'sha256')
+        with self.assertRaises(Exception):
+            model.add_dm_integrity(make_partition(model), 'hmac-sha256')
+
+    @mock.patch('subiquity.models.filesystem.LUKS_INTEGRITY_SUPPORTED', True)
+    def test_luks_integrity(self):
+        model, part = make_model_and_partition()
+        plain = model.add_dm_crypt(part, 'passw0rd')
+        part2 = make_partition(model, part.device, size=part.size)
+        authenticated = model.add_dm_crypt(part2, 'passw0rd', 'hmac-sha256')
+        self.assertLess(authenticated.size, plain.size)
+        self.assertEqual(asdict(authenticated)['integrity'], 'hmac-sha256')
+        self.assertNotIn('integrity', asdict(plain))
+
+    @mock.patch('subiquity.models.filesystem.DM_INTEGRITY_SUPPORTED', False)
+    @mock.patch('subiquity.models.filesystem.LUKS_INTEGRITY_SUPPORTED', False)
+    def test_integrity_unsupported(self):
+        model, part = make_model_and_partition()
+        with self.assertRaises(Exception):
+            model.add_dm_integrity(part, 'sha256')
+        with self.assertRaises(Exception):
+            model.add_dm_crypt(part, 'passw0rd', 'hmac-sha256')
+        self.assertIsNone(part.constructed_device())
+        dm_crypt = model.add_dm_crypt(part, 'passw0rd')
+        model.check_integrity()
+        # As read from a storage config.
+        dm_crypt.integrity = 'hmac-sha256'
+        with self.assertRaises(Exception):
+            model.check_integrity()
+
+    def test_dm_crypt_needs_available_volume(self):
+        model, part = make_model_and_partition()
+        model.add_dm_crypt(part, 'passw0rd')
+        with self.assertRaises(Exception):
+            model.add_dm_crypt(part, 'passw0rd')
+
+    def test_partition_probed_info(self):
+        model, disk = make_model_and_disk()
+        part = make_partition(model, disk, preserve=True)
+        model._probe_data = {
+            'blockdev': {
+                part._path(): {
+                    'ID_FS_TYPE': 'ntfs',
+                    'ID_PART_ENTRY_OFFSET': '2048',
+                    },
+                },
+            }
+        self.assertEqual(part.probed_fstype, 'ntfs')
+        self.assertEqual(part.probed_offset, 2048*512)
+        part.offset = 1 << 30
+        self.assertEqual(part.probed_offset, 1 << 30)
+
+    def test_render_resized_partition(self):
+        model, disk = make_model_and_disk()
+        disk.preserve = True
+        win = make_partition(model, disk, preserve=True)
+        win.size //= 2
+        win.resize = True
+        root = model.add_partition(disk, win.size)
+        root.offset = 1 << 30
+        actions = {a['id']: a for a in model._render_actions()}
+        self.assertTrue(actions[win.id]['preserve'])
+        self.assertTrue(actions[win.id]['resize'])
+        self.assertNotIn('resize', actions[root.id])
+        self.assertEqual(actions[root.id]['offset'], 1 << 30)
+
 
 def fake_up_blockdata_disk(disk, **kw):
     model = disk._m
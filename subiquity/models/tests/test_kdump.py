@@ -0,0 +1,49 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.models.kdump import (
+    crashkernel_size,
+    KdumpModel,
+    )
+
+
+GiB = 1 << 30
+
+
+class TestCrashkernelSize(unittest.TestCase):
+
+    def test_sizes(self):
+        self.assertIsNone(crashkernel_size(1 * GiB))
+        self.assertEqual(crashkernel_size(2 * GiB), 320)
+        self.assertEqual(crashkernel_size(16 * GiB), 512)
+        self.assertEqual(crashkernel_size(48 * GiB), 1024)
+        self.assertEqual(crashkernel_size(1024 * GiB), 4096)
+
+    def test_allows_for_reserved_memory(self):
+        # What MemTotal says on a VM with 4GiB of RAM.
+        self.assertEqual(crashkernel_size(4028 << 20), 512)
+
+
+class TestKdumpModel(unittest.TestCase):
+
+    def test_crashkernel(self):
+        model = KdumpModel()
+        self.assertIsNone(model.crashkernel())
+        model.memory = 8 * GiB
+        self.assertEqual(model.crashkernel(), '512M')
+        model.crashkernel_override = '1G'
+        self.assertEqual(model.crashkernel(), '1G')
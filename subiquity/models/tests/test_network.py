@@ -0,0 +1,70 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import os
+import tempfile
+import unittest
+
+import yaml
+
+from subiquity.models.network import NetworkModel
+
+
+class TestNetworkModel(unittest.TestCase):
+
+    def test_copies_wlan_credentials(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            ca = os.path.join(tmp, 'ca.pem')
+            with open(ca, 'w') as fp:
+                fp.write('CA\n')
+            model = NetworkModel()
+            model.override_config = {'network': {'version': 2, 'wifis': {
+                'wlan0': {'access-points': {'corp': {'auth': {
+                    'key-management': 'eap',
+                    'method': 'peap',
+                    'ca-certificate': ca,
+                    }}}},
+                }}}
+            write_files = model.render()['write_files']
+        [cert] = [
+            f for f in write_files.values() if f['path'].endswith('.pem')]
+        self.assertEqual(cert['content'], 'CA\n')
+        self.assertEqual(cert['permissions'], 0o600)
+        netplan = yaml.safe_load(
+            write_files['etc_netplan_installer']['content'])
+        auth = netplan['network']['wifis']['wlan0']['access-points'][
+            'corp']['auth']
+        self.assertEqual(auth['ca-certificate'], '/' + cert['path'])
+        # The model's own config still refers to the live session's file.
+        self.assertEqual(
+            model.override_config['network']['wifis']['wlan0'][
+                'access-points']['corp']['auth']['ca-certificate'],
+            ca)
+
+    def test_writes_qinq_dropin(self):
+        model = NetworkModel()
+        model.override_config = {'network': {'version': 2, 'vlans': {
+            'eth0.100': {'id': 100, 'link': 'eth0'},
+            'eth0.100.5': {'id': 5, 'link': 'eth0.100'},
+            }}}
+        write_files = model.render()['write_files']
+        [dropin] = [
+            f for f in write_files.values() if f['path'].endswith('.conf')
+            and 'netdev.d' in f['path']]
+        self.assertEqual(
+            dropin['path'],
+            'etc/systemd/network/10-netplan-eth0.100.netdev.d/'
+            'subiquity-qinq.conf')
+        self.assertIn('Protocol=802.1ad', dropin['content'])
@@ -0,0 +1,63 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import json
+import unittest
+
+from subiquity.common.types import NVMeoFTarget
+from subiquity.models.nvmeof import NVMeoFModel
+
+
+class TestNVMeoFModel(unittest.TestCase):
+
+    def test_render_nothing_connected(self):
+        self.assertEqual(NVMeoFModel().render(), {})
+
+    def test_render(self):
+        model = NVMeoFModel()
+        model.host_nqn = 'nqn.2014-08.org.nvmexpress:uuid:1234'
+        model.targets = [
+            NVMeoFTarget('10.0.0.1', 4420, 'nqn.2014-08.org.example:t1'),
+            ]
+        config = model.render()
+        files = config['write_files']
+        self.assertEqual(
+            json.loads(files['nvme_config']['content']),
+            [{
+                'hostnqn': 'nqn.2014-08.org.nvmexpress:uuid:1234',
+                'subsystems': [{
+                    'nqn': 'nqn.2014-08.org.example:t1',
+                    'ports': [{
+                        'transport': 'tcp',
+                        'traddr': '10.0.0.1',
+                        'trsvcid': '4420',
+                        }],
+                    }],
+            }])
+        self.assertNotIn('nvme_hostid', files)
+        self.assertEqual(
+            files['nvme_hostnqn']['content'],
+            'nqn.2014-08.org.nvmexpress:uuid:1234\n')
+        # nvme-cli has to be installed in the target, not the live system.
+        cmd = config['curthooks_commands']['002-install-nvme-cli']
+        self.assertIn('--target="$TARGET_MOUNT_POINT"', cmd[2])
+
+    def test_render_no_host_nqn(self):
+        model = NVMeoFModel()
+        model.targets = [
+            NVMeoFTarget('10.0.0.1', 4420, 'nqn.2014-08.org.example:t1'),
+            ]
+        files = model.render()['write_files']
+        self.assertNotIn('nvme_hostnqn', files)
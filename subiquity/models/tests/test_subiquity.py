@@ -17,6 +17,12 @@ import fnmatch
 import unittest
 import yaml
 
+from subiquity.common.types import (
+    ExistingUser,
+    IdentityData,
+    IdentityUser,
+    SnapSelection,
+    )
 from subiquity.models.subiquity import SubiquityModel
 
 
@@ -118,6 +124,73 @@ class TestSubiquityModel(unittest.TestCase):
         config = model.render('ident')
         self.assertConfigHasVal(config, 'storage.version', 1)
 
+    def test_existing_user_uid(self):
+        model = SubiquityModel('test')
+        model.get_target_groups = lambda: set()
+        model.locale.selected_language = 'en_US.UTF-8'
+        model.identity.add_user(IdentityData(
+            username='ubuntu', hostname='host', crypted_password='x'))
+        model.identity.existing_user = ExistingUser(
+            username='ubuntu', uid=1001)
+        [user] = model._cloud_init_config()['users']
+        self.assertEqual(user['uid'], 1001)
+        model.identity.existing_user.username = 'other'
+        [user] = model._cloud_init_config()['users']
+        self.assertNotIn('uid', user)
+
+    def test_extra_users(self):
+        model = SubiquityModel('test')
+        model.get_target_groups = lambda: {'sudo', 'adm'}
+        model.locale.selected_language = 'en_US.UTF-8'
+        model.identity.add_user(IdentityData(
+            username='ubuntu', hostname='host', crypted_password='x'))
+        model.identity.extra_users = [
+            IdentityUser(
+                username='ops', crypted_password='y', sudo=True,
+                groups=['adm', 'docker']),
+            IdentityUser(
+                username='deploy', shell='/bin/sh',
+                ssh_authorized_keys=['ssh-ed25519 AAAA deploy']),
+            ]
+        config = model._cloud_init_config()
+        primary, ops, deploy = config['users']
+        self.assertEqual(primary['name'], 'ubuntu')
+        self.assertEqual(ops['groups'], ['adm', 'docker', 'sudo'])
+        self.assertEqual(ops['passwd'], 'y')
+        self.assertFalse(ops['lock_passwd'])
+        self.assertTrue(deploy['lock_passwd'])
+        self.assertNotIn('passwd', deploy)
+        self.assertEqual(deploy['shell'], '/bin/sh')
+        self.assertEqual(
+            deploy['ssh_authorized_keys'], ['ssh-ed25519 AAAA deploy'])
+        self.assertEqual(config['groups'], ['docker'])
+
+    def test_extra_users_without_identity(self):
+        model = SubiquityModel('test')
+        model.get_target_groups = lambda: set()
+        model.locale.selected_language = 'en_US.UTF-8'
+        model.identity.extra_users = [IdentityUser(username='ops')]
+        users = model._cloud_init_config()['users']
+        self.assertEqual(users[0], 'default')
+        self.assertEqual(users[1]['name'], 'ops')
+
+    def test_store_proxy(self):
+        model = SubiquityModel('test')
+        model.locale.selected_language = 'en_US.UTF-8'
+        model.store_proxy.store_id = 'abcd'
+        model.store_proxy.assertions = 'type: account-key\n'
+        model.snaplist.selections = [
+            SnapSelection(name='juju', channel='stable', is_classic=True),
+            ]
+        snap = model._cloud_init_config()['snap']
+        self.assertEqual(snap['assertions'], ['type: account-key\n'])
+        self.assertEqual(
+            snap['commands'],
+            [
+                'snap set system proxy.store=abcd',
+                'snap install --channel=stable --classic juju',
+            ])
+
     def test_write_netplan(self):
         model = SubiquityModel('test')
         config = model.render('ident')
@@ -136,6 +209,15 @@ class TestSubiquityModel(unittest.TestCase):
         config = model.render('ident')
         self.assertIn('sources', config)
 
+    def test_downloaded_source(self):
+        model = SubiquityModel('test')
+        model.source.url = 'https://example.com/filesystem.squashfs'
+        model.source.path = '/run/subiquity/source.img'
+        config = model.render('ident')
+        self.assertConfigHasVal(
+            config, 'sources.ubuntu00',
+            {'type': 'fsimage', 'uri': '/run/subiquity/source.img'})
+
     def test_mirror(self):
         model = SubiquityModel('test')
         mirror_val = 'http://my-mirror'
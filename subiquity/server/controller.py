@@ -13,6 +13,7 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+import asyncio
 import json
 import logging
 import os
@@ -39,6 +40,9 @@ class SubiquityController(BaseController):
     def __init__(self, app):
         super().__init__(app)
         self.context.set('controller', self)
+        self.answered = False
+        self.timed_out = os.path.exists(self._timed_out_path())
+        self._section_timeout = None
 
     def setup_autoinstall(self):
         if not self.app.autoinstall_config:
@@ -47,8 +51,12 @@ class SubiquityController(BaseController):
             ai_data = self.app.autoinstall_config.get(
                 self.autoinstall_key,
                 self.autoinstall_default)
-            if ai_data is not None and self.autoinstall_schema is not None:
-                jsonschema.validate(ai_data, self.autoinstall_schema)
+            if self.autoinstall_schema is not None:
+                if ai_data is not None:
+                    jsonschema.validate(ai_data, self.autoinstall_schema)
+                default = self.section_default()
+                if default is not None:
+                    jsonschema.validate(default, self.autoinstall_schema)
             self.load_autoinstall_data(ai_data)
 
     def load_autoinstall_data(self, data):
@@ -70,16 +78,91 @@ class SubiquityController(BaseController):
         """
         pass
 
+    def interactive_section(self):
+        """Return the entry in interactive-sections for this controller.
+
+        An entry is either the name of a section ('*' for all of them)
+        or a mapping with the name under 'section' and optionally a
+        'timeout' in seconds, after which the config for the section
+        (or the 'default' the entry has) is used as if it had not been
+        interactive. Entries are returned as mappings.
+
+        A default is the config of one section, so the 'default' of a
+        '*' entry is not used: only its timeout applies.
+        """
+        if not self.app.autoinstall_config:
+            return None
+        found = None
+        for entry in self.app.autoinstall_config.get(
+                'interactive-sections', []):
+            if isinstance(entry, str):
+                entry = {'section': entry}
+            if entry['section'] == self.autoinstall_key:
+                return entry
+            if entry['section'] == '*' and found is None:
+                found = {k: v for k, v in entry.items() if k != 'default'}
+        return found
+
+    def section_default(self):
+        section = self.interactive_section()
+        if section is None:
+            return None
+        return section.get('default')
+
     def interactive(self):
         if not self.app.autoinstall_config:
             return True
-        i_sections = self.app.autoinstall_config.get(
-            'interactive-sections', [])
-        return '*' in i_sections or self.autoinstall_key in i_sections
+        if self.timed_out:
+            return False
+        return self.interactive_section() is not None
+
+    def start_section_timeout(self):
+        """Start waiting for an answer for an interactive section.
+
+        This is called when the section is first asked, that is when a
+        client first shows the screen for it.
+        """
+        if self._section_timeout is not None or self.answered:
+            return
+        section = self.interactive_section()
+        if section is None or section.get('timeout') is None:
+            return
+        self._section_timeout = self.app.aio_loop.create_task(
+            self._wait_for_answer(section))
+
+    def _timed_out_path(self):
+        return self.app.state_path('timed-out', self.name)
+
+    async def _wait_for_answer(self, section):
+        await asyncio.sleep(section['timeout'])
+        if self.answered:
+            return
+        # From now on the section is skipped by the clients and its
+        # events are reported like those of non-interactive sections.
+        self.timed_out = True
+        os.makedirs(os.path.dirname(self._timed_out_path()), exist_ok=True)
+        open(self._timed_out_path(), 'w').close()
+        await self.use_section_default(
+            section=section['section'], timeout=section['timeout'],
+            default=section.get('default'))
+
+    @with_context(
+        description="no answer after {timeout}s, using the default",
+        level="INFO")
+    async def use_section_default(self, *, context, section, timeout,
+                                  default):
+        log.info(
+            "interactive section %s was not answered after %ss, using the "
+            "default", section, timeout)
+        if default is not None:
+            self.load_autoinstall_data(default)
+        await self.apply_autoinstall_config()
+        self.configured()
 
     def configured(self):
         """Let the world know that this controller's model is now configured.
         """
+        self.answered = True
         with open(self.app.state_path('states', self.name), 'w') as fp:
             json.dump(self.serialize(), fp)
         if self.model_name is not None:
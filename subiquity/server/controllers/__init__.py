@@ -15,20 +15,31 @@
 
 from .cmdlist import EarlyController, LateController, ErrorController
 from .debconf import DebconfController
+from .errorreports import ErrorReportsController
 from .filesystem import FilesystemController
 from .identity import IdentityController
 from .install import InstallController
+from .inventory import InventoryController
+from .iscsi import ISCSIController
+from .kdump import KdumpController
 from .keyboard import KeyboardController
 from .locale import LocaleController
 from .mirror import MirrorController
 from .network import NetworkController
+from .nvmeof import NVMeoFController
+from .offline import OfflineController
 from .package import PackageController
 from .proxy import ProxyController
 from .reboot import RebootController
+from .recoverykey import RecoveryKeyController
 from .refresh import RefreshController
 from .reporting import ReportingController
+from .rescue import RescueController
 from .snaplist import SnapListController
+from .source import SourceController
 from .ssh import SSHController
+from .storeproxy import StoreProxyController
+from .syslog import SyslogController
 from .updates import UpdatesController
 from .userdata import UserdataController
 from .zdev import ZdevController
@@ -37,21 +48,32 @@ __all__ = [
     'DebconfController',
     'EarlyController',
     'ErrorController',
+    'ErrorReportsController',
     'FilesystemController',
     'IdentityController',
     'InstallController',
+    'InventoryController',
+    'ISCSIController',
+    'KdumpController',
     'KeyboardController',
     'LateController',
     'LocaleController',
     'MirrorController',
     'NetworkController',
+    'NVMeoFController',
+    'OfflineController',
     'PackageController',
     'ProxyController',
     'RebootController',
+    'RecoveryKeyController',
     'RefreshController',
     'ReportingController',
+    'RescueController',
     'SnapListController',
+    'SourceController',
     'SSHController',
+    'StoreProxyController',
+    'SyslogController',
     'UpdatesController',
     'UserdataController',
     'ZdevController',
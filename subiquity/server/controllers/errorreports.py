@@ -0,0 +1,228 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import logging
+import re
+import socket
+
+import aiohttp
+
+from subiquity.server.controller import NonInteractiveController
+
+
+log = logging.getLogger('subiquity.server.controllers.errorreports')
+
+ERROR_REPORT_TIMEOUT = 60
+ERROR_REPORT_ATTEMPTS = 3
+ERROR_REPORT_RETRY_DELAY = 10
+
+REDACTED = '<redacted>'
+
+# The redaction rules that can be named instead of being spelled out as
+# a pattern. By default all of them are applied.
+BUILTIN_REDACTIONS = {
+    'mac-addresses': [
+        (r'\b[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5}\b', REDACTED),
+        ],
+    'ip-addresses': [
+        (r'\b(\d{1,3}\.){3}\d{1,3}\b', REDACTED),
+        # Only addresses with a :: or all eight groups, so that times
+        # are left alone.
+        (r'\b[0-9a-fA-F]{0,4}(:[0-9a-fA-F]{0,4})*::'
+         r'([0-9a-fA-F]{1,4}(:[0-9a-fA-F]{1,4})*)?(/\d{1,3})?',
+         REDACTED),
+        (r'\b[0-9a-fA-F]{1,4}(:[0-9a-fA-F]{1,4}){7}\b', REDACTED),
+        ],
+    'serials': [
+        # As they appear in the storage probe data and curtin config
+        # (both as python or JSON dicts) and in udev properties.
+        (r'''(?P<key>['"]?(serial|wwn|wwid|ID_SERIAL(_SHORT)?|ID_WWN\w*|'''
+         r'''ID_SCSI_SERIAL)['"]?\s*[:=]\s*['"]?)[^'",\s}]+''',
+         r'\g<key>' + REDACTED),
+        ],
+    }
+
+
+def make_redactor(rules, hostnames=()):
+    """Return a function that applies the redaction rules to a string.
+
+    A rule is the name of one of the BUILTIN_REDACTIONS, 'hostnames'
+    (which replaces the names in hostnames) or a mapping with a regular
+    expression pattern and an optional replacement.
+    """
+    subs = []
+    for rule in rules:
+        if rule == 'hostnames':
+            for hostname in hostnames:
+                if hostname:
+                    subs.append((
+                        re.compile(r'\b' + re.escape(hostname) + r'\b'),
+                        REDACTED))
+        elif isinstance(rule, str):
+            for pattern, repl in BUILTIN_REDACTIONS[rule]:
+                subs.append((re.compile(pattern), repl))
+        else:
+            subs.append((
+                re.compile(rule['pattern']),
+                rule.get('replacement', REDACTED)))
+
+    def redact(value):
+        for regex, repl in subs:
+            value = regex.sub(repl, value)
+        return value
+
+    return redact
+
+
+class HTTPDestination:
+    """POST the report, redacted, as JSON to a URL."""
+
+    type = 'http'
+    schema = {
+        'type': 'object',
+        'properties': {
+            'type': {'enum': ['http']},
+            'url': {'type': 'string'},
+            'token': {'type': 'string'},
+            'redact': {
+                'type': 'array',
+                'items': {
+                    'oneOf': [
+                        {
+                            'enum': ['hostnames'] + sorted(BUILTIN_REDACTIONS),
+                            },
+                        {
+                            'type': 'object',
+                            'properties': {
+                                'pattern': {'type': 'string'},
+                                'replacement': {'type': 'string'},
+                                },
+                            'required': ['pattern'],
+                            'additionalProperties': False,
+                            },
+                        ],
+                    },
+                },
+            },
+        'required': ['type', 'url'],
+        'additionalProperties': False,
+        }
+
+    def __init__(self, controller, config):
+        self.controller = controller
+        self.url = config['url']
+        self.name = self.url
+        self.token = config.get('token')
+        self.redact = config.get(
+            'redact', ['hostnames'] + sorted(BUILTIN_REDACTIONS))
+        for rule in self.redact:
+            if isinstance(rule, dict):
+                # Fail while loading the config rather than when there
+                # is an error to report.
+                re.compile(rule['pattern'])
+
+    def make_autoinstall(self):
+        # The token is left out so that it does not end up in the
+        # autoinstall-user-data saved in the target.
+        return {'type': self.type, 'url': self.url, 'redact': self.redact}
+
+    def payload(self, report):
+        redact = make_redactor(self.redact, self.controller.hostnames())
+        return {
+            'base': report.base,
+            'kind': report.kind.name,
+            'fields': {k: redact(v) for k, v in report.fields().items()},
+            }
+
+    async def _post(self, data):
+        headers = {}
+        if self.token:
+            headers['Authorization'] = 'Bearer ' + self.token
+        timeout = aiohttp.ClientTimeout(total=ERROR_REPORT_TIMEOUT)
+        async with aiohttp.ClientSession(
+                timeout=timeout, trust_env=True) as session:
+            async with session.post(
+                    self.url, json=data, headers=headers) as resp:
+                if resp.status >= 300:
+                    raise RuntimeError(
+                        "error report server returned HTTP status {}".format(
+                            resp.status))
+
+    async def send(self, report):
+        data = self.payload(report)
+        for attempt in range(1, ERROR_REPORT_ATTEMPTS + 1):
+            try:
+                await self._post(data)
+            except (OSError, RuntimeError, aiohttp.ClientError,
+                    asyncio.TimeoutError) as e:
+                if attempt == ERROR_REPORT_ATTEMPTS:
+                    raise
+                log.warning(
+                    "sending %s failed (attempt %d of %d): %s", report.base,
+                    attempt, ERROR_REPORT_ATTEMPTS,
+                    str(e) or type(e).__name__)
+                await asyncio.sleep(ERROR_REPORT_RETRY_DELAY)
+            else:
+                return
+
+
+DESTINATION_TYPES = {cls.type: cls for cls in [HTTPDestination]}
+
+
+class ErrorReportsController(NonInteractiveController):
+
+    autoinstall_key = 'error-reports'
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'launchpad': {'type': 'boolean'},
+            'destinations': {
+                'type': 'array',
+                'items': {
+                    'oneOf': [
+                        cls.schema for cls in DESTINATION_TYPES.values()
+                        ],
+                    },
+                },
+            },
+        'additionalProperties': False,
+        }
+
+    def load_autoinstall_data(self, data):
+        if data is None:
+            return
+        reporter = self.app.error_reporter
+        reporter.allow_upload = data.get('launchpad', True)
+        reporter.destinations = [
+            DESTINATION_TYPES[config['type']](self, config)
+            for config in data.get('destinations', [])
+            ]
+
+    def hostnames(self):
+        return [
+            socket.gethostname(),
+            self.app.base_model.identity.hostname,
+            ]
+
+    def make_autoinstall(self):
+        reporter = self.app.error_reporter
+        r = {}
+        if not reporter.allow_upload:
+            r['launchpad'] = False
+        if reporter.destinations:
+            r['destinations'] = [
+                d.make_autoinstall() for d in reporter.destinations]
+        return r
@@ -14,15 +14,23 @@
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import asyncio
+import fnmatch
 import glob
 import json
 import logging
 import os
+import re
 import select
+import shutil
+import subprocess
 from typing import Optional
+import uuid
 
+from aiohttp import web
 import pyudev
 
+from curtin.block.mkfs import mkfs_commands
+
 
 from subiquitycore.async_helpers import (
     run_in_thread,
@@ -31,6 +39,7 @@ from subiquitycore.async_helpers import (
     )
 from subiquitycore.context import with_context
 from subiquitycore.utils import (
+    arun_command,
     run_command,
     )
 from subiquitycore.lsb_release import lsb_release
@@ -38,16 +47,43 @@ from subiquitycore.lsb_release import lsb_release
 from subiquity.common.apidef import API
 from subiquity.common.errorreport import ErrorReportKind
 from subiquity.common.filesystem import FilesystemManipulator
+from subiquity.common.installfiles import (
+    find_fstab_device,
+    INSTALL_FILES,
+    parse_fstab,
+    parse_os_release,
+    parse_passwd,
+    read_install_files,
+    REINSTALL_ROOT_FSTYPES,
+    )
 from subiquity.common.types import (
     Bootloader,
     GuidedChoice,
+    GuidedReinstall,
+    GuidedReinstallTarget,
+    GuidedResize,
+    GuidedResizeBlocker,
+    GuidedResizeTarget,
     GuidedStorageResponse,
     ProbeStatus,
     StorageResponse,
+    SwapConfig,
+    SwapKind,
     )
 from subiquity.models.filesystem import (
+    align_down,
+    align_up,
+    check_btrfs_subvolumes,
+    DEFAULT_BTRFS_SUBVOLUMES,
     dehumanize_size,
     DeviceAction,
+    get_hibernation_swap_size,
+    GUIDED_FSTYPES,
+    humanize_size,
+    OPTIONAL_FSTYPES,
+    PARTITION_NAME_SUPPORTED,
+    RESIZE_SUPPORTED,
+    ZFS_SUPPORTED,
     )
 from subiquity.server.controller import (
     SubiquityController,
@@ -61,13 +97,122 @@ block_discover_log = logging.getLogger('block-discover')
 # installation.
 DEFAULT_MIN_SIZE_GUIDED = 6 * (1 << 30)
 
+# grub can only read pools that use a limited set of features, so the
+# pool that holds /boot is created with only these enabled.
+BPOOL_FEATURES = [
+    'async_destroy',
+    'bookmarks',
+    'embedded_data',
+    'empty_bpobj',
+    'enabled_txg',
+    'extensible_dataset',
+    'filesystem_limits',
+    'hole_birth',
+    'large_blocks',
+    'lz4_compress',
+    'spacemap_histogram',
+    ]
+
+ZFS_FS_PROPERTIES = {
+    'acltype': 'posixacl',
+    'compression': 'lz4',
+    'devices': 'off',
+    'normalization': 'formD',
+    'relatime': 'on',
+    'sync': 'standard',
+    'xattr': 'sa',
+    }
+
+# The installer media, which is what a reset partition holds a copy of.
+INSTALL_MEDIA = '/cdrom'
+
+# The reset partition is this much bigger than the installer media, to
+# leave room for the boot configuration and for the squashfs images
+# being a little different in size when an updated installer is copied
+# over an old one.
+RESET_PARTITION_SLACK = 1.1
+RESET_PARTITION_ALIGN = 256 * (1 << 20)
+# The reset partition holds a FAT filesystem, so it gets the Microsoft
+# basic data type like any other FAT data partition.
+RESET_PARTITION_TYPE = 'ebd0a0a2-b9e5-4433-87c0-68b6b72699c7'
+
+
+def _nvme_id_ctrl(path):
+    try:
+        cp = subprocess.run(
+            ['nvme', 'id-ctrl', path, '-o', 'json'],
+            stdout=subprocess.PIPE, stderr=subprocess.DEVNULL,
+            encoding='utf-8', check=True)
+        return json.loads(cp.stdout)
+    except (OSError, subprocess.CalledProcessError, ValueError):
+        return {}
+
+
+def find_secure_wipe_modes(blockdevs, dry_run=False):
+    """Find out which secure wipe modes each disk supports.
+
+    The result maps each disk's path to a dict from mode to a rough
+    estimate of how long it takes in seconds (or None)."""
+    r = {}
+    for path, data in blockdevs.items():
+        if data.get('DEVTYPE') != 'disk':
+            continue
+        kname = os.path.basename(path)
+        modes = {}
+        if dry_run:
+            modes['discard'] = 10
+            if kname.startswith('nvme'):
+                modes['nvme-format'] = 10
+            r[path] = modes
+            continue
+        try:
+            with open('/sys/class/block/{}/queue/discard_max_bytes'.format(
+                    kname)) as fp:
+                if int(fp.read()) > 0:
+                    modes['discard'] = 10
+        except (OSError, ValueError):
+            pass
+        if data.get('ID_ATA_FEATURE_SET_SECURITY') == '1' and \
+           data.get('ID_ATA_FEATURE_SET_SECURITY_FROZEN') != '1':
+            minutes = data.get('ID_ATA_FEATURE_SET_SECURITY_ERASE_UNIT_MIN')
+            if minutes is not None:
+                minutes = int(minutes) * 60
+            modes['ata-secure-erase'] = minutes
+        if kname.startswith('nvme') and shutil.which('nvme'):
+            ctrl = _nvme_id_ctrl(path)
+            # Bit 1 of OACS is "supports the Format NVM command" and the
+            # low three bits of SANICAP are the sanitize actions
+            # supported.
+            if ctrl.get('oacs', 0) & 0x2:
+                modes['nvme-format'] = 10
+            if ctrl.get('sanicap', 0) & 0x7:
+                modes['nvme-sanitize'] = None
+        if modes:
+            r[path] = modes
+    return r
+
 
 class FilesystemController(SubiquityController, FilesystemManipulator):
 
     endpoint = API.storage
 
     autoinstall_key = "storage"
-    autoinstall_schema = {'type': 'object'}  # ...
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'layout': {
+                'type': 'object',
+                'properties': {
+                    'name': {'type': 'string'},
+                    'fstype': {
+                        'type': 'string',
+                        'enum': GUIDED_FSTYPES + list(OPTIONAL_FSTYPES),
+                        },
+                    },
+                'required': ['name'],
+                },
+            },
+        }  # ...
     model_name = "filesystem"
 
     def __init__(self, app):
@@ -79,10 +224,19 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
             self.model.bootloader = getattr(Bootloader, name)
         self._monitor = None
         self._errors = {}
+        self._reset_partition_size = None
+        # ntfsresize --info can take a while on a big filesystem, so it
+        # is only run once per partition per probe.
+        self._ntfs_min_sizes = {}
+        # Likewise, each partition is only mounted to look for an install
+        # once per probe.
+        self._install_files = {}
         self._probe_once_task = SingleInstanceTask(
             self._probe_once, propagate_errors=False)
         self._probe_task = SingleInstanceTask(
             self._probe, propagate_errors=False)
+        self.app.hub.subscribe(
+            'storage-devices-changed', self._probe_task.start_sync)
 
     def load_autoinstall_data(self, data):
         log.debug("load_autoinstall_data %s", data)
@@ -118,16 +272,81 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
                 "autoinstall config did not create needed bootloader "
                 "partition")
 
-    def guided_direct(self, disk):
+    def _check_fstype(self, fstype):
+        if fstype in OPTIONAL_FSTYPES and \
+           fstype not in self.model.optional_fstypes:
+            raise Exception(
+                "{} is not supported by the running kernel".format(fstype))
+
+    def _check_guided_fstype(self, fstype):
+        if fstype not in GUIDED_FSTYPES and fstype not in OPTIONAL_FSTYPES:
+            raise Exception(
+                "guided storage does not support {} for /".format(fstype))
+        self._check_fstype(fstype)
+
+    def _memory_size(self):
+        with open('/proc/meminfo') as fp:
+            for line in fp:
+                if line.startswith('MemTotal:'):
+                    return int(line.split()[1]) * 1024
+        raise Exception("cannot find MemTotal in /proc/meminfo")
+
+    def _hibernation_swap_size(self):
+        if self.model.swap_policy.size is not None:
+            return align_up(self.model.swap_policy.size)
+        return get_hibernation_swap_size(self._memory_size())
+
+    def _check_swap_policy(self, layout):
+        if self.model.swap_policy.kind == SwapKind.PARTITION:
+            raise Exception(
+                "a swap partition is not supported with the {} "
+                "layout".format(layout))
+
+    def _shrink_for_swap(self, volume, size):
+        if volume.size - size < self.model.lower_size_limit:
+            raise Exception(
+                "{} is too small for {} of swap".format(
+                    volume.label, humanize_size(size)))
+        volume.size = align_down(volume.size - size)
+
+    def _set_resume_uuid(self, volume):
+        # Pick the UUID of the swap space now so that the initramfs can
+        # be told where to resume from.
+        volume.fs().uuid = str(uuid.uuid4())
+
+    def _root_subvolumes(self, fstype, subvolumes):
+        if fstype != 'btrfs':
+            if subvolumes is not None:
+                raise Exception("subvolumes are only supported with btrfs")
+            return None
+        if subvolumes is None:
+            subvolumes = DEFAULT_BTRFS_SUBVOLUMES
+        subvolumes = [dict(subvolume) for subvolume in subvolumes]
+        check_btrfs_subvolumes(subvolumes)
+        return subvolumes
+
+    def guided_direct(self, disk, fstype="ext4", subvolumes=None):
+        self._check_guided_fstype(fstype)
+        subvolumes = self._root_subvolumes(fstype, subvolumes)
         self.reformat(disk)
         result = {
             "size": disk.free_for_partitions,
-            "fstype": "ext4",
+            "fstype": fstype,
             "mount": "/",
+            "subvolumes": subvolumes,
             }
         self.partition_disk_handler(disk, None, result)
+        if self.model.swap_policy.kind == SwapKind.PARTITION:
+            root = self.model._mount_for_path('/').device.volume
+            self._shrink_for_swap(root, self._hibernation_swap_size())
+            swap = self.create_partition(disk, dict(
+                size=disk.free_for_partitions, fstype='swap', mount=None))
+            self._set_resume_uuid(swap)
 
-    def guided_lvm(self, disk, lvm_options=None):
+    def guided_lvm(self, disk, lvm_options=None, fstype="ext4",
+                   subvolumes=None):
+        self._check_guided_fstype(fstype)
+        subvolumes = self._root_subvolumes(fstype, subvolumes)
         self.reformat(disk)
         if DeviceAction.TOGGLE_BOOT in disk.supported_actions:
             self.add_boot_disk(disk)
@@ -150,6 +369,7 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
         spec = dict(name=vg_name, devices=set([part]))
         if lvm_options and lvm_options['encrypt']:
             spec['password'] = lvm_options['luks_options']['password']
+            spec['integrity'] = lvm_options['luks_options'].get('integrity')
         vg = self.create_volgroup(spec)
         # There's no point using LVM and unconditionally filling the
         # VG with a single LV, but we should use more of a smaller
@@ -167,13 +387,434 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
         else:
             # Use at most 100G of a large disk.
             lv_size = 100 * (2 << 30)
-        self.create_logical_volume(
+        root = self.create_logical_volume(
             vg=vg, spec=dict(
                 size=lv_size,
                 name="ubuntu-lv",
+                fstype=fstype,
+                mount="/",
+                subvolumes=subvolumes,
+                ))
+        if self.model.swap_policy.kind == SwapKind.PARTITION:
+            size = self._hibernation_swap_size()
+            if vg.free_for_partitions < size:
+                self._shrink_for_swap(root, size)
+            swap = self.create_logical_volume(
+                vg=vg, spec=dict(
+                    size=size,
+                    name="swap",
+                    fstype="swap",
+                    mount=None,
+                    ))
+            self._set_resume_uuid(swap)
+
+    def guided_zfs(self, disk, zfs_options=None):
+        if not ZFS_SUPPORTED:
+            raise Exception("curtin cannot create ZFS pools")
+        self._check_swap_policy('zfs')
+        self.reformat(disk)
+        if DeviceAction.TOGGLE_BOOT in disk.supported_actions:
+            self.add_boot_disk(disk)
+        bpart = self.create_partition(
+            device=disk, spec=dict(
+                size=dehumanize_size('2G'),
+                fstype=None,
+                ))
+        rpart = self.create_partition(
+            device=disk, spec=dict(
+                size=disk.free_for_partitions,
+                fstype=None,
+                ))
+        bpool_properties = {'ashift': 12, 'autotrim': 'on'}
+        for feature in BPOOL_FEATURES:
+            bpool_properties['feature@' + feature] = 'enabled'
+        bpool = self.model.add_zpool(
+            [bpart], 'bpool', '/boot',
+            pool_properties=bpool_properties,
+            fs_properties=dict(
+                ZFS_FS_PROPERTIES, canmount='off', encryption='off'),
+            default_features=False)
+        rpool_kw = {}
+        if zfs_options and zfs_options['encrypt']:
+            # curtin creates a small LUKS volume holding the key for
+            # the pool's native encryption, unlocked with the
+            # passphrase at boot.
+            rpool_kw['encryption_style'] = 'luks_keystore'
+            rpool_kw['key'] = zfs_options['password']
+        rpool = self.model.add_zpool(
+            [rpart], 'rpool', '/',
+            pool_properties={'ashift': 12, 'autotrim': 'on'},
+            fs_properties=dict(
+                ZFS_FS_PROPERTIES, canmount='off', dnodesize='auto'),
+            **rpool_kw)
+        suffix = uuid.uuid4().hex[:6]
+        self.model.add_zfs(
+            rpool, 'ROOT', dict(canmount='off', mountpoint='none'))
+        self.model.add_zfs(
+            rpool, 'ROOT/ubuntu_' + suffix, dict(mountpoint='/'))
+        self.model.add_zfs(
+            bpool, 'BOOT', dict(canmount='off', mountpoint='none'))
+        self.model.add_zfs(
+            bpool, 'BOOT/ubuntu_' + suffix, dict(mountpoint='/boot'))
+        # A swapfile on ZFS is asking for trouble.
+        self.model.swap = {'swap': 0}
+
+    def _reset_partition_size_for(self, disk, size=None):
+        """Return the size of the reset partition to add to disk.
+
+        This checks what can be checked before guided storage changes
+        the disk, so that a bad choice is refused with the disk as it
+        was.
+        """
+        if size is None:
+            size = self._reset_partition_size
+        if size is None:
+            raise ValueError(
+                "there is no installer media to copy to a reset partition")
+        # Guided storage deletes the disk's partitions, and a disk
+        # without partitions gets a GPT unless it is a DASD or already
+        # has some other (empty) partition table.
+        if disk.dasd() is not None or \
+           (not disk.partitions() and disk.ptable not in (None, 'gpt')):
+            raise ValueError(
+                "a reset partition needs a GPT partition table, which {} "
+                "would not have".format(disk.label))
+        size = align_up(size, RESET_PARTITION_ALIGN)
+        if disk.size - size < DEFAULT_MIN_SIZE_GUIDED:
+            raise ValueError(
+                "{} is too small for a reset partition".format(disk.label))
+        return size
+
+    def add_reset_partition(self, disk, size=None):
+        """Add a reset partition at the end of a disk guided storage used.
+
+        The largest partition on the disk is shrunk if there is not
+        enough free space after it.
+        """
+        size = self._reset_partition_size_for(disk, size)
+        if disk.ptable != 'gpt':
+            raise Exception(
+                "{} does not have a GPT partition table".format(disk.label))
+        needed = size - disk.free_for_partitions
+        if needed > 0:
+            largest = max(disk.partitions(), key=lambda p: p.size)
+            if largest.size - needed < self.model.lower_size_limit:
+                raise Exception(
+                    "{} is too small for a reset partition".format(
+                        disk.label))
+            largest.size = align_down(largest.size - needed)
+            vg = largest._constructed_device
+            if vg is not None and vg.type == 'dm_crypt':
+                # An encrypted VG is on a LUKS volume on the partition.
+                vg = vg._constructed_device
+            if vg is not None and vg.type == 'lvm_volgroup' and \
+               vg.free_for_partitions < 0:
+                lv = max(vg._partitions, key=lambda lv: lv.size)
+                lv.size = align_down(lv.size + vg.free_for_partitions)
+        spec = dict(size=size, fstype='fat32', mount=None)
+        if PARTITION_NAME_SUPPORTED:
+            spec['partition_name'] = 'reset'
+            spec['partition_type'] = RESET_PARTITION_TYPE
+        self.model.reset_partition = self.create_partition(
+            device=disk, spec=spec)
+
+    async def _check_resize(self, disk, resize: GuidedResize):
+        # Do not trust the client to have stuck to the limits the guided
+        # GET reported: shrinking NTFS below what ntfsresize allows
+        # destroys data.
+        for target in await self._resize_targets():
+            if target.disk_id == disk.id and \
+               target.partition_number == resize.partition_number:
+                break
+        else:
+            raise web.HTTPUnprocessableEntity(
+                reason="partition {} of {} cannot be resized".format(
+                    resize.partition_number, disk.label))
+        if target.blocker is not None:
+            raise web.HTTPUnprocessableEntity(
+                reason="{} cannot be resized: {}".format(
+                    target.label, target.blocker.name))
+        if not target.minimum <= resize.size <= target.maximum:
+            raise web.HTTPUnprocessableEntity(
+                reason="{} can only be resized to between {} and {}, "
+                "not {}".format(
+                    target.label, target.minimum, target.maximum,
+                    resize.size))
+
+    async def guided_resize(self, disk, resize: GuidedResize):
+        self._check_swap_policy('resize')
+        await self._check_resize(disk, resize)
+        part = self.model._one(
+            type='partition', device=disk, number=resize.partition_number)
+        start = part.probed_offset
+        new_start = align_up(start + resize.size)
+        # The new partition goes in the space freed up by shrinking
+        # part, which ends wherever the next partition starts.
+        following = [
+            p.probed_offset for p in disk.partitions()
+            if p.probed_offset is not None and p.probed_offset > start
+            ]
+        if following:
+            new_end = align_down(min(following))
+        else:
+            new_end = align_down(disk.available_for_partitions)
+        if new_end <= new_start:
+            raise Exception(
+                "resizing {} to {} leaves no room".format(
+                    part.label, resize.size))
+        part.size = align_up(resize.size)
+        part.resize = True
+        if DeviceAction.TOGGLE_BOOT in disk.supported_actions and \
+           not disk._is_boot_device():
+            self.add_boot_disk(disk)
+        root = self.create_partition(
+            device=disk, spec=dict(
+                size=new_end - new_start,
                 fstype="ext4",
                 mount="/",
                 ))
+        root.offset = new_start
+
+    async def _ntfs_min_size(self, part):
+        path = part._path()
+        if path not in self._ntfs_min_sizes:
+            self._ntfs_min_sizes[path] = await self._run_ntfsresize(part)
+        return self._ntfs_min_sizes[path]
+
+    async def _run_ntfsresize(self, part):
+        if self.opts.dry_run:
+            return part.size // 3
+        # ntfsresize refuses to look at a filesystem that was not
+        # cleanly unmounted, for example because Windows is hibernated
+        # or has "fast startup" enabled, which is what we want.
+        cp = await arun_command(['ntfsresize', '--info', part._path()])
+        if cp.returncode != 0:
+            log.debug(
+                "ntfsresize --info %s failed: %s", part._path(), cp.stdout)
+            return None
+        m = re.search(r'You might resize at (\d+) bytes', cp.stdout)
+        if m is None:
+            return None
+        return int(m.group(1))
+
+    async def _resize_target(self, part):
+        disk = part.device
+        target = GuidedResizeTarget(
+            disk_id=disk.id,
+            partition_number=part._number,
+            label=part.label,
+            size=part.size,
+            fstype=part.probed_fstype)
+        numbers = sorted(p._number for p in disk.partitions())
+        if target.fstype == 'BitLocker':
+            # An encrypted volume has to be resized from Windows (or
+            # have BitLocker turned off).
+            target.blocker = GuidedResizeBlocker.BITLOCKER
+        elif disk.ptable != 'gpt':
+            target.blocker = GuidedResizeBlocker.NOT_GPT
+        elif self.model.bootloader != Bootloader.NONE and \
+                not disk._can_be_boot_disk():
+            target.blocker = GuidedResizeBlocker.NO_BOOTLOADER
+        elif numbers != list(range(1, len(numbers) + 1)):
+            # The new partition will get the next number after the
+            # existing ones, which only works out if there are no gaps.
+            target.blocker = GuidedResizeBlocker.PARTITION_NUMBERING
+        elif any(p.probed_offset is None for p in disk.partitions()):
+            target.blocker = GuidedResizeBlocker.CHECK_FAILED
+        if target.blocker is not None:
+            return target
+        minimum = await self._ntfs_min_size(part)
+        if minimum is None:
+            target.blocker = GuidedResizeBlocker.CHECK_FAILED
+            return target
+        minimum = align_up(minimum)
+        maximum = align_down(part.size - DEFAULT_MIN_SIZE_GUIDED)
+        if maximum < minimum:
+            target.blocker = GuidedResizeBlocker.TOO_FULL
+        else:
+            target.minimum = minimum
+            target.maximum = maximum
+        return target
+
+    async def _resize_targets(self):
+        if not RESIZE_SUPPORTED:
+            return []
+        targets = []
+        for disk in self.model.all_disks():
+            for part in disk.partitions():
+                # Only offer partitions the user has not already
+                # decided to do something else with.
+                if not part.preserve:
+                    continue
+                fs = part.fs()
+                if fs is not None and (not fs.preserve or fs.mount()):
+                    continue
+                if part.probed_fstype in ('ntfs', 'BitLocker'):
+                    targets.append(await self._resize_target(part))
+        return targets
+
+    def _dry_run_install(self, part):
+        # Pretend the first ext4 partition on a disk holds an install
+        # that keeps /home on its largest other ext4 partition.
+        others = [
+            p for p in part.device.partitions()
+            if p.probed_fstype == 'ext4'
+            ]
+        if len(others) < 2 or others[0] is not part:
+            return {}
+        home = max(others[1:], key=lambda p: p.size)
+        return {
+            'etc/os-release': 'PRETTY_NAME="Ubuntu 20.04.2 LTS"\n',
+            'etc/fstab': '{} /home ext4 defaults 0 2\n'.format(home._path()),
+            'etc/passwd': (
+                'root:x:0:0:root:/root:/bin/bash\n'
+                'ubuntu:x:1000:1000:Ubuntu,,,:/home/ubuntu:/bin/bash\n'),
+            'etc/netplan/00-installer-config.yaml': (
+                'network:\n'
+                '  version: 2\n'
+                '  ethernets:\n'
+                '    all-en:\n'
+                '      match:\n'
+                '        name: "en*"\n'
+                '      addresses: [192.168.100.10/24]\n'
+                '      gateway4: 192.168.100.1\n'),
+            }
+
+    async def _read_install(self, part, patterns=INSTALL_FILES):
+        """Read the files describing the install on part, if there is one.
+
+        patterns are paths relative to the root of the install and may
+        contain wildcards. The result maps the paths of the files that
+        were found to their contents.
+        """
+        if self.opts.dry_run:
+            files = self._dry_run_install(part)
+            return {
+                name: content for name, content in files.items()
+                if any(fnmatch.fnmatch(name, p) for p in patterns)
+                }
+        key = (part._path(), tuple(patterns))
+        if key not in self._install_files:
+            self._install_files[key] = await read_install_files(
+                part._path(), part.probed_fstype, patterns)
+        return self._install_files[key]
+
+    async def read_installs(self, patterns):
+        """Read files from the installs on the disks.
+
+        The result is a list of (path, files) pairs, one for each
+        existing partition that may be the root filesystem of an
+        install, with files as _read_install returns them.
+        """
+        await self._start_task
+        await self._probe_task.wait()
+        installs = []
+        for disk in self.model.all_disks():
+            for part in disk.partitions():
+                if not part.preserve:
+                    continue
+                if part.probed_fstype not in REINSTALL_ROOT_FSTYPES:
+                    continue
+                files = await self._read_install(part, patterns)
+                installs.append((part._path(), files))
+        return installs
+
+    def _available_for_reinstall(self, part):
+        # Like resize targets, only offer partitions the user has not
+        # already decided to do something else with.
+        if not part.preserve:
+            return False
+        fs = part.fs()
+        return fs is None or (fs.preserve and not fs.mount())
+
+    async def _reinstall_target(self, part):
+        files = await self._read_install(part)
+        if 'etc/fstab' not in files:
+            return None
+        disk = part.device
+        blockdevs = self.model._probe_data['blockdev']
+        parts = {p._path(): p for p in disk.partitions()}
+        found = {}
+        for spec, mountpoint, fstype, options in parse_fstab(
+                files['etc/fstab']):
+            if fstype == 'swap':
+                key = 'swap'
+            elif mountpoint in ('/boot', '/home'):
+                key = mountpoint
+            else:
+                continue
+            p = parts.get(find_fstab_device(spec, blockdevs))
+            if p is not None and p is not part and \
+               self._available_for_reinstall(p):
+                found.setdefault(key, p)
+        # A /home that is a directory or subvolume on the root
+        # filesystem (or is on another disk) cannot be kept like this.
+        home = found.get('/home')
+        if home is None:
+            return None
+        os_release = parse_os_release(files.get('etc/os-release', ''))
+        target = GuidedReinstallTarget(
+            disk_id=disk.id,
+            root_partition_number=part._number,
+            home_partition_number=home._number,
+            os_name=os_release.get(
+                'PRETTY_NAME', os_release.get('NAME', 'Linux')),
+            users=parse_passwd(files.get('etc/passwd', '')))
+        if '/boot' in found:
+            target.boot_partition_number = found['/boot']._number
+        if 'swap' in found:
+            target.swap_partition_number = found['swap']._number
+        return target
+
+    async def _reinstall_targets(self):
+        targets = []
+        for disk in self.model.all_disks():
+            for part in disk.partitions():
+                if not self._available_for_reinstall(part):
+                    continue
+                if part.probed_fstype not in REINSTALL_ROOT_FSTYPES:
+                    continue
+                target = await self._reinstall_target(part)
+                if target is not None:
+                    targets.append(target)
+        return targets
+
+    async def guided_reinstall(self, disk, reinstall: GuidedReinstall):
+        root = self.model._one(
+            type='partition', device=disk,
+            number=reinstall.root_partition_number)
+        target = await self._reinstall_target(root)
+        if target is None:
+            raise Exception(
+                "{} does not hold an install that can be "
+                "reinstalled".format(root.label))
+
+        def partition(number):
+            return self.model._one(
+                type='partition', device=disk, number=number)
+
+        if target.swap_partition_number is not None:
+            self.partition_disk_handler(
+                disk, partition(target.swap_partition_number),
+                {'fstype': 'swap'})
+            self.model.swap = {'swap': 0}
+        else:
+            self._check_swap_policy('reinstall')
+        if DeviceAction.TOGGLE_BOOT in disk.supported_actions and \
+           not disk._is_boot_device():
+            self.add_boot_disk(disk)
+        self.partition_disk_handler(
+            disk, root, {'fstype': 'ext4', 'mount': '/'})
+        if target.boot_partition_number is not None:
+            self.partition_disk_handler(
+                disk, partition(target.boot_partition_number),
+                {'fstype': 'ext4', 'mount': '/boot'})
+        self.partition_disk_handler(
+            disk, partition(target.home_partition_number),
+            {'fstype': None, 'use_swap': False, 'mount': '/home'})
+        for user in target.users:
+            if user.username == reinstall.username:
+                self.app.base_model.identity.existing_user = user
 
     async def _probe_response(self, wait, resp_cls):
         if self._probe_task.task is None or not self._probe_task.task.done():
@@ -205,11 +846,41 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
             orig_config=self.model._orig_config,
             config=self.model._render_actions(include_all=True),
             blockdev=self.model._probe_data['blockdev'],
-            dasd=self.model._probe_data.get('dasd', {}))
+            dasd=self.model._probe_data.get('dasd', {}),
+            generation=self.model.generation,
+            wipe_modes=self.model._probe_data.get('wipe_modes', {}),
+            reset_partition=self._reset_partition_id())
+
+    def _reset_partition_id(self):
+        if self.model.reset_partition is None:
+            return None
+        return self.model.reset_partition.id
 
-    async def POST(self, config: list):
-        self.model._actions = self.model._actions_from_config(
-            config, self.model._probe_data['blockdev'], is_probe_data=False)
+    async def POST(self, config: list, generation: Optional[int] = None) \
+            -> Optional[StorageResponse]:
+        if generation is not None and generation != self.model.generation:
+            log.debug(
+                "refusing config for generation %s, now at %s",
+                generation, self.model.generation)
+            return await self.GET()
+        all_ids = set(self.model._all_ids)
+        try:
+            actions = self.model._actions_from_config(
+                config, self.model._probe_data['blockdev'],
+                is_probe_data=False)
+            self.model.check_thin_lvm(actions)
+            self.model.check_partition_names(actions)
+            self.model.check_zfs(actions)
+            self.model.check_integrity(actions)
+        except Exception:
+            self.model._all_ids = all_ids
+            raise
+        self.model._actions = actions
+        if self.model.reset_partition is not None:
+            # The client sends back every action, the reset partition
+            # included (unless it was deleted), under the same id.
+            self.model.reset_partition = self.model._one(
+                type='partition', id=self.model.reset_partition.id)
         self.configured()
 
     async def guided_GET(self, min_size: int = None, wait: bool = False) \
@@ -224,24 +895,60 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
             error_report=self.full_probe_error(),
             disks=[
                 d.for_client(min_size) for d in self.model._all(type='disk')
-            ])
+            ],
+            resize_targets=await self._resize_targets(),
+            reinstall_targets=await self._reinstall_targets(),
+            optional_fstypes=self.model.optional_fstypes,
+            reset_partition_size=self._reset_partition_size,
+            zfs_supported=ZFS_SUPPORTED)
 
     async def guided_POST(self, choice: Optional[GuidedChoice]) \
             -> StorageResponse:
+        self.app.base_model.identity.existing_user = None
         if choice is not None:
             disk = self.model._one(type='disk', id=choice.disk_id)
-            if choice.use_lvm:
+            if choice.use_zfs and not ZFS_SUPPORTED:
+                raise web.HTTPUnprocessableEntity(
+                    reason="curtin cannot create ZFS pools")
+            reset_size = None
+            if choice.reset_partition:
+                if choice.reinstall is not None or choice.resize is not None:
+                    raise web.HTTPUnprocessableEntity(
+                        reason="a reset partition needs the entire disk")
+                try:
+                    reset_size = self._reset_partition_size_for(disk)
+                except ValueError as e:
+                    raise web.HTTPUnprocessableEntity(reason=str(e))
+            kw = {}
+            if choice.fstype is not None:
+                kw['fstype'] = choice.fstype
+            if choice.reinstall is not None:
+                await self.guided_reinstall(disk, choice.reinstall)
+            elif choice.resize is not None:
+                await self.guided_resize(disk, choice.resize)
+            elif choice.use_lvm:
                 lvm_options = None
                 if choice.password is not None:
                     lvm_options = {
                         'encrypt': True,
                         'luks_options': {
                             'password': choice.password,
+                            'integrity': choice.integrity,
                             },
                         }
-                self.guided_lvm(disk, lvm_options)
+                self.guided_lvm(disk, lvm_options, **kw)
+            elif choice.use_zfs:
+                zfs_options = None
+                if choice.password is not None:
+                    zfs_options = {
+                        'encrypt': True,
+                        'password': choice.password,
+                        }
+                self.guided_zfs(disk, zfs_options)
             else:
-                self.guided_direct(disk)
+                self.guided_direct(disk, **kw)
+            if reset_size is not None:
+                self.add_reset_partition(disk, reset_size)
         return await self.GET()
 
     async def reset_POST(self, context, request) -> StorageResponse:
@@ -257,6 +964,17 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
                     return True
         return False
 
+    def _set_swap_policy(self, config):
+        if config.kind == SwapKind.FILE and config.size is None:
+            raise ValueError("a swapfile needs a size")
+        self.model.swap_policy = config
+
+    async def swap_GET(self) -> SwapConfig:
+        return self.model.swap_policy
+
+    async def swap_POST(self, config: SwapConfig) -> None:
+        self._set_swap_policy(config)
+
     @with_context(name='probe_once', description='restricted={restricted}')
     async def _probe_once(self, *, context, restricted):
         if restricted:
@@ -269,11 +987,17 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
             key = "ProbeData"
         storage = await run_in_thread(
             self.app.prober.get_storage, probe_types)
+        if not restricted:
+            storage['wipe_modes'] = await run_in_thread(
+                find_secure_wipe_modes, storage['blockdev'],
+                self.opts.dry_run)
         fpath = os.path.join(self.app.block_log_dir, fname)
         with open(fpath, 'w') as fp:
             json.dump(storage, fp, indent=4)
         self.app.note_file_for_apport(key, fpath)
         self.model.load_probe_data(storage)
+        self._ntfs_min_sizes = {}
+        self._install_files = {}
 
     @with_context()
     async def _probe(self, *, context=None):
@@ -305,17 +1029,79 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
     @with_context()
     def convert_autoinstall_config(self, context=None):
         log.debug("self.ai_data = %s", self.ai_data)
+        swap = self.ai_data.get('swap')
+        if swap is not None and 'policy' in swap:
+            # The swap: section is passed to curtin unchanged unless it
+            # uses subiquity's own policy: form.
+            size = swap.get('size')
+            if size is not None:
+                size = dehumanize_size(str(size))
+            self._set_swap_policy(SwapConfig(
+                kind=SwapKind[swap['policy'].upper()], size=size))
+            swap = None
         if 'layout' in self.ai_data:
             layout = self.ai_data['layout']
             meth = getattr(self, "guided_" + layout['name'])
             disk = self.model.disk_for_match(
                 self.model.all_disks(),
                 layout.get("match", {'size': 'largest'}))
-            meth(disk)
+            kw = {}
+            for key in 'fstype', 'subvolumes':
+                if key not in layout:
+                    continue
+                if layout['name'] not in ('direct', 'lvm'):
+                    raise Exception(
+                        "the {} layout does not support {!r}".format(
+                            layout['name'], key))
+                kw[key] = layout[key]
+            reset_partition = layout.get('reset-partition', False)
+            reset_size = None
+            if reset_partition:
+                size = None
+                if reset_partition is not True:
+                    size = dehumanize_size(str(reset_partition))
+                reset_size = self._reset_partition_size_for(disk, size)
+            meth(disk, **kw)
+            if reset_size is not None:
+                self.add_reset_partition(disk, reset_size)
+            disk.secure_wipe = layout.get('wipe')
         elif 'config' in self.ai_data:
+            for action in self.ai_data['config']:
+                if action.get('type') == 'dm_verity':
+                    # A verity device protects a read-only filesystem
+                    # with a hash tree made after it has been written,
+                    # which is not something an installer can do.
+                    raise Exception(
+                        "dm_verity devices are not supported, only "
+                        "dm_integrity")
             self.model.apply_autoinstall_config(self.ai_data['config'])
+            self.model.check_thin_lvm()
+            self.model.check_partition_names()
+            self.model.check_zfs()
+            self.model.check_integrity()
+            for fs in self.model._all(type='format'):
+                self._check_fstype(fs.fstype)
+                if fs.subvolumes is not None and fs.fstype != 'btrfs':
+                    raise Exception(
+                        "{} is {}, which does not have subvolumes".format(
+                            fs.id, fs.fstype))
+            for fs in self.model._all(type='format', fstype='btrfs'):
+                check_btrfs_subvolumes(fs.subvolumes or [])
             self.model.grub = self.ai_data.get('grub', {})
-            self.model.swap = self.ai_data.get('swap')
+            self.model.swap = swap
+        for disk in self.model.all_disks():
+            self._check_secure_wipe(disk)
+
+    def _check_secure_wipe(self, disk):
+        mode = disk.secure_wipe
+        if mode is None:
+            return
+        if mode not in disk.secure_wipe_modes():
+            raise Exception(
+                "{} does not support wiping with {}".format(disk.path, mode))
+        if disk.preserve:
+            raise Exception(
+                "cannot wipe {} and keep partitions on it".format(disk.path))
 
     def start(self):
         if self.model.bootloader == Bootloader.PREP:
@@ -325,7 +1111,39 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
             self.supports_resilient_boot = release >= '20.04'
         self._start_task = schedule_task(self._start())
 
+    async def _check_optional_fstypes(self):
+        fstypes = []
+        for fstype in OPTIONAL_FSTYPES:
+            if self.opts.dry_run:
+                fstypes.append(fstype)
+                continue
+            if fstype not in mkfs_commands:
+                # curtin would fail to format it.
+                continue
+            # modprobe --dry-run succeeds for built in modules too.
+            cp = await arun_command(['modprobe', '--dry-run', fstype])
+            if cp.returncode == 0 and shutil.which('mkfs.' + fstype):
+                fstypes.append(fstype)
+        log.debug("optional filesystems supported: %s", fstypes)
+        self.model.optional_fstypes = fstypes
+
+    async def _find_reset_partition_size(self):
+        if self.opts.dry_run:
+            media_size = 2 * (1 << 30)
+        else:
+            if not os.path.isdir(INSTALL_MEDIA):
+                return
+            cp = await arun_command(['du', '-sb', INSTALL_MEDIA])
+            if cp.returncode != 0:
+                log.debug("du %s failed: %s", INSTALL_MEDIA, cp.stderr)
+                return
+            media_size = int(cp.stdout.split()[0])
+        self._reset_partition_size = align_up(
+            int(media_size * RESET_PARTITION_SLACK), RESET_PARTITION_ALIGN)
+
     async def _start(self):
+        await self._check_optional_fstypes()
+        await self._find_reset_partition_size()
         context = pyudev.Context()
         self._monitor = pyudev.Monitor.from_netlink(context)
         self._monitor.filter_by(subsystem='block')
@@ -362,8 +1180,15 @@ class FilesystemController(SubiquityController, FilesystemManipulator):
     def make_autoinstall(self):
         rendered = self.model.render()
         r = {
-            'config': rendered['storage']['config']
+            # Not the rendered config, which has had the secure wipe
+            # modes turned into early_commands.
+            'config': self.model._render_actions(),
             }
-        if 'swap' in rendered:
+        policy = self.model.swap_policy
+        if policy.kind != SwapKind.AUTO:
+            r['swap'] = {'policy': policy.kind.name.lower()}
+            if policy.size is not None:
+                r['swap']['size'] = policy.size
+        elif 'swap' in rendered:
             r['swap'] = rendered['swap']
         return r
@@ -14,17 +14,54 @@
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import logging
+import os
+import re
+from typing import List
 
 import attr
+from aiohttp import web
 
 from subiquitycore.context import with_context
 
 from subiquity.common.apidef import API
-from subiquity.common.types import IdentityData
+from subiquity.common.types import IdentityData, IdentityUser
 from subiquity.server.controller import SubiquityController
 
 log = logging.getLogger('subiquity.server.controllers.identity')
 
+# The same rules as the identity screen applies to the first user.
+USERNAME_MAXLEN = 32
+USERNAME_REGEX = r'[a-z_][a-z0-9_-]*'
+
+
+def reserved_usernames():
+    path = os.path.join(os.environ.get("SNAP", "."), "reserved-usernames")
+    if not os.path.exists(path):
+        return {'root'}
+    reserved = set()
+    with open(path) as fp:
+        for line in fp:
+            line = line.strip()
+            if line.startswith('#') or not line:
+                continue
+            reserved.add(line)
+    return reserved
+
+
+def check_username(username, reserved):
+    if len(username) > USERNAME_MAXLEN:
+        raise ValueError(
+            "username {!r} is longer than {} characters".format(
+                username, USERNAME_MAXLEN))
+    if not re.fullmatch(USERNAME_REGEX, username):
+        raise ValueError(
+            "username {!r} does not match {}".format(
+                username, USERNAME_REGEX))
+    if username in reserved:
+        raise ValueError(
+            "username {!r} is reserved for use by the system".format(
+                username))
+
 
 class IdentityController(SubiquityController):
 
@@ -38,6 +75,29 @@ class IdentityController(SubiquityController):
             'username': {'type': 'string'},
             'hostname': {'type': 'string'},
             'password': {'type': 'string'},
+            'users': {
+                'type': 'array',
+                'items': {
+                    'type': 'object',
+                    'properties': {
+                        'username': {'type': 'string'},
+                        'realname': {'type': 'string'},
+                        'password': {'type': 'string'},
+                        'shell': {'type': 'string'},
+                        'sudo': {'type': 'boolean'},
+                        'groups': {
+                            'type': 'array',
+                            'items': {'type': 'string'},
+                            },
+                        'ssh-authorized-keys': {
+                            'type': 'array',
+                            'items': {'type': 'string'},
+                            },
+                        },
+                    'required': ['username'],
+                    'additionalProperties': False,
+                    },
+                },
             },
         'required': ['username', 'hostname', 'password'],
         'additionalProperties': False,
@@ -52,6 +112,31 @@ class IdentityController(SubiquityController):
                 crypted_password=data['password'],
                 )
             self.model.add_user(identity_data)
+            self.set_extra_users([
+                IdentityUser(
+                    username=user['username'],
+                    realname=user.get('realname', ''),
+                    crypted_password=user.get('password', ''),
+                    shell=user.get('shell', '/bin/bash'),
+                    sudo=user.get('sudo', False),
+                    groups=user.get('groups', []),
+                    ssh_authorized_keys=user.get('ssh-authorized-keys', []),
+                    )
+                for user in data.get('users', [])
+                ])
+
+    def set_extra_users(self, users):
+        reserved = reserved_usernames()
+        usernames = set()
+        if self.model.user is not None:
+            usernames.add(self.model.user.username)
+        for user in users:
+            check_username(user.username, reserved)
+            if user.username in usernames:
+                raise ValueError(
+                    "user {} is listed more than once".format(user.username))
+            usernames.add(user.username)
+        self.model.extra_users = users
 
     @with_context()
     async def apply_autoinstall_config(self, context=None):
@@ -64,6 +149,19 @@ class IdentityController(SubiquityController):
             return {}
         r = attr.asdict(self.model.user)
         r['hostname'] = self.model.hostname
+        if self.model.extra_users:
+            r['users'] = [
+                {
+                    'username': user.username,
+                    'realname': user.realname,
+                    'password': user.crypted_password,
+                    'shell': user.shell,
+                    'sudo': user.sudo,
+                    'groups': user.groups,
+                    'ssh-authorized-keys': user.ssh_authorized_keys,
+                    }
+                for user in self.model.extra_users
+                ]
         return r
 
     async def GET(self) -> IdentityData:
@@ -71,6 +169,9 @@ class IdentityController(SubiquityController):
         if self.model.user is not None:
             data.username = self.model.user.username
             data.realname = self.model.user.realname
+        elif self.model.existing_user is not None:
+            data.username = self.model.existing_user.username
+            data.realname = self.model.existing_user.realname
         if self.model.hostname:
             data.hostname = self.model.hostname
         return data
@@ -78,3 +179,12 @@ class IdentityController(SubiquityController):
     async def POST(self, data: IdentityData):
         self.model.add_user(data)
         self.configured()
+
+    async def users_GET(self) -> List[IdentityUser]:
+        return self.model.extra_users
+
+    async def users_POST(self, data: List[IdentityUser]):
+        try:
+            self.set_extra_users(data)
+        except ValueError as e:
+            raise web.HTTPUnprocessableEntity(reason=str(e))
@@ -16,11 +16,15 @@
 import asyncio
 import contextlib
 import datetime
+import glob
+import hashlib
 import logging
 import os
 import re
 import shutil
+import subprocess
 import sys
+import tempfile
 
 from curtin.commands.install import (
     ERROR_TARFILE,
@@ -28,6 +32,7 @@ from curtin.commands.install import (
     )
 from curtin.util import write_file
 
+import aiohttp
 import yaml
 
 from subiquitycore.async_helpers import (
@@ -43,6 +48,7 @@ from subiquity.common.errorreport import ErrorReportKind
 from subiquity.server.controller import (
     SubiquityController,
     )
+from subiquity.server.controllers.filesystem import INSTALL_MEDIA
 from subiquity.common.types import (
     ApplicationState,
     )
@@ -50,6 +56,42 @@ from subiquity.journald import journald_subscriptions
 
 log = logging.getLogger("subiquity.server.controllers.install")
 
+SOURCE_CHUNK_SIZE = 1 << 20
+
+# A grub.d script that adds an entry for booting the copy of the
+# installer media on the reset partition.
+RESET_GRUB_SCRIPT = """\
+#!/bin/sh
+exec tail -n +3 $0
+menuentry "Restore Ubuntu to factory state" {{
+    search --no-floppy --set=root --fs-uuid {fs_uuid}
+    linux /casper/vmlinuz uuid={casper_uuid} nopersistent
+    initrd /casper/initrd
+}}
+"""
+
+
+# kdump-tools' own etc/default/grub.d/kdump-tools.cfg reserves a fixed
+# amount of memory. That is a conffile, so rather than edit it this goes
+# in a file that sorts after it: the kernel uses the last crashkernel=.
+KDUMP_GRUB_CFG = """\
+GRUB_CMDLINE_LINUX_DEFAULT="$GRUB_CMDLINE_LINUX_DEFAULT crashkernel={size}"
+"""
+
+
+# Installed when the linux console cannot show the selected language:
+# messages there are in English instead of boxes, and fbterm (if it
+# could be installed) can be run for a console that shows the language.
+CONSOLE_PROFILE = """\
+# The linux console cannot show {language}, run fbterm for one that can.
+case "$(tty 2>/dev/null)" in
+    /dev/tty[0-9]*)
+        unset LANGUAGE
+        export LC_MESSAGES=C.UTF-8
+        ;;
+esac
+"""
+
 
 class TracebackExtractor:
 
@@ -188,11 +230,15 @@ class InstallController(SubiquityController):
         log.debug('curtin_install')
         self.curtin_event_contexts[''] = context
 
-        curtin_cmd = self._get_curtin_command()
+        try:
+            curtin_cmd = self._get_curtin_command()
 
-        log.debug('curtin install cmd: {}'.format(curtin_cmd))
+            log.debug('curtin install cmd: {}'.format(curtin_cmd))
 
-        cp = await arun_command(self.logged_command(curtin_cmd), check=True)
+            cp = await arun_command(
+                self.logged_command(curtin_cmd), check=True)
+        finally:
+            self.model.filesystem.remove_key_files()
 
         log.debug('curtin_install completed: %s', cp.returncode)
 
@@ -202,7 +248,10 @@ class InstallController(SubiquityController):
         try:
             await asyncio.wait({e.wait() for e in self.model.install_events})
 
-            if not self.app.interactive:
+            # The confirmation is asked for after the storage section,
+            # so nobody is going to give it if that was not answered.
+            if not self.app.interactive or \
+               self.app.controllers.Filesystem.timed_out:
                 if 'autoinstall' in self.app.kernel_cmdline:
                     self.model.confirm()
 
@@ -212,6 +261,11 @@ class InstallController(SubiquityController):
 
             self.app.update_state(ApplicationState.RUNNING)
 
+            if self.model.source.url is not None and \
+               self.model.source.path is None:
+                await self.download_source(
+                    context=context, url=self.model.source.url)
+
             if os.path.exists(self.model.target):
                 await self.unmount_target(
                     context=context, target=self.model.target)
@@ -247,6 +301,43 @@ class InstallController(SubiquityController):
                 ErrorReportKind.INSTALL_FAIL, "install failed", **kw)
             raise
 
+    @with_context(description="downloading {url}", level="INFO")
+    async def download_source(self, *, context, url):
+        source = self.model.source
+        # A netbooted live session has no disk of its own, so the image
+        # ends up in memory.
+        path = self.app.state_path('source.img')
+        partial = path + '.part'
+        digest = hashlib.sha256()
+        size = 0
+        # No total timeout: the image can be large and the network slow.
+        timeout = aiohttp.ClientTimeout(sock_connect=60, sock_read=60)
+        try:
+            async with aiohttp.ClientSession(
+                    timeout=timeout, trust_env=True) as session:
+                async with session.get(url) as resp:
+                    resp.raise_for_status()
+                    with open(partial, 'wb') as fp:
+                        async for chunk in resp.content.iter_chunked(
+                                SOURCE_CHUNK_SIZE):
+                            digest.update(chunk)
+                            fp.write(chunk)
+                            size += len(chunk)
+            log.debug("downloaded %s bytes from %s", size, url)
+            if digest.hexdigest() != source.sha256:
+                raise RuntimeError(
+                    "sha256 of {} is {}, expected {}".format(
+                        url, digest.hexdigest(), source.sha256))
+            os.rename(partial, path)
+        except BaseException:
+            # Whatever was downloaded is taking up memory for nothing.
+            try:
+                os.unlink(partial)
+            except FileNotFoundError:
+                pass
+            raise
+        source.path = path
+
     async def drain_curtin_events(self, *, context):
         waited = 0.0
         while len(self.curtin_event_contexts) > 1 and waited < 5.0:
@@ -264,14 +355,31 @@ class InstallController(SubiquityController):
         autoinstall_config = "#cloud-config\n" + yaml.dump(
             {"autoinstall": self.app.make_autoinstall()})
         write_file(autoinstall_path, autoinstall_config, mode=0o600)
+        # Making the autoinstall config renders the storage config, which
+        # writes the keys out again.
+        self.model.filesystem.remove_key_files()
         await self.configure_cloud_init(context=context)
         packages = []
         if self.model.ssh.install_server:
             packages = ['openssh-server']
+        packages.extend(self.model.filesystem.needed_packages())
+        packages.extend(self.model.iscsi.needed_packages())
         packages.extend(self.app.base_model.packages)
         for package in packages:
             await self.install_package(context=context, package=package)
+        optional_packages = self.model.filesystem.optional_packages() + \
+            self.model.locale.optional_packages()
+        for package in optional_packages:
+            await self.install_optional_package(
+                context=context, package=package)
+        crashkernel = await self.install_kdump(context=context)
         await self.restore_apt_config(context=context)
+        if crashkernel is not None:
+            await self.configure_kdump(context=context, size=crashkernel)
+        if not self.model.locale.console_supported():
+            await self.configure_console(context=context)
+        if self.model.filesystem.reset_partition is not None:
+            await self.create_reset_partition(context=context)
 
     @with_context(description="configuring cloud-init")
     async def configure_cloud_init(self, context):
@@ -291,6 +399,42 @@ class InstallController(SubiquityController):
                 ]
         await arun_command(self.logged_command(cmd), check=True)
 
+    async def install_optional_package(self, *, context, package):
+        """Install package if possible, and return whether it was.
+
+        This is for packages that are not in the pool on the installer
+        media, which cannot be installed without the network: not having
+        them is not worth failing the install over.
+        """
+        if not self.model.network.has_network:
+            log.warning("not installing %s without the network", package)
+            return False
+        try:
+            await self.install_package(context=context, package=package)
+        except subprocess.CalledProcessError:
+            log.warning("installing %s failed", package)
+            return False
+        return True
+
+    async def install_kdump(self, *, context):
+        """Install kdump-tools if wanted and possible.
+
+        Returns how much memory to reserve for the crash kernel, or None
+        if kernel crash dumps are not set up.
+        """
+        if not self.model.kdump.enabled:
+            return None
+        crashkernel = self.model.kdump.crashkernel()
+        if crashkernel is None:
+            log.warning("not enough memory for kernel crash dumps")
+            return None
+        # Memory reserved for a crash kernel that nothing loads would
+        # just be wasted.
+        if not await self.install_optional_package(
+                context=context, package='kdump-tools'):
+            return None
+        return crashkernel
+
     @with_context(description="restoring apt configuration")
     async def restore_apt_config(self, context):
         if self.app.opts.dry_run:
@@ -309,6 +453,65 @@ class InstallController(SubiquityController):
         for cmd in cmds:
             await arun_command(self.logged_command(cmd), check=True)
 
+    @with_context(description="reserving {size} for kernel crash dumps")
+    async def configure_kdump(self, *, context, size):
+        if self.app.opts.dry_run:
+            await arun_command(["sleep", str(1/self.app.scale_factor)])
+            return
+        write_file(
+            self.tpath('etc/default/grub.d/99-subiquity-kdump.cfg'),
+            KDUMP_GRUB_CFG.format(size=size), mode=0o644)
+        await arun_command(self.logged_command([
+            sys.executable, "-m", "curtin", "in-target", "-t", "/target",
+            "--", "update-grub",
+            ]), check=True)
+
+    @with_context(description="configuring the console")
+    async def configure_console(self, *, context):
+        write_file(
+            self.tpath('etc/profile.d/subiquity-console.sh'),
+            CONSOLE_PROFILE.format(
+                language=self.model.locale.selected_language),
+            mode=0o644)
+
+    @with_context(description="creating the reset partition")
+    async def create_reset_partition(self, *, context):
+        if self.app.opts.dry_run:
+            await arun_command(["sleep", str(2/self.app.scale_factor)])
+            return
+        path = self.model.filesystem.reset_partition._path()
+        with tempfile.TemporaryDirectory() as mnt:
+            await arun_command(['mount', path, mnt], check=True)
+            try:
+                # The media has symlinks (back into itself) that FAT
+                # cannot hold, and rsync skips them without -l.
+                await arun_command(
+                    self.logged_command(
+                        ['rsync', '-rt', INSTALL_MEDIA + '/', mnt + '/']),
+                    check=True)
+            finally:
+                await arun_command(['umount', mnt])
+        cp = await arun_command(
+            ['blkid', '-s', 'UUID', '-o', 'value', path], check=True)
+        # casper only boots from media with the same UUID as the
+        # initrd it is booted with.
+        casper_uuid = ''
+        for uuid_path in glob.glob(
+                os.path.join(INSTALL_MEDIA, '.disk', 'casper-uuid-*')):
+            with open(uuid_path) as fp:
+                casper_uuid = fp.read().strip()
+            break
+        script = self.tpath('etc/grub.d/99_reset')
+        write_file(
+            script,
+            RESET_GRUB_SCRIPT.format(
+                fs_uuid=cp.stdout.strip(), casper_uuid=casper_uuid),
+            mode=0o755)
+        await arun_command(self.logged_command([
+            sys.executable, "-m", "curtin", "in-target", "-t", "/target",
+            "--", "update-grub",
+            ]), check=True)
+
     @with_context(description="downloading and installing {policy} updates")
     async def run_unattended_upgrades(self, context, policy):
         if self.app.opts.dry_run:
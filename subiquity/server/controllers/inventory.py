@@ -0,0 +1,224 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import logging
+import os
+
+import aiohttp
+
+from subiquitycore.context import with_context
+
+from subiquity.common.apidef import API
+from subiquity.common.types import (
+    ApplicationState,
+    InventoryConfig,
+    )
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger('subiquity.server.controllers.inventory')
+
+INVENTORY_TIMEOUT = 30
+INVENTORY_ATTEMPTS = 3
+INVENTORY_RETRY_DELAY = 10
+
+DMI_KEYS = [
+    'sys_vendor',
+    'product_name',
+    'product_version',
+    'product_serial',
+    'product_uuid',
+    'board_vendor',
+    'board_name',
+    'board_serial',
+    'chassis_serial',
+    'chassis_asset_tag',
+    'bios_vendor',
+    'bios_version',
+    ]
+
+
+class InventoryController(SubiquityController):
+
+    endpoint = API.inventory
+
+    autoinstall_key = model_name = "inventory"
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'url': {'type': 'string'},
+            'token': {'type': 'string'},
+            'probe-data': {'type': 'boolean'},
+            },
+        'required': ['url'],
+        'additionalProperties': False,
+        }
+
+    def __init__(self, app):
+        super().__init__(app)
+        # Set once the report has been sent (or there was nothing to
+        # send), so that the Reboot controller can wait for it.
+        self.report_event = asyncio.Event()
+
+    def load_autoinstall_data(self, data):
+        if data is None:
+            return
+        self.model.url = data['url']
+        self.model.token = data.get('token')
+        self.model.probe_data = data.get('probe-data', True)
+
+    def make_autoinstall(self):
+        if self.model.url is None:
+            return None
+        # The token is left out so that it does not end up in the
+        # autoinstall-user-data saved in the target.
+        return {
+            'url': self.model.url,
+            'probe-data': self.model.probe_data,
+            }
+
+    def serialize(self):
+        # The token is not written to the state files either. It comes
+        # from the autoinstall config, which is loaded again when the
+        # server restarts.
+        return {
+            'url': self.model.url,
+            'probe_data': self.model.probe_data,
+            }
+
+    def deserialize(self, data):
+        self.model.url = data['url']
+        self.model.probe_data = data['probe_data']
+
+    def start(self):
+        self.app.aio_loop.create_task(self._run())
+
+    async def _run(self):
+        Install = self.app.controllers.Install
+        await asyncio.wait({Install.install_task})
+        try:
+            if self.app.state == ApplicationState.DONE:
+                await self.app.controllers.Late.run_event.wait()
+            if self.model.url:
+                await self.report()
+        finally:
+            self.report_event.set()
+
+    def _dmi(self):
+        dmi = {}
+        for name in DMI_KEYS:
+            try:
+                with open(os.path.join('/sys/class/dmi/id', name)) as fp:
+                    dmi[name.replace('_', '-')] = fp.read().strip()
+            except OSError:
+                pass
+        return dmi
+
+    def _disks(self):
+        disks = []
+        for disk in self.app.base_model.filesystem.all_disks():
+            disks.append({
+                'path': disk.path,
+                'serial': disk.serial,
+                'wwn': disk.wwn,
+                'model': disk.model,
+                'size': disk.size,
+                })
+        return disks
+
+    def _nics(self):
+        nics = []
+        network = self.app.base_model.network
+        for dev in network.get_all_netdevs(include_deleted=True):
+            if dev.info is None:
+                # Virtual devices (bonds, VLANs, ...) we created.
+                continue
+            nics.append({
+                'name': dev.name,
+                'type': dev.type,
+                'hwaddr': getattr(dev.info, 'hwaddr', None),
+                'vendor': getattr(dev.info, 'vendor', None),
+                'model': getattr(dev.info, 'model', None),
+                })
+        return nics
+
+    def inventory(self):
+        status = {'state': self.app.state.name}
+        if self.app.fatal_error is not None:
+            status['error-report'] = self.app.fatal_error.base
+        data = {
+            'session-id': self.app.session_id,
+            'hostname': self.app.base_model.identity.hostname,
+            'status': status,
+            'dmi': self._dmi(),
+            'disks': self._disks(),
+            'nics': self._nics(),
+            }
+        if self.model.probe_data:
+            data['probe-data'] = {
+                'storage': self.app.base_model.filesystem._probe_data,
+                }
+        return data
+
+    async def _post(self, data):
+        headers = {}
+        if self.model.token:
+            headers['Authorization'] = 'Bearer ' + self.model.token
+        timeout = aiohttp.ClientTimeout(total=INVENTORY_TIMEOUT)
+        async with aiohttp.ClientSession(
+                timeout=timeout, trust_env=True) as session:
+            async with session.post(
+                    self.model.url, json=data, headers=headers) as resp:
+                if resp.status >= 300:
+                    raise RuntimeError(
+                        "inventory server returned HTTP status {}".format(
+                            resp.status))
+
+    @with_context(description="reporting hardware inventory")
+    async def report(self, *, context):
+        """Send the inventory, giving up quietly if that keeps failing.
+
+        A CMDB being down is not a reason to fail (or hold up) the install.
+        """
+        data = self.inventory()
+        for attempt in range(1, INVENTORY_ATTEMPTS + 1):
+            try:
+                await self._post(data)
+            except (OSError, RuntimeError, aiohttp.ClientError,
+                    asyncio.TimeoutError) as e:
+                log.warning(
+                    "sending inventory failed (attempt %d of %d): %s",
+                    attempt, INVENTORY_ATTEMPTS, str(e) or type(e).__name__)
+                if attempt < INVENTORY_ATTEMPTS:
+                    await asyncio.sleep(INVENTORY_RETRY_DELAY)
+            else:
+                log.debug("sent inventory to %s", self.model.url)
+                return
+
+    async def GET(self) -> InventoryConfig:
+        # Anything that can reach the API can read this, so the token is
+        # never handed out.
+        return InventoryConfig(
+            url=self.model.url, probe_data=self.model.probe_data)
+
+    async def POST(self, data: InventoryConfig):
+        self.model.url = data.url
+        if data.token is not None:
+            # A config that was read with GET has no token, and posting
+            # it back should not drop the one that is set.
+            self.model.token = data.token
+        self.model.probe_data = data.probe_data
+        self.configured()
@@ -0,0 +1,354 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import logging
+import random
+import shutil
+
+from subiquitycore.context import with_context
+from subiquitycore.utils import arun_command
+
+from subiquity.common.apidef import API
+from subiquity.common.types import (
+    ISCSIChap,
+    ISCSIDiscovery,
+    ISCSIDiscoveryResponse,
+    ISCSILogin,
+    ISCSIStatus,
+    ISCSITarget,
+    MultipathDevice,
+    )
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger("subiquity.server.controllers.iscsi")
+
+DEFAULT_PORT = 3260
+
+# iscsiadm exits with this when asked about sessions and there are none.
+ISCSI_ERR_NO_OBJS_FOUND = 21
+
+dry_run_iqns = [
+    'iqn.2003-01.org.example:storage.lun1',
+    'iqn.2003-01.org.example:storage.lun2',
+    ]
+
+
+def normalize_portal(portal):
+    """Add the default port to a portal address that does not have one."""
+    portal = portal.strip()
+    if portal.startswith('['):
+        if portal.endswith(']'):
+            portal = '{}:{}'.format(portal, DEFAULT_PORT)
+    elif portal.count(':') > 1:
+        # A bare IPv6 address.
+        portal = '[{}]:{}'.format(portal, DEFAULT_PORT)
+    elif ':' not in portal:
+        portal = '{}:{}'.format(portal, DEFAULT_PORT)
+    return portal
+
+
+class ISCSIError(Exception):
+    """iscsiadm failed, with a message that is worth showing the user."""
+
+
+def same_target(a, b):
+    return (a.portal, a.iqn) == (b.portal, b.iqn)
+
+
+def parse_sendtargets(output):
+    # Lines look like "10.0.0.1:3260,1 iqn.2003-01.org.example:lun1"
+    targets = []
+    for line in output.splitlines():
+        parts = line.split()
+        if len(parts) != 2:
+            continue
+        portal = parts[0].rsplit(',', 1)[0]
+        targets.append(ISCSITarget(portal=portal, iqn=parts[1]))
+    return targets
+
+
+def parse_sessions(output):
+    # Lines look like "tcp: [1] 10.0.0.1:3260,1 iqn.2003-01.org.example:lun1
+    # (non-flash)"
+    targets = []
+    for line in output.splitlines():
+        parts = line.split()
+        if len(parts) < 4:
+            continue
+        portal = parts[2].rsplit(',', 1)[0]
+        targets.append(
+            ISCSITarget(portal=portal, iqn=parts[3], logged_in=True))
+    return targets
+
+
+def parse_multipath_paths(output):
+    # The output of 'multipathd show paths raw format "%m %w %d"' (alias,
+    # wwid, path device), one path per line.
+    devices = {}
+    for line in output.splitlines():
+        parts = line.split()
+        if len(parts) != 3 or parts[0] == '[orphan]':
+            continue
+        name, wwid, dev = parts
+        if name not in devices:
+            devices[name] = MultipathDevice(name=name, wwid=wwid, paths=[])
+        devices[name].paths.append(dev)
+    return list(devices.values())
+
+
+class ISCSIController(SubiquityController):
+
+    endpoint = API.iscsi
+
+    autoinstall_key = model_name = "iscsi"
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'targets': {
+                'type': 'array',
+                'items': {
+                    'type': 'object',
+                    'properties': {
+                        'portal': {'type': 'string'},
+                        'iqn': {'type': 'string'},
+                        'username': {'type': 'string'},
+                        'password': {'type': 'string'},
+                        },
+                    'required': ['portal', 'iqn'],
+                    'additionalProperties': False,
+                    },
+                },
+            },
+        'additionalProperties': False,
+        }
+
+    def __init__(self, app):
+        super().__init__(app)
+        self.ai_logins = []
+        self._dry_run_sessions = []
+
+    def interactive(self):
+        if not self.opts.dry_run and shutil.which('iscsiadm') is None:
+            return False
+        return super().interactive()
+
+    def _logins_from_data(self, data):
+        logins = []
+        for target in data.get('targets', []):
+            chap = None
+            if 'username' in target:
+                chap = ISCSIChap(
+                    username=target['username'],
+                    password=target.get('password', ''))
+            logins.append(ISCSILogin(
+                target=ISCSITarget(
+                    portal=normalize_portal(target['portal']),
+                    iqn=target['iqn']),
+                chap=chap))
+        return logins
+
+    def load_autoinstall_data(self, data):
+        if data is not None:
+            self.ai_logins = self._logins_from_data(data)
+        else:
+            self.ai_logins = []
+
+    @with_context()
+    async def apply_autoinstall_config(self, context=None):
+        for login in self.ai_logins:
+            await self._login(login)
+        if self.ai_logins:
+            await self.app.hub.abroadcast('storage-devices-changed')
+
+    def serialize(self):
+        return self.make_autoinstall()
+
+    def deserialize(self, data):
+        # The sessions themselves survive a restart of the server, and
+        # iscsiadm's node records keep the CHAP passwords, so they are not
+        # needed again.
+        self.model.logins = self._logins_from_data(data)
+
+    def make_autoinstall(self):
+        # Like the identity section, this must not include a plaintext
+        # password, so the CHAP passwords are left out.
+        targets = []
+        for login in self.model.logins:
+            target = {
+                'portal': login.target.portal,
+                'iqn': login.target.iqn,
+                }
+            if login.chap is not None:
+                target['username'] = login.chap.username
+            targets.append(target)
+        return {'targets': targets}
+
+    async def _run(self, cmd, **kw):
+        cp = await arun_command(cmd, **kw)
+        if cp.returncode != 0:
+            raise ISCSIError(cp.stderr.strip() or cp.stdout.strip())
+        return cp
+
+    async def _iscsiadm(self, *args):
+        return await self._run(['iscsiadm'] + list(args))
+
+    async def _update(self, args, name, value, *, secret=False):
+        cmd = ['iscsiadm'] + args + ['-o', 'update', '-n', name]
+        if secret:
+            # Pass the value through stdin so that it does not end up in
+            # the logs alongside the command line.
+            cmd = ['sh', '-c', 'IFS= read -r v; exec "$@" -v "$v"', '--'] + cmd
+            await self._run(cmd, input=value + '\n')
+        else:
+            await self._run(cmd + ['-v', value])
+
+    async def _set_chap(self, args, prefix, chap):
+        await self._update(args, prefix + 'authmethod', 'CHAP')
+        await self._update(args, prefix + 'username', chap.username)
+        await self._update(
+            args, prefix + 'password', chap.password, secret=True)
+
+    async def _login(self, login):
+        target = login.target
+        node = ['-m', 'node', '-T', target.iqn, '-p', target.portal]
+        log.debug("logging into %s on %s", target.iqn, target.portal)
+        if self.opts.dry_run:
+            await asyncio.sleep(random.random()*0.4)
+            self._dry_run_sessions.append(
+                ISCSITarget(target.portal, target.iqn, logged_in=True))
+        else:
+            # Create the node record in case this target was not found by
+            # discovery (it may not be advertised by the portal).
+            await self._iscsiadm(*node, '-o', 'new')
+            if login.chap is not None:
+                await self._set_chap(
+                    node, 'node.session.auth.', login.chap)
+            # This is what makes the initramfs of the installed system
+            # log in again.
+            await self._update(node, 'node.startup', 'automatic')
+            await self._iscsiadm(*node, '--login')
+            # Let udev finish creating the device nodes for the new
+            # LUNs (and multipathd assemble any maps) before probing.
+            await arun_command(['udevadm', 'settle'])
+        self.model.logins = [
+            existing for existing in self.model.logins
+            if not same_target(existing.target, target)
+            ]
+        self.model.logins.append(login)
+
+    async def _sessions(self):
+        if self.opts.dry_run:
+            return list(self._dry_run_sessions)
+        cp = await arun_command(['iscsiadm', '-m', 'session'])
+        if cp.returncode != 0:
+            if cp.returncode != ISCSI_ERR_NO_OBJS_FOUND:
+                log.debug("listing iSCSI sessions failed: %s", cp.stderr)
+            return []
+        return parse_sessions(cp.stdout)
+
+    async def _multipath(self):
+        if self.opts.dry_run:
+            if not self._dry_run_sessions:
+                return []
+            return [MultipathDevice(
+                name='mpatha', wwid='36001405b0c1a2f9e2c04fd8b2d8c1e6a',
+                paths=['sdb', 'sdc'])]
+        if shutil.which('multipathd') is None:
+            return []
+        cp = await arun_command(
+            ['multipathd', 'show', 'paths', 'raw', 'format', '%m %w %d'])
+        if cp.returncode != 0:
+            return []
+        return parse_multipath_paths(cp.stdout)
+
+    def _initiator_name(self):
+        if self.opts.dry_run:
+            return 'iqn.2004-10.com.ubuntu:01:dryrun'
+        try:
+            with open('/etc/iscsi/initiatorname.iscsi') as fp:
+                for line in fp:
+                    if line.startswith('InitiatorName='):
+                        return line.split('=', 1)[1].strip()
+        except FileNotFoundError:
+            pass
+        return ''
+
+    async def GET(self) -> ISCSIStatus:
+        return ISCSIStatus(
+            initiator_name=self._initiator_name(),
+            targets=await self._sessions(),
+            multipath=await self._multipath())
+
+    async def _status_with_error(self, error):
+        status = await self.GET()
+        status.error = error
+        return status
+
+    async def POST(self) -> None:
+        self.configured()
+
+    async def discover_POST(self, discovery: ISCSIDiscovery) \
+            -> ISCSIDiscoveryResponse:
+        portal = normalize_portal(discovery.portal)
+        if self.opts.dry_run:
+            await asyncio.sleep(random.random()*0.4)
+            targets = [ISCSITarget(portal, iqn) for iqn in dry_run_iqns]
+        else:
+            base = ['-m', 'discoverydb', '-t', 'sendtargets', '-p', portal]
+            try:
+                await self._iscsiadm(*base, '-o', 'new')
+                if discovery.chap is not None:
+                    await self._set_chap(
+                        base, 'discovery.sendtargets.auth.', discovery.chap)
+                cp = await self._iscsiadm(*base, '--discover')
+            except ISCSIError as e:
+                return ISCSIDiscoveryResponse(targets=[], error=str(e))
+            targets = parse_sendtargets(cp.stdout)
+        sessions = await self._sessions()
+        for target in targets:
+            target.logged_in = any(same_target(target, s) for s in sessions)
+        return ISCSIDiscoveryResponse(targets=targets)
+
+    async def login_POST(self, login: ISCSILogin) -> ISCSIStatus:
+        login.target.portal = normalize_portal(login.target.portal)
+        try:
+            await self._login(login)
+        except ISCSIError as e:
+            return await self._status_with_error(str(e))
+        await self.app.hub.abroadcast('storage-devices-changed')
+        return await self.GET()
+
+    async def logout_POST(self, target: ISCSITarget) -> ISCSIStatus:
+        if self.opts.dry_run:
+            self._dry_run_sessions = [
+                session for session in self._dry_run_sessions
+                if not same_target(session, target)
+                ]
+        else:
+            try:
+                await self._iscsiadm(
+                    '-m', 'node', '-T', target.iqn, '-p', target.portal,
+                    '--logout')
+            except ISCSIError as e:
+                return await self._status_with_error(str(e))
+            await arun_command(['udevadm', 'settle'])
+        self.model.logins = [
+            login for login in self.model.logins
+            if not same_target(login.target, target)
+            ]
+        await self.app.hub.abroadcast('storage-devices-changed')
+        return await self.GET()
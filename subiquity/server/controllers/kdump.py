@@ -0,0 +1,82 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+from subiquity.common.apidef import API
+from subiquity.common.types import KdumpInfo
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger('subiquity.server.controllers.kdump')
+
+
+def memory_size():
+    with open('/proc/meminfo') as fp:
+        for line in fp:
+            if line.startswith('MemTotal:'):
+                return int(line.split()[1]) * 1024
+    return None
+
+
+class KdumpController(SubiquityController):
+
+    endpoint = API.kdump
+
+    autoinstall_key = model_name = "kdump"
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'enabled': {'type': 'boolean'},
+            'crashkernel': {
+                'type': 'string',
+                'pattern': r'^[0-9]+[KMG]$',
+                },
+            },
+        'additionalProperties': False,
+        }
+
+    def __init__(self, app):
+        super().__init__(app)
+        self.model.memory = memory_size()
+
+    def load_autoinstall_data(self, data):
+        if data is None:
+            return
+        self.model.enabled = data.get('enabled', False)
+        self.model.crashkernel_override = data.get('crashkernel')
+
+    def serialize(self):
+        return self.model.enabled
+
+    def deserialize(self, data):
+        self.model.enabled = data
+
+    def make_autoinstall(self):
+        r = {'enabled': self.model.enabled}
+        if self.model.crashkernel_override is not None:
+            r['crashkernel'] = self.model.crashkernel_override
+        return r
+
+    async def GET(self) -> KdumpInfo:
+        return KdumpInfo(
+            enabled=self.model.enabled,
+            crashkernel=self.model.crashkernel())
+
+    async def POST(self, data: bool):
+        if data and self.model.crashkernel() is None:
+            raise ValueError("not enough memory for kernel crash dumps")
+        self.model.enabled = data
+        self.configured()
@@ -15,10 +15,14 @@
 
 import asyncio
 import enum
+import functools
 import logging
 import requests
+import time
+from urllib import parse
 from xml.etree import ElementTree
 
+from curtin.commands.apt_config import PRIMARY_ARCHES
 from curtin.config import merge_config
 
 from subiquitycore.async_helpers import (
@@ -26,12 +30,55 @@ from subiquitycore.async_helpers import (
     SingleInstanceTask,
     )
 from subiquitycore.context import with_context
+from subiquitycore.lsb_release import lsb_release
 
 from subiquity.common.apidef import API
+from subiquity.common.types import (
+    MirrorRanking,
+    MirrorRankingState,
+    MirrorSpeed,
+    )
 from subiquity.server.controller import SubiquityController
+from subiquity.server.ipv6 import has_dns64, reachable_over_ipv6
 
 log = logging.getLogger('subiquity.server.controllers.mirror')
 
+GEOIP_URL = "https://geoip.ubuntu.com/lookup"
+# The mirrors of the primary archive in a country, according to
+# Launchpad.
+MIRROR_LIST_URL = "http://mirrors.ubuntu.com/{cc}.txt"
+MIRROR_RANK_CANDIDATES = 5
+MIRROR_RANK_TIMEOUT = 10
+
+
+def parse_mirror_list(content):
+    mirrors = []
+    for line in content.splitlines():
+        line = line.strip().rstrip('/')
+        if not line.startswith(('http://', 'https://')):
+            continue
+        if line not in mirrors:
+            mirrors.append(line)
+    return mirrors
+
+
+def rank_mirrors(results):
+    """Sort results fastest first, with the failed mirrors at the end."""
+    return sorted(results, key=lambda r: (r.speed is None, -(r.speed or 0)))
+
+
+def measure_mirror(url, codename):
+    """Time downloading the Release file of codename from the mirror."""
+    release_url = '{}/dists/{}/Release'.format(url.rstrip('/'), codename)
+    start = time.monotonic()
+    try:
+        response = requests.get(release_url, timeout=MIRROR_RANK_TIMEOUT)
+        response.raise_for_status()
+    except requests.exceptions.RequestException as e:
+        return MirrorSpeed(url=url, error=str(e))
+    elapsed = max(time.monotonic() - start, 0.001)
+    return MirrorSpeed(url=url, speed=len(response.content) / elapsed)
+
 
 class CheckState(enum.IntEnum):
     NOT_STARTED = enum.auto()
@@ -51,6 +98,7 @@ class MirrorController(SubiquityController):
             'preserve_sources_list': {'type': 'boolean'},
             'primary': {'type': 'array'},
             'geoip':  {'type': 'boolean'},
+            'rank-mirrors': {'type': 'boolean'},
             'sources': {'type': 'object'},
             },
         }
@@ -61,13 +109,19 @@ class MirrorController(SubiquityController):
         self.geoip_enabled = True
         self.check_state = CheckState.NOT_STARTED
         self.lookup_task = SingleInstanceTask(self.lookup)
+        self.cc = None
+        self.rank_enabled = False
+        self.ranking = MirrorRanking(state=MirrorRankingState.NOT_STARTED)
+        self.rank_task = SingleInstanceTask(self.rank)
         self.app.hub.subscribe('network-up', self.maybe_start_check)
         self.app.hub.subscribe('network-proxy-set', self.maybe_start_check)
+        self.app.hub.subscribe('network-offline', self.stop_check)
 
     def load_autoinstall_data(self, data):
         if data is None:
             return
         geoip = data.pop('geoip', True)
+        self.rank_enabled = data.pop('rank-mirrors', False)
         merge_config(self.model.config, data)
         self.geoip_enabled = geoip and self.model.is_default()
 
@@ -82,19 +136,55 @@ class MirrorController(SubiquityController):
                 await asyncio.wait_for(self.lookup_task.wait(), 10)
         except asyncio.TimeoutError:
             pass
+        if not self.rank_enabled or self.rank_task.task is None:
+            return
+        try:
+            with context.child('waiting_for_ranking'):
+                await asyncio.wait_for(self.rank_task.wait(), 60)
+        except asyncio.TimeoutError:
+            pass
 
     def maybe_start_check(self):
         if not self.geoip_enabled:
             return
+        if self.app.base_model.offline.offline:
+            log.debug("offline install, not doing geoip lookup")
+            return
         if self.check_state != CheckState.DONE:
             self.check_state = CheckState.CHECKING
             self.lookup_task.start_sync()
 
+    def stop_check(self):
+        # Restarting the lookup stops it at once, rather than leaving
+        # anything waiting for it to wait for a network that is not
+        # going to be used.
+        if self.check_state == CheckState.CHECKING:
+            self.lookup_task.start_sync()
+
+    def _ipv6_only(self):
+        return self.app.base_model.network.ipv6_only
+
+    async def _reachable(self, url):
+        if not self._ipv6_only():
+            return True
+        return await run_in_thread(
+            reachable_over_ipv6, parse.urlparse(url).hostname)
+
     @with_context()
     async def lookup(self, context):
+        if self.app.base_model.offline.offline:
+            self.check_state = CheckState.NOT_STARTED
+            return
+        if self._ipv6_only():
+            log.debug(
+                "IPv6 only network, DNS64 %s",
+                "found" if await run_in_thread(has_dns64) else "not found")
+        if not await self._reachable(GEOIP_URL):
+            log.debug("cannot reach geoip over IPv6, skipping lookup")
+            self.check_state = CheckState.FAILED
+            return
         try:
-            response = await run_in_thread(
-                requests.get, "https://geoip.ubuntu.com/lookup")
+            response = await run_in_thread(requests.get, GEOIP_URL)
             response.raise_for_status()
         except requests.exceptions.RequestException:
             log.exception("geoip lookup failed")
@@ -117,7 +207,60 @@ class MirrorController(SubiquityController):
             self.check_state = CheckState.FAILED
             return
         self.check_state = CheckState.DONE
+        self.cc = cc
         self.model.set_country(cc)
+        mirror = self.model.get_mirror()
+        if not await self._reachable(mirror):
+            # The country mirrors are run by third parties and not all
+            # of them have IPv6, but the primary archive does.
+            log.debug(
+                "cannot reach %s over IPv6, using %s", mirror,
+                self.model.default_mirror)
+            self.model.set_mirror(self.model.default_mirror)
+        if self.rank_enabled:
+            self.rank_task.start_sync()
+
+    async def _measure(self, url, codename):
+        if not await self._reachable(url):
+            return MirrorSpeed(url=url, error="not reachable over IPv6")
+        return await run_in_thread(measure_mirror, url, codename)
+
+    @with_context()
+    async def rank(self, context):
+        if self.check_state != CheckState.DONE or \
+           self.model.architecture not in PRIMARY_ARCHES:
+            # There is no list of country mirrors for the ports archive.
+            self.ranking = MirrorRanking(state=MirrorRankingState.FAILED)
+            return
+        self.ranking = MirrorRanking(state=MirrorRankingState.RUNNING)
+        current = self.model.get_mirror()
+        candidates = [current]
+        try:
+            response = await run_in_thread(functools.partial(
+                requests.get, MIRROR_LIST_URL.format(cc=self.cc.upper()),
+                timeout=MIRROR_RANK_TIMEOUT))
+            response.raise_for_status()
+        except requests.exceptions.RequestException:
+            log.exception("fetching the mirror list failed")
+        else:
+            candidates.extend(
+                m for m in parse_mirror_list(response.text)
+                if m != current.rstrip('/'))
+        codename = lsb_release().get('codename', '')
+        results = []
+        for url in candidates[:MIRROR_RANK_CANDIDATES]:
+            with context.child('measure', url):
+                results.append(await self._measure(url, codename))
+        results = rank_mirrors(results)
+        log.debug("mirror speeds: %s", results)
+        selected = None
+        # Leave the mirror alone if it has been changed in the meantime.
+        if results[0].speed is not None and \
+           self.model.get_mirror() == current:
+            selected = results[0].url
+            self.model.set_mirror(selected)
+        self.ranking = MirrorRanking(
+            state=MirrorRankingState.DONE, results=results, selected=selected)
 
     def serialize(self):
         return self.model.get_mirror()
@@ -128,6 +271,8 @@ class MirrorController(SubiquityController):
     def make_autoinstall(self):
         r = self.model.render()['apt']
         r['geoip'] = self.geoip_enabled
+        if self.rank_enabled:
+            r['rank-mirrors'] = True
         return r
 
     async def GET(self) -> str:
@@ -136,3 +281,19 @@ class MirrorController(SubiquityController):
     async def POST(self, data: str):
         self.model.set_mirror(data)
         self.configured()
+
+    async def ranking_GET(self, wait: bool = False) -> MirrorRanking:
+        if wait:
+            if self.check_state == CheckState.CHECKING:
+                await self.lookup_task.wait()
+            if self.rank_task.task is not None:
+                await self.rank_task.wait()
+        return self.ranking
+
+    async def ranking_POST(self) -> None:
+        if self.ranking.state == MirrorRankingState.RUNNING:
+            return
+        self.rank_enabled = True
+        if self.check_state != CheckState.CHECKING:
+            # Otherwise the lookup starts the ranking when it is done.
+            self.rank_task.start_sync()
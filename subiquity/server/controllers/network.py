@@ -18,13 +18,16 @@ import logging
 from typing import List, Optional
 
 import aiohttp
+import yaml
 
 from subiquitycore.async_helpers import schedule_task
 from subiquitycore.context import with_context
 from subiquitycore.controllers.network import BaseNetworkController
 from subiquitycore.models.network import (
     BondConfig,
+    BridgeConfig,
     NetDevInfo,
+    RoutingConfig,
     StaticConfig,
     )
 
@@ -35,11 +38,43 @@ from subiquity.common.apidef import (
     NetEventAPI,
     )
 from subiquity.common.errorreport import ErrorReportKind
+from subiquity.common.installfiles import (
+    NETPLAN_FILES,
+    parse_os_release,
+    )
+from subiquity.common.types import InstalledNetworkConfig
 from subiquity.server.controller import SubiquityController
 
 
 log = logging.getLogger("subiquity.server.controllers.network")
 
+def installed_network_config(source, files):
+    """Describe the netplan config of the install whose files are files.
+
+    files maps paths relative to the root of the install to their
+    contents. None is returned if the install has no netplan config.
+    """
+    names = sorted(name for name in files if name.startswith('etc/netplan/'))
+    if not names:
+        return None
+    interfaces = set()
+    for name in names:
+        try:
+            config = yaml.safe_load(files[name])
+        except yaml.YAMLError:
+            continue
+        network = (config or {}).get('network') or {}
+        for key in 'ethernets', 'bonds', 'bridges', 'vlans':
+            interfaces.update(network.get(key) or {})
+    os_release = parse_os_release(files.get('etc/os-release', ''))
+    return InstalledNetworkConfig(
+        source=source,
+        os_name=os_release.get(
+            'PRETTY_NAME', os_release.get('NAME', 'Linux')),
+        files=[files[name] for name in names],
+        interfaces=sorted(interfaces))
+
+
 MATCH = {
     'type': 'object',
     'properties': {
@@ -170,8 +205,7 @@ class NetworkController(BaseNetworkController, SubiquityController):
             self.apply_config(context)
         with context.child("wait_for_apply"):
             await self.apply_config_task.wait()
-        self.model.has_network = bool(
-            self.network_event_receiver.default_routes)
+        self.update_has_network()
 
     async def _apply_config(self, *, context=None, silent=False):
         try:
@@ -200,9 +234,17 @@ class NetworkController(BaseNetworkController, SubiquityController):
             netdev.netdev_info() for netdev in self.model.get_all_netdevs()
             ]
 
+    def has_default_route(self):
+        return bool(self.network_event_receiver.default_routes)
+
+    def update_has_network(self):
+        # has_network means "the install can use the network", which it
+        # must not when the user has asked for an offline install.
+        offline = self.app.base_model.offline.offline
+        self.model.has_network = self.has_default_route() and not offline
+
     def configured(self):
-        self.model.has_network = bool(
-            self.network_event_receiver.default_routes)
+        self.update_has_network()
         super().configured()
 
     async def POST(self) -> None:
@@ -214,6 +256,21 @@ class NetworkController(BaseNetworkController, SubiquityController):
             ips.extend(map(str, dev.actual_global_ip_addresses))
         return ips
 
+    async def installed_configs_GET(self) -> List[InstalledNetworkConfig]:
+        installs = await self.app.controllers.Filesystem.read_installs(
+            NETPLAN_FILES)
+        configs = []
+        for source, files in installs:
+            config = installed_network_config(source, files)
+            if config is not None:
+                configs.append(config)
+        return configs
+
+    async def import_installed_POST(self,
+                                    config: InstalledNetworkConfig) -> None:
+        log.debug("importing network config from %s", config.source)
+        self.import_netplan_config(config.files)
+
     async def subscription_PUT(self, socket_path: str) -> None:
         log.debug('added subscription %s', socket_path)
         conn = aiohttp.UnixConnector(socket_path)
@@ -223,7 +280,8 @@ class NetworkController(BaseNetworkController, SubiquityController):
         self.app.aio_loop.create_task(
             self._call_client(
                 client, conn, lock, "route_watch",
-                self.network_event_receiver.default_routes))
+                self.network_event_receiver.default_routes,
+                self.network_event_receiver.ipv6_only))
 
     async def subscription_DELETE(self, socket_path: str) -> None:
         if socket_path not in self.clients:
@@ -261,7 +319,8 @@ class NetworkController(BaseNetworkController, SubiquityController):
 
     def update_default_routes(self, routes):
         super().update_default_routes(routes)
-        self._call_clients("route_watch", routes)
+        self._call_clients(
+            "route_watch", routes, self.network_event_receiver.ipv6_only)
 
     def _send_update(self, act, dev):
         with self.context.child(
@@ -286,20 +345,29 @@ class NetworkController(BaseNetworkController, SubiquityController):
                                      static_config: StaticConfig) -> None:
         self.set_static_config(dev_name, ip_version, static_config)
 
+    async def set_routing_config_POST(self, dev_name: str,
+                                      routing_config: RoutingConfig) -> None:
+        self.set_routing_config(dev_name, routing_config)
+
     async def enable_dhcp_POST(self, dev_name: str, ip_version: int) -> None:
         self.enable_dhcp(dev_name, ip_version)
 
     async def disable_POST(self, dev_name: str, ip_version: int) -> None:
         self.disable_network(dev_name, ip_version)
 
-    async def vlan_PUT(self, dev_name: str, vlan_id: int) -> None:
-        self.add_vlan(dev_name, vlan_id)
+    async def vlan_PUT(self, dev_name: str, vlan_ids: List[int]) -> None:
+        self.add_vlans(dev_name, vlan_ids)
 
     async def add_or_edit_bond_POST(self, existing_name: Optional[str],
                                     new_name: str,
                                     bond_config: BondConfig) -> None:
         self.add_or_update_bond(existing_name, new_name, bond_config)
 
+    async def add_or_edit_bridge_POST(self, existing_name: Optional[str],
+                                      new_name: str,
+                                      bridge_config: BridgeConfig) -> None:
+        self.add_or_update_bridge(existing_name, new_name, bridge_config)
+
     async def delete_POST(self, dev_name: str) -> None:
         self.delete_link(dev_name)
 
@@ -0,0 +1,222 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import json
+import logging
+import os
+import shutil
+import uuid
+
+from subiquitycore.async_helpers import schedule_task
+from subiquitycore.context import with_context
+from subiquitycore.utils import arun_command
+
+from subiquity.common.apidef import API
+from subiquity.common.types import (
+    NVMeoFResponse,
+    NVMeoFTarget,
+    )
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger("subiquity.server.controllers.nvmeof")
+
+DEFAULT_PORT = 4420
+
+# The port NVMe over Fabrics discovery controllers listen on.
+DISCOVERY_PORT = 8009
+
+
+class NVMeoFError(Exception):
+    """nvme failed, with a message that is worth showing the user."""
+
+
+def same_target(a, b):
+    return (a.address, a.port, a.subnqn) == (b.address, b.port, b.subnqn)
+
+
+def parse_nvme_discovery(output, transport='tcp'):
+    """Parse the output of "nvme discover -o json"."""
+    targets = []
+    for record in json.loads(output).get('records', []):
+        # Skip referrals to other discovery controllers.
+        if record.get('subtype') != 'nvme subsystem':
+            continue
+        if record.get('trtype') != transport:
+            continue
+        targets.append(NVMeoFTarget(
+            address=record['traddr'],
+            port=int(record['trsvcid']),
+            subnqn=record['subnqn'],
+            transport=transport))
+    return targets
+
+
+class NVMeoFController(SubiquityController):
+
+    endpoint = API.nvmeof
+
+    autoinstall_key = model_name = "nvmeof"
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'targets': {
+                'type': 'array',
+                'items': {
+                    'type': 'object',
+                    'properties': {
+                        'address': {'type': 'string'},
+                        'port': {'type': 'integer'},
+                        'subnqn': {'type': 'string'},
+                        'transport': {'type': 'string', 'enum': ['tcp']},
+                        },
+                    'required': ['address', 'subnqn'],
+                    'additionalProperties': False,
+                    },
+                },
+            },
+        'additionalProperties': False,
+        }
+
+    def __init__(self, app):
+        super().__init__(app)
+        self.ai_targets = []
+
+    def _targets_from_data(self, data):
+        return [
+            NVMeoFTarget(
+                address=target['address'],
+                port=target.get('port', DEFAULT_PORT),
+                subnqn=target['subnqn'],
+                transport=target.get('transport', 'tcp'))
+            for target in data.get('targets', [])
+            ]
+
+    def load_autoinstall_data(self, data):
+        if data is not None:
+            self.ai_targets = self._targets_from_data(data)
+        else:
+            self.ai_targets = []
+
+    def start(self):
+        self._start_task = schedule_task(self._read_host())
+        if self.interactive():
+            # There is no screen for this: the subsystems are connected
+            # to while the storage is being configured, and anything
+            # connected after this is still in the model when the
+            # storage is confirmed and the curtin config is rendered.
+            self.configured()
+
+    @with_context()
+    async def apply_autoinstall_config(self, context=None):
+        await self._start_task
+        for target in self.ai_targets:
+            await self._connect(target)
+        if self.ai_targets:
+            await self.app.hub.abroadcast('storage-devices-changed')
+
+    def make_autoinstall(self):
+        targets = []
+        for target in self.model.targets:
+            targets.append({
+                'address': target.address,
+                'port': target.port,
+                'subnqn': target.subnqn,
+                'transport': target.transport,
+                })
+        return {'targets': targets}
+
+    async def _read_host(self):
+        if self.opts.dry_run:
+            self.model.host_nqn = \
+                'nqn.2014-08.org.nvmexpress:uuid:00000000-dry-run'
+            return
+        for name, fname in ('host_nqn', 'hostnqn'), ('host_id', 'hostid'):
+            try:
+                with open(os.path.join('/etc/nvme', fname)) as fp:
+                    setattr(self.model, name, fp.read().strip() or None)
+            except FileNotFoundError:
+                pass
+        if self.model.host_nqn is None and shutil.which('nvme'):
+            cp = await arun_command(['nvme', 'gen-hostnqn'])
+            if cp.returncode == 0:
+                self.model.host_nqn = cp.stdout.strip() or None
+        if self.model.host_nqn is None:
+            # The same form of NQN as nvme gen-hostnqn makes. There has
+            # to be one, as the installed system has to connect to the
+            # subsystems as the same host.
+            self.model.host_nqn = \
+                'nqn.2014-08.org.nvmexpress:uuid:' + str(uuid.uuid4())
+
+    async def _nvme(self, *args):
+        cmd = ['nvme'] + list(args)
+        if self.model.host_nqn:
+            cmd.extend(['--hostnqn', self.model.host_nqn])
+        if self.model.host_id:
+            cmd.extend(['--hostid', self.model.host_id])
+        cp = await arun_command(cmd)
+        if cp.returncode != 0:
+            raise NVMeoFError(cp.stderr.strip() or cp.stdout.strip())
+        return cp
+
+    async def _connect(self, target):
+        log.debug("connecting to %s", target)
+        if not self.opts.dry_run:
+            await self._nvme(
+                'connect', '-t', target.transport, '-a', target.address,
+                '-s', str(target.port), '-n', target.subnqn)
+            await arun_command(['udevadm', 'settle'])
+        target.connected = True
+        self.model.targets = [
+            t for t in self.model.targets if not same_target(t, target)
+            ]
+        self.model.targets.append(target)
+
+    async def GET(self) -> NVMeoFResponse:
+        return NVMeoFResponse(targets=self.model.targets)
+
+    async def discover_POST(self, address: str, port: int = DISCOVERY_PORT) \
+            -> NVMeoFResponse:
+        await self._start_task
+        if self.opts.dry_run:
+            output = json.dumps({'records': [{
+                'trtype': 'tcp',
+                'subtype': 'nvme subsystem',
+                'traddr': address,
+                'trsvcid': str(DEFAULT_PORT),
+                'subnqn': 'nqn.2014-08.org.example:nvme.target1',
+                }]})
+        else:
+            try:
+                cp = await self._nvme(
+                    'discover', '-t', 'tcp', '-a', address, '-s', str(port),
+                    '-o', 'json')
+            except NVMeoFError as e:
+                return NVMeoFResponse(targets=[], error=str(e))
+            output = cp.stdout
+        targets = parse_nvme_discovery(output)
+        for target in targets:
+            target.connected = any(
+                same_target(target, t) for t in self.model.targets)
+        return NVMeoFResponse(targets=targets)
+
+    async def connect_POST(self, target: NVMeoFTarget) -> NVMeoFResponse:
+        await self._start_task
+        try:
+            await self._connect(target)
+        except NVMeoFError as e:
+            return NVMeoFResponse(targets=self.model.targets, error=str(e))
+        await self.app.hub.abroadcast('storage-devices-changed')
+        return await self.GET()
@@ -0,0 +1,61 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+from subiquity.common.apidef import API
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger('subiquity.server.controllers.offline')
+
+
+class OfflineController(SubiquityController):
+
+    endpoint = API.offline
+
+    autoinstall_key = model_name = "offline"
+    autoinstall_schema = {
+        'type': 'boolean',
+        }
+    autoinstall_default = False
+
+    def load_autoinstall_data(self, data):
+        self.deserialize(data)
+
+    def make_autoinstall(self):
+        return self.serialize()
+
+    def serialize(self):
+        return self.model.offline
+
+    def deserialize(self, data):
+        self.model.offline = data
+
+    async def GET(self) -> bool:
+        return self.serialize()
+
+    async def POST(self, data: bool):
+        was_offline, self.model.offline = self.model.offline, data
+        log.debug("offline install: %s", data)
+        network = self.app.controllers.Network
+        network.update_has_network()
+        if data and not was_offline:
+            # The lookups may have started before the choice was made.
+            self.app.hub.broadcast('network-offline')
+        elif was_offline and not data and network.has_default_route():
+            # Start the lookups that were skipped while offline.
+            self.app.hub.broadcast('network-up')
+        self.configured()
@@ -53,6 +53,7 @@ class RebootController(SubiquityController):
         Install = self.app.controllers.Install
         await Install.install_task
         await self.app.controllers.Late.run_event.wait()
+        await self.app.controllers.Inventory.report_event.wait()
         await self.copy_logs_to_target()
         if self.app.interactive:
             await self.user_reboot_event.wait()
@@ -0,0 +1,167 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import logging
+import os
+import tempfile
+
+import aiohttp
+
+from subiquitycore.utils import arun_command
+
+from subiquity.common.apidef import API
+from subiquity.common.types import (
+    RecoveryKeyExport,
+    RecoveryKeyExportKind,
+    RecoveryKeyExportResponse,
+    RecoveryKeyMedium,
+    RecoveryKeyResponse,
+    )
+from subiquity.models.filesystem import make_recovery_key
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger("subiquity.server.controllers.recoverykey")
+
+# Filesystems that can be found on a USB stick and can be written to
+# from the live session.
+MEDIA_FSTYPES = {'vfat', 'fat32', 'exfat', 'ext2', 'ext4'}
+
+ESCROW_TIMEOUT = 30
+
+
+class RecoveryKeyController(SubiquityController):
+
+    endpoint = API.recovery_key
+
+    def __init__(self, app):
+        super().__init__(app)
+        # The key is added to the encrypted volumes when the storage
+        # config is rendered, so it is kept in the filesystem model.
+        self.model = app.base_model.filesystem
+        self._exports = []
+
+    def interactive(self):
+        # The key is asked for while the storage is being configured.
+        return self.app.controllers.Filesystem.interactive()
+
+    def _media(self):
+        media = []
+        for disk in self.model.all_disks():
+            if not disk.removable:
+                continue
+            for volume in [disk] + disk.partitions():
+                fstype = volume.original_fstype()
+                if fstype not in MEDIA_FSTYPES:
+                    continue
+                fs = volume.fs()
+                if fs is None or not fs.preserve:
+                    # Being reformatted (or deleted) by the install.
+                    continue
+                if volume is disk:
+                    path = disk.path
+                else:
+                    path = volume._path()
+                media.append(RecoveryKeyMedium(
+                    path=path, label=volume.label, fstype=fstype))
+        return media
+
+    def _note_export(self, outcome):
+        # Only the outcome is recorded, never the key itself.
+        log.info("recovery key: %s", outcome)
+        self._exports.append(outcome)
+        self.app.note_data_for_apport(
+            "RecoveryKeyExport", "\n".join(self._exports))
+
+    def _machine_identity(self):
+        identity = {'hostname': self.app.base_model.identity.hostname}
+        for name in 'product_uuid', 'product_serial', 'sys_vendor', \
+                'product_name':
+            try:
+                with open(os.path.join('/sys/class/dmi/id', name)) as fp:
+                    identity[name.replace('_', '-')] = fp.read().strip()
+            except OSError:
+                pass
+        return identity
+
+    def _filename(self):
+        hostname = self.app.base_model.identity.hostname or 'ubuntu'
+        return 'recovery-key-{}.txt'.format(hostname)
+
+    async def _write(self, path):
+        fname = self._filename()
+        content = self.model.recovery_key + '\n'
+        if self.opts.dry_run:
+            with open(os.path.join(self.app.root, fname), 'w') as fp:
+                fp.write(content)
+            return
+        with tempfile.TemporaryDirectory() as mnt:
+            cp = await arun_command(['mount', path, mnt])
+            if cp.returncode != 0:
+                raise RuntimeError(cp.stderr.strip())
+            try:
+                with open(os.path.join(mnt, fname), 'w') as fp:
+                    fp.write(content)
+            finally:
+                await arun_command(['umount', mnt])
+
+    async def _escrow(self, url):
+        data = {
+            'recovery-key': self.model.recovery_key,
+            'identity': self._machine_identity(),
+            }
+        timeout = aiohttp.ClientTimeout(total=ESCROW_TIMEOUT)
+        async with aiohttp.ClientSession(timeout=timeout) as session:
+            async with session.post(url, json=data) as resp:
+                if resp.status >= 300:
+                    raise RuntimeError(
+                        "escrow server returned HTTP status {}".format(
+                            resp.status))
+
+    async def GET(self) -> RecoveryKeyResponse:
+        return RecoveryKeyResponse(
+            key=self.model.recovery_key, media=self._media())
+
+    async def POST(self) -> RecoveryKeyResponse:
+        self.model.recovery_key = make_recovery_key()
+        self._exports = []
+        self._note_export("generated and displayed")
+        return await self.GET()
+
+    async def export_POST(self, export: RecoveryKeyExport) \
+            -> RecoveryKeyExportResponse:
+        if self.model.recovery_key is None:
+            raise Exception("no recovery key has been generated")
+        if export.kind == RecoveryKeyExportKind.MEDIA:
+            if export.path not in [m.path for m in self._media()]:
+                raise Exception(
+                    "{} is not removable media".format(export.path))
+            what = "written to {}".format(export.path)
+            coro = self._write(export.path)
+        else:
+            if not export.url:
+                raise Exception("no escrow URL given")
+            what = "sent to {}".format(export.url)
+            coro = self._escrow(export.url)
+        try:
+            await coro
+        except (OSError, RuntimeError, aiohttp.ClientError,
+                asyncio.TimeoutError) as e:
+            error = str(e) or type(e).__name__
+            self._note_export("not {}: {}".format(what, error))
+            return RecoveryKeyExportResponse(error=error)
+        self._note_export(what)
+        return RecoveryKeyExportResponse()
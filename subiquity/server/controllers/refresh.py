@@ -16,14 +16,19 @@
 import asyncio
 import logging
 import os
+from urllib.parse import urlparse
 
-import requests.exceptions
+import requests
+
+import yaml
 
 from subiquitycore.async_helpers import (
+    run_in_thread,
     schedule_task,
     SingleInstanceTask,
     )
 from subiquitycore.context import with_context
+from subiquitycore.utils import run_command
 
 from subiquity.common.apidef import API
 from subiquity.common.types import (
@@ -38,6 +43,23 @@ from subiquity.server.controller import (
 log = logging.getLogger('subiquity.server.controllers.refresh')
 
 
+def snap_source_ok(src):
+    """Whether src can be sideloaded: an absolute path or a http(s) URL
+    naming a .snap file."""
+    parsed = urlparse(src)
+    if parsed.scheme in ('http', 'https'):
+        if not parsed.netloc:
+            return False
+        path = parsed.path
+    elif parsed.scheme == '':
+        path = src
+        if not os.path.isabs(path):
+            return False
+    else:
+        return False
+    return path.endswith('.snap') and os.path.basename(path) != '.snap'
+
+
 class RefreshController(SubiquityController):
 
     endpoint = API.refresh
@@ -48,6 +70,8 @@ class RefreshController(SubiquityController):
         'properties': {
             'update': {'type': 'boolean'},
             'channel': {'type': 'string'},
+            'snap': {'type': 'string'},
+            'assertion': {'type': 'string'},
             },
         'additionalProperties': False,
         }
@@ -58,13 +82,22 @@ class RefreshController(SubiquityController):
         self.snap_name = os.environ.get("SNAP_NAME", "subiquity")
         self.configure_task = None
         self.check_task = None
+        self.local_snap = None
+        self.skipped_offline = False
         self.status = RefreshStatus(availability=RefreshCheckState.UNKNOWN)
         self.app.hub.subscribe(
             'snapd-network-change', self.snapd_network_changed)
+        self.app.hub.subscribe('network-offline', self.stop_check)
 
     def load_autoinstall_data(self, data):
-        if data is not None:
-            self.ai_data = data
+        if data is None:
+            return
+        snap = data.get('snap')
+        if snap is not None and not snap_source_ok(snap):
+            raise ValueError(
+                "snap must be an absolute path or http(s) URL of a .snap "
+                "file, not {!r}".format(snap))
+        self.ai_data = data
 
     @property
     def active(self):
@@ -114,6 +147,10 @@ class RefreshController(SubiquityController):
                     "Snap" + k.title(), r['result'][k])
             subcontext.description = "current version of snap is: %r" % (
                 self.status.current_snap_version)
+        if self.get_refresh_snap() is not None:
+            # There is no point switching channels if we are going to
+            # refresh to a particular snap file.
+            return
         channel = self.get_refresh_channel()
         desc = "switching {} to {}".format(self.snap_name, channel)
         with context.child("switching", desc) as subcontext:
@@ -155,11 +192,86 @@ class RefreshController(SubiquityController):
         release = info.split()[1]
         return 'stable/ubuntu-' + release
 
+    def get_refresh_snap(self):
+        """Return the (snap, assertion) to sideload, or None.
+
+        Either can be a local path or a http(s) URL. If the assertion
+        is not specified, it is looked for next to the snap with a
+        .assert extension.
+        """
+        prefix = "subiquity-snap="
+        for arg in self.app.kernel_cmdline:
+            if arg.startswith(prefix):
+                log.debug(
+                    "get_refresh_snap: found %s on kernel cmdline", arg)
+                snap = arg[len(prefix):]
+                if snap_source_ok(snap):
+                    break
+                log.warning(
+                    "get_refresh_snap: ignoring %s, not an absolute path or "
+                    "http(s) URL of a .snap file", arg)
+        else:
+            snap = self.ai_data.get('snap')
+        if snap is None:
+            return None
+        assertion = self.ai_data.get('assertion')
+        if assertion is None:
+            base, ext = os.path.splitext(snap)
+            assertion = base + '.assert'
+        return snap, assertion
+
+    def _fetch(self, src, destdir):
+        if urlparse(src).scheme not in ('http', 'https'):
+            return src
+        dest = os.path.join(destdir, os.path.basename(urlparse(src).path))
+        with requests.get(src, stream=True, timeout=60) as r:
+            r.raise_for_status()
+            with open(dest, 'wb') as fp:
+                # iter_content, unlike r.raw, undoes any gzip or deflate
+                # content-encoding.
+                for chunk in r.iter_content(chunk_size=1 << 20):
+                    fp.write(chunk)
+        return dest
+
+    def _snap_version(self, snap):
+        if urlparse(snap).scheme != '':
+            # Not worth downloading the snap just to find out.
+            return os.path.basename(urlparse(snap).path)
+        if not os.path.exists(snap):
+            raise FileNotFoundError(snap)
+        cp = run_command(
+            ['unsquashfs', '-n', '-cat', snap, 'meta/snap.yaml'])
+        if cp.returncode != 0:
+            return os.path.basename(snap)
+        return str(yaml.safe_load(cp.stdout).get('version', ''))
+
+    @with_context()
+    async def fetch_snap(self, context):
+        snap, assertion = self.get_refresh_snap()
+        context.description = "fetching {} and {}".format(snap, assertion)
+        destdir = self.app.state_path('refresh')
+        os.makedirs(destdir, exist_ok=True)
+        snap_path = await run_in_thread(self._fetch, snap, destdir)
+        assertion_path = await run_in_thread(self._fetch, assertion, destdir)
+        for path in snap_path, assertion_path:
+            if not os.path.exists(path):
+                raise FileNotFoundError(path)
+        return snap_path, assertion_path
+
     def snapd_network_changed(self):
-        if self.active and \
-          self.status.availability == RefreshCheckState.UNKNOWN:
+        if not self.active:
+            return
+        if self.status.availability == RefreshCheckState.UNKNOWN or \
+           self.skipped_offline:
             self.check_task.start_sync()
 
+    def stop_check(self):
+        # As for the mirror lookup, the restarted check finds the
+        # install is offline and gives up at once.
+        if self.check_task is None or self.check_task.task.done():
+            return
+        self.check_task.start_sync()
+
     @with_context()
     async def check_for_update(self, context):
         await asyncio.shield(self.configure_task)
@@ -167,6 +279,29 @@ class RefreshController(SubiquityController):
             context.description = "not offered update when already updated"
             self.status.availability = RefreshCheckState.UNAVAILABLE
             return
+        refresh_snap = self.get_refresh_snap()
+        if refresh_snap is not None:
+            # The snap is only downloaded when the update is started, so
+            # that a slow download does not make this check time out.
+            try:
+                version = await run_in_thread(
+                    self._snap_version, refresh_snap[0])
+            except OSError:
+                log.exception("finding snap to refresh to failed")
+                context.description = "finding snap failed"
+                self.status.availability = RefreshCheckState.UNAVAILABLE
+                return
+            self.status.new_snap_version = version
+            context.description = (
+                "local version of snap available: %r" % version)
+            self.status.availability = RefreshCheckState.AVAILABLE
+            return
+        if self.app.base_model.offline.offline:
+            context.description = "not checking for update when offline"
+            self.skipped_offline = True
+            self.status.availability = RefreshCheckState.UNAVAILABLE
+            return
+        self.skipped_offline = False
         try:
             result = await self.app.snapd.get('v2/find', select='refresh')
         except requests.exceptions.RequestException:
@@ -189,6 +324,19 @@ class RefreshController(SubiquityController):
 
     @with_context()
     async def start_update(self, context):
+        if self.get_refresh_snap() is not None:
+            if self.local_snap is None:
+                self.local_snap = await self.fetch_snap(context=context)
+            snap_path, assertion_path = self.local_snap
+            with open(assertion_path, 'rb') as fp:
+                assertion = fp.read()
+            # snapd will refuse to install the snap unless the
+            # assertions check out, so acking them is the verification.
+            await self.app.snapd.post_assertion(assertion)
+            # The subiquity snap uses classic confinement.
+            change = await self.app.snapd.sideload(snap_path, classic=True)
+            context.description = "change id: {}".format(change)
+            return change
         change = await self.app.snapd.post(
             'v2/snaps/{}'.format(self.snap_name),
             {'action': 'refresh'})
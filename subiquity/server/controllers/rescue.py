@@ -0,0 +1,387 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import json
+import logging
+import os
+import subprocess
+
+from subiquitycore.context import with_context
+from subiquitycore.utils import arun_command, run_command
+
+from subiquity.common.apidef import API
+from subiquity.common.installfiles import (
+    parse_fstab,
+    parse_os_release,
+    read_install_files,
+    REINSTALL_ROOT_FSTYPES,
+    )
+from subiquity.common.types import (
+    RescueAction,
+    RescueActionResult,
+    RescueInstall,
+    RescueStatus,
+    RescueUnlock,
+    )
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger("subiquity.server.controllers.rescue")
+
+RESCUE_FILES = ['etc/os-release', 'etc/fstab']
+
+# Filesystems from the install's fstab that are checked along with its
+# root filesystem. Anything else (network filesystems, tmpfs, ...)
+# cannot or need not be checked.
+FSCK_FSTYPES = {'ext2', 'ext3', 'ext4', 'xfs', 'btrfs', 'vfat'}
+
+# The filesystems of the live session that are made available in the
+# install when it is chrooted into.
+BIND_MOUNTS = ['dev', 'proc', 'sys', 'run']
+
+
+def parse_lsblk(output):
+    """Parse "lsblk --json --paths --output NAME,FSTYPE".
+
+    Returns (path, fstype, has_children) for each device, parents
+    before their children. A device that is part of several others
+    (a multipath or RAID member, say) is only listed once.
+    """
+    devices = []
+    seen = set()
+
+    def visit(dev):
+        children = dev.get('children') or []
+        if dev['name'] not in seen:
+            seen.add(dev['name'])
+            devices.append((dev['name'], dev.get('fstype'), bool(children)))
+        for child in children:
+            visit(child)
+
+    for dev in json.loads(output).get('blockdevices', []):
+        visit(dev)
+    return devices
+
+
+def fsck_command(path, fstype):
+    if fstype == 'xfs':
+        return ['xfs_repair', path]
+    if fstype == 'btrfs':
+        # "btrfs check --repair" is not safe to run without an expert
+        # looking at what it is going to do, so only report problems.
+        return ['btrfs', 'check', path]
+    return ['fsck', '-f', '-y', '-t', fstype, path]
+
+
+def luks_name(path):
+    return 'rescue-' + os.path.basename(path)
+
+
+class RescueController(SubiquityController):
+
+    endpoint = API.rescue
+
+    def __init__(self, app):
+        super().__init__(app)
+        # root device -> (RescueInstall, contents of its /etc/fstab)
+        self._installs = {}
+        self._locked = []
+        self._scanned = False
+        self._mounted = None
+        # Held by every API call, so that (for example) nothing mounts a
+        # filesystem while it is being checked.
+        self._lock = asyncio.Lock()
+        self._dry_run_unlocked = set()
+        self.mount_point = self.app.state_path('rescue')
+
+    def interactive(self):
+        return self.app.rescue
+
+    async def _command(self, cmd, *, input=None):
+        if self.opts.dry_run:
+            log.debug("not running %s in dry-run mode", cmd)
+            await asyncio.sleep(0.5)
+            return subprocess.CompletedProcess(cmd, 0, '', None)
+        return await arun_command(cmd, input=input, stderr=subprocess.STDOUT)
+
+    async def _chroot(self, cmd):
+        return await self._command(['chroot', self.mount_point] + cmd)
+
+    async def _dry_run_devices(self):
+        fs = self.app.controllers.Filesystem
+        await fs._start_task
+        await fs._probe_task.wait()
+        devices = []
+        for disk in fs.model.all_disks():
+            for part in disk.partitions():
+                path = part._path()
+                unlocked = path in self._dry_run_unlocked
+                devices.append((path, part.probed_fstype, unlocked))
+                if unlocked:
+                    devices.append(('/dev/mapper/' + luks_name(path),
+                                    'ext4', False))
+        return devices
+
+    async def _devices(self):
+        if self.opts.dry_run:
+            return await self._dry_run_devices()
+        # Make the logical volumes in any volume groups that have been
+        # found (maybe just now, in an unlocked device) available.
+        await arun_command(['vgchange', '-ay'])
+        cp = await arun_command(
+            ['lsblk', '--json', '--paths', '--output', 'NAME,FSTYPE'])
+        if cp.returncode != 0:
+            log.debug("lsblk failed: %s", cp.stderr)
+            return []
+        return parse_lsblk(cp.stdout)
+
+    async def _read_files(self, path, fstype):
+        if self.opts.dry_run:
+            return {
+                'etc/os-release': 'PRETTY_NAME="Ubuntu 20.04.2 LTS"\n',
+                'etc/fstab': '',
+                }
+        return await read_install_files(path, fstype, RESCUE_FILES)
+
+    @with_context()
+    async def find_installs(self, context):
+        old_installs = self._installs
+        self._installs = {}
+        self._locked = []
+        for path, fstype, has_children in await self._devices():
+            if fstype == 'crypto_LUKS':
+                if not has_children:
+                    self._locked.append(path)
+                continue
+            if fstype not in REINSTALL_ROOT_FSTYPES:
+                continue
+            if path in old_installs:
+                # Devices are only read the first time they are seen:
+                # the one that is mounted cannot be mounted again, and
+                # the others need not be.
+                self._installs[path] = old_installs[path]
+                continue
+            files = await self._read_files(path, fstype)
+            if 'etc/os-release' not in files:
+                continue
+            os_release = parse_os_release(files['etc/os-release'])
+            install = RescueInstall(
+                root=path,
+                os_name=os_release.get(
+                    'PRETTY_NAME', os_release.get('NAME', 'Linux')))
+            self._installs[path] = (install, files.get('etc/fstab', ''))
+        self._scanned = True
+
+    def _status(self, error=None):
+        installs = []
+        for root, (install, fstab) in self._installs.items():
+            install.mounted = root == self._mounted
+            installs.append(install)
+        return RescueStatus(
+            installs=installs,
+            locked=list(self._locked),
+            mount_point=self.mount_point if self._mounted else None,
+            error=error)
+
+    async def _fstab_devices(self, fstab):
+        """Yield (path, mountpoint, fstype, options) for fstab's entries.
+
+        Entries for swap, for filesystems that are not mounted at boot
+        and for devices that cannot be found are skipped.
+        """
+        for spec, mountpoint, fstype, options in parse_fstab(fstab):
+            if not mountpoint.startswith('/') or fstype in ('swap', 'none'):
+                continue
+            if 'noauto' in options.split(','):
+                continue
+            if '=' in spec:
+                cp = await self._command(['findfs', spec])
+                if cp.returncode != 0:
+                    log.debug("cannot find %s for %s", spec, mountpoint)
+                    continue
+                spec = cp.stdout.strip()
+            yield spec, mountpoint, fstype, options
+
+    def _fstab(self, root):
+        if root not in self._installs:
+            raise RuntimeError("no install found on {}".format(root))
+        install, fstab = self._installs[root]
+        return fstab
+
+    @with_context(description="{root}")
+    async def mount(self, *, context, root):
+        if self._mounted == root:
+            return
+        fstab = self._fstab(root)
+        await self.unmount()
+        entries = [e async for e in self._fstab_devices(fstab)]
+        # The options for / say which btrfs subvolume to mount, if any.
+        root_options = 'defaults'
+        for path, mountpoint, fstype, options in entries:
+            if mountpoint == '/':
+                root_options = options
+        os.makedirs(self.mount_point, exist_ok=True)
+        cp = await self._command(
+            ['mount', '-o', root_options, root, self.mount_point])
+        if cp.returncode != 0:
+            raise RuntimeError(cp.stdout)
+        self._mounted = root
+        for path, mountpoint, fstype, options in entries:
+            if mountpoint == '/':
+                continue
+            cp = await self._command(
+                ['mount', '-t', fstype, '-o', options, path,
+                 self.mount_point + mountpoint])
+            if cp.returncode != 0:
+                log.debug(
+                    "mounting %s at %s failed: %s", path, mountpoint,
+                    cp.stdout)
+        for name in BIND_MOUNTS:
+            target = os.path.join(self.mount_point, name)
+            await self._command(['mount', '--rbind', '/' + name, target])
+            # Do not let unmounting the install unmount the live
+            # session's filesystems too.
+            await self._command(['mount', '--make-rslave', target])
+
+    @with_context()
+    async def unmount(self, context):
+        if self._mounted is None:
+            return
+        cp = await self._command(['umount', '--recursive', self.mount_point])
+        if cp.returncode != 0:
+            raise RuntimeError(cp.stdout)
+        self._mounted = None
+
+    async def _fsck(self, root):
+        fstab = self._fstab(root)
+        await self.unmount()
+        checks = {}
+        for path, fstype, has_children in await self._devices():
+            if path == root:
+                checks[root] = fstype
+        async for path, mountpoint, fstype, options in \
+                self._fstab_devices(fstab):
+            if fstype in FSCK_FSTYPES:
+                checks.setdefault(path, fstype)
+        output = []
+        success = True
+        for path, fstype in checks.items():
+            cp = await self._command(fsck_command(path, fstype))
+            output.append(cp.stdout)
+            # fsck exits with 1 when it corrected errors, which is
+            # what was asked for.
+            if cp.returncode not in (0, 1):
+                success = False
+        return RescueActionResult(success=success, output=''.join(output))
+
+    async def _reinstall_grub(self, root):
+        await self.mount(root=root)
+        if os.path.exists('/sys/firmware/efi'):
+            cmds = [['grub-install']]
+        else:
+            cp = await self._chroot(['grub-probe', '--target=disk', '/boot'])
+            if cp.returncode != 0:
+                return RescueActionResult(success=False, output=cp.stdout)
+            disk = cp.stdout.strip()
+            if not disk:
+                # Guessing could put the boot loader on the wrong disk.
+                return RescueActionResult(
+                    success=False,
+                    output="cannot find the disk /boot is on\n")
+            cmds = [['grub-install', disk]]
+        cmds.append(['update-grub'])
+        output = []
+        for cmd in cmds:
+            cp = await self._chroot(cmd)
+            output.append(cp.stdout)
+            if cp.returncode != 0:
+                return RescueActionResult(
+                    success=False, output=''.join(output))
+        return RescueActionResult(success=True, output=''.join(output))
+
+    async def _update_initramfs(self, root):
+        await self.mount(root=root)
+        cp = await self._chroot(['update-initramfs', '-u', '-k', 'all'])
+        return RescueActionResult(
+            success=cp.returncode == 0, output=cp.stdout)
+
+    @with_context(description="{action.name} on {root}")
+    async def run_action(self, *, context, root, action):
+        if action == RescueAction.FSCK:
+            return await self._fsck(root)
+        elif action == RescueAction.REINSTALL_GRUB:
+            return await self._reinstall_grub(root)
+        elif action == RescueAction.UPDATE_INITRAMFS:
+            return await self._update_initramfs(root)
+
+    async def _refreshed_status(self, error=None, rescan=False):
+        # Scanning mounts every filesystem that might be an install, so
+        # it is only done again when there may be new devices.
+        if rescan or not self._scanned:
+            await self.find_installs()
+        return self._status(error)
+
+    async def GET(self) -> RescueStatus:
+        async with self._lock:
+            return await self._refreshed_status()
+
+    async def unlock_POST(self, data: RescueUnlock) -> RescueStatus:
+        async with self._lock:
+            if self.opts.dry_run:
+                self._dry_run_unlocked.add(data.path)
+                return await self._refreshed_status(rescan=True)
+            cp = await arun_command(
+                ['cryptsetup', 'open', '--key-file=-', data.path,
+                 luks_name(data.path)],
+                input=data.passphrase)
+            if cp.returncode != 0:
+                return await self._refreshed_status(cp.stderr.strip())
+            return await self._refreshed_status(rescan=True)
+
+    async def mount_POST(self, root: str) -> RescueStatus:
+        async with self._lock:
+            try:
+                await self.mount(root=root)
+            except RuntimeError as e:
+                return await self._refreshed_status(str(e))
+            return await self._refreshed_status()
+
+    async def unmount_POST(self) -> RescueStatus:
+        async with self._lock:
+            try:
+                await self.unmount()
+            except RuntimeError as e:
+                return await self._refreshed_status(str(e))
+            return await self._refreshed_status()
+
+    async def run_POST(self, root: str, action: RescueAction) \
+            -> RescueActionResult:
+        async with self._lock:
+            try:
+                return await self.run_action(root=root, action=action)
+            except RuntimeError as e:
+                return RescueActionResult(success=False, output=str(e))
+
+    async def reboot_POST(self) -> None:
+        async with self._lock:
+            try:
+                await self.unmount()
+            except RuntimeError:
+                log.exception("unmounting %s failed", self.mount_point)
+        if self.opts.dry_run:
+            self.app.exit()
+        else:
+            run_command(["/sbin/reboot"])
@@ -21,6 +21,7 @@ import attr
 import requests.exceptions
 
 from subiquitycore.async_helpers import (
+    run_in_thread,
     schedule_task,
     )
 from subiquitycore.context import with_context
@@ -35,10 +36,13 @@ from subiquity.common.types import (
 from subiquity.server.controller import (
     SubiquityController,
     )
+from subiquity.server.ipv6 import reachable_over_ipv6
 
 
 log = logging.getLogger('subiquity.server.controllers.snaplist')
 
+SNAP_STORE_HOST = 'api.snapcraft.io'
+
 
 class SnapdSnapInfoLoader:
 
@@ -138,6 +142,7 @@ class SnapListController(SubiquityController):
     def __init__(self, app):
         super().__init__(app)
         self.loader = self._make_loader()
+        self._store_reachable_over_ipv6 = None
         self.app.hub.subscribe(
             'snapd-network-change', self.snapd_network_changed)
 
@@ -151,6 +156,7 @@ class SnapListController(SubiquityController):
         self.model.set_installed_list(to_install)
 
     def snapd_network_changed(self):
+        self._store_reachable_over_ipv6 = None
         if not self.interactive():
             return
         # If the loader managed to load the list of snaps, the
@@ -165,10 +171,27 @@ class SnapListController(SubiquityController):
     def make_autoinstall(self):
         return [attr.asdict(sel) for sel in self.model.selections]
 
+    async def _store_reachable(self):
+        # Without IPv4, fail at once if the store has no IPv6 address
+        # rather than leave the user waiting for snapd to time out. A
+        # proxy gets to make its own arrangements.
+        if not self.app.base_model.network.ipv6_only:
+            return True
+        if self.app.base_model.proxy.proxy:
+            return True
+        if self._store_reachable_over_ipv6 is None:
+            self._store_reachable_over_ipv6 = await run_in_thread(
+                reachable_over_ipv6, SNAP_STORE_HOST)
+        return self._store_reachable_over_ipv6
+
     async def GET(self, wait: bool = False) -> SnapListResponse:
         if self.loader.failed or not self.app.base_model.network.has_network:
             self.configured()
             return SnapListResponse(status=SnapCheckState.FAILED)
+        if not await self._store_reachable():
+            log.debug("the snap store cannot be reached over IPv6")
+            self.configured()
+            return SnapListResponse(status=SnapCheckState.FAILED)
         if not self.loader.snap_list_fetched and not wait:
             return SnapListResponse(status=SnapCheckState.LOADING)
         await self.loader.get_snap_list_task()
@@ -0,0 +1,59 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import logging
+
+from subiquity.server.controller import NonInteractiveController
+
+
+log = logging.getLogger('subiquity.server.controllers.source')
+
+
+class SourceController(NonInteractiveController):
+
+    model_name = autoinstall_key = "source"
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'url': {
+                'type': 'string',
+                'pattern': '^https?://',
+                },
+            'sha256': {
+                'type': 'string',
+                'pattern': '^[0-9a-fA-F]{64}$',
+                },
+            },
+        'required': ['url', 'sha256'],
+        'additionalProperties': False,
+        }
+
+    def load_autoinstall_data(self, data):
+        if data is None:
+            return
+        self.model.url = data['url']
+        self.model.sha256 = data['sha256'].lower()
+
+    def serialize(self):
+        return {'url': self.model.url, 'sha256': self.model.sha256}
+
+    def deserialize(self, data):
+        self.model.url = data['url']
+        self.model.sha256 = data['sha256']
+
+    def make_autoinstall(self):
+        if self.model.url is None:
+            return None
+        return self.serialize()
@@ -0,0 +1,159 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import functools
+import logging
+from typing import Optional
+
+import requests
+
+from subiquitycore.async_helpers import run_in_thread
+from subiquitycore.context import with_context
+from subiquitycore.utils import arun_command
+
+from subiquity.common.apidef import API
+from subiquity.common.types import StoreProxyConfig
+from subiquity.server.controller import SubiquityController
+
+
+log = logging.getLogger('subiquity.server.controllers.storeproxy')
+
+# Where a snap-store-proxy serves the assertions a device needs to
+# trust it.
+STORE_ASSERTIONS_PATH = 'v2/auth/store/assertions'
+
+
+def parse_store_id(assertions):
+    """Find the id of the store in the store assertion in assertions."""
+    in_store = False
+    for line in assertions.splitlines():
+        if line.startswith('type: '):
+            in_store = line == 'type: store'
+        elif not line:
+            in_store = False
+        elif in_store and line.startswith('store: '):
+            return line[len('store: '):].strip()
+    return None
+
+
+class StoreProxyController(SubiquityController):
+
+    endpoint = API.store_proxy
+
+    autoinstall_key = "snap-store-proxy"
+    model_name = "store_proxy"
+    autoinstall_schema = {
+        'type': 'object',
+        'properties': {
+            'url': {'type': 'string', 'format': 'uri'},
+            'store-id': {'type': 'string'},
+            },
+        'required': ['url'],
+        'additionalProperties': False,
+        }
+
+    def load_autoinstall_data(self, data):
+        if data is None:
+            return
+        self.model.url = data['url']
+        self.model.store_id = data.get('store-id', '')
+
+    @with_context()
+    async def apply_autoinstall_config(self, context):
+        if not self.model.url:
+            return
+        error = await self.register(context=context)
+        if error is not None:
+            raise Exception(error)
+
+    async def _snap_set(self, *args):
+        if self.opts.dry_run:
+            log.debug("not running snap set %s in dry-run mode", args)
+            return ''
+        cp = await arun_command(['snap', 'set', 'system'] + list(args))
+        if cp.returncode != 0:
+            return cp.stderr.strip() or "snap set failed"
+        return ''
+
+    @with_context()
+    async def register(self, *, context):
+        url = self.model.url.rstrip('/')
+        try:
+            response = await run_in_thread(functools.partial(
+                requests.get, url + '/' + STORE_ASSERTIONS_PATH, timeout=60))
+            response.raise_for_status()
+        except requests.exceptions.RequestException as e:
+            return "fetching the assertions from {} failed: {}".format(url, e)
+        assertions = response.text
+        store_id = self.model.store_id or parse_store_id(assertions)
+        if not store_id:
+            return "{} did not serve a store assertion".format(url)
+        try:
+            await self.app.snapd.post_assertion(assertions)
+        except requests.exceptions.RequestException as e:
+            return "snapd did not accept the assertions: {}".format(e)
+        # So that the live session can list snaps from the proxy too.
+        error = await self._snap_set('proxy.store=' + store_id)
+        if error:
+            return "configuring snapd failed: {}".format(error)
+        log.debug("registered with store %s at %s", store_id, url)
+        self.model.store_id = store_id
+        self.model.assertions = assertions
+        self.app.hub.broadcast('snapd-network-change')
+        return None
+
+    async def unregister(self):
+        if self.model.assertions:
+            error = await self._snap_set('proxy.store=')
+            if error:
+                log.warning("resetting proxy.store failed: %s", error)
+            self.app.hub.broadcast('snapd-network-change')
+        self.model.url = self.model.store_id = self.model.assertions = ''
+
+    def serialize(self):
+        return {
+            'url': self.model.url,
+            'store_id': self.model.store_id,
+            'assertions': self.model.assertions,
+            }
+
+    def deserialize(self, data):
+        self.model.url = data['url']
+        self.model.store_id = data['store_id']
+        self.model.assertions = data['assertions']
+
+    def make_autoinstall(self):
+        if not self.model.url:
+            return {}
+        r = {'url': self.model.url}
+        if self.model.store_id:
+            r['store-id'] = self.model.store_id
+        return r
+
+    async def GET(self) -> StoreProxyConfig:
+        return StoreProxyConfig(
+            url=self.model.url, store_id=self.model.store_id)
+
+    async def POST(self, data: StoreProxyConfig) -> Optional[str]:
+        await self.unregister()
+        if data.url:
+            self.model.url = data.url
+            self.model.store_id = data.store_id
+            error = await self.register()
+            if error is not None:
+                log.debug("registering with %s failed: %s", data.url, error)
+                return error
+        self.configured()
+        return None
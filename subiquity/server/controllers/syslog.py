@@ -0,0 +1,213 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import json
+import logging
+import logging.handlers
+import queue
+import socket
+
+import attr
+
+from subiquity.server.controller import NonInteractiveController
+
+
+log = logging.getLogger('subiquity.server.controllers.syslog')
+
+SYSLOG_PROTOCOLS = {'udp', 'tcp', 'json'}
+DEFAULT_SYSLOG_PORTS = {'udp': 514, 'tcp': 514, 'json': 5170}
+
+
+@attr.s(auto_attribs=True)
+class SyslogTarget:
+    protocol: str
+    host: str
+    port: int
+
+
+def parse_syslog_target(value):
+    """Parse [PROTOCOL://]HOST[:PORT], where PROTOCOL is udp, tcp or json.
+
+    udp and tcp send syslog messages, json sends one JSON object per
+    line over TCP. IPv6 addresses have to be in brackets.
+    """
+    protocol = 'udp'
+    if '://' in value:
+        protocol, value = value.split('://', 1)
+        if protocol not in SYSLOG_PROTOCOLS:
+            raise ValueError(
+                "unknown syslog protocol {!r}".format(protocol))
+    port = DEFAULT_SYSLOG_PORTS[protocol]
+    if value.startswith('['):
+        host, sep, rest = value[1:].partition(']')
+        if not sep or (rest and not rest.startswith(':')):
+            raise ValueError("invalid syslog host {!r}".format(value))
+        rest = rest[1:]
+    elif value.count(':') == 1:
+        host, rest = value.split(':')
+    else:
+        host, rest = value, ''
+    if rest:
+        try:
+            port = int(rest)
+        except ValueError:
+            raise ValueError("invalid syslog port {!r}".format(rest))
+    if not host:
+        raise ValueError("no syslog host in {!r}".format(value))
+    return SyslogTarget(protocol=protocol, host=host, port=port)
+
+
+EVENT_FIELDS = ['event_type', 'context', 'context_id', 'parent_id', 'result']
+
+
+class JSONSocketHandler(logging.handlers.SocketHandler):
+    """Send records as newline separated JSON rather than pickles."""
+
+    hostname = socket.gethostname()
+
+    def makePickle(self, record):
+        data = {
+            'timestamp': record.created,
+            'hostname': self.hostname,
+            'pid': record.process,
+            'level': record.levelname,
+            'logger': record.name,
+            'message': record.getMessage(),
+            }
+        for field in EVENT_FIELDS:
+            if hasattr(record, field):
+                data[field] = getattr(record, field)
+        return (json.dumps(data) + '\n').encode('utf-8')
+
+
+class SyslogSocketHandler(logging.handlers.SocketHandler):
+    """Send syslog messages over TCP.
+
+    SysLogHandler can do that too, but connects when it is created and
+    never reconnects, where SocketHandler connects (with a timeout) when
+    there is something to send and retries if the connection drops.
+    """
+
+    def makePickle(self, record):
+        syslog = logging.handlers.SysLogHandler
+        severity = syslog.priority_names[
+            syslog.priority_map.get(record.levelname, 'warning')]
+        priority = (syslog.LOG_USER << 3) | severity
+        # Collectors expect messages over TCP to be terminated by a
+        # newline.
+        return '<{}>{}\n'.format(priority, self.format(record)).encode(
+            'utf-8')
+
+
+def make_handler(target):
+    address = (target.host, target.port)
+    if target.protocol == 'json':
+        return JSONSocketHandler(*address)
+    if target.protocol == 'tcp':
+        handler = SyslogSocketHandler(*address)
+    else:
+        handler = logging.handlers.SysLogHandler(address)
+    handler.setFormatter(
+        logging.Formatter('subiquity[%(process)d]: %(message)s'))
+    return handler
+
+
+class SyslogController(NonInteractiveController):
+
+    autoinstall_key = "syslog"
+    autoinstall_schema = {'type': 'string'}
+
+    def __init__(self, app):
+        super().__init__(app)
+        self.cmdline_target = None
+        for arg in app.kernel_cmdline:
+            if arg.startswith('syslog='):
+                self.cmdline_target = arg[len('syslog='):]
+        self.target = self.cmdline_target
+        self.ai_target = None
+        self._forwarding = None
+        self._queue_handler = None
+        self._listener = None
+        app.add_event_listener(self)
+
+    def load_autoinstall_data(self, data):
+        if data is None:
+            return
+        parse_syslog_target(data)
+        self.ai_target = data
+        if self.cmdline_target is None:
+            self.target = data
+
+    def start(self):
+        # This is called early if there is an autoinstall config and
+        # again with all the other controllers.
+        if self.target is None or self.target == self._forwarding:
+            return
+        try:
+            target = parse_syslog_target(self.target)
+            handler = make_handler(target)
+        except (OSError, ValueError) as e:
+            log.warning("not forwarding logs to %s: %s", self.target, e)
+            return
+        self.stop()
+        log.info("forwarding logs and events to %s", target)
+        # Sending happens in the queue listener's thread so that a slow
+        # or unreachable collector does not hold up the server.
+        q = queue.Queue()
+        self._queue_handler = logging.handlers.QueueHandler(q)
+        self._listener = logging.handlers.QueueListener(q, handler)
+        self._listener.start()
+        logging.getLogger().addHandler(self._queue_handler)
+        self._forwarding = self.target
+
+    def stop(self):
+        if self._listener is None:
+            return
+        logging.getLogger().removeHandler(self._queue_handler)
+        self._listener.stop()
+        for handler in self._listener.handlers:
+            handler.close()
+        self._listener = self._queue_handler = self._forwarding = None
+
+    def _send_event(self, event_type, context, description, result=None):
+        if self._queue_handler is None:
+            return
+        name = context.full_name()
+        msg = '{}: {}'.format(event_type, name)
+        if description:
+            msg += ': ' + description
+        extra = {
+            'event_type': event_type,
+            'context': name,
+            'context_id': str(context.id),
+            'parent_id': str(context.parent.id) if context.parent else '',
+            }
+        if result is not None:
+            extra['result'] = result.name
+            msg += ' [{}]'.format(result.name)
+        level = getattr(logging, context.level, logging.INFO)
+        record = logging.makeLogRecord(dict(
+            name='subiquity.event', levelno=level,
+            levelname=logging.getLevelName(level), msg=msg, **extra))
+        self._queue_handler.handle(record)
+
+    def report_start_event(self, context, description):
+        self._send_event('start', context, description)
+
+    def report_finish_event(self, context, description, result):
+        self._send_event('finish', context, description, result)
+
+    def make_autoinstall(self):
+        return self.ai_target
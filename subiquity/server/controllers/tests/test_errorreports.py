@@ -0,0 +1,50 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.server.controllers.errorreports import make_redactor
+
+
+class TestRedaction(unittest.TestCase):
+
+    def test_builtins(self):
+        redact = make_redactor(
+            ['hostnames', 'ip-addresses', 'mac-addresses', 'serials'],
+            ['ubuntu-server', ''])
+        self.assertEqual(
+            redact(
+                "ubuntu-server: ens3 52:54:00:12:34:56 10.0.0.5/24 "
+                "fe80::5054:ff:fe12:3456/64 at 12:34:56"),
+            "<redacted>: ens3 <redacted> <redacted>/24 <redacted> "
+            "at 12:34:56")
+        self.assertEqual(
+            redact(
+                "{'serial': 'QEMU_HARDDISK_QM00001', 'path': '/dev/sda'} "
+                "ID_SERIAL_SHORT=QM00001"),
+            "{'serial': '<redacted>', 'path': '/dev/sda'} "
+            "ID_SERIAL_SHORT=<redacted>")
+
+    def test_patterns(self):
+        redact = make_redactor([
+            {'pattern': r'corp\.example\.com'},
+            {'pattern': r'user(\d+)', 'replacement': r'someone\1'},
+            ])
+        self.assertEqual(
+            redact("user42@mail.corp.example.com"),
+            "someone42@mail.<redacted>")
+
+    def test_nothing(self):
+        self.assertEqual(make_redactor([])("10.0.0.5"), "10.0.0.5")
@@ -0,0 +1,319 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+from unittest import mock
+
+from aiohttp import web
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.installfiles import INSTALL_FILES
+from subiquity.common.types import (
+    Bootloader,
+    GuidedChoice,
+    GuidedReinstall,
+    GuidedResize,
+    )
+from subiquity.models.tests.test_filesystem import (
+    make_disk,
+    make_model,
+    make_partition,
+    )
+from subiquity.server.controllers.filesystem import FilesystemController
+
+
+class opts:
+    dry_run = True
+
+
+def make_fs_controller(model):
+    return make_controller(
+        FilesystemController, opts=opts, model=model, _ntfs_min_sizes={},
+        _install_files={})
+
+
+@mock.patch('subiquity.server.controllers.filesystem.RESIZE_SUPPORTED', True)
+class TestGuidedResize(unittest.TestCase):
+
+    def setUp(self):
+        self.model = make_model(Bootloader.NONE)
+        self.disk = make_disk(self.model, preserve=True)
+        self.windows = make_partition(
+            self.model, self.disk, preserve=True, size=40 << 30)
+        self.model._probe_data = {
+            'blockdev': {
+                self.windows._path(): {
+                    'ID_FS_TYPE': 'ntfs',
+                    'ID_PART_ENTRY_OFFSET': '2048',
+                    },
+                },
+            }
+        self.controller = make_fs_controller(self.model)
+
+    def resize(self, size):
+        resize = GuidedResize(
+            partition_number=self.windows._number, size=size)
+        run_coro(self.controller.guided_resize(self.disk, resize))
+
+    def test_resize(self):
+        self.resize(20 << 30)
+        self.assertTrue(self.windows.resize)
+        self.assertEqual(self.windows.size, 20 << 30)
+        [root] = [
+            p for p in self.disk.partitions() if p is not self.windows]
+        self.assertEqual(root.fs().mount().path, '/')
+        self.assertEqual(self.model.render()['storage']['version'], 2)
+
+    def test_unsupported(self):
+        with mock.patch(
+                'subiquity.server.controllers.filesystem.RESIZE_SUPPORTED',
+                False):
+            self.assertEqual(
+                run_coro(self.controller._resize_targets()), [])
+            with self.assertRaises(web.HTTPUnprocessableEntity):
+                self.resize(20 << 30)
+        self.assertFalse(self.windows.resize)
+
+    def test_below_minimum(self):
+        # In dry-run mode, ntfsresize "reports" a third of the size.
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            self.resize(10 << 30)
+        self.assertFalse(self.windows.resize)
+        self.assertEqual(len(self.disk.partitions()), 1)
+
+    def test_above_maximum(self):
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            self.resize(40 << 30)
+        self.assertFalse(self.windows.resize)
+
+    def test_blocked(self):
+        self.disk.ptable = 'msdos'
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            self.resize(20 << 30)
+        self.assertFalse(self.windows.resize)
+
+    def test_not_a_target(self):
+        self.model._probe_data['blockdev'][self.windows._path()][
+            'ID_FS_TYPE'] = 'ext4'
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            self.resize(20 << 30)
+
+    def test_ntfsresize_cached(self):
+        with mock.patch.object(
+                self.controller, '_run_ntfsresize',
+                return_value=self.windows.size // 3) as run_ntfsresize:
+            run_coro(self.controller._resize_targets())
+            run_coro(self.controller._resize_targets())
+        run_ntfsresize.assert_called_once_with(self.windows)
+
+
+class TestResetPartition(unittest.TestCase):
+
+    def setUp(self):
+        self.model = make_model(Bootloader.NONE)
+        self.disk = make_disk(self.model, size=8 << 30)
+        self.controller = make_fs_controller(self.model)
+        self.controller._reset_partition_size = 1 << 30
+        self.model.reset_partition = None
+
+    def test_encrypted_lvm(self):
+        self.controller.guided_lvm(self.disk, {
+            'encrypt': True,
+            'luks_options': {'password': 'passw0rd'},
+            })
+        self.controller.add_reset_partition(self.disk)
+        self.assertEqual(self.model.reset_partition.device, self.disk)
+        [vg] = self.model._all(type='lvm_volgroup')
+        self.assertGreaterEqual(vg.free_for_partitions, 0)
+        self.assertGreaterEqual(self.disk.free_for_partitions, 0)
+
+    def test_tracked_by_identity(self):
+        self.controller.guided_direct(self.disk)
+        self.controller.add_reset_partition(self.disk)
+        reset = self.model.reset_partition
+        self.assertFalse(reset.flag)
+        self.assertIn('reset partition', reset.annotations)
+        self.assertFalse(reset.available())
+        # A Windows "Microsoft reserved" partition is not a reset
+        # partition.
+        msr = make_partition(self.model, make_disk(self.model), flag='msftres')
+        self.assertNotIn('reset partition', msr.annotations)
+
+    @mock.patch(
+        'subiquity.server.controllers.filesystem.PARTITION_NAME_SUPPORTED',
+        True)
+    def test_partition_type(self):
+        self.controller.guided_direct(self.disk)
+        self.controller.add_reset_partition(self.disk)
+        self.assertEqual(self.model.reset_partition.partition_name, 'reset')
+        self.assertEqual(
+            self.model.reset_partition.partition_type,
+            'ebd0a0a2-b9e5-4433-87c0-68b6b72699c7')
+
+    def test_storage_POST(self):
+        self.controller.guided_direct(self.disk)
+        self.controller.add_reset_partition(self.disk)
+        reset_id = self.model.reset_partition.id
+        self.model._probe_data = {'blockdev': {self.disk.path: {}}}
+        with mock.patch.object(self.controller, 'configured'):
+            run_coro(self.controller.POST(
+                self.model._render_actions(include_all=True)))
+        self.assertEqual(self.model.reset_partition.id, reset_id)
+        self.assertIn(self.model.reset_partition, self.model._actions)
+
+    def guided_POST(self, **kw):
+        choice = GuidedChoice(
+            disk_id=self.disk.id, reset_partition=True, **kw)
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            run_coro(self.controller.guided_POST(choice))
+        self.assertEqual(self.disk.partitions(), [])
+        self.assertIsNone(self.model.reset_partition)
+
+    def test_no_installer_media(self):
+        self.controller._reset_partition_size = None
+        self.guided_POST(use_lvm=True)
+
+    def test_disk_too_small(self):
+        self.controller._reset_partition_size = 3 << 30
+        self.guided_POST()
+
+    def test_not_whole_disk(self):
+        self.guided_POST(reinstall=GuidedReinstall(root_partition_number=1))
+
+    def test_msdos(self):
+        self.disk.ptable = 'msdos'
+        self.guided_POST()
+
+
+class TestReadInstall(unittest.TestCase):
+
+    def test_cached(self):
+        model = make_model(Bootloader.NONE)
+        part = make_partition(model, preserve=True)
+        model._probe_data = {
+            'blockdev': {part._path(): {'ID_FS_TYPE': 'ext4'}},
+            }
+        controller = make_fs_controller(model)
+        controller.opts = mock.Mock(dry_run=False)
+        files = {'etc/fstab': ''}
+        with mock.patch(
+                'subiquity.server.controllers.filesystem.read_install_files',
+                new=mock.AsyncMock(return_value=files)) as read:
+            self.assertEqual(run_coro(controller._read_install(part)), files)
+            self.assertEqual(run_coro(controller._read_install(part)), files)
+        read.assert_called_once_with(part._path(), 'ext4', INSTALL_FILES)
+
+
+class TestGuidedFstype(unittest.TestCase):
+
+    def setUp(self):
+        self.model = make_model(Bootloader.NONE)
+        self.disk = make_disk(self.model)
+        self.controller = make_fs_controller(self.model)
+
+    def root_fstype(self):
+        [mount] = [m for m in self.model.all_mounts() if m.path == '/']
+        return mount.device.fstype
+
+    def test_direct(self):
+        self.controller.guided_direct(self.disk, fstype='btrfs')
+        self.assertEqual(self.root_fstype(), 'btrfs')
+
+    def test_unsupported(self):
+        with self.assertRaises(Exception):
+            self.controller.guided_direct(self.disk, fstype='vfat')
+        with self.assertRaises(Exception):
+            self.controller.guided_lvm(self.disk, fstype='xfs')
+
+    def test_optional(self):
+        with self.assertRaises(Exception):
+            self.controller.guided_direct(self.disk, fstype='bcachefs')
+        self.model.optional_fstypes = ['bcachefs']
+        self.controller.guided_direct(self.disk, fstype='bcachefs')
+        self.assertEqual(self.root_fstype(), 'bcachefs')
+
+    @mock.patch('subiquity.server.controllers.filesystem.ZFS_SUPPORTED', False)
+    def test_zfs_unsupported(self):
+        with self.assertRaises(Exception):
+            self.controller.guided_zfs(self.disk)
+        choice = GuidedChoice(disk_id=self.disk.id, use_zfs=True)
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            run_coro(self.controller.guided_POST(choice))
+        self.assertEqual(self.model._all(type='zpool'), [])
+
+    def test_autoinstall_zfs_fstype(self):
+        self.controller.ai_data = {
+            'layout': {'name': 'zfs', 'fstype': 'btrfs'},
+            }
+        with mock.patch.object(self.controller, 'guided_zfs') as guided_zfs:
+            with self.assertRaisesRegex(Exception, 'does not support'):
+                self.controller.convert_autoinstall_config()
+        guided_zfs.assert_not_called()
+
+    def test_autoinstall_zfs_subvolumes(self):
+        self.controller.ai_data = {
+            'layout': {
+                'name': 'zfs',
+                'subvolumes': [{'name': '@', 'mount': '/'}],
+                },
+            }
+        with mock.patch.object(self.controller, 'guided_zfs') as guided_zfs:
+            with self.assertRaisesRegex(Exception, 'does not support'):
+                self.controller.convert_autoinstall_config()
+        guided_zfs.assert_not_called()
+
+    def test_autoinstall_ext4_subvolumes(self):
+        self.controller.ai_data = {
+            'layout': {
+                'name': 'direct',
+                'subvolumes': [{'name': '@', 'mount': '/'}],
+                },
+            }
+        with self.assertRaisesRegex(Exception, 'only supported with btrfs'):
+            self.controller.convert_autoinstall_config()
+
+    def test_autoinstall_config_subvolumes(self):
+        self.model._probe_data = {'blockdev': {self.disk.path: {}}}
+        self.controller.ai_data = {
+            'config': [
+                {'type': 'disk', 'id': 'disk0', 'path': self.disk.path,
+                 'ptable': 'gpt'},
+                {'type': 'partition', 'id': 'part0', 'device': 'disk0',
+                 'size': 1 << 30, 'number': 1},
+                {'type': 'format', 'id': 'format0', 'volume': 'part0',
+                 'fstype': 'ext4',
+                 'subvolumes': [{'name': '@', 'mount': '/'}]},
+                ],
+            }
+        with self.assertRaisesRegex(Exception, 'does not have subvolumes'):
+            self.controller.convert_autoinstall_config()
+
+    def test_autoinstall_direct_fstype(self):
+        self.controller.ai_data = {
+            'layout': {'name': 'direct', 'fstype': 'btrfs'},
+            }
+        self.controller.convert_autoinstall_config()
+        self.assertEqual(self.root_fstype(), 'btrfs')
+
+    def test_autoinstall_dm_verity(self):
+        self.controller.ai_data = {
+            'config': [
+                {'type': 'disk', 'id': 'disk0', 'serial': 'serial0'},
+                {'type': 'dm_verity', 'id': 'verity0', 'volume': 'disk0'},
+                ],
+            }
+        with self.assertRaisesRegex(Exception, 'dm_verity'):
+            self.controller.convert_autoinstall_config()
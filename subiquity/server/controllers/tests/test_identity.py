@@ -0,0 +1,82 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import os
+import unittest
+from unittest import mock
+
+from aiohttp import web
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.types import IdentityData, IdentityUser
+from subiquity.models.identity import IdentityModel
+from subiquity.server.controllers.identity import IdentityController
+
+
+TOP_DIR = os.path.join(
+    os.path.dirname(os.path.abspath(__file__)), '..', '..', '..', '..')
+
+
+class TestExtraUsers(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(IdentityController)
+        self.controller.model = IdentityModel()
+        self.controller.model.add_user(IdentityData(
+            username='ubuntu', hostname='host', crypted_password='x'))
+        patcher = mock.patch.dict(os.environ, {'SNAP': TOP_DIR})
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def set_users(self, *usernames):
+        self.controller.set_extra_users([
+            IdentityUser(username=username) for username in usernames])
+
+    def test_ok(self):
+        self.set_users('ops', 'backup_1')
+        self.assertEqual(
+            [u.username for u in self.controller.model.extra_users],
+            ['ops', 'backup_1'])
+
+    def test_reserved(self):
+        with self.assertRaisesRegex(ValueError, 'reserved'):
+            self.set_users('daemon')
+        with self.assertRaisesRegex(ValueError, 'reserved'):
+            self.set_users('root')
+
+    def test_syntax(self):
+        for username in 'Ops', '1ops', 'ops:x', 'ops user', '':
+            with self.subTest(username=username):
+                with self.assertRaisesRegex(ValueError, 'does not match'):
+                    self.set_users(username)
+
+    def test_too_long(self):
+        with self.assertRaisesRegex(ValueError, 'longer than'):
+            self.set_users('a' * 33)
+
+    def test_duplicate(self):
+        with self.assertRaisesRegex(ValueError, 'more than once'):
+            self.set_users('ubuntu')
+
+    def test_nothing_set_on_error(self):
+        with self.assertRaises(ValueError):
+            self.set_users('ops', 'root')
+        self.assertEqual(self.controller.model.extra_users, [])
+
+    def test_users_POST(self):
+        with self.assertRaises(web.HTTPUnprocessableEntity):
+            run_coro(self.controller.users_POST(
+                [IdentityUser(username='bin')]))
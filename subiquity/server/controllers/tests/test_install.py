@@ -0,0 +1,177 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import hashlib
+import os
+import subprocess
+import tempfile
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.server.controllers.install import InstallController
+
+
+class FakeContent:
+
+    def __init__(self, chunks, exc=None):
+        self.chunks = chunks
+        self.exc = exc
+
+    async def iter_chunked(self, size):
+        for chunk in self.chunks:
+            yield chunk
+        if self.exc is not None:
+            raise self.exc
+
+
+def fake_session(content):
+    resp = mock.MagicMock()
+    resp.content = content
+    resp.raise_for_status = mock.Mock()
+    session = mock.MagicMock()
+    session.__aenter__.return_value = session
+    session.get.return_value.__aenter__.return_value = resp
+    return mock.Mock(return_value=session)
+
+
+class TestDownloadSource(unittest.TestCase):
+
+    def setUp(self):
+        tdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tdir.cleanup)
+        self.tdir = tdir.name
+        self.controller = make_controller(InstallController)
+        self.controller.app.state_path = lambda name: os.path.join(
+            self.tdir, name)
+        self.controller.model = mock.Mock()
+        self.source = self.controller.model.source
+        self.source.sha256 = hashlib.sha256(b'image').hexdigest()
+        self.source.path = None
+
+    def download(self, content):
+        with mock.patch('aiohttp.ClientSession', fake_session(content)):
+            run_coro(self.controller.download_source(
+                url='http://example.com/source.img'))
+
+    def test_download(self):
+        self.download(FakeContent([b'ima', b'ge']))
+        self.assertEqual(os.listdir(self.tdir), ['source.img'])
+        self.assertEqual(self.source.path, os.path.join(
+            self.tdir, 'source.img'))
+
+    def test_bad_checksum(self):
+        with self.assertRaisesRegex(RuntimeError, 'expected'):
+            self.download(FakeContent([b'not the image']))
+        self.assertEqual(os.listdir(self.tdir), [])
+        self.assertIsNone(self.source.path)
+
+    def test_interrupted(self):
+        with self.assertRaises(asyncio.TimeoutError):
+            self.download(FakeContent([b'ima'], asyncio.TimeoutError()))
+        self.assertEqual(os.listdir(self.tdir), [])
+        self.assertIsNone(self.source.path)
+
+
+class TestInstallOptionalPackage(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(InstallController)
+        self.controller.model = mock.Mock()
+        self.controller.model.network.has_network = True
+
+    def install(self, **kw):
+        with mock.patch.object(
+                self.controller, 'install_package',
+                new=mock.AsyncMock(**kw)) as install_package:
+            installed = run_coro(self.controller.install_optional_package(
+                context=None, package='systemd-zram-generator'))
+        return installed, install_package
+
+    def test_installed(self):
+        installed, install_package = self.install()
+        self.assertTrue(installed)
+        install_package.assert_called_once_with(
+            context=None, package='systemd-zram-generator')
+
+    def test_no_network(self):
+        self.controller.model.network.has_network = False
+        installed, install_package = self.install()
+        self.assertFalse(installed)
+        install_package.assert_not_called()
+
+    def test_failed(self):
+        installed, install_package = self.install(
+            side_effect=subprocess.CalledProcessError(100, ['apt-get']))
+        self.assertFalse(installed)
+
+
+class TestInstallKdump(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(InstallController)
+        self.controller.model = mock.Mock()
+        self.controller.model.kdump.enabled = True
+        self.controller.model.kdump.crashkernel.return_value = '512M'
+
+    def install_kdump(self, installed=True):
+        with mock.patch.object(
+                self.controller, 'install_optional_package',
+                new=mock.AsyncMock(return_value=installed)) as install:
+            crashkernel = run_coro(
+                self.controller.install_kdump(context=None))
+        return crashkernel, install
+
+    def test_installed(self):
+        crashkernel, install = self.install_kdump()
+        self.assertEqual(crashkernel, '512M')
+        install.assert_called_once_with(context=None, package='kdump-tools')
+
+    def test_not_installed(self):
+        crashkernel, install = self.install_kdump(installed=False)
+        self.assertIsNone(crashkernel)
+
+    def test_not_enough_memory(self):
+        self.controller.model.kdump.crashkernel.return_value = None
+        crashkernel, install = self.install_kdump()
+        self.assertIsNone(crashkernel)
+        install.assert_not_called()
+
+    def test_disabled(self):
+        self.controller.model.kdump.enabled = False
+        crashkernel, install = self.install_kdump()
+        self.assertIsNone(crashkernel)
+        install.assert_not_called()
+
+
+class TestConfigureKdump(unittest.TestCase):
+
+    def test_leaves_conffile_alone(self):
+        tdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tdir.cleanup)
+        controller = make_controller(InstallController)
+        controller.app.opts.dry_run = False
+        controller.app.log_syslog_id = 'subiquity'
+        controller.model = mock.Mock()
+        controller.model.target = tdir.name
+        with mock.patch(
+                'subiquity.server.controllers.install.arun_command',
+                new=mock.AsyncMock()):
+            run_coro(controller.configure_kdump(context=None, size='512M'))
+        self.assertEqual(
+            os.listdir(os.path.join(tdir.name, 'etc/default/grub.d')),
+            ['99-subiquity-kdump.cfg'])
@@ -0,0 +1,62 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.types import InventoryConfig
+from subiquity.models.inventory import InventoryModel
+from subiquity.server.controllers.inventory import InventoryController
+
+
+class TestTokenRedacted(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(InventoryController)
+        self.controller.model = InventoryModel()
+        self.controller.configured = mock.Mock()
+        self.controller.load_autoinstall_data({
+            'url': 'https://cmdb.example.com/report',
+            'token': 'sekrit',
+            })
+
+    def test_get(self):
+        config = run_coro(self.controller.GET())
+        self.assertEqual(config.url, 'https://cmdb.example.com/report')
+        self.assertIsNone(config.token)
+
+    def test_serialize(self):
+        self.assertNotIn('sekrit', repr(self.controller.serialize()))
+
+    def test_make_autoinstall(self):
+        self.assertNotIn('token', self.controller.make_autoinstall())
+
+    def test_deserialize_keeps_token(self):
+        self.controller.deserialize(self.controller.serialize())
+        self.assertEqual(self.controller.model.token, 'sekrit')
+
+    def test_post_without_token_keeps_token(self):
+        config = run_coro(self.controller.GET())
+        config.probe_data = False
+        run_coro(self.controller.POST(config))
+        self.assertEqual(self.controller.model.token, 'sekrit')
+        self.assertFalse(self.controller.model.probe_data)
+
+    def test_post_token(self):
+        run_coro(self.controller.POST(InventoryConfig(
+            url='https://cmdb.example.com/report', token='new')))
+        self.assertEqual(self.controller.model.token, 'new')
@@ -0,0 +1,112 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import json
+import unittest
+
+from subiquitycore.tests import make_controller
+
+from subiquity.common.types import (
+    ISCSIChap,
+    ISCSILogin,
+    ISCSITarget,
+    MultipathDevice,
+    )
+from subiquity.models.iscsi import ISCSIModel
+from subiquity.server.controllers.iscsi import (
+    ISCSIController,
+    normalize_portal,
+    parse_multipath_paths,
+    parse_sendtargets,
+    parse_sessions,
+    )
+
+
+class TestISCSIParsing(unittest.TestCase):
+
+    def test_normalize_portal(self):
+        self.assertEqual(normalize_portal('10.0.0.1'), '10.0.0.1:3260')
+        self.assertEqual(normalize_portal('10.0.0.1:3261'), '10.0.0.1:3261')
+        self.assertEqual(normalize_portal('fd00::1'), '[fd00::1]:3260')
+        self.assertEqual(normalize_portal('[fd00::1]'), '[fd00::1]:3260')
+        self.assertEqual(
+            normalize_portal('[fd00::1]:3261'), '[fd00::1]:3261')
+
+    def test_parse_sendtargets(self):
+        output = (
+            "10.0.0.1:3260,1 iqn.2003-01.org.example:lun1\n"
+            "[fd00::1]:3260,1 iqn.2003-01.org.example:lun2\n")
+        self.assertEqual(
+            parse_sendtargets(output),
+            [
+                ISCSITarget('10.0.0.1:3260', 'iqn.2003-01.org.example:lun1'),
+                ISCSITarget('[fd00::1]:3260', 'iqn.2003-01.org.example:lun2'),
+            ])
+
+    def test_parse_sessions(self):
+        output = (
+            "tcp: [1] 10.0.0.1:3260,1 iqn.2003-01.org.example:lun1 "
+            "(non-flash)\n")
+        self.assertEqual(
+            parse_sessions(output),
+            [ISCSITarget(
+                '10.0.0.1:3260', 'iqn.2003-01.org.example:lun1', True)])
+
+    def test_parse_multipath_paths(self):
+        output = (
+            "mpatha 3600140512345 sdb\n"
+            "mpatha 3600140512345 sdc\n"
+            "[orphan] 3600140567890 sdd\n")
+        self.assertEqual(
+            parse_multipath_paths(output),
+            [MultipathDevice('mpatha', '3600140512345', ['sdb', 'sdc'])])
+
+
+class TestISCSIPasswords(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(ISCSIController)
+        self.controller.model = ISCSIModel()
+        self.controller.model.logins = [
+            ISCSILogin(
+                target=ISCSITarget('10.0.0.1:3260', 'iqn.2003-01.org.ex:a'),
+                chap=ISCSIChap(username='user', password='s3kr1t')),
+            ISCSILogin(
+                target=ISCSITarget('10.0.0.2:3260', 'iqn.2003-01.org.ex:b')),
+            ]
+
+    def test_make_autoinstall(self):
+        self.assertEqual(self.controller.make_autoinstall(), {
+            'targets': [
+                {
+                    'portal': '10.0.0.1:3260',
+                    'iqn': 'iqn.2003-01.org.ex:a',
+                    'username': 'user',
+                    },
+                {
+                    'portal': '10.0.0.2:3260',
+                    'iqn': 'iqn.2003-01.org.ex:b',
+                    },
+                ],
+            })
+
+    def test_serialize(self):
+        state = self.controller.serialize()
+        self.assertNotIn('s3kr1t', json.dumps(state))
+        self.controller.model.logins = []
+        self.controller.deserialize(state)
+        [with_chap, without_chap] = self.controller.model.logins
+        self.assertEqual(with_chap.chap.username, 'user')
+        self.assertIsNone(without_chap.chap)
@@ -18,6 +18,8 @@ import os
 import tempfile
 import unittest
 
+from subiquitycore.tests import make_controller
+
 from subiquity.models.keyboard import (
     KeyboardModel,
     )
@@ -46,7 +48,7 @@ class TestSubiquityModel(unittest.TestCase):
                 new_setting = KeyboardSetting('fr', 'azerty')
                 model = KeyboardModel(tmpdir)
                 model.setting = new_setting
-                c = object.__new__(KeyboardController)
+                c = make_controller(KeyboardController)
                 c.opts = opts
                 c.model = model
                 await c.set_keyboard()
@@ -0,0 +1,139 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.types import MirrorSpeed
+from subiquity.server.controllers.mirror import (
+    CheckState,
+    MirrorController,
+    parse_mirror_list,
+    rank_mirrors,
+    )
+
+
+class TestParseMirrorList(unittest.TestCase):
+
+    def test_parse(self):
+        content = (
+            "http://gb.archive.ubuntu.com/ubuntu/\n"
+            "https://mirror.example.com/ubuntu\n"
+            "\n"
+            "rsync://mirror.example.com/ubuntu\n"
+            "http://gb.archive.ubuntu.com/ubuntu\n")
+        self.assertEqual(
+            parse_mirror_list(content),
+            [
+                'http://gb.archive.ubuntu.com/ubuntu',
+                'https://mirror.example.com/ubuntu',
+            ])
+
+
+class TestRankMirrors(unittest.TestCase):
+
+    def test_fastest_first_failures_last(self):
+        slow = MirrorSpeed(url='http://slow', speed=10.0)
+        fast = MirrorSpeed(url='http://fast', speed=1000.0)
+        broken = MirrorSpeed(url='http://broken', error='timed out')
+        self.assertEqual(
+            rank_mirrors([broken, slow, fast]), [fast, slow, broken])
+
+
+GEOIP_RESPONSE = (
+    '<Response><CountryCode>GB</CountryCode></Response>')
+
+
+class TestIPv6Only(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(MirrorController)
+        self.controller.app.base_model.network.ipv6_only = True
+        self.controller.app.base_model.offline.offline = False
+        self.controller.model = mock.Mock()
+        self.controller.model.get_mirror.return_value = (
+            'http://gb.archive.ubuntu.com/ubuntu')
+        self.controller.model.default_mirror = (
+            'http://archive.ubuntu.com/ubuntu')
+        self.controller.rank_enabled = False
+        self.reachable = set()
+        for name, kw in [
+                ('reachable_over_ipv6',
+                 {'side_effect': self.reachable.__contains__}),
+                ('has_dns64', {'return_value': False}),
+                ]:
+            patcher = mock.patch(
+                'subiquity.server.controllers.mirror.' + name, **kw)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        patcher = mock.patch('requests.get')
+        self.get = patcher.start()
+        self.addCleanup(patcher.stop)
+        self.get.return_value.text = GEOIP_RESPONSE
+
+    def test_geoip_unreachable(self):
+        run_coro(self.controller.lookup())
+        self.assertEqual(self.controller.check_state, CheckState.FAILED)
+        self.get.assert_not_called()
+
+    def test_country_mirror_unreachable(self):
+        self.reachable.add('geoip.ubuntu.com')
+        run_coro(self.controller.lookup())
+        self.assertEqual(self.controller.check_state, CheckState.DONE)
+        self.controller.model.set_country.assert_called_once_with('gb')
+        self.controller.model.set_mirror.assert_called_once_with(
+            'http://archive.ubuntu.com/ubuntu')
+
+    def test_country_mirror_reachable(self):
+        self.reachable.update({'geoip.ubuntu.com', 'gb.archive.ubuntu.com'})
+        run_coro(self.controller.lookup())
+        self.controller.model.set_mirror.assert_not_called()
+
+    def test_dual_stack(self):
+        self.controller.app.base_model.network.ipv6_only = False
+        run_coro(self.controller.lookup())
+        self.assertEqual(self.controller.check_state, CheckState.DONE)
+        self.controller.model.set_mirror.assert_not_called()
+
+    def test_measure_unreachable(self):
+        speed = run_coro(
+            self.controller._measure('http://mirror.example.com', 'focal'))
+        self.assertEqual(speed.url, 'http://mirror.example.com')
+        self.assertEqual(speed.error, 'not reachable over IPv6')
+
+
+class TestOffline(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(MirrorController)
+        self.controller.app.base_model.offline.offline = True
+        self.controller.check_state = CheckState.CHECKING
+
+    def test_lookup_offline(self):
+        with mock.patch('requests.get') as get:
+            run_coro(self.controller.lookup())
+        self.assertEqual(self.controller.check_state, CheckState.NOT_STARTED)
+        get.assert_not_called()
+
+    def test_stop_check(self):
+        self.controller.lookup_task = mock.Mock()
+        self.controller.stop_check()
+        self.controller.lookup_task.start_sync.assert_called_once_with()
+        self.controller.lookup_task.reset_mock()
+        self.controller.check_state = CheckState.DONE
+        self.controller.stop_check()
+        self.controller.lookup_task.start_sync.assert_not_called()
@@ -0,0 +1,101 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquitycore.models.network import (
+    MAX_VLANS_AT_ONCE,
+    NetworkDev,
+    NetworkModel,
+    )
+
+from subiquity.common.types import InstalledNetworkConfig
+from subiquity.server.controllers.network import (
+    installed_network_config,
+    NetworkController,
+    )
+
+
+class TestAddVlans(unittest.TestCase):
+
+    def setUp(self):
+        self.model = NetworkModel('test')
+        eth0 = NetworkDev(self.model, 'eth0', 'eth')
+        eth0.config = {}
+        self.model.devices_by_name = {'eth0': eth0}
+        self.controller = make_controller(NetworkController)
+        self.controller.model = self.model
+        self.controller.new_link = mock.Mock()
+        self.controller.update_link = mock.Mock()
+        self.controller.apply_config = mock.Mock()
+
+    def test_applied_once(self):
+        run_coro(self.controller.vlan_PUT('eth0', [10, 20, 30]))
+        self.assertEqual(
+            sorted(self.model.devices_by_name),
+            ['eth0', 'eth0.10', 'eth0.20', 'eth0.30'])
+        self.controller.apply_config.assert_called_once_with()
+
+    def test_too_many(self):
+        ids = list(range(1, MAX_VLANS_AT_ONCE + 2))
+        with self.assertRaises(ValueError):
+            run_coro(self.controller.vlan_PUT('eth0', ids))
+        self.assertEqual(list(self.model.devices_by_name), ['eth0'])
+        self.controller.apply_config.assert_not_called()
+
+    def test_invalid_id(self):
+        with self.assertRaises(ValueError):
+            run_coro(self.controller.vlan_PUT('eth0', [10, 4096]))
+        self.assertEqual(list(self.model.devices_by_name), ['eth0'])
+
+
+class TestInstalledNetworkConfig(unittest.TestCase):
+
+    def test_config(self):
+        files = {
+            'etc/os-release': 'PRETTY_NAME="Ubuntu 20.04.2 LTS"\n',
+            'etc/fstab': '',
+            'etc/netplan/50-cloud-init.yaml': (
+                'network:\n'
+                '  ethernets:\n'
+                '    eth0: {dhcp4: true}\n'),
+            'etc/netplan/00-installer-config.yaml': (
+                'network:\n'
+                '  bonds:\n'
+                '    bond0: {interfaces: [eth1, eth2]}\n'),
+            }
+        self.assertEqual(
+            installed_network_config('/dev/sda2', files),
+            InstalledNetworkConfig(
+                source='/dev/sda2',
+                os_name='Ubuntu 20.04.2 LTS',
+                files=[
+                    files['etc/netplan/00-installer-config.yaml'],
+                    files['etc/netplan/50-cloud-init.yaml'],
+                    ],
+                interfaces=['bond0', 'eth0']))
+
+    def test_bad_yaml(self):
+        files = {'etc/netplan/01.yaml': 'network: [\n'}
+        config = installed_network_config('/dev/sda2', files)
+        self.assertEqual(config.os_name, 'Linux')
+        self.assertEqual(config.interfaces, [])
+
+    def test_no_netplan(self):
+        files = {'etc/os-release': 'NAME="Ubuntu"\n', 'etc/fstab': ''}
+        self.assertIsNone(installed_network_config('/dev/sda2', files))
@@ -0,0 +1,93 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import json
+import unittest
+
+from subiquitycore.tests import make_controller
+
+from subiquity.common.types import NVMeoFTarget
+from subiquity.models.nvmeof import NVMeoFModel
+from subiquity.server.controllers.nvmeof import (
+    NVMeoFController,
+    parse_nvme_discovery,
+    )
+
+
+class TestNVMeoFParsing(unittest.TestCase):
+
+    def test_parse_nvme_discovery(self):
+        output = json.dumps({'records': [
+            {
+                'trtype': 'tcp',
+                'subtype': 'nvme subsystem',
+                'traddr': '10.0.0.1',
+                'trsvcid': '4420',
+                'subnqn': 'nqn.2014-08.org.example:t1',
+            },
+            {
+                'trtype': 'tcp',
+                'subtype': 'discovery subsystem referral',
+                'traddr': '10.0.0.2',
+                'trsvcid': '8009',
+                'subnqn': 'nqn.2014-08.org.nvmexpress.discovery',
+            },
+            {
+                'trtype': 'rdma',
+                'subtype': 'nvme subsystem',
+                'traddr': '10.0.0.3',
+                'trsvcid': '4420',
+                'subnqn': 'nqn.2014-08.org.example:t3',
+            },
+            ]})
+        self.assertEqual(
+            parse_nvme_discovery(output),
+            [NVMeoFTarget('10.0.0.1', 4420, 'nqn.2014-08.org.example:t1')])
+
+    def test_parse_nvme_discovery_no_records(self):
+        self.assertEqual(parse_nvme_discovery('{}'), [])
+
+
+class TestNVMeoFAutoinstall(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(NVMeoFController)
+        self.controller.model = NVMeoFModel()
+
+    def test_load_autoinstall_data_defaults(self):
+        self.controller.load_autoinstall_data({
+            'targets': [
+                {'address': '10.0.0.1', 'subnqn': 'nqn.2014-08.org.ex:a'},
+                ],
+            })
+        self.assertEqual(
+            self.controller.ai_targets,
+            [NVMeoFTarget('10.0.0.1', 4420, 'nqn.2014-08.org.ex:a', 'tcp')])
+
+    def test_make_autoinstall(self):
+        self.controller.model.targets = [
+            NVMeoFTarget(
+                '10.0.0.1', 4420, 'nqn.2014-08.org.ex:a', connected=True),
+            ]
+        self.assertEqual(self.controller.make_autoinstall(), {
+            'targets': [
+                {
+                    'address': '10.0.0.1',
+                    'port': 4420,
+                    'subnqn': 'nqn.2014-08.org.ex:a',
+                    'transport': 'tcp',
+                    },
+                ],
+            })
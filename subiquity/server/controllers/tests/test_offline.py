@@ -0,0 +1,58 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.server.controllers.offline import OfflineController
+
+
+class TestOfflinePOST(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(OfflineController)
+        self.controller.model = mock.Mock(offline=False)
+        self.controller.configured = mock.Mock()
+        self.network = self.controller.app.controllers.Network
+        self.network.has_default_route.return_value = True
+
+    def test_go_offline(self):
+        run_coro(self.controller.POST(True))
+        self.assertTrue(self.controller.model.offline)
+        self.network.update_has_network.assert_called_once_with()
+        self.controller.app.hub.broadcast.assert_called_once_with(
+            'network-offline')
+        self.controller.configured.assert_called_once_with()
+
+    def test_back_online(self):
+        self.controller.model.offline = True
+        run_coro(self.controller.POST(False))
+        self.assertFalse(self.controller.model.offline)
+        self.controller.app.hub.broadcast.assert_called_once_with(
+            'network-up')
+        self.controller.configured.assert_called_once_with()
+
+    def test_back_online_without_route(self):
+        self.controller.model.offline = True
+        self.network.has_default_route.return_value = False
+        run_coro(self.controller.POST(False))
+        self.controller.app.hub.broadcast.assert_not_called()
+
+    def test_unchanged(self):
+        run_coro(self.controller.POST(False))
+        self.controller.app.hub.broadcast.assert_not_called()
+        self.controller.configured.assert_called_once_with()
@@ -0,0 +1,120 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import os
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro, SubiTestCase
+
+from subiquity.common.types import (
+    RecoveryKeyExport,
+    RecoveryKeyExportKind,
+    )
+from subiquity.models.tests.test_filesystem import (
+    make_disk,
+    make_model,
+    make_partition,
+    )
+from subiquity.server.controllers.recoverykey import RecoveryKeyController
+
+
+class opts:
+    dry_run = True
+
+
+class TestRecoveryKeyController(SubiTestCase):
+
+    def setUp(self):
+        self.model = make_model()
+        self.controller = make_controller(
+            RecoveryKeyController, opts=opts, model=self.model, _exports=[])
+        self.controller.app.root = self.tmp_dir()
+        self.controller.app.base_model.identity.hostname = 'host'
+
+    def make_stick(self, fstype='vfat', preserve=True):
+        disk = make_disk(self.model)
+        disk._info.raw['ID_BUS'] = 'usb'
+        part = make_partition(self.model, disk, preserve=True)
+        self.model._orig_config.append({
+            'type': 'format', 'id': 'format-' + part.id, 'volume': part.id,
+            'fstype': fstype,
+            })
+        self.model.add_filesystem(part, fstype, preserve=preserve)
+        return part
+
+    def notes(self):
+        return [
+            c.args[1]
+            for c in self.controller.app.note_data_for_apport.call_args_list
+            ]
+
+    def test_media(self):
+        part = self.make_stick()
+        [medium] = run_coro(self.controller.GET()).media
+        self.assertEqual(medium.path, part._path())
+        self.assertEqual(medium.fstype, 'vfat')
+
+    def test_media_skips_fixed_and_reformatted(self):
+        make_partition(self.model, make_disk(self.model), preserve=True)
+        self.make_stick(preserve=False)
+        self.make_stick(fstype='ntfs')
+        self.assertEqual(run_coro(self.controller.GET()).media, [])
+
+    def test_generate(self):
+        resp = run_coro(self.controller.POST())
+        self.assertEqual(resp.key, self.model.recovery_key)
+        self.assertIsNotNone(resp.key)
+        # The key itself never gets into the apport report.
+        self.assertEqual(self.notes(), ["generated and displayed"])
+
+    def test_export_needs_key(self):
+        export = RecoveryKeyExport(kind=RecoveryKeyExportKind.ESCROW, url='x')
+        with self.assertRaises(Exception):
+            run_coro(self.controller.export_POST(export))
+
+    def test_export_to_media(self):
+        part = self.make_stick()
+        run_coro(self.controller.POST())
+        export = RecoveryKeyExport(
+            kind=RecoveryKeyExportKind.MEDIA, path=part._path())
+        resp = run_coro(self.controller.export_POST(export))
+        self.assertIsNone(resp.error)
+        path = os.path.join(self.controller.app.root, 'recovery-key-host.txt')
+        with open(path) as fp:
+            self.assertEqual(fp.read(), self.model.recovery_key + '\n')
+
+    def test_export_to_media_not_listed(self):
+        run_coro(self.controller.POST())
+        export = RecoveryKeyExport(
+            kind=RecoveryKeyExportKind.MEDIA, path='/dev/sda1')
+        with self.assertRaises(Exception):
+            run_coro(self.controller.export_POST(export))
+
+    def test_escrow_failure(self):
+        run_coro(self.controller.POST())
+        export = RecoveryKeyExport(
+            kind=RecoveryKeyExportKind.ESCROW, url='https://escrow.example')
+        with mock.patch.object(
+                self.controller, '_escrow',
+                side_effect=RuntimeError(
+                    "escrow server returned HTTP status 500")):
+            resp = run_coro(self.controller.export_POST(export))
+        self.assertEqual(
+            resp.error, "escrow server returned HTTP status 500")
+        self.assertEqual(
+            self.notes()[-1],
+            "generated and displayed\n"
+            "not sent to https://escrow.example: "
+            "escrow server returned HTTP status 500")
@@ -0,0 +1,185 @@
+# Copyright 2019 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import gzip
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.types import RefreshCheckState, RefreshStatus
+from subiquity.server.controllers.refresh import (
+    RefreshController,
+    snap_source_ok,
+    )
+
+
+def make_refresh_controller(cmdline=(), ai_data=None):
+    c = make_controller(RefreshController, app=mock.MagicMock())
+    c.app.kernel_cmdline = list(cmdline)
+    c.app.updated = False
+    c.ai_data = ai_data or {}
+    c.local_snap = None
+    c.status = RefreshStatus(availability=RefreshCheckState.UNKNOWN)
+    return c
+
+
+class TestSnapSourceOk(unittest.TestCase):
+
+    def test_ok(self):
+        self.assertTrue(snap_source_ok('/cdrom/subiquity.snap'))
+        self.assertTrue(
+            snap_source_ok('https://example.com/snaps/subiquity_1.snap'))
+        self.assertTrue(snap_source_ok('http://10.0.0.1/subiquity.snap'))
+
+    def test_not_ok(self):
+        self.assertFalse(snap_source_ok('subiquity.snap'))
+        self.assertFalse(snap_source_ok('/cdrom/subiquity'))
+        self.assertFalse(snap_source_ok('/cdrom/.snap'))
+        self.assertFalse(snap_source_ok('ftp://example.com/subiquity.snap'))
+        self.assertFalse(snap_source_ok('file:///cdrom/subiquity.snap'))
+        self.assertFalse(snap_source_ok('https:///subiquity.snap'))
+
+
+class TestGetRefreshSnap(unittest.TestCase):
+
+    def test_none(self):
+        self.assertIsNone(make_refresh_controller().get_refresh_snap())
+
+    def test_autoinstall(self):
+        c = make_refresh_controller(ai_data={
+            'snap': '/cdrom/subiquity.snap',
+            'assertion': '/cdrom/subiquity.assertion',
+            })
+        self.assertEqual(
+            c.get_refresh_snap(),
+            ('/cdrom/subiquity.snap', '/cdrom/subiquity.assertion'))
+
+    def test_cmdline_wins(self):
+        c = make_refresh_controller(
+            cmdline=['quiet', 'subiquity-snap=http://host/subiquity.snap'],
+            ai_data={'snap': '/cdrom/subiquity.snap'})
+        self.assertEqual(
+            c.get_refresh_snap(),
+            ('http://host/subiquity.snap', 'http://host/subiquity.assert'))
+
+    def test_bad_cmdline_ignored(self):
+        c = make_refresh_controller(
+            cmdline=['subiquity-snap=../../etc/shadow'],
+            ai_data={'snap': '/cdrom/subiquity.snap'})
+        self.assertEqual(
+            c.get_refresh_snap(),
+            ('/cdrom/subiquity.snap', '/cdrom/subiquity.assert'))
+
+    def test_bad_autoinstall_rejected(self):
+        c = make_refresh_controller()
+        with self.assertRaises(ValueError):
+            c.load_autoinstall_data({'snap': 'subiquity'})
+
+
+class TestFetch(unittest.TestCase):
+
+    def test_local_path_not_copied(self):
+        c = make_refresh_controller()
+        self.assertEqual(
+            c._fetch('/cdrom/subiquity.snap', '/nonexistent'),
+            '/cdrom/subiquity.snap')
+
+    def test_content_decoded(self):
+        # The response's iter_content does the decoding; make sure that
+        # is what ends up in the file, not the encoded bytes.
+        response = mock.MagicMock()
+        response.__enter__.return_value = response
+        response.raw.read.return_value = gzip.compress(b'snap')
+        response.iter_content.return_value = [b'sn', b'ap']
+        c = make_refresh_controller()
+        with tempfile.TemporaryDirectory() as tmpdir:
+            with mock.patch(
+                    'subiquity.server.controllers.refresh.requests.get',
+                    return_value=response):
+                dest = c._fetch('https://host/dir/subiquity.snap', tmpdir)
+            self.assertEqual(dest, os.path.join(tmpdir, 'subiquity.snap'))
+            with open(dest, 'rb') as fp:
+                self.assertEqual(fp.read(), b'snap')
+
+
+class TestCheckForUpdate(unittest.TestCase):
+
+    def test_url_not_downloaded(self):
+        async def t():
+            c = make_refresh_controller(
+                cmdline=['subiquity-snap=http://host/subiquity_12.snap'])
+            c.configure_task = asyncio.get_event_loop().create_future()
+            c.configure_task.set_result(None)
+            with mock.patch.object(c, 'fetch_snap') as fetch_snap:
+                await c.check_for_update()
+            fetch_snap.assert_not_called()
+            self.assertEqual(
+                c.status.availability, RefreshCheckState.AVAILABLE)
+            self.assertEqual(c.status.new_snap_version, 'subiquity_12.snap')
+        run_coro(t())
+
+    def test_missing_local_snap(self):
+        async def t():
+            c = make_refresh_controller(
+                ai_data={'snap': '/nonexistent/subiquity.snap'})
+            c.configure_task = asyncio.get_event_loop().create_future()
+            c.configure_task.set_result(None)
+            await c.check_for_update()
+            self.assertEqual(
+                c.status.availability, RefreshCheckState.UNAVAILABLE)
+        run_coro(t())
+
+
+class TestStopCheck(unittest.TestCase):
+
+    def test_running_check_restarted(self):
+        c = make_refresh_controller()
+        c.check_task = mock.Mock()
+        c.check_task.task.done.return_value = False
+        c.stop_check()
+        c.check_task.start_sync.assert_called_once_with()
+
+    def test_finished_check_left_alone(self):
+        c = make_refresh_controller()
+        c.check_task = mock.Mock()
+        c.check_task.task.done.return_value = True
+        c.stop_check()
+        c.check_task.start_sync.assert_not_called()
+
+    def test_inactive(self):
+        c = make_refresh_controller()
+        c.check_task = None
+        c.stop_check()
+
+
+class TestStartUpdate(unittest.TestCase):
+
+    def test_sideload_classic(self):
+        with tempfile.TemporaryDirectory() as tdir:
+            snap = os.path.join(tdir, 'subiquity_12.snap')
+            assertion = os.path.join(tdir, 'subiquity_12.assert')
+            for path in snap, assertion:
+                with open(path, 'w') as fp:
+                    fp.write('data')
+            c = make_refresh_controller(ai_data={'snap': snap})
+            c.local_snap = snap, assertion
+            c.app.snapd.post_assertion = mock.AsyncMock()
+            c.app.snapd.sideload = mock.AsyncMock(return_value='7')
+            self.assertEqual(run_coro(c.start_update()), '7')
+        c.app.snapd.sideload.assert_called_once_with(snap, classic=True)
@@ -0,0 +1,180 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import json
+import subprocess
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.types import RescueAction, RescueUnlock
+from subiquity.server.controllers.rescue import (
+    fsck_command,
+    parse_lsblk,
+    RescueController,
+    )
+
+
+def completed(stdout=''):
+    return subprocess.CompletedProcess([], 0, stdout, None)
+
+
+FSTAB = 'UUID=root / ext4 defaults 0 1\n'
+
+
+class TestRescueHelpers(unittest.TestCase):
+
+    def test_parse_lsblk(self):
+        output = json.dumps({'blockdevices': [
+            {'name': '/dev/sda', 'fstype': None, 'children': [
+                {'name': '/dev/sda1', 'fstype': 'vfat'},
+                {'name': '/dev/sda2', 'fstype': 'crypto_LUKS', 'children': [
+                    {'name': '/dev/mapper/rescue-sda2',
+                     'fstype': 'LVM2_member', 'children': [
+                         {'name': '/dev/mapper/vg-root', 'fstype': 'ext4'},
+                         ]},
+                    ]},
+                {'name': '/dev/sda3', 'fstype': 'crypto_LUKS'},
+                ]},
+            ]})
+        self.assertEqual(parse_lsblk(output), [
+            ('/dev/sda', None, True),
+            ('/dev/sda1', 'vfat', False),
+            ('/dev/sda2', 'crypto_LUKS', True),
+            ('/dev/mapper/rescue-sda2', 'LVM2_member', True),
+            ('/dev/mapper/vg-root', 'ext4', False),
+            ('/dev/sda3', 'crypto_LUKS', False),
+            ])
+
+    def test_parse_lsblk_lists_shared_children_once(self):
+        md = {'name': '/dev/md0', 'fstype': 'ext4'}
+        output = json.dumps({'blockdevices': [
+            {'name': '/dev/sda', 'fstype': 'linux_raid_member',
+             'children': [md]},
+            {'name': '/dev/sdb', 'fstype': 'linux_raid_member',
+             'children': [md]},
+            ]})
+        self.assertEqual(parse_lsblk(output), [
+            ('/dev/sda', 'linux_raid_member', True),
+            ('/dev/md0', 'ext4', False),
+            ('/dev/sdb', 'linux_raid_member', True),
+            ])
+
+    def test_fsck_command(self):
+        self.assertEqual(
+            fsck_command('/dev/sda2', 'ext4'),
+            ['fsck', '-f', '-y', '-t', 'ext4', '/dev/sda2'])
+        self.assertEqual(
+            fsck_command('/dev/sda2', 'xfs'), ['xfs_repair', '/dev/sda2'])
+        self.assertEqual(
+            fsck_command('/dev/sda2', 'btrfs'),
+            ['btrfs', 'check', '/dev/sda2'])
+
+
+class TestRescueController(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(RescueController)
+        self.controller.opts = mock.Mock(dry_run=False)
+        self.controller._installs = {}
+        self.controller._locked = []
+        self.controller._scanned = False
+        self.controller._mounted = None
+        self.controller.mount_point = '/tmp/rescue'
+        self.devices = [('/dev/sda1', 'ext4', False)]
+        self.controller._devices = mock.AsyncMock(
+            side_effect=lambda: list(self.devices))
+        self.controller._read_files = mock.AsyncMock(return_value={
+            'etc/os-release': 'PRETTY_NAME="Ubuntu 20.04.2 LTS"\n',
+            'etc/fstab': FSTAB,
+            })
+
+    def test_scanned_once(self):
+        async def t():
+            self.controller._lock = asyncio.Lock()
+            await self.controller.GET()
+            status = await self.controller.GET()
+            self.assertEqual(
+                [i.root for i in status.installs], ['/dev/sda1'])
+        run_coro(t())
+        self.controller._read_files.assert_called_once_with(
+            '/dev/sda1', 'ext4')
+
+    def test_unlock_rescans_new_devices_only(self):
+        async def t():
+            self.controller._lock = asyncio.Lock()
+            await self.controller.GET()
+            self.devices.append(('/dev/mapper/rescue-sda2', 'ext4', False))
+            with mock.patch(
+                    'subiquity.server.controllers.rescue.arun_command',
+                    mock.AsyncMock(return_value=completed())):
+                status = await self.controller.unlock_POST(
+                    RescueUnlock(path='/dev/sda2', passphrase='pass'))
+            self.assertEqual(
+                [i.root for i in status.installs],
+                ['/dev/sda1', '/dev/mapper/rescue-sda2'])
+        run_coro(t())
+        self.assertEqual(
+            [c.args for c in self.controller._read_files.call_args_list],
+            [('/dev/sda1', 'ext4'), ('/dev/mapper/rescue-sda2', 'ext4')])
+
+    def test_grub_disk_not_guessed(self):
+        self.controller._installs = {'/dev/sda1': (mock.Mock(), FSTAB)}
+        self.controller._mounted = '/dev/sda1'
+        self.controller._command = mock.AsyncMock(return_value=completed())
+
+        async def t():
+            self.controller._lock = asyncio.Lock()
+            with mock.patch('os.path.exists', return_value=False):
+                return await self.controller.run_POST(
+                    '/dev/sda1', RescueAction.REINSTALL_GRUB)
+        result = run_coro(t())
+        self.assertFalse(result.success)
+        self.assertIn('cannot find the disk', result.output)
+        for call in self.controller._command.call_args_list:
+            self.assertNotIn('grub-install', call.args[0])
+
+    def test_nothing_mounted_during_fsck(self):
+        self.controller._installs = {'/dev/sda1': (mock.Mock(), FSTAB)}
+        self.controller._scanned = True
+        commands = []
+
+        async def command(cmd, *, input=None):
+            commands.append(cmd[0])
+            if cmd[0] == 'fsck':
+                await self.fsck_done.wait()
+            return completed('/dev/sda1\n')
+        self.controller._command = command
+
+        async def t():
+            self.controller._lock = asyncio.Lock()
+            self.fsck_done = asyncio.Event()
+            fsck = asyncio.ensure_future(self.controller.run_POST(
+                '/dev/sda1', RescueAction.FSCK))
+            await asyncio.sleep(0)
+            mount = asyncio.ensure_future(
+                self.controller.mount_POST('/dev/sda1'))
+            for _ in range(10):
+                await asyncio.sleep(0)
+            self.assertEqual(commands, ['findfs', 'fsck'])
+            self.fsck_done.set()
+            result = await fsck
+            await mount
+            self.assertTrue(result.success)
+            self.assertEqual(commands[2:3], ['findfs'])
+            self.assertIn('mount', commands)
+        run_coro(t())
@@ -0,0 +1,67 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.types import SnapCheckState
+from subiquity.server.controllers.snaplist import SnapListController
+
+
+class TestIPv6Only(unittest.TestCase):
+
+    def setUp(self):
+        self.controller = make_controller(SnapListController)
+        self.controller.app.base_model.network.has_network = True
+        self.controller.app.base_model.network.ipv6_only = True
+        self.controller.app.base_model.proxy.proxy = ''
+        self.controller.loader = mock.Mock(failed=False)
+        self.controller.configured = mock.Mock()
+        self.controller.interactive = mock.Mock(return_value=False)
+        self.controller._store_reachable_over_ipv6 = None
+        patcher = mock.patch(
+            'subiquity.server.controllers.snaplist.reachable_over_ipv6',
+            return_value=False)
+        self.reachable = patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_store_unreachable(self):
+        response = run_coro(self.controller.GET())
+        self.assertEqual(response.status, SnapCheckState.FAILED)
+        self.controller.configured.assert_called_once_with()
+
+    def test_checked_once(self):
+        run_coro(self.controller.GET())
+        run_coro(self.controller.GET())
+        self.reachable.assert_called_once_with('api.snapcraft.io')
+        self.controller.snapd_network_changed()
+        run_coro(self.controller.GET())
+        self.assertEqual(self.reachable.call_count, 2)
+
+    def test_store_reachable(self):
+        self.reachable.return_value = True
+        self.assertTrue(run_coro(self.controller._store_reachable()))
+
+    def test_proxy(self):
+        self.controller.app.base_model.proxy.proxy = 'http://proxy:3128'
+        self.assertTrue(run_coro(self.controller._store_reachable()))
+        self.reachable.assert_not_called()
+
+    def test_dual_stack(self):
+        self.controller.app.base_model.network.ipv6_only = False
+        self.assertTrue(run_coro(self.controller._store_reachable()))
+        self.reachable.assert_not_called()
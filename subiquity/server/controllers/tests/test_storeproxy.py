@@ -0,0 +1,54 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.server.controllers.storeproxy import parse_store_id
+
+
+ASSERTIONS = """\
+type: account-key
+authority-id: canonical
+public-key-sha3-384: BWDEoaqyr25nF5SNCvEv2v7QnM9QsfCc0PBMYD_i2NGSQ32EF2d4D0
+account-id: canonical
+name: store
+since: 2016-04-01T00:00:00.0Z
+body-length: 717
+sign-key-sha3-384: -CvQKAwRQ5h3Ffn10FILJoEZUXOv6km9FwA80-Rcj-f-6jadQ89VRs
+
+AcbBTQRWhcGAARAA0y/BXkBJhPLu
+
+AcLDXAQAAQoABgUCV8j/
+
+type: store
+authority-id: canonical
+store: ABCDEFGH12345678
+operator-id: 0123456789abcdef
+timestamp: 2021-03-01T00:00:00.0Z
+url: http://snaps.internal
+sign-key-sha3-384: BWDEoaqyr25nF5SNCvEv2v7QnM9QsfCc0PBMYD_i2NGSQ32EF2d4D0
+
+AcLBUgQAAQoABgUCX
+"""
+
+
+class TestParseStoreId(unittest.TestCase):
+
+    def test_store_assertion(self):
+        self.assertEqual(parse_store_id(ASSERTIONS), 'ABCDEFGH12345678')
+
+    def test_no_store_assertion(self):
+        self.assertIsNone(
+            parse_store_id(ASSERTIONS.split('type: store')[0]))
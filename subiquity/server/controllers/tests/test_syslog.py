@@ -0,0 +1,50 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import unittest
+
+from subiquity.server.controllers.syslog import (
+    parse_syslog_target,
+    SyslogTarget,
+    )
+
+
+class TestParseSyslogTarget(unittest.TestCase):
+
+    def test_host_and_port(self):
+        self.assertEqual(
+            parse_syslog_target('logs.example.com:1514'),
+            SyslogTarget(protocol='udp', host='logs.example.com', port=1514))
+
+    def test_defaults(self):
+        self.assertEqual(
+            parse_syslog_target('10.0.0.1'),
+            SyslogTarget(protocol='udp', host='10.0.0.1', port=514))
+        self.assertEqual(
+            parse_syslog_target('json://10.0.0.1'),
+            SyslogTarget(protocol='json', host='10.0.0.1', port=5170))
+
+    def test_ipv6(self):
+        self.assertEqual(
+            parse_syslog_target('tcp://[fd00::1]:601'),
+            SyslogTarget(protocol='tcp', host='fd00::1', port=601))
+        self.assertEqual(
+            parse_syslog_target('[fd00::1]'),
+            SyslogTarget(protocol='udp', host='fd00::1', port=514))
+
+    def test_invalid(self):
+        for value in ['', 'http://host', 'host:port', '[fd00::1', ':514']:
+            with self.assertRaises(ValueError, msg=value):
+                parse_syslog_target(value)
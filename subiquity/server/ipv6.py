@@ -0,0 +1,57 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+""" Helpers for installing on networks that only have IPv6.
+
+A host is usable on such a network if it has an IPv6 address. Where the
+network provides NAT64 the resolver (DNS64) synthesizes IPv6 addresses for
+hosts that only have IPv4 ones, so those count too and need no special
+handling beyond not insisting on IPv4.
+
+"""
+
+import logging
+import socket
+
+log = logging.getLogger('subiquity.server.ipv6')
+
+# The name RFC 7050 reserves for discovering NAT64 prefixes. It only has
+# IPv4 addresses, so any IPv6 address for it was made up by DNS64.
+IPV4ONLY_NAME = 'ipv4only.arpa'
+
+
+def ipv6_addresses(host, port=443):
+    try:
+        infos = socket.getaddrinfo(
+            host, port, socket.AF_INET6, socket.SOCK_STREAM)
+    except (socket.gaierror, UnicodeError):
+        return []
+    return sorted({info[4][0] for info in infos})
+
+
+def reachable_over_ipv6(host):
+    """Return whether host can be connected to without IPv4.
+
+    This only checks that host resolves to an IPv6 address. That is far
+    quicker than waiting for a connection to time out and it is the
+    question that matters here.
+    """
+    addresses = ipv6_addresses(host)
+    log.debug("IPv6 addresses for %s: %s", host, addresses)
+    return bool(addresses)
+
+
+def has_dns64():
+    return bool(ipv6_addresses(IPV4ONLY_NAME))
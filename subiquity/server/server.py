@@ -17,8 +17,10 @@ import asyncio
 import logging
 import os
 import shlex
+import socket
 import sys
 import time
+import uuid
 from typing import List, Optional
 
 from aiohttp import web
@@ -52,6 +54,10 @@ from subiquity.common.errorreport import (
     ErrorReportKind,
     ErrorReporter,
     )
+from subiquity.common.mdns import (
+    render_avahi_service,
+    txt_records,
+    )
 from subiquity.common.serialize import to_json
 from subiquity.common.types import (
     ApplicationState,
@@ -92,12 +98,21 @@ class MetaController:
             interactive=self.app.interactive,
             echo_syslog_id=self.app.echo_syslog_id,
             event_syslog_id=self.app.event_syslog_id,
-            log_syslog_id=self.app.log_syslog_id)
+            log_syslog_id=self.app.log_syslog_id,
+            rescue=self.app.rescue)
 
     async def confirm_POST(self, tty: str) -> None:
         self.app.confirming_tty = tty
         self.app.base_model.confirm()
 
+    async def section_shown_POST(self, endpoint_name: str) -> None:
+        endpoint = getattr(API, endpoint_name, None)
+        if endpoint is None:
+            return
+        for controller in self.app.controllers.instances:
+            if controller.endpoint is endpoint and controller.interactive():
+                controller.start_section_timeout()
+
     async def restart_POST(self) -> None:
         self.app.restart()
 
@@ -162,6 +177,24 @@ class SubiquityServer(Application):
                 'minimum': 1,
                 'maximum': 1,
                 },
+            'interactive-sections': {
+                'type': 'array',
+                'items': {
+                    'oneOf': [
+                        {'type': 'string'},
+                        {
+                            'type': 'object',
+                            'properties': {
+                                'section': {'type': 'string'},
+                                'timeout': {'type': 'number', 'minimum': 1},
+                                'default': {},
+                                },
+                            'required': ['section'],
+                            'additionalProperties': False,
+                            },
+                        ],
+                    },
+                },
             },
         'required': ['version'],
         'additionalProperties': True,
@@ -172,25 +205,36 @@ class SubiquityServer(Application):
     controllers = [
         "Early",
         "Reporting",
+        "Syslog",
         "Error",
+        "ErrorReports",
         "Userdata",
         "Package",
         "Debconf",
         "Locale",
+        "Offline",
         "Refresh",
         "Keyboard",
         "Zdev",
         "Network",
         "Proxy",
+        "StoreProxy",
         "Mirror",
+        "Source",
+        "ISCSI",
+        "NVMeoF",
         "Filesystem",
+        "RecoveryKey",
         "Identity",
         "SSH",
+        "Kdump",
         "SnapList",
         "Install",
         "Updates",
         "Late",
+        "Inventory",
         "Reboot",
+        "Rescue",
         ]
 
     def make_model(self):
@@ -202,6 +246,14 @@ class SubiquityServer(Application):
     def __init__(self, opts, block_log_dir):
         super().__init__(opts)
         self.block_log_dir = block_log_dir
+        self.autoinstall_from_stdin = opts.autoinstall == '-'
+        if self.autoinstall_from_stdin:
+            # The config is loaded more than once, and again by the new
+            # process when the server restarts, so keep a copy of it.
+            opts.autoinstall = self.state_path('autoinstall-stdin.yaml')
+            atomic_helper.write_file(
+                opts.autoinstall, sys.stdin.read().encode('utf-8'),
+                mode=0o600)
         self.cloud_init_ok = None
         self._state = ApplicationState.STARTING_UP
         self.state_event = asyncio.Event()
@@ -212,6 +264,7 @@ class SubiquityServer(Application):
         self.installer_user_name = None
         self.installer_user_passwd_kind = PasswordKind.NONE
         self.installer_user_passwd = None
+        self.session_id = None
 
         self.echo_syslog_id = 'subiquity_echo.{}'.format(os.getpid())
         self.event_syslog_id = 'subiquity_event.{}'.format(os.getpid())
@@ -221,6 +274,7 @@ class SubiquityServer(Application):
             self.context.child("ErrorReporter"), self.opts.dry_run, self.root)
         self.prober = Prober(opts.machine_config, self.debug_flags)
         self.kernel_cmdline = shlex.split(opts.kernel_cmdline)
+        self.rescue = opts.rescue or 'subiquity-rescue' in self.kernel_cmdline
         if opts.snaps_from_examples:
             connection = FakeSnapdConnection(
                 os.path.join(
@@ -372,12 +426,20 @@ class SubiquityServer(Application):
         log.debug("load_autoinstall_config only_early %s", only_early)
         if self.opts.autoinstall is None:
             return
+        if self.rescue:
+            # Rescuing an existing install should never start an
+            # automated one.
+            log.debug("ignoring autoinstall config in rescue mode")
+            return
         with open(self.opts.autoinstall) as fp:
             self.autoinstall_config = yaml.safe_load(fp)
         if only_early:
             self.controllers.Reporting.setup_autoinstall()
             self.controllers.Reporting.start()
+            self.controllers.Syslog.setup_autoinstall()
+            self.controllers.Syslog.start()
             self.controllers.Error.setup_autoinstall()
+            self.controllers.ErrorReports.setup_autoinstall()
             with self.context.child("core_validation", level="INFO"):
                 jsonschema.validate(self.autoinstall_config, self.base_schema)
             self.controllers.Early.setup_autoinstall()
@@ -490,12 +552,50 @@ class SubiquityServer(Application):
         else:
             self.installer_user_passwd_kind = PasswordKind.NONE
 
+    def load_session_id(self):
+        # The session id identifies this run of the installer, so it has
+        # to survive the server being restarted.
+        path = self.state_path("session-id")
+        if os.path.exists(path):
+            with open(path) as fp:
+                self.session_id = fp.read().strip()
+            return
+        self.session_id = str(uuid.uuid4())
+        with open(path, 'w') as fp:
+            fp.write(self.session_id)
+
+    def _can_ssh_to_installer(self):
+        username = self.installer_user_name
+        if username is None:
+            return False
+        if self.installer_user_passwd_kind != PasswordKind.NONE:
+            return True
+        return bool(user_key_fingerprints(username))
+
+    async def publish_mdns_service(self):
+        services_dir = os.path.join(self.root, 'etc', 'avahi', 'services')
+        if not self.opts.dry_run and not os.path.isdir(services_dir):
+            log.debug("avahi not installed, not advertising the installer")
+            return
+        if not self._can_ssh_to_installer():
+            return
+        fingerprints = await run_in_thread(host_key_fingerprints)
+        records = txt_records(
+            socket.gethostname(), self.session_id, fingerprints)
+        os.makedirs(services_dir, exist_ok=True)
+        # avahi-daemon notices new service files by itself.
+        path = os.path.join(services_dir, 'subiquity.service')
+        with open(path, 'w') as fp:
+            fp.write(render_avahi_service(records))
+
     async def start(self):
         self.controllers.load_all()
         await self.start_api_server()
         self.update_state(ApplicationState.CLOUD_INIT_WAIT)
         await self.wait_for_cloudinit()
         self.set_installer_password()
+        self.load_session_id()
+        await self.publish_mdns_service()
         self.load_autoinstall_config(only_early=True)
         if self.autoinstall_config and self.controllers.Early.cmds:
             stamp_file = self.state_path("early-commands")
@@ -521,11 +621,15 @@ class SubiquityServer(Application):
         await self.apply_autoinstall_config()
 
     def _network_change(self):
+        if self.base_model.offline.offline:
+            return
         self.hub.broadcast('snapd-network-change')
 
     async def _proxy_set(self):
         await run_in_thread(
             self.snapd.connection.configure_proxy, self.base_model.proxy)
+        if self.base_model.offline.offline:
+            return
         self.hub.broadcast('snapd-network-change')
 
     def restart(self):
@@ -534,6 +638,9 @@ class SubiquityServer(Application):
             cmdline = [
                 sys.executable, '-m', 'subiquity.cmd.server',
                 ] + sys.argv[1:]
+            if self.autoinstall_from_stdin:
+                # There is nothing left on stdin to read.
+                cmdline.extend(['--autoinstall', self.opts.autoinstall])
         os.execvp(cmdline[0], cmdline)
 
     def make_autoinstall(self):
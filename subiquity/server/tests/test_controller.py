@@ -0,0 +1,156 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import asyncio
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from subiquitycore.tests import make_controller, run_coro
+
+from subiquity.common.apidef import API
+from subiquity.server.controller import SubiquityController
+from subiquity.server.server import MetaController
+
+
+def make_mock_controller(key, sections):
+    controller = mock.Mock()
+    controller.autoinstall_key = key
+    controller.app.autoinstall_config = {
+        'version': 1,
+        'interactive-sections': sections,
+        }
+    return controller
+
+
+class TestInteractiveSection(unittest.TestCase):
+
+    def section(self, key, sections):
+        return SubiquityController.interactive_section(
+            make_mock_controller(key, sections))
+
+    def test_name(self):
+        self.assertEqual(
+            self.section('identity', ['network', 'identity']),
+            {'section': 'identity'})
+
+    def test_not_interactive(self):
+        self.assertIsNone(self.section('identity', ['network']))
+
+    def test_star(self):
+        self.assertEqual(
+            self.section('identity', ['*']), {'section': '*'})
+
+    def test_mapping(self):
+        entry = {'section': 'identity', 'timeout': 60}
+        self.assertEqual(self.section('identity', [entry]), entry)
+
+    def test_name_beats_star(self):
+        entry = {'section': 'identity', 'timeout': 60}
+        self.assertEqual(
+            self.section('identity', [{'section': '*'}, entry]), entry)
+
+    def test_star_default_not_used(self):
+        entry = {'section': '*', 'timeout': 60, 'default': {'a': 1}}
+        self.assertEqual(
+            self.section('identity', [entry]),
+            {'section': '*', 'timeout': 60})
+
+    def test_no_autoinstall(self):
+        controller = make_mock_controller('identity', ['*'])
+        controller.app.autoinstall_config = None
+        self.assertIsNone(
+            SubiquityController.interactive_section(controller))
+
+
+class SectionController(SubiquityController):
+
+    autoinstall_key = 'section'
+    model_name = None
+
+    def load_autoinstall_data(self, data):
+        self.loaded = data
+
+    async def apply_autoinstall_config(self, context=None):
+        self.applied = self.loaded
+
+
+class TestSectionTimeout(unittest.TestCase):
+
+    def setUp(self):
+        tdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tdir.cleanup)
+        os.mkdir(os.path.join(tdir.name, 'states'))
+        self.controller = make_controller(SectionController)
+        self.controller.app.state_path = lambda *parts: os.path.join(
+            tdir.name, *parts)
+        self.controller.name = 'Section'
+        self.controller.answered = False
+        self.controller.timed_out = False
+        self.controller._section_timeout = None
+        self.controller.loaded = self.controller.applied = None
+
+    def run_timeout(self, entry, answer=False):
+        self.controller.app.autoinstall_config = {
+            'version': 1,
+            'interactive-sections': [entry],
+            }
+
+        async def t():
+            self.controller.app.aio_loop = asyncio.get_event_loop()
+            self.controller.start_section_timeout()
+            if answer:
+                self.controller.configured()
+            if self.controller._section_timeout is not None:
+                await self.controller._section_timeout
+        run_coro(t())
+
+    def test_default_applied(self):
+        self.run_timeout(
+            {'section': 'section', 'timeout': 0.01, 'default': {'a': 1}})
+        self.assertTrue(self.controller.timed_out)
+        self.assertFalse(self.controller.interactive())
+        self.assertEqual(self.controller.applied, {'a': 1})
+        self.assertTrue(self.controller.answered)
+        self.assertTrue(os.path.exists(self.controller._timed_out_path()))
+
+    def test_answered_in_time(self):
+        self.run_timeout(
+            {'section': 'section', 'timeout': 0.01, 'default': {'a': 1}},
+            answer=True)
+        self.assertFalse(self.controller.timed_out)
+        self.assertIsNone(self.controller.applied)
+
+    def test_no_timeout(self):
+        self.run_timeout({'section': 'section'})
+        self.assertIsNone(self.controller._section_timeout)
+
+
+class TestSectionShown(unittest.TestCase):
+
+    def test_only_shown_section_started(self):
+        app = mock.Mock()
+        shown, other, noninteractive = mock.Mock(), mock.Mock(), mock.Mock()
+        shown.endpoint = noninteractive.endpoint = API.identity
+        other.endpoint = API.ssh
+        noninteractive.interactive.return_value = False
+        app.controllers.instances = [shown, other, noninteractive]
+        meta = object.__new__(MetaController)
+        meta.app = app
+        run_coro(meta.section_shown_POST('identity'))
+        shown.start_section_timeout.assert_called_once_with()
+        other.start_section_timeout.assert_not_called()
+        noninteractive.start_section_timeout.assert_not_called()
@@ -0,0 +1,63 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import socket
+import unittest
+from unittest import mock
+
+from subiquity.server.ipv6 import (
+    has_dns64,
+    ipv6_addresses,
+    IPV4ONLY_NAME,
+    reachable_over_ipv6,
+    )
+
+
+def addrinfo(*addresses):
+    return [
+        (socket.AF_INET6, socket.SOCK_STREAM, 6, '', (address, 443, 0, 0))
+        for address in addresses
+        ]
+
+
+class TestIPv6(unittest.TestCase):
+
+    @mock.patch('socket.getaddrinfo')
+    def test_addresses(self, getaddrinfo):
+        getaddrinfo.return_value = addrinfo(
+            '2001:db8::2', '2001:db8::1', '2001:db8::2')
+        self.assertEqual(
+            ipv6_addresses('example.com'), ['2001:db8::1', '2001:db8::2'])
+        getaddrinfo.assert_called_once_with(
+            'example.com', 443, socket.AF_INET6, socket.SOCK_STREAM)
+
+    @mock.patch('socket.getaddrinfo')
+    def test_unresolvable(self, getaddrinfo):
+        getaddrinfo.side_effect = socket.gaierror(socket.EAI_NONAME, 'no')
+        self.assertEqual(ipv6_addresses('example.com'), [])
+        self.assertFalse(reachable_over_ipv6('example.com'))
+
+    @mock.patch('socket.getaddrinfo')
+    def test_reachable(self, getaddrinfo):
+        getaddrinfo.return_value = addrinfo('2001:db8::1')
+        self.assertTrue(reachable_over_ipv6('example.com'))
+
+    @mock.patch('socket.getaddrinfo')
+    def test_dns64(self, getaddrinfo):
+        getaddrinfo.return_value = addrinfo('64:ff9b::c000:aa')
+        self.assertTrue(has_dns64())
+        self.assertEqual(getaddrinfo.call_args[0][0], IPV4ONLY_NAME)
+        getaddrinfo.return_value = []
+        self.assertFalse(has_dns64())
@@ -19,15 +19,19 @@ from .filesystem import (
     )
 from .identity import IdentityView
 from .installprogress import ProgressView
+from .iscsi import ISCSIView
 from .keyboard import KeyboardView
+from .rescue import RescueView
 from .welcome import WelcomeView
 from .zdev import ZdevView
 __all__ = [
     'FilesystemView',
     'GuidedDiskSelectionView',
     'IdentityView',
+    'ISCSIView',
     'KeyboardView',
     'ProgressView',
+    'RescueView',
     'WelcomeView',
     'ZdevView',
 ]
@@ -214,20 +214,31 @@ class ErrorReportStretchy(Stretchy):
         if self.error_ref.state == ErrorReportState.DONE:
             assert self.report
             widgets.append(btns['view'])
-            widgets.append(Text(""))
-            widgets.append(Text(rewrap(_(submit_text))))
-            widgets.append(Text(""))
-
-            if self.report.uploader:
-                if self.upload_pb is None:
-                    self.upload_pb = self.pb(self.report.uploader)
-                widgets.append(self.upload_pb)
-            else:
-                if self.report.oops_id:
-                    widgets.append(btns['submitted'])
+            if self.report.allow_upload:
+                widgets.append(Text(""))
+                widgets.append(Text(rewrap(_(submit_text))))
+                widgets.append(Text(""))
+
+                if self.report.uploader:
+                    if self.upload_pb is None:
+                        self.upload_pb = self.pb(self.report.uploader)
+                    widgets.append(self.upload_pb)
                 else:
-                    widgets.append(btns['submit'])
-                self.upload_pb = None
+                    if self.report.oops_id:
+                        widgets.append(btns['submitted'])
+                    else:
+                        widgets.append(btns['submit'])
+                    self.upload_pb = None
+
+            if self.report.sent_to:
+                # {destinations} is a list of URLs the report was sent to
+                sent_text = _(
+                    "The error report has been sent to {destinations}."
+                    ).format(destinations=", ".join(self.report.sent_to))
+                widgets.extend([
+                    Text(""),
+                    Text(rewrap(sent_text)),
+                    ])
 
             fs_label, fs_loc = self.report.persistent_details
             if fs_label is not None:
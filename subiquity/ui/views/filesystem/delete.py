@@ -22,6 +22,7 @@ from subiquitycore.ui.table import (
     TablePile,
     TableRow,
     )
+from subiquitycore.ui.selector import Selector
 from subiquitycore.ui.utils import button_pile
 from subiquitycore.ui.stretchy import Stretchy
 
@@ -98,6 +99,45 @@ class ConfirmDeleteStretchy(Stretchy):
         self.parent.remove_overlay()
 
 
+secure_wipe_labels = {
+    'zero': _("Overwrite with zeros"),
+    'discard': _("Discard all blocks"),
+    'nvme-format': _("NVMe format with user data erase"),
+    'nvme-sanitize': _("NVMe sanitize"),
+    'ata-secure-erase': _("ATA secure erase"),
+    }
+
+
+def describe_duration(seconds):
+    if seconds is None:
+        return None
+    if seconds < 60:
+        return _("less than a minute")
+    if seconds < 90 * 60:
+        minutes = round(seconds / 60)
+        return ngettext(
+            "about {count} minute", "about {count} minutes",
+            minutes).format(count=minutes)
+    hours = round(seconds / 3600)
+    return ngettext(
+        "about {count} hour", "about {count} hours",
+        hours).format(count=hours)
+
+
+def secure_wipe_options(disk):
+    opts = [(_("Only remove partition tables and signatures"), True, None)]
+    for mode, estimate in sorted(disk.secure_wipe_modes().items()):
+        label = _(secure_wipe_labels[mode])
+        duration = describe_duration(estimate)
+        if duration is not None:
+            # {duration} is how long the wipe will take, e.g.
+            # "about 3 hours"
+            label = _("{mode} ({duration})").format(
+                mode=label, duration=duration)
+        opts.append((label, True, mode))
+    return opts
+
+
 class ConfirmReformatStretchy(Stretchy):
 
     def __init__(self, parent, obj):
@@ -148,15 +188,30 @@ class ConfirmReformatStretchy(Stretchy):
         widgets = [
             Text("\n".join(lines)),
             Text(""),
+            ]
+        self.wipe_selector = None
+        if obj.type == "disk":
+            self.wipe_selector = Selector(secure_wipe_options(obj))
+            self.wipe_selector.value = obj.secure_wipe
+            widgets.extend([
+                Text(_("Erase method:")),
+                self.wipe_selector,
+                Text(""),
+                ])
+        widgets.extend([
             button_pile([
                 delete_btn,
                 other_btn(label=_("Cancel"), on_press=self.cancel),
                 ]),
-        ]
-        super().__init__(title, widgets, 0, 2)
+            ])
+        super().__init__(title, widgets, 0, len(widgets) - 1)
 
     def confirm(self, sender=None):
-        self.parent.controller.reformat(self.obj)
+        if self.wipe_selector is not None:
+            self.parent.controller.reformat(
+                self.obj, secure_wipe=self.wipe_selector.value)
+        else:
+            self.parent.controller.reformat(self.obj)
         self.parent.refresh_model_inputs()
         self.parent.remove_overlay()
 
@@ -28,6 +28,7 @@ log = logging.getLogger('subiquity.ui.filesystem.disk_info')
 labels_keys = [
     ('Path:', 'devname'),
     ('Multipath:', 'multipath'),
+    ('Paths:', 'paths'),
     ('Vendor:', 'vendor'),
     ('Model:', 'model'),
     ('SerialNo:', 'serial'),
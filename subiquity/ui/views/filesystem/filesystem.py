@@ -56,6 +56,7 @@ from subiquitycore.ui.utils import (
     Color,
     make_action_menu_row,
     Padding,
+    rewrap,
     screen,
     )
 from subiquitycore.view import BaseView
@@ -235,6 +236,30 @@ class WhyNotStretchy(Stretchy):
         self.parent.remove_overlay()
 
 
+devices_changed_text = _("""\
+The storage devices attached to this machine changed while you were
+editing the storage configuration, so your changes have not been
+saved. Please make them again.
+""")
+
+
+class DevicesChangedStretchy(Stretchy):
+
+    def __init__(self, parent):
+        self.parent = parent
+        widgets = [
+            Text(rewrap(_(devices_changed_text))),
+            Text(""),
+            button_pile([
+                other_btn(label=_("Close"), on_press=self.close),
+                ]),
+        ]
+        super().__init__(_("Storage devices changed"), widgets, 0, 2)
+
+    def close(self, sender=None):
+        self.parent.remove_overlay()
+
+
 def _whynot_shower(view, action, whynot):
     def impl(obj):
         view.show_stretchy_overlay(WhyNotStretchy(view, obj, action, whynot))
@@ -427,6 +452,7 @@ class FilesystemView(BaseView):
         self.controller = controller
 
         self.mount_list = MountList(self)
+        self.thin_warning = Text("")
         self.avail_list = DeviceList(self, True)
         self.used_list = DeviceList(self, False)
         self.avail_list.table.bind(self.used_list.table)
@@ -444,6 +470,7 @@ class FilesystemView(BaseView):
             Text(_("FILE SYSTEM SUMMARY")),
             Text(""),
             self.mount_list,
+            Color.info_error(self.thin_warning),
             Text(""),
             Text(""),
             Text(_("AVAILABLE DEVICES")),
@@ -487,6 +514,18 @@ class FilesystemView(BaseView):
         rows.append(TableRow([Text("")]))
         return TablePile(rows)
 
+    def _thin_warning_text(self):
+        lines = []
+        for pool in self.model.overprovisioned_thin_pools():
+            lines.append(_(
+                "Thin pool {pool} is overprovisioned: its thin volumes "
+                "total {allocated} but it only has {size}. Writes will "
+                "fail if the pool fills up.").format(
+                    pool=pool.name,
+                    allocated=humanize_size(pool.thin_allocated),
+                    size=humanize_size(pool.size)))
+        return "\n".join(lines)
+
     def _build_buttons(self):
         self.done = Toggleable(done_btn(_("Done"), on_press=self.done))
 
@@ -512,6 +551,7 @@ class FilesystemView(BaseView):
             self._create_raid_btn.enabled = len(raid_devices) > 1
             self._create_vg_btn.enabled = len(lvm_devices) > 0
         self.mount_list.refresh_model_inputs()
+        self.thin_warning.set_text(self._thin_warning_text())
         self.avail_list.refresh_model_inputs()
         self.used_list.refresh_model_inputs()
         # This is an awful hack, actual thinking required:
@@ -44,8 +44,20 @@ from subiquitycore.ui.utils import (
     )
 from subiquitycore.view import BaseView
 
-from subiquity.common.types import GuidedChoice
-from subiquity.models.filesystem import humanize_size
+from subiquity.common.types import (
+    GuidedChoice,
+    GuidedReinstall,
+    GuidedResize,
+    GuidedResizeBlocker,
+    )
+from subiquity.models.filesystem import (
+    align_up,
+    dehumanize_size,
+    GUIDED_FSTYPES,
+    HUMAN_UNITS,
+    humanize_size,
+    )
+from subiquity.ui.views.filesystem.partition import SizeField
 
 
 log = logging.getLogger("subiquity.ui.views.filesystem.guided")
@@ -81,6 +93,20 @@ class LVMOptionsForm(SubForm):
     luks_options = SubFormField(LUKSOptionsForm, "", help=NO_HELP)
 
 
+class ZFSOptionsForm(SubForm):
+
+    def __init__(self, parent):
+        super().__init__(parent)
+        connect_signal(self.encrypt.widget, 'change', self._toggle)
+        self.keystore_options.enabled = self.encrypt.value
+
+    def _toggle(self, sender, val):
+        self.keystore_options.enabled = val
+
+    encrypt = BooleanField(_("Encrypt the ZFS pool"), help=NO_HELP)
+    keystore_options = SubFormField(LUKSOptionsForm, "", help=NO_HELP)
+
+
 def summarize_device(disk):
     label = disk.label
     rows = [(disk, [
@@ -106,8 +132,15 @@ def summarize_device(disk):
 class GuidedChoiceForm(SubForm):
 
     disk = ChoiceField(caption=NO_CAPTION, help=NO_HELP, choices=["x"])
+    fstype = ChoiceField(
+        _("Root filesystem:"), help=NO_HELP, choices=["ext4"])
     use_lvm = BooleanField(_("Set up this disk as an LVM group"), help=NO_HELP)
     lvm_options = SubFormField(LVMOptionsForm, "", help=NO_HELP)
+    use_zfs = BooleanField(_("Set up this disk with ZFS"), help=NO_HELP)
+    zfs_options = SubFormField(ZFSOptionsForm, "", help=NO_HELP)
+    reset_partition = BooleanField(
+        _("Add a partition the system can be reset to factory state from"),
+        help=NO_HELP)
 
     def __init__(self, parent):
         super().__init__(parent, initial={'use_lvm': True})
@@ -129,11 +162,157 @@ class GuidedChoiceForm(SubForm):
             t0.bind(t)
         self.disk.widget.options = options
         self.disk.widget.index = initial
+        self.fstype.widget.options = [
+            Option((fstype, True, fstype))
+            for fstype in GUIDED_FSTYPES + parent.optional_fstypes
+            ]
         connect_signal(self.use_lvm.widget, 'change', self._toggle)
+        connect_signal(self.use_zfs.widget, 'change', self._toggle_zfs)
         self.lvm_options.enabled = self.use_lvm.value
+        self.zfs_options.enabled = self.use_zfs.value
+        if parent.reset_partition_size is None:
+            self.remove_field('reset_partition')
+        if not parent.zfs_supported:
+            self.remove_field('use_zfs')
+            self.remove_field('zfs_options')
 
     def _toggle(self, sender, val):
         self.lvm_options.enabled = val
+        if val:
+            self.use_zfs.value = False
+
+    def _toggle_zfs(self, sender, val):
+        self.zfs_options.enabled = val
+        self.fstype.enabled = not val
+        if val:
+            self.use_lvm.value = False
+
+
+resize_blocker_messages = {
+    GuidedResizeBlocker.BITLOCKER: _(
+        "BitLocker is turned on"),
+    GuidedResizeBlocker.NOT_GPT: _(
+        "disk does not have a GPT partition table"),
+    GuidedResizeBlocker.NO_BOOTLOADER: _(
+        "no bootloader partition on disk"),
+    GuidedResizeBlocker.PARTITION_NUMBERING: _(
+        "partitions are not numbered consecutively"),
+    GuidedResizeBlocker.CHECK_FAILED: _(
+        "filesystem could not be checked; shut Windows down fully"),
+    GuidedResizeBlocker.TOO_FULL: _(
+        "filesystem is too full"),
+    }
+
+
+def summarize_resize_target(target):
+    desc = "{} ({}, {})".format(
+        target.label, target.fstype, humanize_size(target.size))
+    if target.blocker is not None:
+        desc += " - " + _(resize_blocker_messages[target.blocker])
+    return desc
+
+
+class ResizeChoiceForm(SubForm):
+
+    target = ChoiceField(_("Shrink:"), help=NO_HELP, choices=["x"])
+    size = SizeField(_("New size:"))
+
+    def __init__(self, parent):
+        options = []
+        initial = -1
+        for target in parent.resize_targets:
+            enabled = target.blocker is None
+            if enabled and initial < 0:
+                initial = len(options)
+            options.append(
+                Option((summarize_resize_target(target), enabled, target)))
+        super().__init__(parent)
+        if not options:
+            # GuidedForm removes this form in this case.
+            return
+        if initial < 0:
+            initial = 0
+        self.target.widget.options = options
+        self.target.widget.index = initial
+        connect_signal(self.target.widget, 'select', self._select_target)
+        self._select_target(None, self.target.value)
+
+    def _select_target(self, sender, target):
+        self.max_size = target.maximum
+        if self.max_size is None:
+            self.max_size = target.size
+        self.min_size = target.minimum
+        if self.min_size is None:
+            self.min_size = self.max_size
+        self.size_str = humanize_size(self.max_size)
+        self.size.caption = _("New size ({min}-{max}):").format(
+            min=humanize_size(self.min_size), max=self.size_str)
+        self.size.value = humanize_size(
+            align_up((self.min_size + self.max_size) // 2))
+
+    def clean_size(self, val):
+        if not val:
+            return self.max_size
+        suffixes = ''.join(HUMAN_UNITS) + ''.join(HUMAN_UNITS).lower()
+        if val[-1] not in suffixes:
+            val += self.size_str[-1]
+        if val == self.size_str:
+            return self.max_size
+        else:
+            return dehumanize_size(val)
+
+    def validate_size(self):
+        if self.size.value < self.min_size:
+            return _("{label} cannot be shrunk below {size}").format(
+                label=self.target.value.label,
+                size=humanize_size(self.min_size))
+        if self.size.value > self.max_size:
+            return _("{label} must be shrunk to at most {size}").format(
+                label=self.target.value.label,
+                size=self.size_str)
+
+
+def summarize_reinstall_target(target, disks):
+    label = target.disk_id
+    for disk in disks:
+        if disk.id == target.disk_id:
+            label = disk.label
+    return _("{os} (partition {number} of {disk})").format(
+        os=target.os_name, number=target.root_partition_number, disk=label)
+
+
+class ReinstallChoiceForm(SubForm):
+
+    target = ChoiceField(_("Reinstall:"), help=NO_HELP, choices=["x"])
+    user = ChoiceField(
+        _("Re-create user:"),
+        help=_("The user is created with the same user ID so that it "
+               "still owns its files in /home."),
+        choices=["x"])
+
+    def __init__(self, parent):
+        super().__init__(parent)
+        if not parent.reinstall_targets:
+            # GuidedForm removes this form in this case.
+            return
+        self.target.widget.options = [
+            Option((summarize_reinstall_target(target, parent.disks),
+                    True, target))
+            for target in parent.reinstall_targets
+            ]
+        self.target.widget.index = 0
+        connect_signal(self.target.widget, 'select', self._select_target)
+        self._select_target(None, self.target.value)
+
+    def _select_target(self, sender, target):
+        options = [Option((_("None"), True, None))]
+        for user in target.users:
+            label = user.username
+            if user.realname:
+                label += " ({})".format(user.realname)
+            options.append(Option((label, True, user.username)))
+        self.user.widget.options = options
+        self.user.widget.index = min(1, len(options) - 1)
 
 
 class GuidedForm(Form):
@@ -142,18 +321,53 @@ class GuidedForm(Form):
 
     guided = RadioButtonField(group, _("Use an entire disk"), help=NO_HELP)
     guided_choice = SubFormField(GuidedChoiceForm, "", help=NO_HELP)
+    resize = RadioButtonField(
+        group, _("Install alongside an existing (Windows) partition"),
+        help=NO_HELP)
+    resize_choice = SubFormField(ResizeChoiceForm, "", help=NO_HELP)
+    reinstall = RadioButtonField(
+        group, _("Reinstall, keeping the existing /home"), help=NO_HELP)
+    reinstall_choice = SubFormField(ReinstallChoiceForm, "", help=NO_HELP)
     custom = RadioButtonField(group, _("Custom storage layout"), help=NO_HELP)
 
     cancel_label = _("Back")
 
-    def __init__(self, disks):
+    def __init__(self, disks, resize_targets=(), optional_fstypes=(),
+                 reinstall_targets=(), reset_partition_size=None,
+                 zfs_supported=False):
         self.disks = disks
+        self.resize_targets = resize_targets
+        self.reinstall_targets = reinstall_targets
+        self.optional_fstypes = list(optional_fstypes)
+        self.reset_partition_size = reset_partition_size
+        self.zfs_supported = zfs_supported
         super().__init__()
         connect_signal(self.guided.widget, 'change', self._toggle_guided)
+        if resize_targets:
+            connect_signal(self.resize.widget, 'change', self._toggle_resize)
+            self.resize_choice.enabled = False
+            if all(t.blocker is not None for t in resize_targets):
+                self.resize.enabled = False
+        else:
+            self.remove_field('resize')
+            self.remove_field('resize_choice')
+        if reinstall_targets:
+            connect_signal(
+                self.reinstall.widget, 'change', self._toggle_reinstall)
+            self.reinstall_choice.enabled = False
+        else:
+            self.remove_field('reinstall')
+            self.remove_field('reinstall_choice')
 
     def _toggle_guided(self, sender, new_value):
         self.guided_choice.enabled = new_value
 
+    def _toggle_resize(self, sender, new_value):
+        self.resize_choice.enabled = new_value
+
+    def _toggle_reinstall(self, sender, new_value):
+        self.reinstall_choice.enabled = new_value
+
 
 HELP = _("""
 
@@ -173,11 +387,44 @@ You can also choose to encrypt LVM volume group. This will require
 setting a password, that one will need to type on every boot before
 the system boots.
 
+If you choose to use ZFS, a small pool called bpool is created for
+/boot and a pool called rpool covering the rest of the disk holds the
+root filesystem. If you choose to encrypt rpool, ZFS native encryption
+is used with the key kept in a small LUKS volume that is unlocked with
+your passphrase on every boot.
+
+You can also choose to add a reset partition at the end of the disk.
+The installer media is copied to it and an entry for booting it is
+added to the boot menu, so that the system can later be reinstalled
+without the media. The partition is a little bigger than the media:
+the root filesystem (or the LVM group or ZFS pool) is made smaller to
+make room for it.
+
 If you do not choose to use LVM, a single partition is created covering the
 rest of the disk which is then formatted as ext4 and mounted at /.
 
+You can pick btrfs instead of ext4 for the root filesystem, in which
+case / is put in a subvolume called @, with /home and /var/log in
+subvolumes of their own. If the running kernel supports other
+filesystems that can be used for / (such as bcachefs), you can pick
+one of those instead.
+
 In either case, you will still have a chance to review and modify the results.
 
+If an existing NTFS partition (usually a Windows installation) is found,
+you can choose to install alongside it instead. The partition is shrunk
+to the size you choose and Ubuntu is installed into the space this frees
+up, sharing the existing EFI system partition. This is only possible if
+Windows was shut down fully (not hibernated or with "fast startup"
+enabled) and BitLocker is turned off or suspended.
+
+If an existing Linux install that keeps /home on a partition of its own
+is found, you can choose to reinstall over it. Its root filesystem (and
+/boot, if it has one) is formatted and the /home partition is mounted in
+the new system without being formatted. You can also have the installer
+create the same user as before, with the same user ID, so that it still
+owns its files.
+
 If you choose to use a custom storage layout, no changes are made to the disks
 and you will have to, at a minimum, select a boot disk and mount a filesystem
 at /.
@@ -201,12 +448,19 @@ class GuidedDiskSelectionView(BaseView):
 
     title = _("Guided storage configuration")
 
-    def __init__(self, controller, disks):
+    def __init__(self, controller, disks, resize_targets=(),
+                 optional_fstypes=(), reinstall_targets=(),
+                 reset_partition_size=None, zfs_supported=False):
         self.controller = controller
 
         if disks:
             if any(disk.ok_for_guided for disk in disks):
-                self.form = GuidedForm(disks=disks)
+                self.form = GuidedForm(
+                    disks=disks, resize_targets=resize_targets,
+                    optional_fstypes=optional_fstypes,
+                    reinstall_targets=reinstall_targets,
+                    reset_partition_size=reset_partition_size,
+                    zfs_supported=zfs_supported)
 
                 connect_signal(self.form, 'submit', self.done)
                 connect_signal(self.form, 'cancel', self.cancel)
@@ -234,10 +488,33 @@ class GuidedDiskSelectionView(BaseView):
         if results['guided']:
             choice = GuidedChoice(
                 disk_id=results['guided_choice']['disk'].id,
-                use_lvm=results['guided_choice']['use_lvm'])
+                use_lvm=results['guided_choice']['use_lvm'],
+                use_zfs=results['guided_choice'].get('use_zfs', False))
             opts = results['guided_choice'].get('lvm_options', {})
             if opts.get('encrypt', False):
                 choice.password = opts['luks_options']['password']
+            opts = results['guided_choice'].get('zfs_options', {})
+            if opts.get('encrypt', False):
+                choice.password = opts['keystore_options']['password']
+            fstype = results['guided_choice'].get('fstype', 'ext4')
+            if fstype != 'ext4':
+                choice.fstype = fstype
+            choice.reset_partition = results['guided_choice'].get(
+                'reset_partition', False)
+        elif results.get('resize'):
+            target = results['resize_choice']['target']
+            choice = GuidedChoice(
+                disk_id=target.disk_id,
+                resize=GuidedResize(
+                    partition_number=target.partition_number,
+                    size=results['resize_choice']['size']))
+        elif results.get('reinstall'):
+            target = results['reinstall_choice']['target']
+            choice = GuidedChoice(
+                disk_id=target.disk_id,
+                reinstall=GuidedReinstall(
+                    root_partition_number=target.root_partition_number,
+                    username=results['reinstall_choice']['user']))
         self.controller.guided_choice(choice)
 
     def manual(self, sender):
@@ -26,9 +26,11 @@ from urwid import connect_signal, Text
 
 from subiquitycore.ui.form import (
     BooleanField,
+    ChoiceField,
     Form,
     FormField,
     simple_field,
+    StringField,
     WantsToKnowFormField,
 )
 from subiquitycore.ui.interactive import StringEditor
@@ -39,11 +41,20 @@ from subiquitycore.ui.utils import rewrap
 
 from subiquity.models.filesystem import (
     align_up,
+    DEFAULT_BTRFS_SUBVOLUMES,
     Disk,
+    format_btrfs_subvolumes,
+    FS_LABEL_MAX_LENGTHS,
+    GPT_PARTITION_NAME_MAX_LENGTH,
+    GPT_PARTITION_TYPES,
     HUMAN_UNITS,
     dehumanize_size,
     humanize_size,
     LVM_VolGroup,
+    parse_btrfs_subvolumes,
+    parse_gpt_partition_type,
+    PARTITION_NAME_SUPPORTED,
+    THIN_LVM_SUPPORTED,
 )
 from subiquity.ui.mount import (
     common_mountpoints,
@@ -54,6 +65,8 @@ from subiquity.ui.mount import (
 
 log = logging.getLogger('subiquity.ui.filesystem.add_partition')
 
+THIN_POOL = 'thin-pool'
+
 
 class FSTypeField(FormField):
 
@@ -66,9 +79,13 @@ class FSTypeField(FormField):
             ('ext4',  True),
             ('xfs',   True),
             ('btrfs', True),
+            ]
+        for fstype in form.model.optional_fstypes:
+            options.append((fstype, True))
+        options += [
             ('---',   False),
             ('swap',  True),
-        ]
+            ]
         if form.existing_fs_type is None:
             options = options + [
                 ('---',                  False),
@@ -158,6 +175,11 @@ class PartitionForm(Form):
         self.mountpoints = {
             m.path: m.device.volume for m in self.model.all_mounts()
             if m.path != initial_path}
+        for fs in self.model._all(type='format', fstype='btrfs'):
+            if fs.volume is device:
+                continue
+            for subvolume in fs.subvolumes or []:
+                self.mountpoints[subvolume['mount']] = fs.volume
         self.max_size = max_size
         if max_size is not None:
             self.size_str = humanize_size(max_size)
@@ -182,6 +204,13 @@ class PartitionForm(Form):
         if fstype is None:
             if self.existing_fs_type == "swap":
                 show_use = True
+        # An existing filesystem keeps its label.
+        self.label.enabled = fstype is not None
+        self.subvolumes.enabled = fstype == 'btrfs'
+        if fstype == 'btrfs' and not self.subvolumes.value and \
+           self.mount.value == '/':
+            self.subvolumes.value = format_btrfs_subvolumes(
+                DEFAULT_BTRFS_SUBVOLUMES)
         if self.form_pile is not None:
             for i, (w, o) in enumerate(self.form_pile.contents):
                 if w is self.mount._table and show_use:
@@ -199,9 +228,25 @@ class PartitionForm(Form):
         self.mount.validate()
 
     name = LVNameField(_("Name: "))
+    lv_type = ChoiceField(_("Type:"), choices=["x"])
     size = SizeField()
+    partition_name = StringField(
+        _("Partition name:"),
+        help=_("The name of the partition in the partition table, which "
+               "is not the same as the filesystem label."))
+    partition_type = StringField(
+        _("Partition type:"),
+        help=_("Leave blank for the usual type, or enter a partition type "
+               "GUID or one of: {types}.").format(
+                   types=", ".join(GPT_PARTITION_TYPES)))
     fstype = FSTypeField(_("Format:"))
+    label = StringField(_("Label:"))
     mount = MountField(_("Mount:"))
+    subvolumes = StringField(
+        _("Subvolumes:"),
+        help=_("Space separated name:path[:options] subvolumes to create "
+               "and mount, for example @home:/home:compress=zstd. Leave "
+               "blank to use the filesystem without subvolumes."))
     use_swap = BooleanField(
         _("Use as swap"),
         help=_("Use this swap partition in the installed system."))
@@ -217,6 +262,23 @@ class PartitionForm(Form):
         else:
             return dehumanize_size(val)
 
+    def clean_partition_name(self, val):
+        return val or None
+
+    def clean_partition_type(self, val):
+        if not val:
+            return None
+        try:
+            return parse_gpt_partition_type(val)
+        except ValueError:
+            raise ValueError(_("Not a partition type GUID or known type"))
+
+    def clean_label(self, val):
+        return val or None
+
+    def clean_subvolumes(self, val):
+        return parse_btrfs_subvolumes(val) or None
+
     def clean_mount(self, val):
         if self.model.is_mounted_filesystem(self.fstype):
             return val
@@ -248,6 +310,35 @@ class PartitionForm(Form):
                 "There is already a logical volume named {name}."
                 ).format(name=self.name.value)
 
+    def validate_partition_name(self):
+        v = self.partition_name.value
+        if v is not None and \
+           len(v.encode('utf-16-le')) > 2*GPT_PARTITION_NAME_MAX_LENGTH:
+            return _("A partition name can be at most {max} characters "
+                     "long").format(max=GPT_PARTITION_NAME_MAX_LENGTH)
+
+    def validate_label(self):
+        v = self.label.value
+        if v is None:
+            return
+        max_len = FS_LABEL_MAX_LENGTHS.get(self.fstype.value)
+        if max_len is not None and len(v.encode('utf-8')) > max_len:
+            return _("A {fstype} label can be at most {max} bytes "
+                     "long").format(fstype=self.fstype.value, max=max_len)
+
+    def validate_subvolumes(self):
+        subvolumes = self.subvolumes.value
+        if not subvolumes:
+            return
+        if self.mount.value is None:
+            return _("The filesystem must be mounted to use subvolumes")
+        for subvolume in subvolumes:
+            path = subvolume['mount']
+            dev = self.mountpoints.get(path)
+            if dev is not None:
+                return _("{device} is already mounted at {path}.").format(
+                    device=dev.label.title(), path=path)
+
     def validate_mount(self):
         mount = self.mount.value
         if mount is None:
@@ -351,6 +442,10 @@ def initial_data_for_fs(fs):
                 r['use_swap'] = fs.mount() is not None
         else:
             r['fstype'] = fs.fstype
+            r['label'] = fs.label or ''
+            if fs.fstype == 'btrfs':
+                r['subvolumes'] = format_btrfs_subvolumes(
+                    fs.subvolumes or [])
         if fs._m.is_mounted_filesystem(fs.fstype):
             mount = fs.mount()
             if mount is not None:
@@ -386,6 +481,9 @@ class PartitionStretchy(Stretchy):
                 label = _("Save")
             initial['size'] = humanize_size(self.partition.size)
             max_size += self.partition.size
+            if not isinstance(disk, LVM_VolGroup):
+                initial['partition_name'] = partition.partition_name or ''
+                initial['partition_type'] = partition.partition_type or ''
 
             if not partition.is_esp:
                 initial.update(initial_data_for_fs(self.partition.fs()))
@@ -408,11 +506,20 @@ class PartitionStretchy(Stretchy):
                     x += 1
                 initial['name'] = name
 
+        self.max_size = max_size
         self.form = PartitionForm(
             self.model, max_size, initial, lvm_names, partition)
 
         if not isinstance(disk, LVM_VolGroup):
             self.form.remove_field('name')
+        if isinstance(disk, LVM_VolGroup) and THIN_LVM_SUPPORTED:
+            self._setup_lv_type()
+        else:
+            self.form.remove_field('lv_type')
+        if isinstance(disk, LVM_VolGroup) or self._ptable() != 'gpt' or \
+           not PARTITION_NAME_SUPPORTED:
+            self.form.remove_field('partition_name')
+            self.form.remove_field('partition_type')
 
         if label is not None:
             self.form.buttons.base_widget[0].set_label(label)
@@ -454,9 +561,14 @@ class PartitionStretchy(Stretchy):
                 self.form.mount.enabled = False
                 self.form.fstype.enabled = False
                 self.form.size.enabled = False
+            if partition.is_esp or partition.flag in ["bios_grub", "prep"]:
+                # The type of these is implied by their flag.
+                self.form.partition_type.enabled = False
             if partition.preserve:
                 self.form.name.enabled = False
                 self.form.size.enabled = False
+                self.form.partition_name.enabled = False
+                self.form.partition_type.enabled = False
 
         connect_signal(self.form, 'submit', self.done)
         connect_signal(self.form, 'cancel', self.cancel)
@@ -529,12 +641,68 @@ class PartitionStretchy(Stretchy):
 
         super().__init__(title, widgets, 0, focus_index)
 
+    def _ptable(self):
+        if self.partition is not None:
+            return self.disk.ptable
+        return self.disk.ptable_for_new_partition()
+
+    def _setup_lv_type(self):
+        form = self.form
+        opts = [
+            Option((_("Linear"), True, None)),
+            Option((_("Thin pool"), True, THIN_POOL)),
+            ]
+        for pool in self.disk.thin_pools():
+            if pool is not self.partition:
+                opts.append(Option((
+                    _("Thin volume in {pool}").format(pool=pool.name),
+                    True,
+                    pool,
+                    )))
+        form.lv_type.widget.options = opts
+        if self.partition is not None:
+            if self.partition.thin_pool:
+                form.lv_type.widget.value = THIN_POOL
+            else:
+                form.lv_type.widget.value = self.partition.pool
+            # Converting between types is not supported.
+            form.lv_type.enabled = False
+        connect_signal(form.lv_type.widget, 'select', self._select_lv_type)
+        self._select_lv_type(None, form.lv_type.widget.value)
+
+    def _select_lv_type(self, sender, lv_type):
+        form = self.form
+        max_size = self.max_size
+        if lv_type == THIN_POOL:
+            form.fstype.enabled = False
+            form.mount.enabled = False
+        else:
+            form.fstype.enabled = True
+            form.select_fstype(None, form.fstype.value)
+            if lv_type is not None:
+                # A thin volume does not take space from the volume
+                # group, and the pool can be overprovisioned.
+                max_size = self.disk.size
+        form.max_size = max_size
+        form.size_str = humanize_size(max_size)
+        form.size.caption = _("Size (max {size}):").format(
+            size=form.size_str)
+
     def cancel(self, button=None):
         self.parent.remove_overlay()
 
     def done(self, form):
         log.debug("Add Partition Result: {}".format(form.as_data()))
         data = form.as_data()
+        lv_type = data.pop('lv_type', None)
+        if lv_type == THIN_POOL:
+            data['thin_pool'] = True
+        elif lv_type is not None:
+            data['pool'] = lv_type
+        if self.partition is not None and self.partition.preserve:
+            # curtin cannot change these on an existing partition.
+            data.pop('partition_name', None)
+            data.pop('partition_type', None)
         if self.partition is not None and self.partition.is_esp:
             if self.partition.original_fstype() is None:
                 data['fstype'] = self.partition.fs().fstype
@@ -569,6 +737,7 @@ class FormatEntireStretchy(Stretchy):
         self.form = PartitionForm(self.model, 0, initial, None, device)
         self.form.remove_field('size')
         self.form.remove_field('name')
+        self.form.remove_field('lv_type')
 
         connect_signal(self.form, 'submit', self.done)
         connect_signal(self.form, 'cancel', self.cancel)
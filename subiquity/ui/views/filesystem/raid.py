@@ -183,7 +183,8 @@ class RaidStretchy(Stretchy):
         active_device_count = len(self.form.devices.widget.active_devices)
         if active_device_count >= new_level.min_devices:
             self.form.size.value = humanize_size(
-                get_raid_size(new_level.value, self.form.devices.value))
+                get_raid_size(
+                    new_level.value, self.form.devices.widget.active_devices))
         else:
             self.form.size.value = '-'
         self.form.devices.widget.set_supports_spares(new_level.supports_spares)
@@ -192,9 +193,11 @@ class RaidStretchy(Stretchy):
         self.form.devices.validate()
 
     def _change_devices(self, sender, new_devices):
+        # Spares do not contribute to the size of the array.
         if len(sender.active_devices) >= self.form.level.value.min_devices:
             self.form.size.value = humanize_size(
-                get_raid_size(self.form.level.value.value, new_devices))
+                get_raid_size(
+                    self.form.level.value.value, sender.active_devices))
         else:
             self.form.size.value = '-'
 
@@ -41,6 +41,8 @@ def make_format_entire_view(model, disk):
     return base_view, stretchy
 
 
+@mock.patch(
+    'subiquity.ui.views.filesystem.partition.PARTITION_NAME_SUPPORTED', True)
 class PartitionViewTests(unittest.TestCase):
 
     def test_initial_focus(self):
@@ -65,6 +67,9 @@ class PartitionViewTests(unittest.TestCase):
         valid_data['mount'] = '/'
         valid_data['size'] = dehumanize_size(valid_data['size'])
         valid_data['use_swap'] = False
+        valid_data['partition_name'] = None
+        valid_data['partition_type'] = None
+        valid_data['label'] = None
         view.controller.partition_disk_handler.assert_called_once_with(
             stretchy.disk, None, valid_data)
 
@@ -82,13 +87,56 @@ class PartitionViewTests(unittest.TestCase):
         view_helpers.click(stretchy.form.done_btn.base_widget)
         expected_data = {
             'size': dehumanize_size(form_data['size']),
+            'partition_name': None,
+            'partition_type': None,
             'fstype': 'xfs',
+            'label': None,
             'mount': None,
             'use_swap': False,
             }
         view.controller.partition_disk_handler.assert_called_once_with(
             stretchy.disk, stretchy.partition, expected_data)
 
+    def test_partition_type_and_label(self):
+        form_data = {
+            'partition_name': "boot",
+            'partition_type': "xbootldr",
+            'fstype': "ext4",
+            'label': "boot",
+            }
+        model, disk = make_model_and_disk()
+        view, stretchy = make_partition_view(model, disk)
+        view_helpers.enter_data(stretchy.form, form_data)
+        stretchy.form.mount.value = '/boot'
+        view_helpers.click(stretchy.form.done_btn.base_widget)
+        expected_data = {
+            'size': disk.free_for_partitions,
+            'partition_name': 'boot',
+            'partition_type': 'bc13c2ff-59e6-4262-a352-b275fd6f7172',
+            'fstype': 'ext4',
+            'label': 'boot',
+            'mount': '/boot',
+            'use_swap': False,
+            }
+        view.controller.partition_disk_handler.assert_called_once_with(
+            stretchy.disk, None, expected_data)
+
+    def test_invalid_partition_type(self):
+        model, disk = make_model_and_disk()
+        view, stretchy = make_partition_view(model, disk)
+        view_helpers.enter_data(stretchy.form, {'partition_type': 'bogus'})
+        stretchy.form.partition_type.validate()
+        self.assertTrue(stretchy.form.partition_type.in_error)
+
+    def test_partition_type_unsupported(self):
+        model, disk = make_model_and_disk()
+        with mock.patch(
+                'subiquity.ui.views.filesystem.partition.'
+                'PARTITION_NAME_SUPPORTED', False):
+            view, stretchy = make_partition_view(model, disk)
+        self.assertNotIn('partition_name', stretchy.form.as_data())
+        self.assertNotIn('partition_type', stretchy.form.as_data())
+
     def test_size_clamping(self):
         model, disk = make_model_and_disk()
         partition = model.add_partition(disk, 512*(2**20))
@@ -116,6 +164,7 @@ class PartitionViewTests(unittest.TestCase):
         view_helpers.click(stretchy.form.done_btn.base_widget)
         expected_data = {
             'fstype': 'xfs',
+            'label': None,
             'mount': None,
             'use_swap': False,
             }
@@ -181,7 +230,9 @@ class PartitionViewTests(unittest.TestCase):
         view_helpers.click(stretchy.form.done_btn.base_widget)
         expected_data = {
             'size': dehumanize_size(form_data['size']),
+            'partition_name': None,
             'fstype': "fat32",
+            'label': None,
             'mount': '/boot/efi',
             'use_swap': False,
             }
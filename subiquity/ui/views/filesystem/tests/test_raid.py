@@ -8,6 +8,8 @@ from subiquitycore.view import BaseView
 
 from subiquity.client.controllers.filesystem import FilesystemController
 from subiquity.models.filesystem import (
+    get_raid_size,
+    humanize_size,
     raidlevels_by_value,
     )
 from subiquity.ui.views.filesystem.raid import RaidStretchy
@@ -70,3 +72,15 @@ class RaidViewTests(unittest.TestCase):
         view_helpers.click(stretchy.form.done_btn.base_widget)
         view.controller.raid_handler.assert_called_once_with(
             raid, expected_data)
+
+    def test_size_ignores_spares(self):
+        model, disk = make_model_and_disk()
+        parts = [model.add_partition(disk, 10*(2**30)) for i in range(5)]
+        view, stretchy = make_view(model)
+        devices = {p: 'active' for p in parts[:4]}
+        devices[parts[4]] = 'spare'
+        stretchy.form.devices.value = devices
+        stretchy._select_level(None, raidlevels_by_value["raid10"])
+        self.assertEqual(
+            stretchy.form.size.value,
+            humanize_size(get_raid_size("raid10", set(parts[:4]))))
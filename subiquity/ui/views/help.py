@@ -57,6 +57,7 @@ from subiquitycore.ui.width import (
 
 from subiquity.common.types import PasswordKind
 from subiquity.ui.views.error import ErrorReportListStretchy
+from subiquity.ui.views.kdump import KdumpStretchy
 
 log = logging.getLogger('subiquity.ui.help')
 
@@ -294,10 +295,13 @@ class OpenHelpMenu(WidgetWrap):
             _("Keyboard shortcuts"), on_press=self.parent.shortcuts)
         drop_to_shell = menu_item(
             _("Enter shell"), on_press=self.parent.debug_shell)
+        kdump = menu_item(
+            _("Kernel crash dumps"), on_press=self.parent.kdump)
         buttons = {
             about,
             close,
             drop_to_shell,
+            kdump,
             keys,
             }
         if self.parent.ssh_info is not None:
@@ -339,6 +343,8 @@ class OpenHelpMenu(WidgetWrap):
             drop_to_shell,
             view_errors,
             hline,
+            kdump,
+            hline,
             about,
             ]
 
@@ -485,5 +491,13 @@ class HelpMenu(PopUpLauncher):
     def toggle_rich(self, sender):
         self.app.toggle_rich()
 
+    async def _show_kdump(self):
+        info = await self.app.wait_with_text_dialog(
+            self.app.client.kdump.GET(), "Getting kernel crash dump settings")
+        self._show_overlay(KdumpStretchy(self.app, info))
+
+    def kdump(self, sender):
+        self.app.aio_loop.create_task(self._show_kdump())
+
     def show_errors(self, sender):
         self._show_overlay(ErrorReportListStretchy(self.app))
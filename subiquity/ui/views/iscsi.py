@@ -0,0 +1,316 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+""" iSCSI
+
+Provides logging into iSCSI targets so that SAN LUNs can be installed to.
+
+"""
+import logging
+
+from urwid import (
+    connect_signal,
+    Text,
+    )
+
+from subiquitycore.gettext38 import ngettext
+from subiquitycore.ui.actionmenu import (
+    ActionMenu,
+    )
+from subiquitycore.ui.buttons import (
+    back_btn,
+    done_btn,
+    other_btn,
+    )
+from subiquitycore.ui.container import (
+    Pile,
+    WidgetWrap,
+    )
+from subiquitycore.ui.form import (
+    Form,
+    PasswordField,
+    StringField,
+    )
+from subiquitycore.ui.stretchy import Stretchy
+from subiquitycore.ui.table import (
+    ColSpec,
+    TableListBox,
+    TableRow,
+    )
+from subiquitycore.ui.utils import (
+    button_pile,
+    Color,
+    make_action_menu_row,
+    screen,
+    )
+from subiquitycore.view import BaseView
+
+from subiquity.common.types import ISCSIChap
+
+
+log = logging.getLogger('subiquity.ui.views.iscsi')
+
+
+def chap_from_form(form):
+    if not form.username.value:
+        return None
+    return ISCSIChap(
+        username=form.username.value, password=form.password.value)
+
+
+class DiscoverForm(Form):
+
+    ok_label = _("Discover")
+
+    portal = StringField(
+        _("Portal address:"),
+        help=_("The address of the iSCSI portal, optionally followed by "
+               "\":port\" if it does not listen on port 3260."))
+    username = StringField(
+        _("Username:"),
+        help=_("Leave blank if discovery does not need CHAP "
+               "authentication."))
+    password = PasswordField(_("Password:"))
+
+    def clean_portal(self, value):
+        value = value.strip()
+        if not value:
+            raise ValueError(_("Portal address must not be empty"))
+        return value
+
+
+class LoginForm(Form):
+
+    ok_label = _("Log in")
+
+    username = StringField(
+        _("Username:"),
+        help=_("Leave blank if the target does not need CHAP "
+               "authentication."))
+    password = PasswordField(_("Password:"))
+
+
+class DiscoverStretchy(Stretchy):
+
+    def __init__(self, parent):
+        self.parent = parent
+        self.form = DiscoverForm()
+        connect_signal(self.form, 'submit', self.done)
+        connect_signal(self.form, 'cancel', self.cancel)
+        super().__init__(
+            _('Discover iSCSI targets'),
+            [Pile(self.form.as_rows()), Text(""), self.form.buttons],
+            0, 0)
+
+    def done(self, sender):
+        self.parent.remove_overlay()
+        self.parent.discover(
+            self.form.portal.value, chap_from_form(self.form))
+
+    def cancel(self, sender=None):
+        self.parent.remove_overlay()
+
+
+class LoginStretchy(Stretchy):
+
+    def __init__(self, parent, target):
+        self.parent = parent
+        self.target = target
+        self.form = LoginForm()
+        connect_signal(self.form, 'submit', self.done)
+        connect_signal(self.form, 'cancel', self.cancel)
+        # {iqn} is the name of an iSCSI target
+        title = _('Log in to {iqn}').format(iqn=target.iqn)
+        super().__init__(
+            title,
+            [Pile(self.form.as_rows()), Text(""), self.form.buttons],
+            0, 0)
+
+    def done(self, sender):
+        self.parent.remove_overlay()
+        self.parent.login(self.target, chap_from_form(self.form))
+
+    def cancel(self, sender=None):
+        self.parent.remove_overlay()
+
+
+class ErrorStretchy(Stretchy):
+
+    def __init__(self, parent, title, error):
+        self.parent = parent
+        widgets = [
+            Text(error),
+            Text(""),
+            button_pile([done_btn(_("Close"), on_press=self.close)]),
+            ]
+        super().__init__(title, widgets, 0, 2)
+
+    def close(self, button=None):
+        self.parent.remove_overlay()
+
+
+class ISCSITargetList(WidgetWrap):
+
+    def __init__(self, parent):
+        self.parent = parent
+        self.table = TableListBox([], spacing=2, colspecs={
+            0: ColSpec(rpad=2),
+            1: ColSpec(can_shrink=True),
+            2: ColSpec(rpad=2),
+            })
+        self._no_targets_content = Color.info_minor(Text(
+            _("No targets. Select \"Discover targets\" to find the targets "
+              "a portal offers.")))
+        super().__init__(self.table)
+
+    def _target_action(self, sender, action, target):
+        if action == 'login':
+            self.parent.show_stretchy_overlay(
+                LoginStretchy(self.parent, target))
+        elif action == 'logout':
+            self.parent.logout(target)
+
+    def update(self, targets, multipath):
+        rows = [TableRow([
+            Color.info_minor(heading) for heading in [
+                Text(_("PORTAL")),
+                Text(_("TARGET")),
+                Text(_("STATUS")),
+            ]])]
+        if not targets and not multipath:
+            self._w = self._no_targets_content
+            return
+        self._w = self.table
+        for target in targets:
+            actions = [
+                (_("Log in"), not target.logged_in, 'login'),
+                (_("Log out"), target.logged_in, 'logout'),
+                ]
+            menu = ActionMenu(actions)
+            connect_signal(menu, 'action', self._target_action, target)
+            if target.logged_in:
+                # for translators: the status of an iSCSI session
+                status = Text(_("logged in"))
+            else:
+                status = Text("")
+            row = make_action_menu_row(
+                [Text(target.portal), Text(target.iqn), status, menu],
+                menu,
+                attr_map='menu_button',
+                focus_map={
+                    None: 'menu_button focus',
+                    'info_minor': 'menu_button focus',
+                },
+                cursor_x=0)
+            rows.append(row)
+        if multipath:
+            rows.append(TableRow([Text("")]))
+            rows.append(TableRow([
+                Color.info_minor(heading) for heading in [
+                    Text(_("MULTIPATH")),
+                    Text(_("WWID")),
+                    Text(_("PATHS")),
+                ]]))
+        for device in multipath:
+            paths = ngettext(
+                "{count} path", "{count} paths",
+                len(device.paths)).format(count=len(device.paths))
+            rows.append(TableRow([
+                Text(device.name),
+                Text(device.wwid),
+                Text(paths),
+                ]))
+        self.table.set_contents(rows)
+
+
+class ISCSIView(BaseView):
+
+    title = _("iSCSI targets")
+    excerpt = _("If you want to install to a LUN on an iSCSI SAN, log into "
+                "its target here and it will be offered as a disk on the "
+                "storage screen. Otherwise, select \"Done\".")
+
+    def __init__(self, controller, status):
+        self.controller = controller
+        self.discovered = []
+        self.initiator = Text("")
+        self.target_list = ISCSITargetList(self)
+        self._update(status)
+
+        rows = Pile([
+            ('pack', self.initiator),
+            ('pack', Text("")),
+            self.target_list,
+            ])
+        buttons = [
+            other_btn(_("Discover targets"), on_press=self.show_discover),
+            done_btn(_("Done"), on_press=self.done),
+            back_btn(_("Back"), on_press=self.cancel),
+            ]
+        super().__init__(screen(rows, buttons, excerpt=_(self.excerpt)))
+
+    def _update(self, status):
+        self.status = status
+        # {name} is the iSCSI name (IQN) of this machine
+        self.initiator.set_text(
+            _("Initiator name: {name}").format(name=status.initiator_name))
+        targets = list(status.targets)
+        for target in self.discovered:
+            if not any((s.portal, s.iqn) == (target.portal, target.iqn)
+                       for s in status.targets):
+                target.logged_in = False
+                targets.append(target)
+        self.target_list.update(targets, status.multipath)
+
+    def show_discover(self, sender=None):
+        self.show_stretchy_overlay(DiscoverStretchy(self))
+
+    async def _call(self, coro, message, error_title):
+        result = await self.controller.app.wait_with_text_dialog(
+            coro, message)
+        if result.error:
+            self.show_stretchy_overlay(
+                ErrorStretchy(self, error_title, result.error))
+        return result
+
+    async def _discover(self, portal, chap):
+        result = await self._call(
+            self.controller.discover(portal, chap),
+            _("Discovering targets..."), _("Discovery failed"))
+        self.discovered = result.targets
+        self._update(self.status)
+
+    async def _change_session(self, coro, message, error_title):
+        self._update(await self._call(coro, message, error_title))
+
+    def discover(self, portal, chap):
+        self.controller.app.aio_loop.create_task(
+            self._discover(portal, chap))
+
+    def login(self, target, chap):
+        self.controller.app.aio_loop.create_task(self._change_session(
+            self.controller.login(target, chap),
+            _("Logging in..."), _("Login failed")))
+
+    def logout(self, target):
+        self.controller.app.aio_loop.create_task(self._change_session(
+            self.controller.logout(target),
+            _("Logging out..."), _("Logout failed")))
+
+    def done(self, sender=None):
+        self.controller.done()
+
+    def cancel(self, sender=None):
+        self.controller.cancel()
@@ -0,0 +1,88 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+""" Kdump
+
+Turns kernel crash dumps on the target on or off.
+
+"""
+import logging
+
+from urwid import (
+    connect_signal,
+    Text,
+    )
+
+from subiquitycore.ui.container import Pile
+from subiquitycore.ui.form import (
+    BooleanField,
+    Form,
+    )
+from subiquitycore.ui.stretchy import Stretchy
+from subiquitycore.ui.utils import rewrap
+
+
+log = logging.getLogger('subiquity.ui.views.kdump')
+
+
+KDUMP_INTRO = _("""
+If the kernel of the installed system crashes, a kernel set aside for
+the purpose can save the memory of the crashed kernel to /var/crash for
+later examination. This needs some memory to be reserved at boot.
+""")
+
+
+class KdumpForm(Form):
+
+    ok_label = _("Save")
+
+    enabled = BooleanField(_("Enable kernel crash dumps"))
+
+
+class KdumpStretchy(Stretchy):
+
+    def __init__(self, app, info):
+        self.app = app
+        self.form = KdumpForm(initial={'enabled': info.enabled})
+        connect_signal(self.form, 'submit', self.done)
+        connect_signal(self.form, 'cancel', self.cancel)
+        if info.crashkernel is None:
+            details = _("This machine does not have enough memory to "
+                        "reserve any for kernel crash dumps.")
+            self.form.enabled.enabled = False
+        else:
+            # {size} is an amount of memory, like 512M
+            details = _("{size} of memory will be reserved.").format(
+                size=info.crashkernel)
+        super().__init__(
+            _("Kernel crash dumps"),
+            [
+                Text(rewrap(_(KDUMP_INTRO))),
+                Text(""),
+                Pile(self.form.as_rows()),
+                Text(""),
+                Text(details),
+                Text(""),
+                self.form.buttons,
+            ],
+            2, 2)
+
+    def done(self, sender):
+        self.app.remove_global_overlay(self)
+        self.app.aio_loop.create_task(
+            self.app.client.kdump.POST(self.form.enabled.value))
+
+    def cancel(self, sender=None):
+        self.app.remove_global_overlay(self)
@@ -17,13 +17,24 @@ Select the Ubuntu archive mirror.
 
 """
 import logging
-from urwid import connect_signal
+from urwid import connect_signal, Text
 
+from subiquitycore.async_helpers import schedule_task
 from subiquitycore.view import BaseView
+from subiquitycore.ui.buttons import other_btn
+from subiquitycore.ui.container import Pile
 from subiquitycore.ui.form import (
     Form,
     URLField,
 )
+from subiquitycore.ui.spinner import Spinner
+from subiquitycore.ui.utils import button_pile, screen
+
+from subiquity.common.types import (
+    MirrorRanking,
+    MirrorRankingState,
+    )
+from subiquity.models.filesystem import humanize_size
 
 
 log = logging.getLogger('subiquity.ui.mirror')
@@ -46,7 +57,7 @@ class MirrorView(BaseView):
     excerpt = _("If you use an alternative mirror for Ubuntu, enter its "
                 "details here.")
 
-    def __init__(self, controller, mirror):
+    def __init__(self, controller, mirror, ranking):
         self.controller = controller
 
         self.form = MirrorForm(initial={'url': mirror})
@@ -54,7 +65,52 @@ class MirrorView(BaseView):
         connect_signal(self.form, 'submit', self.done)
         connect_signal(self.form, 'cancel', self.cancel)
 
-        super().__init__(self.form.as_screen(excerpt=_(self.excerpt)))
+        self.spinner = Spinner(controller.app.aio_loop, style='dots')
+        self.rank_btn = other_btn(
+            _("Find the fastest mirror"), on_press=self.rank)
+        self.ranking_pile = Pile([])
+        self.show_ranking(ranking)
+
+        rows = self.form.as_rows() + [
+            Text(""),
+            button_pile([self.rank_btn]),
+            Text(""),
+            self.ranking_pile,
+            ]
+
+        super().__init__(
+            screen(rows, self.form.buttons, excerpt=_(self.excerpt)))
+
+    def show_ranking(self, ranking):
+        self.spinner.stop()
+        if ranking.state == MirrorRankingState.RUNNING:
+            self.spinner.start()
+            widgets = [Text(_("Measuring the speed of mirrors...")),
+                       self.spinner]
+        elif ranking.state == MirrorRankingState.FAILED:
+            widgets = [Text(_("The speed of mirrors could not be measured."))]
+        elif ranking.state == MirrorRankingState.DONE:
+            widgets = [Text(_("Measured download speeds:")), Text("")]
+            for result in ranking.results:
+                if result.speed is None:
+                    speed = _("failed")
+                else:
+                    speed = humanize_size(result.speed) + "/s"
+                widgets.append(Text("{}  {}".format(result.url, speed)))
+        else:
+            widgets = []
+        self.ranking_pile.contents[:] = [
+            (w, self.ranking_pile.options('pack')) for w in widgets]
+
+    def rank(self, sender):
+        self.show_ranking(MirrorRanking(state=MirrorRankingState.RUNNING))
+        schedule_task(self._rank())
+
+    async def _rank(self):
+        ranking = await self.controller.rank()
+        if ranking.selected is not None:
+            self.form.url.value = ranking.selected
+        self.show_ranking(ranking)
 
     def done(self, result):
         log.debug("User input: {}".format(result.as_data()))
@@ -26,6 +26,7 @@ from subiquitycore.ui.form import (
     Form,
     URLField,
 )
+from subiquitycore.ui.utils import SomethingFailed
 
 
 log = logging.getLogger('subiquity.ui.views.proxy')
@@ -35,12 +36,17 @@ proxy_help = _("If you need to use a HTTP proxy to access the outside world, "
                "\n\nThe proxy information should be given in the standard "
                "form of \"http://[[user][:pass]@]host[:port]/\".")
 
+store_proxy_help = _("If this network blocks the snap store but has a snap "
+                     "store proxy, enter its address here.")
+
 
 class ProxyForm(Form):
 
     cancel_label = _("Back")
 
     url = URLField(_("Proxy address:"), help=proxy_help)
+    store_proxy_url = URLField(
+        _("Snap store proxy:"), help=store_proxy_help)
 
 
 class ProxyView(BaseView):
@@ -49,10 +55,13 @@ class ProxyView(BaseView):
     excerpt = _("If this system requires a proxy to connect to the internet, "
                 "enter its details here.")
 
-    def __init__(self, controller, proxy):
+    def __init__(self, controller, proxy, store_proxy_url):
         self.controller = controller
 
-        self.form = ProxyForm(initial={'url': proxy})
+        self.form = ProxyForm(initial={
+            'url': proxy,
+            'store_proxy_url': store_proxy_url,
+            })
 
         connect_signal(self.form, 'submit', self.done)
         connect_signal(self.form, 'cancel', self.cancel)
@@ -61,7 +70,12 @@ class ProxyView(BaseView):
 
     def done(self, result):
         log.debug("User input: {}".format(result.as_data()))
-        self.controller.done(result.url.value)
+        self.controller.done(
+            result.url.value, result.store_proxy_url.value)
+
+    def store_proxy_failed(self, error):
+        self.show_stretchy_overlay(SomethingFailed(
+            self, _("Registering with the snap store proxy failed:"), error))
 
     def cancel(self, result=None):
         self.controller.cancel()
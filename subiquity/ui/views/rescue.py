@@ -0,0 +1,261 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+""" Rescue
+
+Offers ways to repair the installs found on the disks.
+
+"""
+import logging
+
+from urwid import (
+    connect_signal,
+    Text,
+    )
+
+from subiquitycore.ui.actionmenu import (
+    ActionMenu,
+    )
+from subiquitycore.ui.buttons import (
+    back_btn,
+    done_btn,
+    )
+from subiquitycore.ui.container import (
+    ListBox,
+    Pile,
+    WidgetWrap,
+    )
+from subiquitycore.ui.form import (
+    Form,
+    PasswordField,
+    )
+from subiquitycore.ui.stretchy import Stretchy
+from subiquitycore.ui.table import (
+    ColSpec,
+    TableListBox,
+    TableRow,
+    )
+from subiquitycore.ui.utils import (
+    button_pile,
+    Color,
+    make_action_menu_row,
+    screen,
+    )
+from subiquitycore.view import BaseView
+
+from subiquity.common.types import RescueAction
+
+
+log = logging.getLogger('subiquity.ui.views.rescue')
+
+
+ACTION_MESSAGES = {
+    RescueAction.FSCK: _("Checking filesystems..."),
+    RescueAction.REINSTALL_GRUB: _("Reinstalling GRUB..."),
+    RescueAction.UPDATE_INITRAMFS: _("Regenerating the initramfs..."),
+    }
+
+
+class UnlockForm(Form):
+
+    ok_label = _("Unlock")
+
+    passphrase = PasswordField(_("Passphrase:"))
+
+
+class UnlockStretchy(Stretchy):
+
+    def __init__(self, parent, path):
+        self.parent = parent
+        self.path = path
+        self.form = UnlockForm()
+        connect_signal(self.form, 'submit', self.done)
+        connect_signal(self.form, 'cancel', self.cancel)
+        # {path} is the path of an encrypted block device
+        title = _('Unlock {path}').format(path=path)
+        super().__init__(
+            title,
+            [Pile(self.form.as_rows()), Text(""), self.form.buttons],
+            0, 0)
+
+    def done(self, sender):
+        self.parent.remove_overlay()
+        self.parent.unlock(self.path, self.form.passphrase.value)
+
+    def cancel(self, sender=None):
+        self.parent.remove_overlay()
+
+
+class OutputStretchy(Stretchy):
+
+    def __init__(self, parent, title, output):
+        self.parent = parent
+        widgets = [
+            ListBox([Text(output.rstrip() or _("(no output)"))]),
+            Text(""),
+            button_pile([done_btn(_("Close"), on_press=self.close)]),
+            ]
+        super().__init__(title, widgets, 0, 2)
+
+    def close(self, button=None):
+        self.parent.remove_overlay()
+
+
+class RescueInstallList(WidgetWrap):
+
+    def __init__(self, parent):
+        self.parent = parent
+        self.table = TableListBox([], spacing=2, colspecs={
+            0: ColSpec(rpad=2),
+            1: ColSpec(can_shrink=True),
+            2: ColSpec(rpad=2),
+            })
+        self._no_installs_content = Color.info_minor(Text(
+            _("No existing installs were found on the disks.")))
+        super().__init__(self.table)
+
+    def _install_action(self, sender, action, install):
+        if action == 'shell':
+            self.parent.shell(install)
+        elif action == 'unmount':
+            self.parent.unmount()
+        else:
+            self.parent.run_action(install, action)
+
+    def _locked_action(self, sender, action, path):
+        if action == 'unlock':
+            self.parent.show_stretchy_overlay(
+                UnlockStretchy(self.parent, path))
+
+    def _row(self, cells, menu):
+        return make_action_menu_row(
+            cells + [menu],
+            menu,
+            attr_map='menu_button',
+            focus_map={
+                None: 'menu_button focus',
+                'info_minor': 'menu_button focus',
+            },
+            cursor_x=0)
+
+    def update(self, status):
+        if not status.installs and not status.locked:
+            self._w = self._no_installs_content
+            return
+        self._w = self.table
+        rows = [TableRow([
+            Color.info_minor(heading) for heading in [
+                Text(_("DEVICE")),
+                Text(_("SYSTEM")),
+                Text(""),
+            ]])]
+        for install in status.installs:
+            actions = [
+                (_("Open a shell"), True, 'shell'),
+                (_("Reinstall GRUB"), True, RescueAction.REINSTALL_GRUB),
+                (_("Check filesystems"), True, RescueAction.FSCK),
+                (_("Regenerate initramfs"), True,
+                 RescueAction.UPDATE_INITRAMFS),
+                (_("Unmount"), install.mounted, 'unmount'),
+                ]
+            menu = ActionMenu(actions)
+            connect_signal(menu, 'action', self._install_action, install)
+            if install.mounted:
+                # for translators: the status of an install
+                status_text = Text(_("mounted"))
+            else:
+                status_text = Text("")
+            rows.append(self._row(
+                [Text(install.root), Text(install.os_name), status_text],
+                menu))
+        if status.locked:
+            rows.append(TableRow([Text("")]))
+            rows.append(TableRow([
+                Color.info_minor(Text(_("ENCRYPTED DEVICES"))),
+                ]))
+        for path in status.locked:
+            menu = ActionMenu([(_("Unlock"), True, 'unlock')])
+            connect_signal(menu, 'action', self._locked_action, path)
+            rows.append(self._row([Text(path), Text(""), Text("")], menu))
+        self.table.set_contents(rows)
+
+
+class RescueView(BaseView):
+
+    title = _("Rescue an existing install")
+    excerpt = _("These are the installs found on the disks. Select one to "
+                "open a shell in it, with its filesystems mounted, or to "
+                "repair it.")
+
+    def __init__(self, controller, status):
+        self.controller = controller
+        self.install_list = RescueInstallList(self)
+        self.install_list.update(status)
+
+        buttons = [
+            done_btn(_("Reboot"), on_press=self.reboot),
+            back_btn(_("Back"), on_press=self.cancel),
+            ]
+        super().__init__(screen(
+            self.install_list, buttons, excerpt=_(self.excerpt)))
+
+    def _update(self, status):
+        self.install_list.update(status)
+        if status.error:
+            self.show_stretchy_overlay(
+                OutputStretchy(self, _("Rescue failed"), status.error))
+
+    async def _change(self, coro, message):
+        self._update(
+            await self.controller.app.wait_with_text_dialog(coro, message))
+
+    async def _run_action(self, install, action):
+        result = await self.controller.app.wait_with_text_dialog(
+            self.controller.run_action(install.root, action),
+            ACTION_MESSAGES[action])
+        if result.success:
+            title = _("Finished")
+        else:
+            title = _("Failed")
+        self.show_stretchy_overlay(OutputStretchy(self, title, result.output))
+        self._update(await self.controller.status())
+
+    async def _shell(self, install):
+        status = await self.controller.app.wait_with_text_dialog(
+            self.controller.mount(install.root), _("Mounting..."))
+        self._update(status)
+        if status.mount_point is not None and not status.error:
+            self.controller.shell(status.mount_point)
+
+    def unlock(self, path, passphrase):
+        self.controller.app.aio_loop.create_task(self._change(
+            self.controller.unlock(path, passphrase), _("Unlocking...")))
+
+    def unmount(self):
+        self.controller.app.aio_loop.create_task(self._change(
+            self.controller.unmount(), _("Unmounting...")))
+
+    def run_action(self, install, action):
+        self.controller.app.aio_loop.create_task(
+            self._run_action(install, action))
+
+    def shell(self, install):
+        self.controller.app.aio_loop.create_task(self._shell(install))
+
+    def reboot(self, sender=None):
+        self.controller.reboot()
+
+    def cancel(self, sender=None):
+        self.controller.cancel()
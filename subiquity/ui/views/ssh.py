@@ -60,7 +60,7 @@ from subiquity.ui.views.identity import (
 log = logging.getLogger('subiquity.ui.ssh')
 
 
-SSH_IMPORT_MAXLEN = 256 + 3  # account for lp: or gh:
+SSH_IMPORT_MAXLEN = 256 + 3  # account for lp:, gh:, gl: or cb:
 
 _ssh_import_data = {
     None: {
@@ -85,6 +85,28 @@ _ssh_import_data = {
                                 'lower-case alphanumeric characters, hyphens, '
                                 'plus, or periods.'),
         },
+    'gl': {
+        'caption': _("GitLab Username:"),
+        'help': _("Enter your GitLab username."),
+        'valid_char': r'[a-zA-Z0-9_\.\-]',
+        'error_invalid_char': _('A GitLab username may only contain '
+                                'alphanumeric characters, underscores, '
+                                'hyphens, or periods.'),
+        },
+    'cb': {
+        'caption': _("Codeberg Username:"),
+        'help': _("Enter your Codeberg username."),
+        'valid_char': r'[a-zA-Z0-9_\.\-]',
+        'error_invalid_char': _('A Codeberg username may only contain '
+                                'alphanumeric characters, underscores, '
+                                'hyphens, or periods.'),
+        },
+    'url': {
+        'caption': _("URL:"),
+        'help': _("Enter an https:// URL of an authorized_keys file."),
+        'valid_char': r'[^\s]',
+        'error_invalid_char': _('A URL cannot contain spaces.'),
+        },
     }
 
 
@@ -98,8 +120,12 @@ class SSHForm(Form):
             (_("No"), True, None),
             (_("from Github"), True, "gh"),
             (_("from Launchpad"), True, "lp"),
+            (_("from GitLab"), True, "gl"),
+            (_("from Codeberg"), True, "cb"),
+            (_("from a URL"), True, "url"),
             ],
-        help=_("You can import your SSH keys from Github or Launchpad."))
+        help=_("You can import your SSH keys from Github, Launchpad, "
+               "GitLab, Codeberg or an https:// URL."))
 
     import_username = UsernameField(_ssh_import_data[None]['caption'])
 
@@ -151,6 +177,14 @@ class SSHForm(Form):
                 return _("A Github username may only contain alphanumeric "
                          "characters or single hyphens, and cannot begin or "
                          "end with a hyphen.")
+        elif self.ssh_import_id_value in ('gl', 'cb'):
+            if not re.match(r'^[a-zA-Z0-9_][a-zA-Z0-9_\.\-]*$', username):
+                return _("A username must start with a letter, number or "
+                         "underscore. The characters - and . are also "
+                         "allowed after the first character.")
+        elif self.ssh_import_id_value == 'url':
+            if not re.match(r'^https://[^/\s]+', username):
+                return _("The URL must start with https://.")
 
 
 class FetchingSSHKeys(WidgetWrap):
@@ -274,16 +308,19 @@ class SSHView(BaseView):
             install_server=self.form.install_server.value,
             allow_pw=self.form.pwauth.value)
 
+        if not self.form.ssh_import_id.value:
+            self.controller.done(ssh_data)
+            return
         # if user specifed a value, allow user to validate fingerprint
-        if self.form.ssh_import_id.value:
+        if self.form.ssh_import_id.value == 'url':
+            ssh_import_id = self.form.import_username.value
+        else:
             ssh_import_id = self.form.ssh_import_id.value + ":" + \
               self.form.import_username.value
-            fsk = FetchingSSHKeys(self)
-            self.show_overlay(fsk, width=fsk.width, min_width=None)
-            self.controller.fetch_ssh_keys(
-                ssh_import_id=ssh_import_id, ssh_data=ssh_data)
-        else:
-            self.controller.done(ssh_data)
+        fsk = FetchingSSHKeys(self)
+        self.show_overlay(fsk, width=fsk.width, min_width=None)
+        self.controller.fetch_ssh_keys(
+            ssh_import_id=ssh_import_id, ssh_data=ssh_data)
 
     def cancel(self, result=None):
         self.controller.cancel()
@@ -19,7 +19,6 @@ Welcome provides user with language selection
 """
 
 import logging
-import os
 
 from urwid import Text
 
@@ -30,6 +29,8 @@ from subiquitycore.ui.utils import button_pile, rewrap, screen
 from subiquitycore.screen import is_linux_tty
 from subiquitycore.view import BaseView
 
+from subiquity.common.console import fbterm_available, read_languagelist
+
 log = logging.getLogger("subiquity.views.welcome")
 
 
@@ -47,16 +48,15 @@ attach the contents of /var/log, it would be most appreciated.
 
 
 def get_languages():
-    base = os.environ.get("SNAP", ".")
-    lang_path = os.path.join(base, "languagelist")
+    # Languages the linux console cannot show are left out, unless the
+    # client can switch to fbterm when one is chosen.
+    console_only = is_linux_tty() and not fbterm_available()
 
     languages = []
-    with open(lang_path) as lang_file:
-        for line in lang_file:
-            level, code, name = line.strip().split(':')
-            if is_linux_tty() and level != "console":
-                continue
-            languages.append((code, name))
+    for level, code, name in read_languagelist():
+        if console_only and level != "console":
+            continue
+        languages.append((code, name))
     languages.sort(key=lambda x: x[1])
     return languages
 
@@ -17,8 +17,9 @@ import abc
 import asyncio
 import logging
 import os
+from socket import AF_INET, AF_INET6
 import subprocess
-from typing import Optional
+from typing import List, Optional
 
 import yaml
 
@@ -29,8 +30,13 @@ from subiquitycore.context import with_context
 from subiquitycore.file_util import write_file
 from subiquitycore.models.network import (
     BondConfig,
+    BridgeConfig,
     DHCPState,
+    MAX_VLANS_AT_ONCE,
     NetDevAction,
+    networkd_dropins,
+    RoutingConfig,
+    stacked_vlan_names,
     StaticConfig,
     WLANConfig,
     )
@@ -54,7 +60,27 @@ class SubiquityNetworkEventReceiver(NetworkEventReceiver):
     def __init__(self, controller):
         self.controller = controller
         self.model = controller.model
-        self.default_routes = set()
+        self._default_routes = {
+            AF_INET: set(),
+            AF_INET6: set(),
+            }
+
+    @property
+    def default_routes(self):
+        return self._default_routes[AF_INET] | self._default_routes[AF_INET6]
+
+    @property
+    def ipv6_only(self):
+        return bool(
+            self._default_routes[AF_INET6]
+            and not self._default_routes[AF_INET])
+
+    def _remove_default_routes(self, ifindex):
+        if ifindex not in self.default_routes:
+            return
+        for routes in self._default_routes.values():
+            routes.discard(ifindex)
+        self.controller.update_default_routes(self.default_routes)
 
     def new_link(self, ifindex, link):
         netdev = self.model.new_link(ifindex, link)
@@ -63,9 +89,7 @@ class SubiquityNetworkEventReceiver(NetworkEventReceiver):
 
     def del_link(self, ifindex):
         netdev = self.model.del_link(ifindex)
-        if ifindex in self.default_routes:
-            self.default_routes.remove(ifindex)
-            self.controller.update_default_routes(self.default_routes)
+        self._remove_default_routes(ifindex)
         if netdev is not None:
             self.controller.del_link(netdev)
 
@@ -74,9 +98,8 @@ class SubiquityNetworkEventReceiver(NetworkEventReceiver):
         if netdev is None:
             return
         flags = getattr(netdev.info, "flags", 0)
-        if not (flags & IFF_UP) and ifindex in self.default_routes:
-            self.default_routes.remove(ifindex)
-            self.controller.update_default_routes(self.default_routes)
+        if not (flags & IFF_UP):
+            self._remove_default_routes(ifindex)
         self.controller.update_link(netdev)
 
     def route_change(self, action, data):
@@ -86,11 +109,14 @@ class SubiquityNetworkEventReceiver(NetworkEventReceiver):
         if data['table'] != 254:
             return
         ifindex = data['ifindex']
+        routes = self._default_routes.get(data.get('family', AF_INET))
+        if routes is None:
+            return
         if action == "NEW" or action == "CHANGE":
-            self.default_routes.add(ifindex)
-        elif action == "DEL" and ifindex in self.default_routes:
-            self.default_routes.remove(ifindex)
-        log.debug('default routes %s', self.default_routes)
+            routes.add(ifindex)
+        elif action == "DEL":
+            routes.discard(ifindex)
+        log.debug('default routes %s', self._default_routes)
         self.controller.update_default_routes(self.default_routes)
 
 
@@ -132,6 +158,8 @@ class BaseNetworkController(BaseController):
     def __init__(self, app):
         super().__init__(app)
         self.apply_config_task = SingleInstanceTask(self._apply_config)
+        self._written_dropins = set()
+        self._stacked_vlans = set()
         if self.opts.dry_run:
             self.root = os.path.abspath(".subiquity")
             netplan_path = self.netplan_path
@@ -249,6 +277,16 @@ class BaseNetworkController(BaseController):
             self.model.stringify_config(config),
             omode="w")
 
+        dropins = networkd_dropins(config, self.opts.project)
+        for p in self._written_dropins - set(dropins):
+            os.unlink(os.path.join(self.root, p))
+        for p, content in dropins.items():
+            path = os.path.join(self.root, p)
+            os.makedirs(os.path.dirname(path), exist_ok=True)
+            write_file(path, content, omode="w")
+        self._written_dropins = set(dropins)
+        self._stacked_vlans = set(stacked_vlan_names(config))
+
         self.parse_netplan_configs()
 
     @with_context(
@@ -272,7 +310,14 @@ class BaseNetworkController(BaseController):
                     dhcp_events.add(e)
             if dev.info is None:
                 continue
-            if dev.config != self.model.config.config_for_device(dev.info):
+            # A VLAN has to be recreated for a change of protocol
+            # to take effect.
+            protocol_changed = (
+                dev.type == "vlan" and dev.config is not None and
+                dev.is_used_by_vlan != (dev.name in self._stacked_vlans))
+            if protocol_changed or (
+                    dev.config != self.model.config.config_for_device(
+                        dev.info)):
                 if dev.is_virtual:
                     devs_to_delete.append(dev)
                 else:
@@ -370,6 +415,13 @@ class BaseNetworkController(BaseController):
         self.update_link(dev)
         self.apply_config()
 
+    def set_routing_config(self, dev_name: str,
+                           routing_config: RoutingConfig) -> None:
+        dev = self.model.get_netdev_by_name(dev_name)
+        dev.set_routing_config(routing_config)
+        self.update_link(dev)
+        self.apply_config()
+
     def enable_dhcp(self, dev_name: str, ip_version: int) -> None:
         dev = self.model.get_netdev_by_name(dev_name)
         dev.remove_ip_networks_for_version(ip_version)
@@ -384,9 +436,17 @@ class BaseNetworkController(BaseController):
         self.update_link(dev)
         self.apply_config()
 
-    def add_vlan(self, dev_name: str, id: int):
-        new = self.model.new_vlan(dev_name, id)
-        self.new_link(new)
+    def add_vlans(self, dev_name: str, ids: List[int]):
+        if len(ids) > MAX_VLANS_AT_ONCE:
+            raise ValueError(
+                "cannot add more than {} VLANs at once".format(
+                    MAX_VLANS_AT_ONCE))
+        for id in ids:
+            if not 1 <= id <= 4095:
+                raise ValueError("{} is not a valid VLAN ID".format(id))
+        for id in ids:
+            new = self.model.new_vlan(dev_name, id)
+            self.new_link(new)
         dev = self.model.get_netdev_by_name(dev_name)
         self.update_link(dev)
         self.apply_config()
@@ -394,7 +454,7 @@ class BaseNetworkController(BaseController):
     def delete_link(self, dev_name: str):
         dev = self.model.get_netdev_by_name(dev_name)
         touched_devices = set()
-        if dev.type == "bond":
+        if dev.type in ("bond", "bridge"):
             for device_name in dev.config['interfaces']:
                 interface = self.model.get_netdev_by_name(device_name)
                 touched_devices.add(interface)
@@ -409,14 +469,26 @@ class BaseNetworkController(BaseController):
 
     def add_or_update_bond(self, existing_name: Optional[str],
                            new_name: str, new_info: BondConfig) -> None:
+        self._add_or_update_master(
+            existing_name, new_name, new_info, self.model.new_bond)
+
+    def add_or_update_bridge(self, existing_name: Optional[str],
+                             new_name: str, new_info: BridgeConfig) -> None:
+        self._add_or_update_master(
+            existing_name, new_name, new_info, self.model.new_bridge)
+
+    def _add_or_update_master(self, existing_name, new_name, new_info,
+                              new_master):
+        # Bonds and bridges both take over the IP configuration of the
+        # interfaces they are made from.
         get_netdev_by_name = self.model.get_netdev_by_name
         touched_devices = set()
         for device_name in new_info.interfaces:
             device = get_netdev_by_name(device_name)
-            device.config = {}
+            device.remove_ip_config()
             touched_devices.add(device)
         if existing_name is None:
-            new_dev = self.model.new_bond(new_name, new_info)
+            new_dev = new_master(new_name, new_info)
             self.new_link(new_dev)
         else:
             existing = get_netdev_by_name(existing_name)
@@ -445,9 +517,21 @@ class BaseNetworkController(BaseController):
             return "Configured but not yet created {type} interface.".format(
                 type=device.type)
 
+    def import_netplan_config(self, contents: List[str]) -> None:
+        new, changed, deleted = self.model.import_netplan_config(contents)
+        for dev in deleted:
+            self.del_link(dev)
+        for dev in new:
+            self.new_link(dev)
+        for dev in changed:
+            self.update_link(dev)
+        self.apply_config()
+
     def set_wlan(self, dev_name: str, wlan: WLANConfig) -> None:
         device = self.model.get_netdev_by_name(dev_name)
-        device.set_ssid_psk(wlan.ssid, wlan.psk)
+        device.set_ssid_psk(
+            wlan.ssid, wlan.psk, wlan.auth, hidden=wlan.hidden,
+            key_management=wlan.key_management)
         self.update_link(device)
 
     def start_scan(self, dev_name: str) -> None:
@@ -469,6 +553,7 @@ class BaseNetworkController(BaseController):
 
     @abc.abstractmethod
     def update_default_routes(self, routes):
+        self.model.ipv6_only = self.network_event_receiver.ipv6_only
         if routes:
             self.app.hub.broadcast('network-up')
 
@@ -550,8 +635,9 @@ class NetworkAnswersMixin:
                         v,
                         action.get(submit_key, True)):
                     pass
-        elif action['action'] == 'create-bond':
-            self.ui.body._create_bond()
+        elif action['action'] in ('create-bond', 'create-bridge'):
+            kind = action['action'].split('-')[1]
+            getattr(self.ui.body, '_create_' + kind)()
             yield
             body = self.ui.body._w
             data = action['data'].copy()
@@ -567,9 +653,10 @@ class NetworkAnswersMixin:
                 await asyncio.sleep(0.1)
                 t += 0.1
                 if t > 5.0:
-                    raise Exception("bond did not appear in 5 secs")
+                    raise Exception(
+                        "{} did not appear in 5 secs".format(kind))
             if t > 0:
-                log.debug("waited %s for bond to appear", t)
+                log.debug("waited %s for %s to appear", t, kind)
             yield
         elif action['action'] == 'done':
             self.ui.body.done()
@@ -580,6 +667,10 @@ class NetworkAnswersMixin:
 class NetworkController(BaseNetworkController, TuiController,
                         NetworkAnswersMixin):
 
+    # There is no other install to import the configuration of when
+    # running on the system being configured.
+    can_import_installed_config = False
+
     def __init__(self, app):
         super().__init__(app)
         self.view = None
@@ -596,7 +687,8 @@ class NetworkController(BaseNetworkController, TuiController,
             self.apply_config(silent=True)
             self.view_shown = True
         self.view.update_default_routes(
-            self.network_event_receiver.default_routes)
+            self.network_event_receiver.default_routes,
+            self.network_event_receiver.ipv6_only)
         return self.view
 
     def end_ui(self):
@@ -629,7 +721,8 @@ class NetworkController(BaseNetworkController, TuiController,
     def update_default_routes(self, routes):
         super().update_default_routes(routes)
         if self.view:
-            self.view.update_default_routes(routes)
+            self.view.update_default_routes(
+                routes, self.network_event_receiver.ipv6_only)
 
     def new_link(self, netdev):
         super().new_link(netdev)
@@ -13,6 +13,7 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+import copy
 import enum
 import ipaddress
 import logging
@@ -26,9 +27,17 @@ from subiquitycore import netplan
 
 
 NETDEV_IGNORED_IFACE_TYPES = [
-    'lo', 'bridge', 'tun', 'tap', 'dummy', 'sit', 'can', '???'
+    'lo', 'tun', 'tap', 'dummy', 'sit', 'can', '???'
 ]
-NETDEV_ALLOWED_VIRTUAL_IFACE_TYPES = ['vlan', 'bond']
+NETDEV_ALLOWED_VIRTUAL_IFACE_TYPES = ['vlan', 'bond', 'bridge']
+
+# The keys of an interface's netplan config that configure IP on it,
+# which a bond or bridge takes over from the interfaces it is made of.
+IP_CONFIG_KEYS = [
+    'dhcp4', 'dhcp6', 'dhcp4-overrides', 'dhcp6-overrides',
+    'addresses', 'gateway4', 'gateway6', 'nameservers',
+    'routes', 'routing-policy',
+    ]
 
 
 log = logging.getLogger('subiquitycore.models.network')
@@ -38,13 +47,49 @@ def addr_version(ip):
     return ipaddress.ip_interface(ip).version
 
 
+# Interface names are limited to IFNAMSIZ - 1 characters.
+MAX_NETDEV_NAME_LENGTH = 15
+
+# The most VLANs that can be added in one go. Each one is an interface
+# for netplan and networkd to bring up, and for the network screen to
+# show.
+MAX_VLANS_AT_ONCE = 64
+
+
+def stacked_vlan_names(config):
+    """Return the names of the VLANs in config that carry other VLANs.
+
+    These are the outer (service) tags of QinQ and so use 802.1ad.
+    """
+    vlans = config.get('network', {}).get('vlans', {})
+    links = {vlan.get('link') for vlan in vlans.values()}
+    return sorted(name for name in vlans if name in links)
+
+
+def networkd_dropins(config, project):
+    """Return the systemd-networkd drop-ins that complement config.
+
+    netplan cannot set the protocol of a VLAN, so the outer tags of
+    stacked VLANs are switched to 802.1ad with a drop-in for the
+    .netdev file netplan generates.  The result maps paths relative to
+    the root of the system to file contents.
+    """
+    r = {}
+    for name in stacked_vlan_names(config):
+        path = 'etc/systemd/network/10-netplan-{}.netdev.d/{}-qinq.conf'
+        r[path.format(name, project)] = '[VLAN]\nProtocol=802.1ad\n'
+    return r
+
+
 class NetDevAction(enum.Enum):
     # Information about a network interface
     INFO = pgettext("NetDevAction", "Info")
     EDIT_WLAN = pgettext("NetDevAction", "Edit Wifi")
     EDIT_IPV4 = pgettext("NetDevAction", "Edit IPv4")
     EDIT_IPV6 = pgettext("NetDevAction", "Edit IPv6")
+    EDIT_ROUTES = pgettext("NetDevAction", "Edit routes")
     EDIT_BOND = pgettext("NetDevAction", "Edit bond")
+    EDIT_BRIDGE = pgettext("NetDevAction", "Edit bridge")
     ADD_VLAN = pgettext("NetDevAction", "Add a VLAN tag")
     DELETE = pgettext("NetDevAction", "Delete")
 
@@ -74,16 +119,128 @@ class StaticConfig:
     searchdomains: List[str] = attr.Factory(list)
 
 
+@attr.s(auto_attribs=True)
+class Route:
+    to: str
+    via: Optional[str] = None
+    metric: Optional[int] = None
+    table: Optional[int] = None
+    # The netplan keys of the route that are not modelled above (such
+    # as on-link, scope or type), kept as they are.
+    other: dict = attr.Factory(dict)
+
+    def to_config(self):
+        config = dict(self.other)
+        config['to'] = self.to
+        for key in 'via', 'metric', 'table':
+            if getattr(self, key) is not None:
+                config[key] = getattr(self, key)
+        return config
+
+    @classmethod
+    def from_config(cls, config):
+        other = {
+            k: v for k, v in config.items()
+            if k not in ('to', 'via', 'metric', 'table')
+            }
+        return cls(
+            to=config['to'], via=config.get('via'),
+            metric=config.get('metric'), table=config.get('table'),
+            other=other)
+
+
+@attr.s(auto_attribs=True)
+class RoutingPolicyRule:
+    table: int
+    source: Optional[str] = None
+    destination: Optional[str] = None
+    priority: Optional[int] = None
+    # As for Route (mark, type-of-service).
+    other: dict = attr.Factory(dict)
+
+    def to_config(self):
+        config = dict(self.other)
+        config['table'] = self.table
+        if self.source is not None:
+            config['from'] = self.source
+        if self.destination is not None:
+            config['to'] = self.destination
+        if self.priority is not None:
+            config['priority'] = self.priority
+        return config
+
+    @classmethod
+    def from_config(cls, config):
+        other = {
+            k: v for k, v in config.items()
+            if k not in ('table', 'from', 'to', 'priority')
+            }
+        return cls(
+            table=config['table'], source=config.get('from'),
+            destination=config.get('to'), priority=config.get('priority'),
+            other=other)
+
+
+@attr.s(auto_attribs=True)
+class RoutingConfig:
+    routes: List[Route] = attr.Factory(list)
+    routing_policy: List[RoutingPolicyRule] = attr.Factory(list)
+
+
 @attr.s(auto_attribs=True)
 class VLANConfig:
     id: int
     link: str
+    protocol: str = '802.1q'
+
+
+@attr.s(auto_attribs=True)
+class WLANAuthConfig:
+    """802.1X ("WPA Enterprise") settings for an access point.
+
+    method is one of "peap", "ttls" or "tls". The certificate and key
+    settings are paths to PEM files.
+    """
+    method: str
+    identity: Optional[str] = None
+    anonymous_identity: Optional[str] = None
+    password: Optional[str] = None
+    phase2_auth: Optional[str] = None
+    ca_certificate: Optional[str] = None
+    client_certificate: Optional[str] = None
+    client_key: Optional[str] = None
+    client_key_password: Optional[str] = None
+
+    def to_config(self):
+        config = {'key-management': 'eap'}
+        for field in attr.fields(type(self)):
+            value = getattr(self, field.name)
+            if value is not None:
+                config[field.name.replace('_', '-')] = value
+        return config
+
+    @classmethod
+    def from_config(cls, config):
+        if config.get('key-management') != 'eap' or 'method' not in config:
+            return None
+        kw = {}
+        for field in attr.fields(cls):
+            key = field.name.replace('_', '-')
+            if key in config:
+                kw[field.name] = config[key]
+        return cls(**kw)
 
 
 @attr.s(auto_attribs=True)
 class WLANConfig:
     ssid: str
     psk: str
+    auth: Optional[WLANAuthConfig] = None
+    # A network that does not broadcast its SSID.
+    hidden: bool = False
+    # None for an open or WPA2 Personal network, or "sae" for WPA3
+    # Personal, where psk is the password.
+    key_management: Optional[str] = None
 
 
 @attr.s(auto_attribs=True)
@@ -99,6 +256,10 @@ class BondConfig:
     mode: str
     xmit_hash_policy: Optional[str] = None
     lacp_rate: Optional[str] = None
+    primary: Optional[str] = None
+    mii_monitor_interval: Optional[int] = None
+    up_delay: Optional[int] = None
+    down_delay: Optional[int] = None
 
     def to_config(self):
         mode = self.mode
@@ -109,11 +270,60 @@ class BondConfig:
             params['transmit-hash-policy'] = self.xmit_hash_policy
         if mode in BondParameters.supports_lacp_rate:
             params['lacp-rate'] = self.lacp_rate
+        if mode in BondParameters.supports_primary and self.primary:
+            params['primary'] = self.primary
+        if self.mii_monitor_interval is not None:
+            params['mii-monitor-interval'] = self.mii_monitor_interval
+            # The delays are only meaningful when the links are being
+            # monitored.
+            if self.up_delay is not None:
+                params['up-delay'] = self.up_delay
+            if self.down_delay is not None:
+                params['down-delay'] = self.down_delay
         return {
             'interfaces': self.interfaces,
             'parameters': params,
             }
 
+    @classmethod
+    def from_config(cls, config):
+        params = config.get('parameters', {})
+        return cls(
+            interfaces=config['interfaces'],
+            mode=params['mode'],
+            xmit_hash_policy=params.get('transmit-hash-policy'),
+            lacp_rate=params.get('lacp-rate'),
+            primary=params.get('primary'),
+            mii_monitor_interval=params.get('mii-monitor-interval'),
+            up_delay=params.get('up-delay'),
+            down_delay=params.get('down-delay'))
+
+
+@attr.s(auto_attribs=True)
+class BridgeConfig:
+    interfaces: List[str]
+    stp: bool = True
+    forward_delay: Optional[int] = None
+
+    def to_config(self):
+        params = {
+            'stp': self.stp,
+            }
+        if self.forward_delay is not None:
+            params['forward-delay'] = self.forward_delay
+        return {
+            'interfaces': self.interfaces,
+            'parameters': params,
+            }
+
+    @classmethod
+    def from_config(cls, config):
+        params = config.get('parameters', {})
+        return cls(
+            interfaces=config.get('interfaces', []),
+            stp=params.get('stp', True),
+            forward_delay=params.get('forward-delay'))
+
 
 @attr.s(auto_attribs=True)
 class NetDevInfo:
@@ -123,6 +333,7 @@ class NetDevInfo:
 
     is_connected: bool
     bond_master: Optional[str]
+    bridge_master: Optional[str]
     is_used: bool
     disabled_reason: Optional[str]
     hwaddr: Optional[str]
@@ -133,12 +344,14 @@ class NetDevInfo:
 
     vlan: Optional[VLANConfig]
     bond: Optional[BondConfig]
+    bridge: Optional[BridgeConfig]
     wlan: Optional[WLANConfig]
 
     dhcp4: DHCPStatus
     dhcp6: DHCPStatus
     static4: StaticConfig
     static6: StaticConfig
+    routing: RoutingConfig
 
     enabled_actions: List[NetDevAction]
 
@@ -180,6 +393,12 @@ class BondParameters:
         'fast',
     ]
 
+    supports_primary = {
+        'active-backup',
+        'balance-tlb',
+        'balance-alb',
+    }
+
 
 class NetworkDev(object):
 
@@ -201,30 +420,29 @@ class NetworkDev(object):
             is_connected = bool(self.info.is_connected)
         else:
             is_connected = True
-        bond_master = None
-        for dev2 in self._model.get_all_netdevs():
-            if dev2.type != "bond":
-                continue
-            if self.name in dev2.config.get('interfaces', []):
-                bond_master = dev2.name
-                break
+        bond_master = self.master_of_type("bond")
+        bridge_master = self.master_of_type("bridge")
         if self.type == 'bond' and self.config is not None:
-            params = self.config['parameters']
-            bond = BondConfig(
-                interfaces=self.config['interfaces'],
-                mode=params['mode'],
-                xmit_hash_policy=params.get('xmit-hash-policy'),
-                lacp_rate=params.get('lacp-rate'))
+            bond = BondConfig.from_config(self.config)
         else:
             bond = None
+        if self.type == 'bridge' and self.config is not None:
+            bridge = BridgeConfig.from_config(self.config)
+        else:
+            bridge = None
         if self.type == 'vlan' and self.config is not None:
-            vlan = VLANConfig(id=self.config['id'], link=self.config['link'])
+            if self.is_used_by_vlan:
+                protocol = '802.1ad'
+            else:
+                protocol = '802.1q'
+            vlan = VLANConfig(
+                id=self.config['id'], link=self.config['link'],
+                protocol=protocol)
         else:
             vlan = None
         if self.type == 'wlan':
-            ssid, psk = self.configured_ssid
             wlan = WLANStatus(
-                config=WLANConfig(ssid=ssid, psk=psk),
+                config=self.configured_wlan(),
                 scan_state=self.info.wlan['scan_state'],
                 visible_ssids=self.info.wlan['visible_ssids'])
         else:
@@ -261,11 +479,14 @@ class NetworkDev(object):
             vlan=vlan,
             bond_master=bond_master,
             bond=bond,
+            bridge_master=bridge_master,
+            bridge=bridge,
             wlan=wlan,
             dhcp4=dhcp_statuses[4],
             dhcp6=dhcp_statuses[6],
             static4=static_configs[4],
             static6=static_configs[6],
+            routing=self.routing_config(),
             is_used=self.is_used,
             disabled_reason=self.disabled_reason,
             enabled_actions=[
@@ -329,23 +550,60 @@ class NetworkDev(object):
                 self.info = None
         self._name = new_name
 
+    def routing_config(self):
+        if self.config is None:
+            return RoutingConfig()
+        return RoutingConfig(
+            routes=[
+                Route.from_config(route)
+                for route in self.config.get('routes', [])
+                ],
+            routing_policy=[
+                RoutingPolicyRule.from_config(rule)
+                for rule in self.config.get('routing-policy', [])
+                ])
+
+    def set_routing_config(self, routing_config):
+        for key, items in (('routes', routing_config.routes),
+                           ('routing-policy', routing_config.routing_policy)):
+            if items:
+                self.config[key] = [item.to_config() for item in items]
+            else:
+                self.config.pop(key, None)
+
     def supports_action(self, action):
         return getattr(self, "_supports_" + action.name)
 
-    @property
-    def configured_ssid(self):
+    def configured_wlan(self):
         for ssid, settings in self.config.get('access-points', {}).items():
             psk = settings.get('password')
-            return ssid, psk
-        return None, None
-
-    def set_ssid_psk(self, ssid, psk):
+            key_management = None
+            auth = settings.get('auth')
+            if auth is not None:
+                if auth.get('key-management') == 'sae':
+                    key_management = 'sae'
+                    psk = auth.get('password')
+                auth = WLANAuthConfig.from_config(auth)
+            return WLANConfig(
+                ssid=ssid, psk=psk, auth=auth,
+                hidden=settings.get('hidden', False),
+                key_management=key_management)
+        return WLANConfig(ssid=None, psk=None)
+
+    def set_ssid_psk(self, ssid, psk, auth=None, *, hidden=False,
+                     key_management=None):
         aps = self.config.setdefault('access-points', {})
         aps.clear()
         if ssid is not None:
-            aps[ssid] = {}
-            if psk is not None:
-                aps[ssid]['password'] = psk
+            aps[ssid] = ap = {}
+            if hidden:
+                ap['hidden'] = True
+            if auth is not None:
+                ap['auth'] = auth.to_config()
+            elif key_management == 'sae':
+                ap['auth'] = {'key-management': 'sae', 'password': psk}
+            elif psk is not None:
+                ap['password'] = psk
 
     @property
     def ifindex(self):
@@ -358,18 +616,39 @@ class NetworkDev(object):
     def is_virtual(self):
         return self.type in NETDEV_ALLOWED_VIRTUAL_IFACE_TYPES
 
+    def master_of_type(self, typ):
+        for dev in self._model.get_all_netdevs():
+            if dev.type == typ:
+                if self.name in dev.config.get('interfaces', []):
+                    return dev.name
+        return None
+
     @property
     def is_bond_slave(self):
+        return self.master_of_type("bond") is not None
+
+    @property
+    def is_used_by_vlan(self):
         for dev in self._model.get_all_netdevs():
-            if dev.type == "bond":
-                if self.name in dev.config.get('interfaces', []):
-                    return True
+            if dev.type == "vlan" and self.name == dev.config.get('link'):
+                return True
         return False
 
+    @property
+    def is_stacked_vlan(self):
+        if self.type != "vlan" or self.config is None:
+            return False
+        link = self._model.devices_by_name.get(self.config.get('link'))
+        return link is not None and link.type == "vlan"
+
+    @property
+    def is_bridge_port(self):
+        return self.master_of_type("bridge") is not None
+
     @property
     def is_used(self):
         for dev in self._model.get_all_netdevs():
-            if dev.type == "bond":
+            if dev.type in ("bond", "bridge"):
                 if self.name in dev.config.get('interfaces', []):
                     return True
             if dev.type == "vlan":
@@ -386,12 +665,24 @@ class NetworkDev(object):
     _supports_EDIT_WLAN = property(lambda self: self.type == "wlan")
     _supports_EDIT_IPV4 = True
     _supports_EDIT_IPV6 = True
+    _supports_EDIT_ROUTES = property(
+        lambda self: not self.is_bond_slave and not self.is_bridge_port)
     _supports_EDIT_BOND = property(lambda self: self.type == "bond")
+    _supports_EDIT_BRIDGE = property(lambda self: self.type == "bridge")
+    # VLANs can be stacked once, for QinQ.
     _supports_ADD_VLAN = property(
-        lambda self: self.type != "vlan" and not self.is_bond_slave)
+        lambda self: (not self.is_stacked_vlan and not self.is_bond_slave
+                      and not self.is_bridge_port))
     _supports_DELETE = property(
         lambda self: self.is_virtual and not self.is_used)
 
+    def remove_ip_config(self):
+        """Remove the IP configuration, but not the rest (mtu, match...)."""
+        if self.config is None:
+            self.config = {}
+        for key in IP_CONFIG_KEYS:
+            self.config.pop(key, None)
+
     def remove_ip_networks_for_version(self, version):
         self.config.pop('dhcp{v}'.format(v=version), None)
         self.config.pop('gateway{v}'.format(v=version), None)
@@ -412,12 +703,52 @@ class NetworkModel(object):
         self.support_wlan = support_wlan
         self.devices_by_name = {}  # Maps interface names to NetworkDev
         self.has_network = False
+        # True when there is a default route for IPv6 but not for IPv4.
+        self.ipv6_only = False
         self.project = project
 
     def parse_netplan_configs(self, netplan_root):
         self.config = netplan.Config()
         self.config.load_from_root(netplan_root)
 
+    def import_netplan_config(self, contents):
+        """Replace the configuration of all devices with that in contents.
+
+        contents is a list of netplan yaml documents, such as those from
+        another system. Returns the lists of devices that were added,
+        changed and removed.
+        """
+        config = netplan.Config()
+        for content in contents:
+            config.parse_netplan_config(content)
+        new, changed, deleted = [], [], []
+        for dev in self.get_all_netdevs():
+            if dev.is_virtual:
+                dev.config = None
+                deleted.append(dev)
+            elif dev.info is not None:
+                dev.config = config.config_for_device(dev.info)
+                changed.append(dev)
+        for vdev in config.virtual_devices:
+            dev = self.devices_by_name.get(vdev.name)
+            if dev is None:
+                dev = NetworkDev(self, vdev.name, vdev.type)
+                self.devices_by_name[vdev.name] = dev
+                new.append(dev)
+            elif dev in deleted:
+                deleted.remove(dev)
+                changed.append(dev)
+            elif dev.is_virtual:
+                # A device that was deleted but still exists.
+                new.append(dev)
+            else:
+                log.debug(
+                    "not importing %s, a physical device has that name",
+                    vdev.name)
+                continue
+            dev.config = copy.deepcopy(vdev.config)
+        return new, changed, deleted
+
     def new_link(self, ifindex, link):
         log.debug("new_link %s %s %s", ifindex, link.name, link.type)
         if link.type in NETDEV_IGNORED_IFACE_TYPES:
@@ -438,9 +769,11 @@ class NetworkModel(object):
                 dev.info = link
         else:
             config = self.config.config_for_device(link)
-            if link.is_virtual and not config:
+            if (link.is_virtual or link.type == 'bridge') and not config:
                 # If we see a virtual device without there already
-                # being a config for it, we just ignore it.
+                # being a config for it, we just ignore it. This
+                # includes the bridges software on the host makes for
+                # itself, such as docker0 or lxdbr0.
                 return
             dev = NetworkDev(self, link.name, link.type)
             dev.info = link
@@ -486,6 +819,11 @@ class NetworkModel(object):
         dev.config = bond_config.to_config()
         return dev
 
+    def new_bridge(self, name, bridge_config):
+        dev = self.devices_by_name[name] = NetworkDev(self, name, 'bridge')
+        dev.config = bridge_config.to_config()
+        return dev
+
     def get_all_netdevs(self, include_deleted=False):
         devs = [v for k, v in sorted(self.devices_by_name.items())]
         if not include_deleted:
@@ -511,6 +849,7 @@ class NetworkModel(object):
         type_to_key = {
             'eth': 'ethernets',
             'bond': 'bonds',
+            'bridge': 'bridges',
             'wlan': 'wifis',
             'vlan': 'vlans',
             }
@@ -12,6 +12,10 @@ def _sanitize_inteface_config(iface_config):
     for ap, ap_config in iface_config.get('access-points', {}).items():
         if 'password' in ap_config:
             ap_config['password'] = '<REDACTED>'
+        auth = ap_config.get('auth', {})
+        for key in 'password', 'client-key-password':
+            if key in auth:
+                auth[key] = '<REDACTED>'
 
 
 def sanitize_interface_config(iface_config):
@@ -59,12 +63,16 @@ class Config:
         for phys_key in 'ethernets', 'wifis':
             for dev, dev_config in network.get(phys_key, {}).items():
                 self.physical_devices.append(_PhysicalDevice(dev, dev_config))
-        for virt_key in 'bonds', 'vlans':
+        for virt_key, typ in ('bonds', 'bond'), ('bridges', 'bridge'), \
+                ('vlans', 'vlan'):
             for dev, dev_config in network.get(virt_key, {}).items():
-                self.virtual_devices.append(_VirtualDevice(dev, dev_config))
+                self.virtual_devices.append(
+                    _VirtualDevice(dev, typ, dev_config))
 
     def config_for_device(self, link):
-        if link.is_virtual:
+        # A bridge is only ever configured by name, whatever the kernel
+        # says about it.
+        if link.is_virtual or link.type == 'bridge':
             for dev in self.virtual_devices:
                 if dev.name == link.name:
                     return copy.deepcopy(dev.config)
@@ -127,8 +135,9 @@ class _PhysicalDevice:
 
 
 class _VirtualDevice:
-    def __init__(self, name, config):
+    def __init__(self, name, typ, config):
         self.name = name
+        self.type = typ
         self.config = config
         log.debug(
             "config for %s = %s" % (
@@ -54,6 +54,26 @@ class SnapdConnection:
             self.url_base + path, data=json.dumps(body),
             timeout=60)
 
+    def post_assertion(self, assertion):
+        return self.session.post(
+            self.url_base + 'v2/assertions', data=assertion,
+            headers={'Content-Type': 'application/x.ubuntu.assertion'},
+            timeout=60)
+
+    def sideload(self, snap_path, *, classic=False, dangerous=False):
+        # snapd refuses to install a classic snap, or one whose
+        # assertions have not been acked, unless the form says so.
+        data = {}
+        if classic:
+            data['classic'] = 'true'
+        if dangerous:
+            data['dangerous'] = 'true'
+        with open(snap_path, 'rb') as fp:
+            return self.session.post(
+                self.url_base + 'v2/snaps', data=data,
+                files={'snap': (os.path.basename(snap_path), fp)},
+                timeout=600)
+
     def configure_proxy(self, proxy):
         log.debug("restarting snapd to pick up proxy config")
         dropin_dir = os.path.join(
@@ -151,6 +171,24 @@ class FakeSnapdConnection:
         raise Exception(
             "Don't know how to fake POST response to {}".format((path, args)))
 
+    def post_assertion(self, assertion):
+        return _FakeMemoryResponse({
+            "type": "sync",
+            "status-code": 200,
+            "status": "OK",
+            "result": None,
+            })
+
+    def sideload(self, snap_path, *, classic=False, dangerous=False):
+        # Like a refresh, the post-refresh hook would do this.
+        open(update_marker_file, 'w').close()
+        return _FakeMemoryResponse({
+            "type": "async",
+            "change": "7",
+            "status-code": 202,
+            "status": "Accepted",
+            })
+
     def get(self, path, **args):
         time.sleep(1/self.scale_factor)
         filename = path.replace('/', '-')
@@ -186,6 +224,18 @@ class AsyncSnapd:
         response.raise_for_status()
         return response.json()['change']
 
+    async def post_assertion(self, assertion):
+        response = await run_in_thread(
+            partial(self.connection.post_assertion, assertion))
+        response.raise_for_status()
+
+    async def sideload(self, snap_path, *, classic=False, dangerous=False):
+        response = await run_in_thread(
+            partial(self.connection.sideload, snap_path,
+                    classic=classic, dangerous=dangerous))
+        response.raise_for_status()
+        return response.json()['change']
+
     async def post_and_wait(self, path, body, **args):
         change = await self.post(path, body, **args)
         change_path = 'v2/changes/{}'.format(change)
@@ -0,0 +1,54 @@
+""" Golden file helpers
+
+Compare the text a widget renders to against a dump kept in the tree, so
+that any change to how a screen is laid out shows up as a diff in review.
+
+To (re)generate the dumps, run the tests with SUBIQUITY_UPDATE_GOLDEN=1
+set and commit the changed files after reading the diff. A missing dump
+is a failure otherwise, so that a screen cannot go untested just because
+nobody generated its dump.
+"""
+
+import difflib
+import os
+
+
+UPDATE_ENV = 'SUBIQUITY_UPDATE_GOLDEN'
+
+
+def render_text(widget, size):
+    """Render widget at size (cols, rows) and return the text of it.
+
+    Trailing whitespace is stripped from each line so that the dumps are
+    easy to read and diff. Attributes (colours) are not included.
+    """
+    canvas = widget.render(size, focus=True)
+    lines = [line.decode('utf-8').rstrip() for line in canvas.text]
+    return '\n'.join(lines) + '\n'
+
+
+def updating():
+    return os.environ.get(UPDATE_ENV, '') not in ('', '0')
+
+
+def assert_golden(testcase, path, text):
+    """Fail testcase if text is not the contents of the file at path."""
+    if updating():
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(path, 'w', encoding='utf-8') as fp:
+            fp.write(text)
+        return
+    if not os.path.exists(path):
+        testcase.fail(
+            "{} is missing, run with {}=1 to create it".format(
+                path, UPDATE_ENV))
+    with open(path, encoding='utf-8') as fp:
+        expected = fp.read()
+    if text == expected:
+        return
+    diff = ''.join(difflib.unified_diff(
+        expected.splitlines(True), text.splitlines(True),
+        path, 'rendered'))
+    testcase.fail(
+        "rendering does not match {}, run with {}=1 to update it if the "
+        "change is intended:\n{}".format(path, UPDATE_ENV, diff))
@@ -1,9 +1,33 @@
+import asyncio
 import functools
 import os
 import shutil
 import tempfile
 
-from unittest import TestCase
+from unittest import mock, TestCase
+
+
+def run_coro(coro):
+    """Run coro to completion on a fresh event loop and return its result."""
+    loop = asyncio.new_event_loop()
+    try:
+        return loop.run_until_complete(coro)
+    finally:
+        loop.close()
+
+
+def make_controller(cls, **attrs):
+    """Make an instance of the controller class cls without running __init__.
+
+    The controller's app and context are mocks, and attrs are set on it
+    as well, so tests only need to provide what the code under test uses.
+    """
+    controller = object.__new__(cls)
+    controller.app = mock.Mock()
+    controller.context = mock.MagicMock()
+    for name, value in attrs.items():
+        setattr(controller, name, value)
+    return controller
 
 
 class SubiTestCase(TestCase):
@@ -0,0 +1,58 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from subiquitycore.testing.golden import assert_golden, UPDATE_ENV
+
+
+class TestAssertGolden(unittest.TestCase):
+
+    def setUp(self):
+        tdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tdir.cleanup)
+        self.path = os.path.join(tdir.name, 'golden', 'screen-80x24.txt')
+        patcher = mock.patch.dict(os.environ)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        os.environ.pop(UPDATE_ENV, None)
+
+    def write(self, text):
+        os.makedirs(os.path.dirname(self.path))
+        with open(self.path, 'w') as fp:
+            fp.write(text)
+
+    def test_match(self):
+        self.write('screen\n')
+        assert_golden(self, self.path, 'screen\n')
+
+    def test_mismatch(self):
+        self.write('screen\n')
+        with self.assertRaisesRegex(AssertionError, 'does not match'):
+            assert_golden(self, self.path, 'other screen\n')
+
+    def test_missing(self):
+        with self.assertRaisesRegex(AssertionError, 'is missing'):
+            assert_golden(self, self.path, 'screen\n')
+        self.assertFalse(os.path.exists(self.path))
+
+    def test_update(self):
+        os.environ[UPDATE_ENV] = '1'
+        assert_golden(self, self.path, 'screen\n')
+        with open(self.path) as fp:
+            self.assertEqual(fp.read(), 'screen\n')
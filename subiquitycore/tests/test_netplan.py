@@ -1,7 +1,20 @@
 import os
+from types import SimpleNamespace
 
 from subiquitycore.tests import SubiTestCase, populate_dir
-from subiquitycore.netplan import configs_in_root
+from subiquitycore.models.network import (
+    BondConfig,
+    BridgeConfig,
+    NetworkDev,
+    NetworkModel,
+    networkd_dropins,
+    Route,
+    RoutingPolicyRule,
+    WLANAuthConfig,
+    WLANConfig,
+    )
+from subiquitycore import netplan
+from subiquitycore.netplan import configs_in_root, sanitize_config
 
 
 class TestConfigsInRoot(SubiTestCase):
@@ -38,3 +51,200 @@ class TestConfigsInRoot(SubiTestCase):
         self.assertEqual(
             [os.path.join(my_dir, p) for p in yamls],
             configs_in_root(my_dir))
+
+
+class TestWLANAuth(SubiTestCase):
+    def test_round_trip(self):
+        auth = WLANAuthConfig(
+            method='peap', identity='alice', password='secret',
+            phase2_auth='mschapv2')
+        config = auth.to_config()
+        self.assertEqual(config, {
+            'key-management': 'eap',
+            'method': 'peap',
+            'identity': 'alice',
+            'password': 'secret',
+            'phase2-auth': 'mschapv2',
+            })
+        self.assertEqual(WLANAuthConfig.from_config(config), auth)
+        self.assertIsNone(
+            WLANAuthConfig.from_config({'key-management': 'psk'}))
+
+    def test_sae_hidden(self):
+        dev = NetworkDev(NetworkModel('test'), 'wlan0', 'wlan')
+        dev.set_ssid_psk(
+            'home', 'pw', hidden=True, key_management='sae')
+        self.assertEqual(dev.config['access-points'], {'home': {
+            'hidden': True,
+            'auth': {'key-management': 'sae', 'password': 'pw'},
+            }})
+        self.assertEqual(
+            dev.configured_wlan(),
+            WLANConfig(
+                ssid='home', psk='pw', hidden=True, key_management='sae'))
+
+    def test_sanitize(self):
+        auth = WLANAuthConfig(
+            method='tls', identity='alice', client_key_password='secret')
+        config = {'network': {'wifis': {'wlan0': {'access-points': {
+            'corp': {'auth': auth.to_config()},
+            }}}}}
+        sanitized = sanitize_config(config)
+        ap = sanitized['network']['wifis']['wlan0']['access-points']['corp']
+        self.assertEqual(ap['auth']['client-key-password'], '<REDACTED>')
+        self.assertEqual(ap['auth']['identity'], 'alice')
+
+
+class TestBondBridgeConfig(SubiTestCase):
+    def test_bond_round_trip(self):
+        bond = BondConfig(
+            interfaces=['eth0', 'eth1'], mode='active-backup',
+            primary='eth0', mii_monitor_interval=100, up_delay=200)
+        config = bond.to_config()
+        self.assertEqual(config['parameters'], {
+            'mode': 'active-backup',
+            'primary': 'eth0',
+            'mii-monitor-interval': 100,
+            'up-delay': 200,
+            })
+        self.assertEqual(BondConfig.from_config(config), bond)
+
+    def test_bond_options_depend_on_mode(self):
+        bond = BondConfig(
+            interfaces=['eth0'], mode='802.3ad', xmit_hash_policy='layer2',
+            lacp_rate='fast', primary='eth0', up_delay=200)
+        self.assertEqual(bond.to_config()['parameters'], {
+            'mode': '802.3ad',
+            'transmit-hash-policy': 'layer2',
+            'lacp-rate': 'fast',
+            })
+
+    def test_bridge_round_trip(self):
+        bridge = BridgeConfig(
+            interfaces=['eth0', 'bond0'], stp=False, forward_delay=4)
+        config = bridge.to_config()
+        self.assertEqual(config, {
+            'interfaces': ['eth0', 'bond0'],
+            'parameters': {'stp': False, 'forward-delay': 4},
+            })
+        self.assertEqual(BridgeConfig.from_config(config), bridge)
+
+
+class TestStackedVLANs(SubiTestCase):
+    def test_outer_tag_uses_802_1ad(self):
+        config = {'network': {'vlans': {
+            'eth0.10': {'id': 10, 'link': 'eth0'},
+            'eth0.100': {'id': 100, 'link': 'eth0'},
+            'eth0.100.5': {'id': 5, 'link': 'eth0.100'},
+            }}}
+        self.assertEqual(networkd_dropins(config, 'subiquity'), {
+            'etc/systemd/network/10-netplan-eth0.100.netdev.d/'
+            'subiquity-qinq.conf': '[VLAN]\nProtocol=802.1ad\n',
+            })
+
+    def test_no_stacking(self):
+        config = {'network': {'vlans': {
+            'eth0.10': {'id': 10, 'link': 'eth0'},
+            }}}
+        self.assertEqual(networkd_dropins(config, 'subiquity'), {})
+
+
+class TestRoutingConfig(SubiTestCase):
+    def test_round_trip(self):
+        route = Route(to='10.0.0.0/8', via='192.168.0.1', metric=100)
+        self.assertEqual(route.to_config(), {
+            'to': '10.0.0.0/8', 'via': '192.168.0.1', 'metric': 100})
+        self.assertEqual(Route.from_config(route.to_config()), route)
+        rule = RoutingPolicyRule(table=100, source='192.168.0.0/24')
+        self.assertEqual(
+            rule.to_config(), {'table': 100, 'from': '192.168.0.0/24'})
+        self.assertEqual(
+            RoutingPolicyRule.from_config(rule.to_config()), rule)
+
+    def test_keeps_other_keys(self):
+        config = {
+            'to': '0.0.0.0/0', 'via': '10.0.0.1', 'on-link': True,
+            'scope': 'link', 'type': 'unicast',
+            }
+        route = Route.from_config(config)
+        self.assertEqual(route.via, '10.0.0.1')
+        self.assertEqual(
+            route.other, {'on-link': True, 'scope': 'link', 'type': 'unicast'})
+        self.assertEqual(route.to_config(), config)
+        config = {'from': '10.0.0.0/8', 'table': 100, 'mark': 5}
+        self.assertEqual(
+            RoutingPolicyRule.from_config(config).to_config(), config)
+
+
+class TestImportNetplanConfig(SubiTestCase):
+    def test_replaces_config(self):
+        model = NetworkModel('test')
+        eth0 = NetworkDev(model, 'eth0', 'eth')
+        eth0.info = SimpleNamespace(
+            name='eth0', type='eth', hwaddr='00:11:22:33:44:55',
+            driver='e1000', is_virtual=False)
+        eth0.config = {'dhcp4': True}
+        bond0 = NetworkDev(model, 'bond0', 'bond')
+        bond0.config = {'interfaces': ['eth0']}
+        model.devices_by_name = {'eth0': eth0, 'bond0': bond0}
+        new, changed, deleted = model.import_netplan_config([
+            'network:\n'
+            '  version: 2\n'
+            '  ethernets:\n'
+            '    all-en:\n'
+            '      match: {name: "eth*"}\n'
+            '      addresses: [192.168.100.10/24]\n'
+            '  vlans:\n'
+            '    eth0.10: {id: 10, link: eth0}\n',
+            ])
+        self.assertEqual([dev.name for dev in new], ['eth0.10'])
+        self.assertEqual([dev.name for dev in changed], ['eth0'])
+        self.assertEqual([dev.name for dev in deleted], ['bond0'])
+        self.assertEqual(eth0.config['addresses'], ['192.168.100.10/24'])
+        self.assertIsNone(bond0.config)
+        self.assertEqual(
+            model.get_netdev_by_name('eth0.10').config,
+            {'id': 10, 'link': 'eth0'})
+
+
+class TestBondsAndBridges(SubiTestCase):
+    def test_remove_ip_config(self):
+        dev = NetworkDev(NetworkModel('test'), 'eth0', 'eth')
+        dev.config = {
+            'match': {'macaddress': '00:11:22:33:44:55'},
+            'set-name': 'eth0',
+            'mtu': 9000,
+            'dhcp4': True,
+            'addresses': ['192.168.0.10/24'],
+            'gateway4': '192.168.0.1',
+            'nameservers': {'addresses': ['192.168.0.1']},
+            'routes': [{'to': '10.0.0.0/8', 'via': '192.168.0.1'}],
+            }
+        dev.remove_ip_config()
+        self.assertEqual(dev.config, {
+            'match': {'macaddress': '00:11:22:33:44:55'},
+            'set-name': 'eth0',
+            'mtu': 9000,
+            })
+
+    def test_host_bridges_ignored(self):
+        model = NetworkModel('test')
+        model.config = netplan.Config()
+        model.config.parse_netplan_config(
+            'network:\n'
+            '  version: 2\n'
+            '  ethernets:\n'
+            '    all:\n'
+            '      match: {name: "*"}\n'
+            '      dhcp4: true\n'
+            '  bridges:\n'
+            '    br0: {interfaces: []}\n')
+        for is_virtual in True, False:
+            link = SimpleNamespace(
+                name='docker0', type='bridge', hwaddr='02:42:ac:11:00:02',
+                driver='bridge', is_virtual=is_virtual)
+            self.assertIsNone(model.new_link(1, link))
+        link = SimpleNamespace(
+            name='br0', type='bridge', hwaddr='02:42:ac:11:00:03',
+            driver='bridge', is_virtual=True)
+        self.assertEqual(model.new_link(2, link).config, {'interfaces': []})
@@ -0,0 +1,47 @@
+# Copyright 2021 Canonical, Ltd.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+from unittest import mock
+
+from subiquitycore.snapd import SnapdConnection
+from subiquitycore.tests import SubiTestCase
+
+
+class TestSideload(SubiTestCase):
+
+    def sideload(self, **kw):
+        snap_path = self.tmp_path('subiquity_1234.snap')
+        with open(snap_path, 'wb') as fp:
+            fp.write(b'snap')
+        conn = SnapdConnection('/', '/run/snapd.socket')
+        conn.session = mock.Mock()
+        conn.sideload(snap_path, **kw)
+        [call] = conn.session.post.call_args_list
+        self.assertTrue(call.args[0].endswith('/v2/snaps'))
+        self.assertEqual(
+            list(call.kwargs['files']), ['snap'])
+        self.assertEqual(
+            call.kwargs['files']['snap'][0], 'subiquity_1234.snap')
+        return call.kwargs['data']
+
+    def test_classic(self):
+        self.assertEqual(self.sideload(classic=True), {'classic': 'true'})
+
+    def test_dangerous(self):
+        self.assertEqual(
+            self.sideload(dangerous=True), {'dangerous': 'true'})
+
+    def test_plain(self):
+        self.assertEqual(self.sideload(), {})
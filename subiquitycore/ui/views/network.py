@@ -22,6 +22,7 @@ Provides network device listings and extended network information
 import logging
 
 from urwid import (
+    CheckBox,
     connect_signal,
     Text,
     )
@@ -33,6 +34,7 @@ from subiquitycore.models.network import (
 from subiquitycore.ui.actionmenu import ActionMenu
 from subiquitycore.ui.buttons import (
     back_btn,
+    cancel_btn,
     done_btn,
     menu_btn,
     )
@@ -41,7 +43,7 @@ from subiquitycore.ui.container import (
     WidgetWrap,
     )
 from subiquitycore.ui.spinner import Spinner
-from subiquitycore.ui.stretchy import StretchyOverlay
+from subiquitycore.ui.stretchy import Stretchy, StretchyOverlay
 from subiquitycore.ui.table import ColSpec, TablePile, TableRow
 from subiquitycore.ui.utils import (
     button_pile,
@@ -53,7 +55,10 @@ from subiquitycore.ui.width import widget_width
 from .network_configure_manual_interface import (
     AddVlanStretchy,
     BondStretchy,
+    BridgeStretchy,
     EditNetworkStretchy,
+    EditRoutesStretchy,
+    format_route,
     ViewInterfaceInfo,
     )
 from .network_configure_wlan_interface import NetworkConfigureWLANStretchy
@@ -117,9 +122,17 @@ class NetworkDeviceTable(WidgetWrap):
         if self.dev_info.type == "vlan":
             info = _("VLAN {id} on interface {link}").format(
                 id=self.dev_info.vlan.id, link=self.dev_info.vlan.link)
+            if self.dev_info.vlan.protocol == '802.1ad':
+                info += " " + _("(802.1ad, carries stacked VLANs)")
         elif self.dev_info.type == "bond":
             info = _("bond master for {interfaces}").format(
                 interfaces=', '.join(self.dev_info.bond.interfaces))
+        elif self.dev_info.type == "bridge":
+            if self.dev_info.bridge.interfaces:
+                info = _("bridge for {interfaces}").format(
+                    interfaces=', '.join(self.dev_info.bridge.interfaces))
+            else:
+                info = _("bridge with no devices")
         else:
             info = " / ".join([
                 self.dev_info.hwaddr,
@@ -147,6 +160,10 @@ class NetworkDeviceTable(WidgetWrap):
             notes.append(
                 _("enslaved to {device}").format(
                     device=self.dev_info.bond_master))
+        if self.dev_info.bridge_master:
+            notes.append(
+                _("port of bridge {device}").format(
+                    device=self.dev_info.bridge_master))
         if notes:
             notes = ", ".join(notes)
         else:
@@ -185,6 +202,8 @@ class NetworkDeviceTable(WidgetWrap):
             if reason is None:
                 reason = ""
             address_info.append((Text(_("disabled")), Text(reason)))
+        for route in self.dev_info.routing.routes:
+            address_info.append((Text(_("route")), Text(format_route(route))))
         rows = []
         for label, value in address_info:
             rows.append(TableRow([Text(""), label, (2, value)]))
@@ -208,14 +227,59 @@ class NetworkDeviceTable(WidgetWrap):
         self.table.insert_rows(1, self._address_rows())
 
 
+class ImportInstalledConfigStretchy(Stretchy):
+
+    def __init__(self, parent, configs):
+        self.parent = parent
+        if configs:
+            widgets = [
+                Text(_("Select an install to replace the current network "
+                       "configuration with its configuration.")),
+                Text(""),
+                ]
+            btns = []
+            for config in configs:
+                # {os} is the name of an installed system and {device} is
+                # the partition it is installed on.
+                label = _("{os} on {device}").format(
+                    os=config.os_name, device=config.source)
+                if config.interfaces:
+                    label += " ({})".format(', '.join(config.interfaces))
+                btns.append(
+                    menu_btn(label, on_press=self.import_config,
+                             user_arg=config))
+            widgets.append(button_pile(btns))
+            close_label = _("Cancel")
+        else:
+            widgets = [
+                Text(_("No existing install with a network configuration "
+                       "was found.")),
+                ]
+            close_label = _("Close")
+        widgets.extend([
+            Text(""),
+            button_pile([cancel_btn(close_label, on_press=self.close)]),
+            ])
+        super().__init__(
+            _("Import network configuration"), widgets, 0, len(widgets) - 1)
+
+    def import_config(self, sender, config):
+        self.parent.controller.import_installed_config(config)
+        self.parent.remove_overlay()
+
+    def close(self, sender=None):
+        self.parent.remove_overlay()
+
+
 class NetworkView(BaseView):
     title = _("Network connections")
     excerpt = _("Configure at least one interface this server can use to talk "
                 "to other machines, and which preferably provides sufficient "
                 "access for updates.")
 
-    def __init__(self, controller, netdev_infos):
+    def __init__(self, controller, netdev_infos, offline=None):
         self.controller = controller
+        self.has_default_routes = False
         self.dev_name_to_table = {}
         self.cur_netdev_names = []
         self.error = Text("", align='center')
@@ -242,14 +306,39 @@ class NetworkView(BaseView):
 
         self._create_bond_btn = menu_btn(
             _("Create bond"), on_press=self._create_bond)
-        bp = button_pile([self._create_bond_btn])
+        self._create_bridge_btn = menu_btn(
+            _("Create bridge"), on_press=self._create_bridge)
+        btns = [self._create_bond_btn, self._create_bridge_btn]
+        if controller.can_import_installed_config:
+            btns.append(menu_btn(
+                _("Import from an existing install"),
+                on_press=self._import_installed))
+        bp = button_pile(btns)
         bp.align = 'left'
 
+        self.route_notice = Text("")
+
         rows = [
             self.device_pile,
             bp,
+            Color.info_minor(self.route_notice),
         ]
 
+        # offline is None when the controller cannot install offline.
+        self.offline_box = None
+        if offline is not None:
+            self.offline_box = CheckBox(
+                _("Install offline, without using the network"),
+                state=offline, on_state_change=self._offline_changed)
+            rows.extend([
+                Text(""),
+                self.offline_box,
+                Color.info_minor(Text(_(
+                    "No mirror or updates will be used and no snaps will "
+                    "be offered. The network configuration is still "
+                    "written to the installed system."))),
+                ])
+
         self.buttons = button_pile([
                     done_btn("TBD", on_press=self.done),  # See _route_watcher
                     back_btn(_("Back"), on_press=self.cancel),
@@ -282,6 +371,7 @@ class NetworkView(BaseView):
     _action_EDIT_WLAN = _stretchy_shower(NetworkConfigureWLANStretchy)
     _action_EDIT_IPV4 = _stretchy_shower(EditNetworkStretchy, 4)
     _action_EDIT_IPV6 = _stretchy_shower(EditNetworkStretchy, 6)
+    _action_EDIT_ROUTES = _stretchy_shower(EditRoutesStretchy)
     _action_ADD_VLAN = _stretchy_shower(AddVlanStretchy)
 
     def _action_EDIT_BOND(self, name, dev_info):
@@ -292,6 +382,14 @@ class NetworkView(BaseView):
 
     _action_EDIT_BOND.opens_dialog = True
 
+    def _action_EDIT_BRIDGE(self, name, dev_info):
+        stretchy = BridgeStretchy(
+            self, dev_info, self.get_candidate_bridge_port_names())
+        stretchy.attach_context(self.controller.context.child(name))
+        self.show_stretchy_overlay(stretchy)
+
+    _action_EDIT_BRIDGE.opens_dialog = True
+
     def _action_DELETE(self, name, dev_info):
         with self.controller.context.child(name):
             self.controller.delete_link(dev_info.name)
@@ -302,9 +400,14 @@ class NetworkView(BaseView):
         dev_info = netdev_table.dev_info
         meth("{}/{}".format(dev_info.name, action.name), dev_info)
 
-    def update_default_routes(self, routes):
-        log.debug('view route_watcher %s', routes)
-        if routes:
+    def _offline_changed(self, sender, state):
+        self.controller.set_offline(state)
+        self._update_done_label(state)
+
+    def _update_done_label(self, offline):
+        if offline:
+            label = _("Continue offline")
+        elif self.has_default_routes:
             label = _("Done")
         else:
             label = _("Continue without network")
@@ -315,6 +418,19 @@ class NetworkView(BaseView):
             widget_width(self.buttons.base_widget[1]),
             )
 
+    def update_default_routes(self, routes, ipv6_only=False):
+        log.debug('view route_watcher %s ipv6_only=%s', routes, ipv6_only)
+        self.has_default_routes = bool(routes)
+        if ipv6_only:
+            self.route_notice.set_text("\n" + _(
+                "There is no IPv4 network, so only IPv6 will be used. "
+                "Mirrors and services that cannot be reached over IPv6 "
+                "(directly or through NAT64) will be skipped."))
+        else:
+            self.route_notice.set_text("")
+        offline = self.offline_box is not None and self.offline_box.state
+        self._update_done_label(offline)
+
     def show_apply_spinner(self):
         s = Spinner(self.controller.app.aio_loop)
         s.start()
@@ -396,10 +512,26 @@ class NetworkView(BaseView):
         names = []
         for table in self.dev_name_to_table.values():
             dev_info = table.dev_info
-            if dev_info.type in ("vlan", "bond"):
+            if dev_info.type in ("vlan", "bond", "bridge"):
+                continue
+            if dev_info.bond_master is not None:
+                continue
+            if dev_info.bridge_master is not None:
+                continue
+            names.append(dev_info.name)
+        return names
+
+    def get_candidate_bridge_port_names(self):
+        names = []
+        for table in self.dev_name_to_table.values():
+            dev_info = table.dev_info
+            # Most wireless drivers cannot be bridged.
+            if dev_info.type in ("bridge", "wlan"):
                 continue
             if dev_info.bond_master is not None:
                 continue
+            if dev_info.bridge_master is not None:
+                continue
             names.append(dev_info.name)
         return names
 
@@ -409,6 +541,25 @@ class NetworkView(BaseView):
         stretchy.attach_context(self.controller.context.child("add_bond"))
         self.show_stretchy_overlay(stretchy)
 
+    async def _show_installed_configs(self):
+        configs = await self.controller.app.wait_with_text_dialog(
+            self.controller.installed_network_configs(),
+            _("Looking for existing installs"), can_cancel=True)
+        stretchy = ImportInstalledConfigStretchy(self, configs)
+        stretchy.attach_context(
+            self.controller.context.child("import_installed"))
+        self.show_stretchy_overlay(stretchy)
+
+    def _import_installed(self, sender=None):
+        self.controller.app.aio_loop.create_task(
+            self._show_installed_configs())
+
+    def _create_bridge(self, sender=None):
+        stretchy = BridgeStretchy(
+            self, None, self.get_candidate_bridge_port_names())
+        stretchy.attach_context(self.controller.context.child("add_bridge"))
+        self.show_stretchy_overlay(stretchy)
+
     def show_network_error(self, action, info=None):
         self.error_showing = True
         self.bottom.contents[0:0] = [
@@ -26,10 +26,17 @@ from urwid import (
 from subiquitycore.models.network import (
     BondConfig,
     BondParameters,
+    BridgeConfig,
+    MAX_NETDEV_NAME_LENGTH,
+    MAX_VLANS_AT_ONCE,
+    Route,
+    RoutingConfig,
+    RoutingPolicyRule,
     StaticConfig,
     )
 from subiquitycore.ui.container import Pile, WidgetWrap
 from subiquitycore.ui.form import (
+    BooleanField,
     ChoiceField,
     Form,
     FormField,
@@ -267,22 +274,53 @@ class VlanForm(Form):
         self.dev_name = dev_name
         super().__init__()
 
-    vlan = StringField(_("VLAN ID:"))
+    vlan = StringField(
+        _("VLAN IDs:"),
+        help=_("One or more VLAN IDs or ranges of them, separated by "
+               "commas, for example \"10,20,30-32\"."))
 
     def clean_vlan(self, value):
-        try:
-            vlanid = int(value)
-        except ValueError:
-            vlanid = None
-        if vlanid is None or vlanid < 1 or vlanid > 4095:
+        vlanids = []
+        for part in value.split(','):
+            first, sep, last = part.partition('-')
+            try:
+                first = int(first)
+                if sep:
+                    last = int(last)
+                else:
+                    last = first
+            except ValueError:
+                first = last = None
+            if first is None or first < 1 or last > 4095:
+                raise ValueError(
+                    _("VLAN ID must be between 1 and 4095"))
+            if first > last:
+                raise ValueError(
+                    _("{range} is not a valid range of VLAN IDs").format(
+                        range=part.strip()))
+            if last - first >= MAX_VLANS_AT_ONCE:
+                raise ValueError(
+                    _("At most {max} VLANs can be added at once").format(
+                        max=MAX_VLANS_AT_ONCE))
+            for vlanid in range(first, last + 1):
+                if vlanid not in vlanids:
+                    vlanids.append(vlanid)
+        if len(vlanids) > MAX_VLANS_AT_ONCE:
             raise ValueError(
-                _("VLAN ID must be between 1 and 4095"))
-        return vlanid
+                _("At most {max} VLANs can be added at once").format(
+                    max=MAX_VLANS_AT_ONCE))
+        return vlanids
 
     def validate_vlan(self):
-        new_name = '%s.%s' % (self.dev_name, self.vlan.value)
-        if new_name in self.parent.cur_netdev_names:
-            return _("{netdev} already exists").format(netdev=new_name)
+        for vlanid in self.vlan.value:
+            new_name = '%s.%s' % (self.dev_name, vlanid)
+            if new_name in self.parent.cur_netdev_names:
+                return _("{netdev} already exists").format(netdev=new_name)
+            if len(new_name) > MAX_NETDEV_NAME_LENGTH:
+                return _(
+                    "The name {netdev} would be more than {max} characters "
+                    "long").format(
+                        netdev=new_name, max=MAX_NETDEV_NAME_LENGTH)
 
 
 class AddVlanStretchy(Stretchy):
@@ -302,8 +340,191 @@ class AddVlanStretchy(Stretchy):
         log.debug(
             "AddVlanStretchy.done %s %s",
             self.dev_name, self.form.vlan.value)
-        self.parent.controller.add_vlan(
-            self.dev_name, self.form.vlan.value)
+        self.parent.controller.add_vlans(self.dev_name, self.form.vlan.value)
+        self.parent.remove_overlay()
+
+    def cancel(self, sender=None):
+        self.parent.remove_overlay()
+
+
+def _parse_words(text, first_key, keys):
+    # Parse "value key value key value ..." into a dict, where the leading
+    # value (if first_key is not None) is stored under first_key.
+    words = text.split()
+    r = {}
+    if first_key is not None:
+        if not words:
+            raise ValueError(_("{key} missing").format(key=first_key))
+        r[first_key] = words.pop(0)
+    if len(words) % 2 != 0:
+        raise ValueError(
+            _("\"{text}\" is not valid").format(text=text.strip()))
+    for key, value in zip(words[::2], words[1::2]):
+        if key not in keys or key in r:
+            raise ValueError(
+                _("\"{key}\" is not valid here").format(key=key))
+        r[key] = value
+    return r
+
+
+def _check_network(value):
+    if value == 'default':
+        return value
+    try:
+        ipaddress.ip_network(value, strict=False)
+    except ValueError:
+        raise ValueError(
+            _("{value} is not a valid network").format(value=value))
+    return value
+
+
+def _check_address(value):
+    try:
+        ipaddress.ip_address(value)
+    except ValueError:
+        raise ValueError(
+            _("{value} is not a valid IP address").format(value=value))
+    return value
+
+
+def _check_int(value):
+    try:
+        r = int(value)
+    except ValueError:
+        r = -1
+    if r < 0:
+        raise ValueError(
+            _("{value} is not a valid number").format(value=value))
+    return r
+
+
+def parse_routes(text):
+    """Parse routes like "10.0.0.0/8 via 192.168.0.1 metric 100"."""
+    routes = []
+    for part in text.split(','):
+        if not part.strip():
+            continue
+        words = _parse_words(part, 'to', ('via', 'metric', 'table'))
+        route = Route(to=_check_network(words['to']))
+        if 'via' in words:
+            route.via = _check_address(words['via'])
+        if 'metric' in words:
+            route.metric = _check_int(words['metric'])
+        if 'table' in words:
+            route.table = _check_int(words['table'])
+        routes.append(route)
+    return routes
+
+
+def format_route(route):
+    parts = [route.to]
+    for key in 'via', 'metric', 'table':
+        if getattr(route, key) is not None:
+            parts.extend([key, str(getattr(route, key))])
+    return ' '.join(parts)
+
+
+def parse_routing_policy(text):
+    """Parse rules like "from 10.0.0.0/24 table 100 priority 10"."""
+    rules = []
+    for part in text.split(','):
+        if not part.strip():
+            continue
+        words = _parse_words(
+            part, None, ('from', 'to', 'table', 'priority'))
+        if 'table' not in words:
+            raise ValueError(_("A routing policy rule needs a table"))
+        rule = RoutingPolicyRule(table=_check_int(words['table']))
+        if 'from' in words:
+            rule.source = _check_network(words['from'])
+        if 'to' in words:
+            rule.destination = _check_network(words['to'])
+        if 'priority' in words:
+            rule.priority = _check_int(words['priority'])
+        rules.append(rule)
+    return rules
+
+
+def format_routing_policy_rule(rule):
+    parts = []
+    for key, value in (('from', rule.source), ('to', rule.destination),
+                       ('table', rule.table), ('priority', rule.priority)):
+        if value is not None:
+            parts.extend([key, str(value)])
+    return ' '.join(parts)
+
+
+def keep_other(new_items, old_items, key):
+    """Copy what the dialog does not show to new_items from old_items.
+
+    An item gets the netplan keys the dialog does not know about from
+    the old item it has the same key as, so editing a route's metric
+    (say) does not lose its on-link.
+    """
+    old = {key(item): item.other for item in old_items}
+    for item in new_items:
+        item.other = dict(old.get(key(item), {}))
+    return new_items
+
+
+class RoutesForm(Form):
+
+    ok_label = _("Save")
+
+    routes = StringField(
+        _("Routes:"),
+        help=_("Separate routes with commas, for example "
+               "\"10.0.0.0/8 via 192.168.0.1 metric 100\". A route may "
+               "also name a routing table with \"table N\"."))
+    routing_policy = StringField(
+        _("Routing policy:"),
+        help=_("Rules that pick a routing table, separated by commas, for "
+               "example \"from 192.168.0.0/24 table 100 priority 10\"."))
+
+    def clean_routes(self, value):
+        return parse_routes(value)
+
+    def clean_routing_policy(self, value):
+        return parse_routing_policy(value)
+
+
+class EditRoutesStretchy(Stretchy):
+
+    def __init__(self, parent, dev_info):
+        self.parent = parent
+        self.dev_info = dev_info
+        routing = dev_info.routing
+        initial = {
+            'routes': ', '.join(
+                format_route(route) for route in routing.routes),
+            'routing_policy': ', '.join(
+                format_routing_policy_rule(rule)
+                for rule in routing.routing_policy),
+            }
+        self.form = RoutesForm(initial)
+        connect_signal(self.form, 'submit', self.done)
+        connect_signal(self.form, 'cancel', self.cancel)
+        # {device} is the name of a network device
+        title = _("Edit {device} routes").format(device=dev_info.name)
+        super().__init__(
+            title,
+            [Pile(self.form.as_rows()), Text(""), self.form.buttons],
+            0, 0)
+
+    def done(self, sender):
+        routing = self.dev_info.routing
+        routing_config = RoutingConfig(
+            routes=keep_other(
+                self.form.routes.value, routing.routes,
+                lambda route: (route.to, route.via)),
+            routing_policy=keep_other(
+                self.form.routing_policy.value, routing.routing_policy,
+                lambda rule: (rule.source, rule.destination)))
+        log.debug(
+            "EditRoutesStretchy.done %s %s",
+            self.dev_info.name, routing_config)
+        self.parent.controller.set_routing_config(
+            self.dev_info.name, routing_config)
         self.parent.remove_overlay()
 
     def cancel(self, sender=None):
@@ -364,6 +585,46 @@ MultiNetdevField = simple_field(MultiNetdevChooser)
 MultiNetdevField.takes_default_style = False
 
 
+def clean_optional_int(value, unit):
+    value = value.strip()
+    if not value:
+        return None
+    try:
+        r = int(value)
+    except ValueError:
+        r = -1
+    if r < 0:
+        raise ValueError(
+            _("Must be a whole number of {unit}, or blank").format(unit=unit))
+    return r
+
+
+def optional_int_initial(value):
+    if value is None:
+        return ''
+    return str(value)
+
+
+def validate_new_netdev_name(name, all_netdev_names):
+    if name in all_netdev_names:
+        return _(
+            'There is already a network device named "{netdev}"'
+            ).format(netdev=name)
+    if len(name) == 0:
+        return _("Name cannot be empty")
+    if len(name) > 16:
+        return _("Name cannot be more than 16 characters long")
+
+
+def unused_netdev_name(prefix, all_netdev_names):
+    x = 0
+    while True:
+        name = '{}{}'.format(prefix, x)
+        if name not in all_netdev_names:
+            return name
+        x += 1
+
+
 class BondForm(Form):
 
     def __init__(self, initial, candidate_netdevs, all_netdev_names):
@@ -379,6 +640,22 @@ class BondForm(Form):
     xmit_hash_policy = ChoiceField(
         _("XMIT hash policy:"), choices=BondParameters.xmit_hash_policies)
     lacp_rate = ChoiceField(_("LACP rate:"), choices=BondParameters.lacp_rates)
+    primary = StringField(
+        _("Primary device:"),
+        help=_("The device to use whenever it is available. Leave blank to "
+               "let the kernel choose."))
+    mii_monitor_interval = StringField(
+        _("MII monitor interval:"),
+        help=_("How often to check the links, in milliseconds. Leave blank "
+               "to not monitor them."))
+    up_delay = StringField(
+        _("Up delay:"),
+        help=_("How long to wait before using a link that has come up, in "
+               "milliseconds."))
+    down_delay = StringField(
+        _("Down delay:"),
+        help=_("How long to wait before giving up on a link that has gone "
+               "down, in milliseconds."))
     ok_label = _("Save")
 
     def _select_level(self, sender, new_value):
@@ -386,17 +663,30 @@ class BondForm(Form):
             new_value in BondParameters.supports_xmit_hash_policy)
         self.lacp_rate.enabled = (
             new_value in BondParameters.supports_lacp_rate)
+        self.primary.enabled = (
+            new_value in BondParameters.supports_primary)
 
     def validate_name(self):
-        name = self.name.value
-        if name in self.all_netdev_names:
-            return _(
-                'There is already a network device named "{netdev}"'
-                ).format(netdev=name)
-        if len(name) == 0:
-            return _("Name cannot be empty")
-        if len(name) > 16:
-            return _("Name cannot be more than 16 characters long")
+        return validate_new_netdev_name(
+            self.name.value, self.all_netdev_names)
+
+    def clean_primary(self, value):
+        return value.strip() or None
+
+    def validate_primary(self):
+        primary = self.primary.value
+        if primary and primary not in self.interfaces.value:
+            return _("{netdev} is not one of the selected devices").format(
+                netdev=primary)
+
+    def clean_mii_monitor_interval(self, value):
+        return clean_optional_int(value, _("milliseconds"))
+
+    def clean_up_delay(self, value):
+        return clean_optional_int(value, _("milliseconds"))
+
+    def clean_down_delay(self, value):
+        return clean_optional_int(value, _("milliseconds"))
 
 
 class BondStretchy(Stretchy):
@@ -408,15 +698,9 @@ class BondStretchy(Stretchy):
             self.existing_name = None
             title = _('Create bond')
             label = _("Create")
-            x = 0
-            while True:
-                name = 'bond{}'.format(x)
-                if name not in all_netdev_names:
-                    break
-                x += 1
             initial = {
                 'interfaces': [],
-                'name': name,
+                'name': unused_netdev_name('bond', all_netdev_names),
                 }
         else:
             self.existing_name = existing_bond_info.name
@@ -434,6 +718,11 @@ class BondStretchy(Stretchy):
                 initial['xmit_hash_policy'] = bondconfig.xmit_hash_policy
             if mode in BondParameters.supports_lacp_rate:
                 initial['lacp_rate'] = bondconfig.lacp_rate
+            if mode in BondParameters.supports_primary:
+                initial['primary'] = bondconfig.primary or ''
+            for field in 'mii_monitor_interval', 'up_delay', 'down_delay':
+                initial[field] = optional_int_initial(
+                    getattr(bondconfig, field))
 
         candidate_names = sorted(candidate_names + initial['interfaces'])
 
@@ -457,3 +746,83 @@ class BondStretchy(Stretchy):
 
     def cancel(self, sender=None):
         self.parent.remove_overlay()
+
+
+class BridgeForm(Form):
+
+    def __init__(self, initial, candidate_netdevs, all_netdev_names):
+        self.candidate_netdevs = candidate_netdevs
+        self.all_netdev_names = all_netdev_names
+        super().__init__(initial)
+
+    name = StringField(_("Name:"))
+    interfaces = MultiNetdevField(_("Devices: "))
+    stp = BooleanField(
+        _("Use the spanning tree protocol (STP)"),
+        help=_("STP stops loops forming when the bridge is connected to "
+               "the same network more than once."))
+    forward_delay = StringField(
+        _("Forward delay:"),
+        help=_("How long a port spends listening and learning before it "
+               "starts to forward traffic, in seconds. Leave blank for the "
+               "default."))
+    ok_label = _("Save")
+
+    def validate_name(self):
+        return validate_new_netdev_name(
+            self.name.value, self.all_netdev_names)
+
+    def clean_forward_delay(self, value):
+        return clean_optional_int(value, _("seconds"))
+
+
+class BridgeStretchy(Stretchy):
+
+    def __init__(self, parent, existing_bridge_info, candidate_names):
+        self.parent = parent
+        all_netdev_names = set(parent.cur_netdev_names)
+        if existing_bridge_info is None:
+            self.existing_name = None
+            title = _('Create bridge')
+            label = _("Create")
+            initial = {
+                'interfaces': [],
+                'name': unused_netdev_name('br', all_netdev_names),
+                'stp': True,
+                }
+        else:
+            self.existing_name = existing_bridge_info.name
+            bridgeconfig = existing_bridge_info.bridge
+            title = _('Edit bridge')
+            label = _("Save")
+            all_netdev_names.remove(self.existing_name)
+            initial = {
+                'interfaces': bridgeconfig.interfaces,
+                'name': self.existing_name,
+                'stp': bridgeconfig.stp,
+                'forward_delay': optional_int_initial(
+                    bridgeconfig.forward_delay),
+                }
+
+        candidate_names = sorted(candidate_names + initial['interfaces'])
+
+        self.form = BridgeForm(initial, candidate_names, all_netdev_names)
+        self.form.buttons.base_widget[0].set_label(label)
+        connect_signal(self.form, 'submit', self.done)
+        connect_signal(self.form, 'cancel', self.cancel)
+        super().__init__(
+            title,
+            [Pile(self.form.as_rows()), Text(""), self.form.buttons],
+            0, 0)
+
+    def done(self, sender):
+        result = self.form.as_data()
+        log.debug("BridgeStretchy.done result=%s", result)
+        new_name = result.pop('name')
+        new_config = BridgeConfig(**result)
+        self.parent.controller.add_or_update_bridge(
+            self.existing_name, new_name, new_config)
+        self.parent.remove_overlay()
+
+    def cancel(self, sender=None):
+        self.parent.remove_overlay()
@@ -1,4 +1,5 @@
 import logging
+import os
 
 from urwid import (
     BoxAdapter,
@@ -7,14 +8,23 @@ from urwid import (
     Text,
     )
 
-from subiquitycore.models.network import WLANConfig
+from subiquitycore.models.network import (
+    WLANAuthConfig,
+    WLANConfig,
+    )
 from subiquitycore.ui.buttons import cancel_btn, menu_btn
 from subiquitycore.ui.container import (
     ListBox,
     Pile,
     WidgetWrap,
     )
-from subiquitycore.ui.form import Form, PasswordField, StringField
+from subiquitycore.ui.form import (
+    BooleanField,
+    ChoiceField,
+    Form,
+    PasswordField,
+    StringField,
+    )
 from subiquitycore.ui.stretchy import Stretchy
 from subiquitycore.ui.utils import (
     Color,
@@ -46,15 +56,93 @@ class NetworkList(WidgetWrap):
         self.parent.parent.remove_overlay()
 
 
+security_choices = [
+    (_("Open or WPA2 Personal"), True, None),
+    (_("WPA3 Personal (SAE)"), True, 'sae'),
+    (_("WPA2 Enterprise (PEAP)"), True, 'peap'),
+    (_("WPA2 Enterprise (TTLS)"), True, 'ttls'),
+    (_("WPA2 Enterprise (TLS)"), True, 'tls'),
+    ]
+
+phase2_choices = [
+    ("MSCHAPv2", True, 'mschapv2'),
+    ("PAP", True, 'pap'),
+    ("GTC", True, 'gtc'),
+    ]
+
+# The fields each 802.1X method uses, beyond the identity.
+eap_fields = {
+    'peap': ['anonymous_identity', 'eap_password', 'phase2_auth',
+             'ca_certificate'],
+    'ttls': ['anonymous_identity', 'eap_password', 'phase2_auth',
+             'ca_certificate'],
+    'tls': ['ca_certificate', 'client_certificate', 'client_key',
+            'client_key_password'],
+    }
+
+all_eap_fields = [
+    'identity', 'anonymous_identity', 'eap_password', 'phase2_auth',
+    'ca_certificate', 'client_certificate', 'client_key',
+    'client_key_password',
+    ]
+
+
 class WLANForm(Form):
 
     ok_label = _("Save")
 
     ssid = StringField(caption="Network Name:")
+    hidden = BooleanField(
+        _("Hidden network"),
+        help=_("Select this if the network does not broadcast its name, "
+               "so that it is searched for explicitly."))
+    security = ChoiceField(_("Security:"), choices=security_choices)
     psk = PasswordField(caption="Password:")
+    identity = StringField(_("Identity:"))
+    anonymous_identity = StringField(
+        _("Anonymous identity:"),
+        help=_("Sent in the clear instead of the identity, if set."))
+    eap_password = PasswordField(_("Password:"))
+    phase2_auth = ChoiceField(
+        _("Inner authentication:"), choices=phase2_choices)
+    ca_certificate = StringField(
+        _("CA certificate:"),
+        help=_("Path to a PEM file with the certificate of the authority "
+               "that signed the server's certificate."))
+    client_certificate = StringField(
+        _("Client certificate:"), help=_("Path to a PEM file."))
+    client_key = StringField(
+        _("Client private key:"), help=_("Path to a PEM file."))
+    client_key_password = PasswordField(
+        _("Private key password:"),
+        help=_("Leave blank if the key is not encrypted."))
+
+    def __init__(self, initial={}):
+        super().__init__(initial)
+        connect_signal(self.security.widget, 'select', self.select_security)
+        self.select_security(None, self.security.value)
+
+    def select_security(self, sender, method):
+        self.psk.enabled = method not in eap_fields
+        enabled = set(eap_fields.get(method, []))
+        if method in eap_fields:
+            enabled.add('identity')
+        for name in all_eap_fields:
+            field = getattr(self, name)
+            field.enabled = name in enabled
+            # Clear errors from fields that are now hidden and flag the
+            # required ones that have just appeared.
+            field.validate(show_error=False)
+        self.psk.validate(show_error=False)
 
     def validate_psk(self):
         psk = self.psk.value
+        if self.security.value == 'sae':
+            # SAE has no limits on the length of the password, but it
+            # does need one.
+            if len(psk) == 0:
+                return _("A password is needed for WPA3 Personal")
+            return
         if len(psk) == 0:
             return
         elif len(psk) < 8:
@@ -62,6 +150,40 @@ class WLANForm(Form):
         elif len(psk) > 63:
             return "Password must be less than 63 characters long"
 
+    def validate_identity(self):
+        if not self.identity.value:
+            return _("An identity is needed for WPA2 Enterprise")
+
+    def _validate_path(self, field, required=False):
+        path = field.value
+        if not path:
+            if required:
+                return _("A path is needed for TLS authentication")
+            return
+        if not os.path.isfile(path):
+            return _("{path} does not exist").format(path=path)
+
+    def validate_ca_certificate(self):
+        return self._validate_path(self.ca_certificate)
+
+    def validate_client_certificate(self):
+        return self._validate_path(self.client_certificate, required=True)
+
+    def validate_client_key(self):
+        return self._validate_path(self.client_key, required=True)
+
+    def auth_config(self):
+        method = self.security.value
+        if method not in eap_fields:
+            return None
+        data = self.as_data()
+        auth = WLANAuthConfig(
+            method=method, password=data.get('eap_password') or None)
+        for name in all_eap_fields:
+            if name != 'eap_password' and data.get(name):
+                setattr(auth, name, data[name])
+        return auth
+
 
 class NetworkConfigureWLANStretchy(Stretchy):
     def __init__(self, parent, dev_info):
@@ -70,19 +192,35 @@ class NetworkConfigureWLANStretchy(Stretchy):
         title = _("Network interface {nic} WIFI configuration").format(
             nic=dev_info.name)
 
-        self.form = WLANForm()
+        config = self.dev_info.wlan.config
+        initial = {'hidden': config.hidden}
+        if config.key_management == 'sae':
+            initial['security'] = 'sae'
+        if config.auth is not None:
+            initial['security'] = config.auth.method
+            for name in all_eap_fields:
+                value = getattr(config.auth, name, None)
+                if value is not None:
+                    initial[name] = value
+            if config.auth.password is not None:
+                initial['eap_password'] = config.auth.password
+        self.form = WLANForm(initial)
 
         connect_signal(self.form, 'submit', self.done)
         connect_signal(self.form, 'cancel', self.cancel)
 
-        if self.dev_info.wlan.config.ssid:
-            self.form.ssid.value = self.dev_info.wlan.config.ssid
-        if self.dev_info.wlan.config.psk:
-            self.form.psk.value = self.dev_info.wlan.config.psk
+        if config.ssid:
+            self.form.ssid.value = config.ssid
+        if config.psk:
+            self.form.psk.value = config.psk
 
         self.ssid_row = self.form.ssid._table
-        self.psk_row = self.form.psk._table
-        self.ssid_row.bind(self.psk_row)
+        self.security_rows = [
+            getattr(self.form, name)._table
+            for name in ['hidden', 'security', 'psk'] + all_eap_fields
+            ]
+        for row in self.security_rows:
+            self.ssid_row.bind(row)
 
         self.inputs = Pile(self._build_iface_inputs())
 
@@ -123,18 +261,14 @@ class NetworkConfigureWLANStretchy(Stretchy):
         else:
             scan_btn = disabled(menu_btn("Scanning for networks"))
 
-        warning = (
-            "Only open or WPA2/PSK networks are supported at this time.")
         col = [
-            Text(warning),
-            Text(""),
             self.ssid_row,
             Text(""),
             Padding.fixed_32(networks_btn),
             Padding.fixed_32(scan_btn),
             Text(""),
-            self.psk_row,
         ]
+        col.extend(self.security_rows)
         return col
 
     def update_link(self, dev_info):
@@ -155,8 +289,17 @@ class NetworkConfigureWLANStretchy(Stretchy):
             psk = self.form.psk.value
         else:
             psk = None
+        auth = self.form.auth_config()
+        if auth is not None:
+            psk = None
+        if self.form.security.value == 'sae':
+            key_management = 'sae'
+        else:
+            key_management = None
         self.parent.controller.set_wlan(
-            self.dev_info, WLANConfig(ssid=ssid, psk=psk))
+            self.dev_info, WLANConfig(
+                ssid=ssid, psk=psk, auth=auth, hidden=self.form.hidden.value,
+                key_management=key_management))
         self.parent.update_link(self.dev_info)
         self.parent.remove_overlay()
 
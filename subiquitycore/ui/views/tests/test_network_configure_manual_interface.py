@@ -8,10 +8,18 @@ import attr
 import urwid
 
 from subiquitycore.controllers.network import NetworkController
-from subiquitycore.models.network import NetDevInfo, StaticConfig
+from subiquitycore.models.network import (
+    NetDevInfo,
+    Route,
+    RoutingPolicyRule,
+    StaticConfig,
+    )
 from subiquitycore.testing import view_helpers
 from subiquitycore.ui.views.network_configure_manual_interface import (
     EditNetworkStretchy,
+    format_route,
+    parse_routes,
+    parse_routing_policy,
     ViewInterfaceInfo,
     )
 from subiquitycore.view import BaseView
@@ -141,3 +149,34 @@ class TestViewInterfaceInfo(unittest.TestCase):
         text = view_helpers.find_with_pred(
             view, lambda w: isinstance(w, urwid.Text) and "INFO" in w.text)
         self.assertNotEqual(text, None)
+
+
+class TestParseRoutes(unittest.TestCase):
+
+    def test_parse_routes(self):
+        self.assertEqual(
+            parse_routes("10.0.0.0/8 via 192.168.0.1 metric 100, default "
+                         "via 192.168.1.1 table 200"),
+            [
+                Route(to='10.0.0.0/8', via='192.168.0.1', metric=100),
+                Route(to='default', via='192.168.1.1', table=200),
+            ])
+        self.assertEqual(parse_routes(""), [])
+
+    def test_format_route(self):
+        route = Route(to='10.0.0.0/8', via='192.168.0.1', metric=100)
+        self.assertEqual(parse_routes(format_route(route)), [route])
+
+    def test_invalid_routes(self):
+        for text in ("10.0.0.0/8 via", "10.0.0.0/8 via nowhere",
+                     "bogus", "10.0.0.0/8 gateway 192.168.0.1"):
+            with self.assertRaises(ValueError):
+                parse_routes(text)
+
+    def test_parse_routing_policy(self):
+        self.assertEqual(
+            parse_routing_policy("from 192.168.0.0/24 table 100 priority 10"),
+            [RoutingPolicyRule(
+                table=100, source='192.168.0.0/24', priority=10)])
+        with self.assertRaises(ValueError):
+            parse_routing_policy("from 192.168.0.0/24")